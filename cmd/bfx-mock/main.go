@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/internal/bfxmock"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8765", "Listen address")
+	heartbeat := flag.Duration("hb", 15*time.Second, "Heartbeat interval per channel")
+	update := flag.Duration("update", 200*time.Millisecond, "Interval between updates per channel")
+	seed := flag.Int64("seed", 1, "Random seed for generated market data")
+	dropAfter := flag.Int("drop-after", 0, "Drop the first socket after this many channel frames")
+	maintenanceAfter := flag.Duration("maintenance-after", 0, "Send a 20051 info event this long into each session")
+	corruptEvery := flag.Int("corrupt-cs-every", 0, "Corrupt every Nth checksum frame")
+	gapEvery := flag.Int("gap-every", 0, "Skip a sequence number before every Nth frame")
+	reject := flag.String("reject", "", "Comma separated symbols to reject on subscribe")
+	flag.Parse()
+
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create logger: %v\n", err)
+		os.Exit(1)
+	}
+	defer logger.Sync()
+
+	scenario := bfxmock.Scenario{
+		DropAfterFrames:      *dropAfter,
+		MaintenanceAfter:     *maintenanceAfter,
+		CorruptChecksumEvery: *corruptEvery,
+		GapEvery:             *gapEvery,
+	}
+	if *reject != "" {
+		scenario.RejectSymbols = strings.Split(*reject, ",")
+	}
+
+	server := bfxmock.NewServer(bfxmock.Options{
+		HeartbeatInterval: *heartbeat,
+		UpdateInterval:    *update,
+		Seed:              *seed,
+		Scenario:          scenario,
+		Logger:            logger,
+	})
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signalChan
+		server.Close()
+	}()
+
+	logger.Info("Mock Bitfinex WebSocket listening",
+		zap.String("url", fmt.Sprintf("ws://%s/ws/2", *addr)),
+		zap.Any("scenario", scenario))
+
+	if err := server.ListenAndServe(*addr); err != nil {
+		logger.Fatal("Mock server failed", zap.Error(err))
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"sync"
@@ -18,11 +19,11 @@ import (
 )
 
 type Application struct {
-	cfg               *config.Config
-	logger            *zap.Logger
-	ctx               context.Context
-	cancel            context.CancelFunc
-	wg                sync.WaitGroup
+	cfg    *config.Config
+	logger *zap.Logger
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 
 	// Components
 	router            *ws.Router
@@ -31,8 +32,8 @@ type Application struct {
 	guiApp            *gui.App
 
 	// State
-	isRunning         bool
-	isRunningMutex    sync.RWMutex
+	isRunning      bool
+	isRunningMutex sync.RWMutex
 }
 
 func main() {
@@ -80,13 +81,19 @@ func (a *Application) initializeComponents() error {
 	a.logger.Info("Initializing components")
 
 	// Initialize router
-	a.router = ws.NewRouter(a.logger)
+	router, err := ws.NewRouter(a.cfg, a.logger)
+	if err != nil {
+		return fmt.Errorf("failed to create router: %w", err)
+	}
+	a.router = router
 
 	// Initialize parquet handler
 	a.parquetHandler = parquet.NewHandler(a.cfg, a.logger)
 
-	// Set router handler
-	a.router.SetHandler(a.parquetHandler)
+	// Register parquet sink with the router
+	if err := a.router.AddHandler("parquet", a.parquetHandler, a.cfg.Performance.Backpressure); err != nil {
+		return fmt.Errorf("failed to register parquet handler: %w", err)
+	}
 
 	// Initialize connection manager
 	a.connectionManager = ws.NewConnectionManager(a.cfg, a.logger, a.router)
@@ -254,4 +261,4 @@ func createLogger(level string) (*zap.Logger, error) {
 	config.ErrorOutputPaths = []string{"stderr"}
 
 	return config.Build()
-}
\ No newline at end of file
+}
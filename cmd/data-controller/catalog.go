@@ -0,0 +1,31 @@
+package main
+
+import (
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/internal/config"
+	"github.com/trade-engine/data-controller/internal/sink/parquet"
+)
+
+// runRebuildCatalog regenerates the catalog of every storage root from the
+// manifests of its segments.
+func runRebuildCatalog(configPath string) error {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+
+	logger, err := createNoGUILogger(cfg.Application.LogLevel)
+	if err != nil {
+		return err
+	}
+	defer logger.Sync()
+
+	count, err := parquet.NewWriter(cfg, logger).RebuildCatalog()
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Catalog rebuilt", zap.Int("segments", count))
+	return nil
+}
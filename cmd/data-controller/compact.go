@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/internal/config"
+	"github.com/trade-engine/data-controller/internal/sink/parquet"
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+// runCompact implements the compact subcommand, which merges the segments of
+// one channel, symbol and day into a single sorted segment.
+func runCompact(args []string) error {
+	flags := flag.NewFlagSet("compact", flag.ExitOnError)
+	configPath := flags.String("config", "config.yml", "Path to configuration file")
+	channel := flags.String("channel", "", "Channel to compact (trades, ticker, books, raw_books)")
+	symbol := flags.String("symbol", "", "Symbol to compact, e.g. tBTCUSD")
+	date := flags.String("date", "", "UTC day to compact, as YYYY-MM-DD")
+	dedup := flags.Bool("dedup", false, "Drop duplicate trade IDs and identical rows")
+	flags.Parse(args)
+
+	if *channel == "" || *symbol == "" || *date == "" {
+		return fmt.Errorf("-channel, -symbol and -date are required")
+	}
+	day, err := time.Parse("2006-01-02", *date)
+	if err != nil {
+		return fmt.Errorf("invalid -date: %w", err)
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+
+	logger, err := createNoGUILogger(cfg.Application.LogLevel)
+	if err != nil {
+		return err
+	}
+	defer logger.Sync()
+
+	info, err := parquet.NewWriter(cfg, logger).CompactDay(schema.Channel(*channel), *symbol, day, *dedup)
+	if errors.Is(err, parquet.ErrAlreadyCompacted) {
+		logger.Info("Nothing to compact", zap.String("day", *date))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Compaction finished",
+		zap.Int("segments", len(info.From)),
+		zap.Int64("rows_in", info.RowsIn),
+		zap.Int64("duplicates", info.Duplicates))
+	return nil
+}
@@ -18,11 +18,11 @@ import (
 )
 
 type NoGUIApplication struct {
-	cfg               *config.Config
-	logger            *zap.Logger
-	ctx               context.Context
-	cancel            context.CancelFunc
-	wg                sync.WaitGroup
+	cfg    *config.Config
+	logger *zap.Logger
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 
 	// Components
 	router            *ws.Router
@@ -30,15 +30,44 @@ type NoGUIApplication struct {
 	parquetHandler    *parquet.Handler
 
 	// State
-	isRunning         bool
-	isRunningMutex    sync.RWMutex
+	isRunning      bool
+	isRunningMutex sync.RWMutex
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "compact" {
+		if err := runCompact(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Compaction failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	configPath := flag.String("config", "config.yml", "Path to configuration file")
 	noGUI := flag.Bool("nogui", false, "Run without GUI")
+	replayPath := flag.String("replay", "", "Replay recorded tape file or directory instead of connecting")
+	replaySpeed := flag.Float64("replay-speed", 0, "Replay pacing: 1 = original, N = N times faster, 0 = as fast as possible")
+	replayOutput := flag.String("replay-output", "", "Storage root for the replayed dataset")
+	replayDelta := flag.Bool("replay-delta", false, "Keep Delta tables over the replayed dataset")
+	rebuildCatalog := flag.Bool("rebuild-catalog", false, "Regenerate the dataset catalog from segment manifests and exit")
 	flag.Parse()
 
+	if *rebuildCatalog {
+		if err := runRebuildCatalog(*configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Catalog rebuild failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *replayPath != "" {
+		if err := runReplay(*configPath, *replayPath, *replayOutput, *replaySpeed, *replayDelta); err != nil {
+			fmt.Fprintf(os.Stderr, "Replay failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if *noGUI {
 		app, err := NewNoGUIApplication(*configPath)
 		if err != nil {
@@ -86,13 +115,19 @@ func (a *NoGUIApplication) initializeComponents() error {
 	a.logger.Info("Initializing components")
 
 	// Initialize router
-	a.router = ws.NewRouter(a.logger)
+	router, err := ws.NewRouter(a.cfg, a.logger)
+	if err != nil {
+		return fmt.Errorf("failed to create router: %w", err)
+	}
+	a.router = router
 
 	// Initialize parquet handler
 	a.parquetHandler = parquet.NewHandler(a.cfg, a.logger)
 
-	// Set router handler
-	a.router.SetHandler(a.parquetHandler)
+	// Register parquet sink with the router
+	if err := a.router.AddHandler("parquet", a.parquetHandler, a.cfg.Performance.Backpressure); err != nil {
+		return fmt.Errorf("failed to register parquet handler: %w", err)
+	}
 
 	// Initialize connection manager
 	a.connectionManager = ws.NewConnectionManager(a.cfg, a.logger, a.router)
@@ -152,8 +187,28 @@ func (a *NoGUIApplication) statusReporter() {
 					zap.Int64("trades", stats.TradesReceived),
 					zap.Int64("book_levels", stats.BookLevelsReceived),
 					zap.Int64("raw_book_events", stats.RawBookEventsReceived),
+					zap.Int64("dropped", stats.TickersDropped+stats.TradesDropped+stats.BookLevelsDropped+stats.RawBookEventsDropped),
 					zap.Int64("errors", stats.Errors),
-					zap.Any("segments", writerStats["segments_count"]))
+					zap.Any("segments", writerStats["segments_count"]),
+					zap.Any("fsync", writerStats["fsync"]))
+			}
+
+			sampling := a.router.SamplingStats()
+			a.logger.Info("Ticker sampling",
+				zap.Int64("received", sampling.Received),
+				zap.Int64("emitted", sampling.Emitted),
+				zap.Int64("suppressed", sampling.Suppressed))
+
+			if a.cfg.Debug.SimulateNetworkIssues {
+				a.logger.Info("Injected network faults",
+					zap.Any("faults", a.connectionManager.FaultStats()))
+			}
+
+			for _, hs := range a.router.Stats() {
+				a.logger.Info("Handler lag",
+					zap.String("handler", hs.Name),
+					zap.Duration("max_lag", hs.MaxLag),
+					zap.Any("queues", hs.Queues))
 			}
 		}
 	}
@@ -285,4 +340,4 @@ func createNoGUILogger(level string) (*zap.Logger, error) {
 	config.ErrorOutputPaths = []string{"stderr"}
 
 	return config.Build()
-}
\ No newline at end of file
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/internal/config"
+	"github.com/trade-engine/data-controller/internal/sink/parquet"
+	"github.com/trade-engine/data-controller/internal/ws"
+)
+
+// runReplay regenerates a dataset from recorded tapes by pushing their frames
+// through the same Connection -> Router -> Handler path as live collection.
+// Every storage root is moved under outputPath; the storage manager is off,
+// and Delta tables are only kept when delta is set.
+func runReplay(configPath, tapePath, outputPath string, speed float64, delta bool) error {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+
+	logger, err := createNoGUILogger(cfg.Application.LogLevel)
+	if err != nil {
+		return err
+	}
+	defer logger.Sync()
+
+	if outputPath == "" {
+		return fmt.Errorf("-replay-output is required")
+	}
+	if speed < 0 {
+		return fmt.Errorf("-replay-speed must not be negative")
+	}
+
+	absOut, err := filepath.Abs(outputPath)
+	if err != nil {
+		return err
+	}
+	if err := redirectStorage(&cfg.Storage, absOut); err != nil {
+		return err
+	}
+	cfg.Storage.Manager.Enabled = false
+	cfg.Storage.Delta.Enabled = delta
+	cfg.Performance.Backpressure.SpillPath = ""
+
+	router, err := ws.NewRouter(cfg, logger)
+	if err != nil {
+		return fmt.Errorf("failed to create router: %w", err)
+	}
+
+	handler := parquet.NewHandler(cfg, logger)
+	if err := handler.Start(); err != nil {
+		return err
+	}
+
+	// Nothing is lost by waiting on the sink here, so every queue blocks.
+	if err := router.AddHandler("parquet", handler, config.BackpressureConfig{}); err != nil {
+		handler.Stop()
+		return fmt.Errorf("failed to register parquet handler: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signalChan:
+			logger.Info("Replay interrupted")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	logger.Info("Starting replay",
+		zap.String("tapes", tapePath),
+		zap.String("output", absOut),
+		zap.Float64("speed", speed))
+
+	start := time.Now()
+	replayer := ws.NewReplayer(cfg, logger, router, speed)
+	stats, runErr := replayer.Run(ctx, tapePath)
+
+	router.Close()
+	if err := handler.Stop(); err != nil {
+		logger.Error("Failed to stop parquet handler", zap.Error(err))
+	}
+
+	logger.Info("Replay finished",
+		zap.Int("files", stats.Files),
+		zap.Int64("frames", stats.Frames),
+		zap.Int64("errors", stats.Errors),
+		zap.Duration("duration", time.Since(start)))
+
+	if runErr != nil && runErr != context.Canceled {
+		return runErr
+	}
+	return nil
+}
+
+// redirectStorage moves base_path to output and each per-channel base_path
+// override to a directory of its own under output. It refuses a layout in
+// which any resulting root is one of the live roots.
+func redirectStorage(storage *config.Storage, output string) error {
+	live, err := storageRoots(storage)
+	if err != nil {
+		return err
+	}
+
+	storage.BasePath = output
+	channels := make(map[string]config.StorageOverride, len(storage.Channels))
+	for name, override := range storage.Channels {
+		if override.BasePath != "" {
+			override.BasePath = filepath.Join(output, name)
+		}
+		channels[name] = override
+	}
+	storage.Channels = channels
+
+	replayed, err := storageRoots(storage)
+	if err != nil {
+		return err
+	}
+	for _, root := range replayed {
+		if slices.Contains(live, root) {
+			return fmt.Errorf("replay output %s would write into live storage root %s", output, root)
+		}
+	}
+	return nil
+}
+
+// storageRoots returns the absolute storage roots of storage: base_path and
+// the per-channel base_path overrides.
+func storageRoots(storage *config.Storage) ([]string, error) {
+	paths := []string{storage.BasePath}
+	for _, override := range storage.Channels {
+		if override.BasePath != "" {
+			paths = append(paths, override.BasePath)
+		}
+	}
+
+	roots := make([]string, 0, len(paths))
+	for _, path := range paths {
+		root, err := filepath.Abs(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve storage root %s: %w", path, err)
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
@@ -0,0 +1,154 @@
+package bfxmock
+
+import (
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const checksumDepth = 25
+
+// mockBook is the order book behind one book subscription. Keys and amounts
+// are kept as the exact text sent to the client, since that is what the
+// checksum covers.
+type mockBook struct {
+	raw  bool
+	tick float64
+	mid  float64
+	bids map[string]bookRow
+	asks map[string]bookRow
+
+	nextOrderID int64
+}
+
+type bookRow struct {
+	key    string
+	id     int64
+	price  float64
+	count  int
+	amount float64
+}
+
+func newMockBook(raw bool, mid float64, depth int) *mockBook {
+	b := &mockBook{
+		raw:         raw,
+		tick:        mid * 0.0001,
+		mid:         mid,
+		bids:        make(map[string]bookRow),
+		asks:        make(map[string]bookRow),
+		nextOrderID: 1000000,
+	}
+
+	for i := 1; i <= depth; i++ {
+		b.set(b.mid-float64(i)*b.tick, 1+i%3, float64(i)*0.1)
+		b.set(b.mid+float64(i)*b.tick, 1+i%3, -float64(i)*0.1)
+	}
+	return b
+}
+
+func formatNum(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func (b *mockBook) set(price float64, count int, amount float64) bookRow {
+	price, _ = strconv.ParseFloat(strconv.FormatFloat(price, 'f', 2, 64), 64)
+	amount, _ = strconv.ParseFloat(strconv.FormatFloat(amount, 'f', 4, 64), 64)
+
+	row := bookRow{price: price, count: count, amount: amount}
+	if b.raw {
+		b.nextOrderID++
+		row.id = b.nextOrderID
+		row.key = strconv.FormatInt(row.id, 10)
+	} else {
+		row.key = formatNum(price)
+	}
+
+	side := b.bids
+	if amount < 0 {
+		side = b.asks
+	}
+	side[row.key] = row
+	return row
+}
+
+// entry renders a row the way the channel sends it: [PRICE, COUNT, AMOUNT]
+// for aggregated books and [ORDER_ID, PRICE, AMOUNT] for raw books.
+func (b *mockBook) entry(row bookRow) string {
+	if b.raw {
+		return "[" + row.key + "," + formatNum(row.price) + "," + formatNum(row.amount) + "]"
+	}
+	return "[" + row.key + "," + strconv.Itoa(row.count) + "," + formatNum(row.amount) + "]"
+}
+
+func (b *mockBook) snapshot() string {
+	rows := append(sortedRows(b.bids, true), sortedRows(b.asks, false)...)
+	parts := make([]string, 0, len(rows))
+	for _, row := range rows {
+		parts = append(parts, b.entry(row))
+	}
+	return "[" + strings.Join(parts, ",") + "]"
+}
+
+// update applies one random change and returns the delta entry for it.
+func (b *mockBook) update(rng *rand.Rand) string {
+	bid := rng.Intn(2) == 0
+	side, sign := b.bids, 1.0
+	if !bid {
+		side, sign = b.asks, -1.0
+	}
+
+	if len(side) > 3 && (len(side) > checksumDepth || rng.Float64() < 0.3) {
+		rows := sortedRows(side, bid)
+		row := rows[rng.Intn(len(rows))]
+		delete(side, row.key)
+		if b.raw {
+			row.price = 0
+		} else {
+			row.count = 0
+			row.amount = sign
+		}
+		return b.entry(row)
+	}
+
+	offset := float64(1 + rng.Intn(10))
+	price := b.mid - sign*offset*b.tick
+	row := b.set(price, 1+rng.Intn(5), sign*(0.01+rng.Float64()))
+	return b.entry(row)
+}
+
+// checksum follows Bitfinex: CRC32 over the top 25 levels, interleaving
+// bid and ask key:amount pairs.
+func (b *mockBook) checksum() int32 {
+	bids := sortedRows(b.bids, true)
+	asks := sortedRows(b.asks, false)
+
+	parts := make([]string, 0, checksumDepth*4)
+	for i := 0; i < checksumDepth; i++ {
+		if i < len(bids) {
+			parts = append(parts, bids[i].key, formatNum(bids[i].amount))
+		}
+		if i < len(asks) {
+			parts = append(parts, asks[i].key, formatNum(asks[i].amount))
+		}
+	}
+	return int32(crc32.ChecksumIEEE([]byte(strings.Join(parts, ":"))))
+}
+
+func sortedRows(side map[string]bookRow, desc bool) []bookRow {
+	rows := make([]bookRow, 0, len(side))
+	for _, row := range side {
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].price != rows[j].price {
+			if desc {
+				return rows[i].price > rows[j].price
+			}
+			return rows[i].price < rows[j].price
+		}
+		return rows[i].id < rows[j].id
+	})
+	return rows
+}
@@ -0,0 +1,249 @@
+// Package bfxmock is a local stand-in for the Bitfinex v2 public WebSocket.
+// It speaks enough of the protocol for the collector to run against it and
+// can be scripted to misbehave: dropped sockets, maintenance codes, corrupt
+// checksums and sequence gaps. Tests can start one with NewTestServer.
+package bfxmock
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	FlagTimestamp   = 32768
+	FlagSeqAll      = 65536
+	FlagOBChecksum  = 131072
+	FlagBulkUpdates = 536870912
+
+	CodeMaintenanceStart = 20051
+	CodeMaintenanceEnd   = 20061
+	CodeSymbolInvalid    = 10300
+)
+
+// Scenario scripts faults that every session runs into on its own.
+type Scenario struct {
+	// DropAfterFrames closes the first session after it has sent this many
+	// channel frames.
+	DropAfterFrames int
+	// MaintenanceAfter sends a 20051 info event this long into each session.
+	MaintenanceAfter time.Duration
+	// CorruptChecksumEvery makes every Nth cs frame wrong.
+	CorruptChecksumEvery int
+	// GapEvery skips a sequence number before every Nth channel frame.
+	GapEvery int
+	// RejectSymbols answers subscriptions for these symbols with an error.
+	RejectSymbols []string
+}
+
+type Options struct {
+	HeartbeatInterval time.Duration
+	UpdateInterval    time.Duration
+	// Prices seeds the mid price of each symbol; unknown symbols start at 100.
+	Prices   map[string]float64
+	Seed     int64
+	Scenario Scenario
+	Logger   *zap.Logger
+}
+
+type Server struct {
+	opts     Options
+	logger   *zap.Logger
+	upgrader websocket.Upgrader
+
+	nextChanID atomic.Int32
+	sessionSeq atomic.Int64
+
+	mu       sync.Mutex
+	sessions map[int64]*session
+
+	httpServer *http.Server
+	testServer *httptest.Server
+}
+
+func NewServer(opts Options) *Server {
+	if opts.HeartbeatInterval <= 0 {
+		opts.HeartbeatInterval = 15 * time.Second
+	}
+	if opts.UpdateInterval <= 0 {
+		opts.UpdateInterval = 200 * time.Millisecond
+	}
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	if opts.Seed == 0 {
+		opts.Seed = 1
+	}
+
+	s := &Server{
+		opts:     opts,
+		logger:   opts.Logger,
+		upgrader: websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }},
+		sessions: make(map[int64]*session),
+	}
+	s.nextChanID.Store(10)
+	return s
+}
+
+// NewTestServer starts a server on a loopback port; URL returns its address.
+func NewTestServer(opts Options) *Server {
+	s := NewServer(opts)
+	s.testServer = httptest.NewServer(s)
+	return s
+}
+
+// ListenAndServe serves the mock on addr until Close is called.
+func (s *Server) ListenAndServe(addr string) error {
+	s.httpServer = &http.Server{Addr: addr, Handler: s}
+	if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// URL is the ws:// address of a test server.
+func (s *Server) URL() string {
+	if s.testServer == nil {
+		return ""
+	}
+	return "ws" + strings.TrimPrefix(s.testServer.URL, "http") + "/ws/2"
+}
+
+func (s *Server) Close() {
+	s.DropAll()
+	if s.testServer != nil {
+		s.testServer.Close()
+	}
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+}
+
+// Sessions counts the sockets accepted so far, including closed ones.
+func (s *Server) Sessions() int {
+	return int(s.sessionSeq.Load())
+}
+
+// DropAll closes every open socket without a close frame.
+func (s *Server) DropAll() {
+	for _, sess := range s.snapshotSessions() {
+		sess.close()
+	}
+}
+
+// SendInfo sends an info event with code to every open socket.
+func (s *Server) SendInfo(code int, msg string) {
+	for _, sess := range s.snapshotSessions() {
+		sess.sendEvent(map[string]interface{}{"event": "info", "code": code, "msg": msg})
+	}
+}
+
+// CorruptNextChecksum makes the next cs frame of every open socket wrong.
+func (s *Server) CorruptNextChecksum() {
+	for _, sess := range s.snapshotSessions() {
+		sess.mu.Lock()
+		sess.corruptNext = true
+		sess.mu.Unlock()
+	}
+}
+
+// SkipNextSeq leaves a hole before the next frame of every open socket.
+func (s *Server) SkipNextSeq() {
+	for _, sess := range s.snapshotSessions() {
+		sess.mu.Lock()
+		sess.seq++
+		sess.mu.Unlock()
+	}
+}
+
+func (s *Server) snapshotSessions() []*session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := make([]*session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logger.Warn("Upgrade failed", zap.Error(err))
+		return
+	}
+
+	id := s.sessionSeq.Add(1)
+	sess := &session{
+		id:       id,
+		srv:      s,
+		conn:     conn,
+		rng:      rand.New(rand.NewSource(s.opts.Seed + id)),
+		channels: make(map[int32]*subscription),
+		done:     make(chan struct{}),
+		started:  time.Now(),
+	}
+
+	s.mu.Lock()
+	s.sessions[id] = sess
+	s.mu.Unlock()
+
+	s.logger.Info("Session opened", zap.Int64("session", id))
+
+	sess.sendEvent(map[string]interface{}{
+		"event":    "info",
+		"version":  2,
+		"serverId": fmt.Sprintf("mock-%d", id),
+		"platform": map[string]int{"status": 1},
+	})
+
+	go sess.feed()
+	sess.readLoop()
+
+	sess.close()
+	s.mu.Lock()
+	delete(s.sessions, id)
+	s.mu.Unlock()
+
+	s.logger.Info("Session closed", zap.Int64("session", id))
+}
+
+func (s *Server) rejects(symbol string) bool {
+	for _, r := range s.opts.Scenario.RejectSymbols {
+		if r == symbol {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) price(symbol string) float64 {
+	if p, ok := s.opts.Prices[symbol]; ok {
+		return p
+	}
+	return 100
+}
+
+// inbound covers every client event the mock understands.
+type inbound struct {
+	Event   string          `json:"event"`
+	Flags   int64           `json:"flags"`
+	Channel string          `json:"channel"`
+	Symbol  string          `json:"symbol"`
+	Prec    string          `json:"prec"`
+	Freq    string          `json:"freq"`
+	Len     string          `json:"len"`
+	SubID   *int64          `json:"subId"`
+	ChanID  int32           `json:"chanId"`
+	CID     json.RawMessage `json:"cid"`
+}
@@ -0,0 +1,330 @@
+package bfxmock
+
+import (
+	"encoding/json"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// session is one client socket with its own conf flags, chanIds and
+// per-connection sequence counter.
+type session struct {
+	id      int64
+	srv     *Server
+	conn    *websocket.Conn
+	started time.Time
+
+	mu          sync.Mutex
+	rng         *rand.Rand
+	flags       int64
+	seq         int64
+	frames      int
+	csCount     int
+	corruptNext bool
+	maintained  bool
+	channels    map[int32]*subscription
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type subscription struct {
+	chanID  int32
+	channel string
+	symbol  string
+	price   float64
+	tradeID int64
+	lastHB  time.Time
+	book    *mockBook
+}
+
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+func (s *session) readLoop() {
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var msg inbound
+		if err := json.Unmarshal(data, &msg); err != nil {
+			s.sendEvent(map[string]interface{}{"event": "error", "msg": "invalid message", "code": 10000})
+			continue
+		}
+
+		switch msg.Event {
+		case "conf":
+			s.mu.Lock()
+			s.flags = msg.Flags
+			s.mu.Unlock()
+			s.sendEvent(map[string]interface{}{"event": "conf", "status": "OK", "flags": msg.Flags})
+		case "subscribe":
+			s.subscribe(msg)
+		case "unsubscribe":
+			s.mu.Lock()
+			_, exists := s.channels[msg.ChanID]
+			delete(s.channels, msg.ChanID)
+			s.mu.Unlock()
+			if !exists {
+				s.sendEvent(map[string]interface{}{"event": "error", "msg": "unsub: invalid", "code": 10400})
+				continue
+			}
+			s.sendEvent(map[string]interface{}{"event": "unsubscribed", "status": "OK", "chanId": msg.ChanID})
+		case "ping":
+			s.sendEvent(map[string]interface{}{"event": "pong", "ts": time.Now().UnixMilli(), "cid": msg.CID})
+		default:
+			s.sendEvent(map[string]interface{}{"event": "error", "msg": "unknown event", "code": 10000})
+		}
+	}
+}
+
+func (s *session) subscribe(msg inbound) {
+	reject := func(text string, code int) {
+		event := map[string]interface{}{
+			"event": "error", "msg": text, "code": code,
+			"channel": msg.Channel, "symbol": msg.Symbol,
+		}
+		if msg.SubID != nil {
+			event["subId"] = *msg.SubID
+		}
+		s.sendEvent(event)
+	}
+
+	switch msg.Channel {
+	case "ticker", "trades", "book":
+	default:
+		reject("channel: unknown", 10300)
+		return
+	}
+	if !strings.HasPrefix(msg.Symbol, "t") || s.srv.rejects(msg.Symbol) {
+		reject("symbol: invalid", CodeSymbolInvalid)
+		return
+	}
+
+	sub := &subscription{
+		chanID:  s.srv.nextChanID.Add(1),
+		channel: msg.Channel,
+		symbol:  msg.Symbol,
+		price:   s.srv.price(msg.Symbol),
+		tradeID: 1,
+		lastHB:  time.Now(),
+	}
+
+	resp := map[string]interface{}{
+		"event":   "subscribed",
+		"channel": msg.Channel,
+		"chanId":  sub.chanID,
+		"symbol":  msg.Symbol,
+		"pair":    strings.TrimPrefix(msg.Symbol, "t"),
+	}
+	if msg.SubID != nil {
+		resp["subId"] = *msg.SubID
+	}
+	if msg.Channel == "book" {
+		prec, freq, length := msg.Prec, msg.Freq, msg.Len
+		if prec == "" {
+			prec = "P0"
+		}
+		if freq == "" {
+			freq = "F0"
+		}
+		if length == "" {
+			length = "25"
+		}
+		resp["prec"], resp["freq"], resp["len"] = prec, freq, length
+
+		depth, _ := strconv.Atoi(length)
+		if depth <= 0 || depth > checksumDepth {
+			depth = checksumDepth
+		}
+		sub.book = newMockBook(prec == "R0", sub.price, depth)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.channels[sub.chanID] = sub
+	s.writeLocked(resp)
+	s.sendSnapshotLocked(sub)
+}
+
+func (s *session) sendSnapshotLocked(sub *subscription) {
+	switch sub.channel {
+	case "ticker":
+		s.sendChannelLocked(sub.chanID, s.tickerPayload(sub))
+	case "trades":
+		parts := make([]string, 0, 3)
+		for i := 0; i < 3; i++ {
+			parts = append(parts, s.nextTrade(sub))
+		}
+		s.sendChannelLocked(sub.chanID, "["+strings.Join(parts, ",")+"]")
+	case "book":
+		s.sendChannelLocked(sub.chanID, sub.book.snapshot())
+		s.sendChecksumLocked(sub)
+	}
+}
+
+// feed drives updates, heartbeats and the scripted faults until the socket
+// is closed.
+func (s *session) feed() {
+	ticker := time.NewTicker(s.srv.opts.UpdateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		scenario := s.srv.opts.Scenario
+		if scenario.MaintenanceAfter > 0 && !s.maintained && time.Since(s.started) >= scenario.MaintenanceAfter {
+			s.maintained = true
+			s.writeLocked(map[string]interface{}{
+				"event": "info", "code": CodeMaintenanceStart,
+				"msg": "Stopping. Please try to reconnect",
+			})
+		}
+
+		for _, sub := range s.channels {
+			s.updateLocked(sub)
+			if time.Since(sub.lastHB) >= s.srv.opts.HeartbeatInterval {
+				sub.lastHB = time.Now()
+				s.sendChannelLocked(sub.chanID, `"hb"`)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *session) updateLocked(sub *subscription) {
+	sub.price *= 1 + (s.rng.Float64()-0.5)*0.001
+
+	switch sub.channel {
+	case "ticker":
+		s.sendChannelLocked(sub.chanID, s.tickerPayload(sub))
+	case "trades":
+		trade := s.nextTrade(sub)
+		s.sendChannelLocked(sub.chanID, `"te"`, trade)
+		s.sendChannelLocked(sub.chanID, `"tu"`, trade)
+	case "book":
+		if s.flags&FlagBulkUpdates != 0 {
+			// Bulk frames batch several deltas as an array of entries,
+			// shaped like the snapshot.
+			entries := make([]string, 2+s.rng.Intn(3))
+			for i := range entries {
+				entries[i] = sub.book.update(s.rng)
+			}
+			s.sendChannelLocked(sub.chanID, "["+strings.Join(entries, ",")+"]")
+		} else {
+			s.sendChannelLocked(sub.chanID, sub.book.update(s.rng))
+		}
+		s.sendChecksumLocked(sub)
+	}
+}
+
+func (s *session) tickerPayload(sub *subscription) string {
+	p := sub.price
+	values := []float64{p * 0.9999, 1.5, p * 1.0001, 2.5, p * 0.01, 0.01, p, 1234.5, p * 1.02, p * 0.98}
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.FormatFloat(v, 'f', 4, 64)
+	}
+	return "[" + strings.Join(parts, ",") + "]"
+}
+
+// nextTrade renders [ID, MTS, AMOUNT, PRICE].
+func (s *session) nextTrade(sub *subscription) string {
+	sub.tradeID++
+	amount := s.rng.Float64() - 0.5
+	return "[" + strconv.FormatInt(sub.tradeID, 10) + "," +
+		strconv.FormatInt(time.Now().UnixMilli(), 10) + "," +
+		strconv.FormatFloat(amount, 'f', 4, 64) + "," +
+		strconv.FormatFloat(sub.price, 'f', 2, 64) + "]"
+}
+
+func (s *session) sendChecksumLocked(sub *subscription) {
+	if s.flags&FlagOBChecksum == 0 {
+		return
+	}
+
+	s.csCount++
+	checksum := sub.book.checksum()
+	every := s.srv.opts.Scenario.CorruptChecksumEvery
+	if s.corruptNext || (every > 0 && s.csCount%every == 0) {
+		s.corruptNext = false
+		checksum++
+	}
+	s.sendChannelLocked(sub.chanID, `"cs"`, strconv.FormatInt(int64(checksum), 10))
+}
+
+// sendChannelLocked writes [chanId, parts..., seq?, ts?] with the trailer the
+// session's conf flags ask for.
+func (s *session) sendChannelLocked(chanID int32, parts ...string) {
+	scenario := s.srv.opts.Scenario
+
+	s.frames++
+	if scenario.GapEvery > 0 && s.frames%scenario.GapEvery == 0 {
+		s.seq++
+	}
+	s.seq++
+
+	frame := make([]string, 0, len(parts)+3)
+	frame = append(frame, strconv.FormatInt(int64(chanID), 10))
+	frame = append(frame, parts...)
+	if s.flags&FlagSeqAll != 0 {
+		frame = append(frame, strconv.FormatInt(s.seq, 10))
+	}
+	if s.flags&FlagTimestamp != 0 {
+		frame = append(frame, strconv.FormatInt(time.Now().UnixMilli(), 10))
+	}
+
+	s.write([]byte("[" + strings.Join(frame, ",") + "]"))
+
+	if scenario.DropAfterFrames > 0 && s.id == 1 && s.frames == scenario.DropAfterFrames {
+		s.srv.logger.Info("Dropping session", zap.Int64("session", s.id), zap.Int("frames", s.frames))
+		s.close()
+	}
+}
+
+func (s *session) sendEvent(event map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeLocked(event)
+}
+
+func (s *session) writeLocked(event map[string]interface{}) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		s.srv.logger.Error("Failed to marshal event", zap.Error(err))
+		return
+	}
+	s.write(data)
+}
+
+// write must be called with s.mu held; it is the only writer on the socket.
+func (s *session) write(data []byte) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := s.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		s.close()
+	}
+}
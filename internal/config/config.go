@@ -44,13 +44,16 @@ type Channels struct {
 }
 
 type TickerConfig struct {
-	Enabled      bool          `yaml:"enabled"`
-	SamplingRate time.Duration `yaml:"sampling_rate"`
+	Enabled         bool          `yaml:"enabled"`
+	SamplingRate    time.Duration `yaml:"sampling_rate"`
+	SamplingMode    string        `yaml:"sampling_mode"`
+	EmitOnChangeBps float64       `yaml:"emit_on_change_bps"`
 }
 
 type TradesConfig struct {
-	Enabled bool   `yaml:"enabled"`
-	MsgType string `yaml:"msg_type"`
+	Enabled     bool   `yaml:"enabled"`
+	MsgType     string `yaml:"msg_type"`
+	DedupWindow int    `yaml:"dedup_window"`
 }
 
 type BooksConfig struct {
@@ -68,12 +71,60 @@ type RawBooksConfig struct {
 }
 
 type Storage struct {
+	BasePath         string               `yaml:"base_path"`
+	SegmentSizeMB    int                  `yaml:"segment_size_mb"`
+	Compression      string               `yaml:"compression"`
+	CompressionLevel int                  `yaml:"compression_level"`
+	PartitionTime    string               `yaml:"partition_time"`
+	Durability       string               `yaml:"durability"`
+	Parquet          ParquetConfig        `yaml:"parquet"`
+	WAL              WALConfig            `yaml:"wal"`
+	Delta            DeltaConfig          `yaml:"delta"`
+	Manager          StorageManagerConfig `yaml:"manager"`
+	// Channels overrides the settings above for ticker, trades, books or
+	// raw_books.
+	Channels map[string]StorageOverride `yaml:"channels"`
+}
+
+// StorageOverride holds the storage settings of one channel. Zero fields keep
+// the shared value. Setting compression without compression_level uses the
+// codec's default level.
+type StorageOverride struct {
 	BasePath         string        `yaml:"base_path"`
 	SegmentSizeMB    int           `yaml:"segment_size_mb"`
 	Compression      string        `yaml:"compression"`
 	CompressionLevel int           `yaml:"compression_level"`
-	Parquet          ParquetConfig `yaml:"parquet"`
-	WAL              WALConfig     `yaml:"wal"`
+	RowGroupSizeMB   int           `yaml:"row_group_size_mb"`
+	FlushInterval    time.Duration `yaml:"flush_interval"`
+}
+
+// ForChannel returns the storage settings of channel, with its override
+// applied.
+func (s Storage) ForChannel(channel string) Storage {
+	override, ok := s.Channels[channel]
+	if !ok {
+		return s
+	}
+	if override.BasePath != "" {
+		s.BasePath = override.BasePath
+	}
+	if override.SegmentSizeMB != 0 {
+		s.SegmentSizeMB = override.SegmentSizeMB
+	}
+	if override.Compression != "" {
+		s.Compression = override.Compression
+		s.CompressionLevel = 0
+	}
+	if override.CompressionLevel != 0 {
+		s.CompressionLevel = override.CompressionLevel
+	}
+	if override.RowGroupSizeMB != 0 {
+		s.Parquet.RowGroupSizeMB = override.RowGroupSizeMB
+	}
+	if override.FlushInterval != 0 {
+		s.Parquet.FlushInterval = override.FlushInterval
+	}
+	return s
 }
 
 type ParquetConfig struct {
@@ -83,9 +134,35 @@ type ParquetConfig struct {
 }
 
 type WALConfig struct {
-	Enabled          bool `yaml:"enabled"`
-	Compression      string `yaml:"compression"`
-	RetentionHours   int `yaml:"retention_hours"`
+	Enabled        bool   `yaml:"enabled"`
+	Compression    string `yaml:"compression"`
+	RetentionHours int    `yaml:"retention_hours"`
+}
+
+// DeltaConfig controls the Delta Lake tables kept over each channel's
+// segments. CheckpointInterval is the number of commits between checkpoints;
+// 0 means 10.
+type DeltaConfig struct {
+	Enabled            bool `yaml:"enabled"`
+	CheckpointInterval int  `yaml:"checkpoint_interval"`
+}
+
+// StorageManagerConfig controls the storage manager, which watches free
+// space on the storage roots and applies segment retention.
+type StorageManagerConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	CheckInterval time.Duration `yaml:"check_interval"`
+	// Below LowFreeGB retention runs on every check. Below HardFreeGB the
+	// channels in PauseOrder are paused one per check, first to last, and
+	// resumed once free space is back above LowFreeGB.
+	LowFreeGB  float64  `yaml:"low_free_gb"`
+	HardFreeGB float64  `yaml:"hard_free_gb"`
+	PauseOrder []string `yaml:"pause_order"`
+	// Retention is how long closed segments of a channel stay under its
+	// base path. Older ones are moved below ArchivePath, or deleted when it
+	// is empty.
+	Retention   map[string]time.Duration `yaml:"retention"`
+	ArchivePath string                   `yaml:"archive_path"`
 }
 
 type Metadata struct {
@@ -102,8 +179,8 @@ type Monitoring struct {
 }
 
 type PrometheusConfig struct {
-	Enabled bool `yaml:"enabled"`
-	Port    int  `yaml:"port"`
+	Enabled bool   `yaml:"enabled"`
+	Port    int    `yaml:"port"`
 	Path    string `yaml:"path"`
 }
 
@@ -130,11 +207,23 @@ type GUI struct {
 }
 
 type Performance struct {
-	BufferSize      int               `yaml:"buffer_size"`
-	WorkerCount     int               `yaml:"worker_count"`
-	MaxMemoryMB     int               `yaml:"max_memory_mb"`
-	GCInterval      time.Duration     `yaml:"gc_interval"`
-	CircuitBreaker  CircuitBreakerConfig `yaml:"circuit_breaker"`
+	BufferSize     int                  `yaml:"buffer_size"`
+	WorkerCount    int                  `yaml:"worker_count"`
+	MaxMemoryMB    int                  `yaml:"max_memory_mb"`
+	GCInterval     time.Duration        `yaml:"gc_interval"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+	Backpressure   BackpressureConfig   `yaml:"backpressure"`
+}
+
+// BackpressureConfig selects what the router does when a channel queue is full.
+// Valid policies are "block", "drop_newest", "drop_oldest" and "spill".
+type BackpressureConfig struct {
+	Ticker    string `yaml:"ticker"`
+	Trades    string `yaml:"trades"`
+	Books     string `yaml:"books"`
+	RawBooks  string `yaml:"raw_books"`
+	Controls  string `yaml:"controls"`
+	SpillPath string `yaml:"spill_path"`
 }
 
 type CircuitBreakerConfig struct {
@@ -144,11 +233,28 @@ type CircuitBreakerConfig struct {
 }
 
 type Debug struct {
-	EnableProfiling       bool `yaml:"enable_profiling"`
-	ProfilingPort         int  `yaml:"profiling_port"`
-	VerboseLogging        bool `yaml:"verbose_logging"`
-	SaveRawMessages       bool `yaml:"save_raw_messages"`
-	SimulateNetworkIssues bool `yaml:"simulate_network_issues"`
+	EnableProfiling       bool                `yaml:"enable_profiling"`
+	ProfilingPort         int                 `yaml:"profiling_port"`
+	VerboseLogging        bool                `yaml:"verbose_logging"`
+	SaveRawMessages       bool                `yaml:"save_raw_messages"`
+	RawTapePath           string              `yaml:"raw_tape_path"`
+	RawTapeRotateMB       int                 `yaml:"raw_tape_rotate_mb"`
+	SimulateNetworkIssues bool                `yaml:"simulate_network_issues"`
+	NetworkFaults         NetworkFaultsConfig `yaml:"network_faults"`
+}
+
+// NetworkFaultsConfig drives the fault injector used when
+// simulate_network_issues is on. Rates are per inbound frame, 0 to 1.
+type NetworkFaultsConfig struct {
+	Seed                 int64         `yaml:"seed"`
+	Latency              time.Duration `yaml:"latency"`
+	Jitter               time.Duration `yaml:"jitter"`
+	DropRate             float64       `yaml:"drop_rate"`
+	DuplicateRate        float64       `yaml:"duplicate_rate"`
+	ReorderRate          float64       `yaml:"reorder_rate"`
+	CloseMidSnapshotRate float64       `yaml:"close_mid_snapshot_rate"`
+	StallRate            float64       `yaml:"stall_rate"`
+	StallDuration        time.Duration `yaml:"stall_duration"`
 }
 
 func Load(path string) (*Config, error) {
@@ -172,4 +278,4 @@ func (c *Config) Save(path string) error {
 	}
 
 	return os.WriteFile(path, data, 0644)
-}
\ No newline at end of file
+}
@@ -18,17 +18,17 @@ import (
 )
 
 type App struct {
-	cfg             *config.Config
-	logger          *zap.Logger
-	fyneApp         fyne.App
-	window          fyne.Window
-	parquetHandler  *parquet.Handler
+	cfg            *config.Config
+	logger         *zap.Logger
+	fyneApp        fyne.App
+	window         fyne.Window
+	parquetHandler *parquet.Handler
 
 	// Control state
-	isRunning       bool
-	isRunningMutex  sync.RWMutex
-	startCallback   func() error
-	stopCallback    func() error
+	isRunning      bool
+	isRunningMutex sync.RWMutex
+	startCallback  func() error
+	stopCallback   func() error
 
 	// UI elements
 	startButton     *widget.Button
@@ -43,12 +43,13 @@ type App struct {
 	tradesLabel        *widget.Label
 	bookLevelsLabel    *widget.Label
 	rawBookEventsLabel *widget.Label
+	droppedLabel       *widget.Label
 	errorsLabel        *widget.Label
 	lastFlushLabel     *widget.Label
 
 	// Storage display
-	segmentsLabel      *widget.Label
-	ingestIdLabel      *widget.Label
+	segmentsLabel *widget.Label
+	ingestIdLabel *widget.Label
 
 	// Update ticker
 	updateTicker *time.Ticker
@@ -145,6 +146,7 @@ func (a *App) createStatisticsCard() {
 	a.tradesLabel = widget.NewLabel("Trades: 0")
 	a.bookLevelsLabel = widget.NewLabel("Book Levels: 0")
 	a.rawBookEventsLabel = widget.NewLabel("Raw Book Events: 0")
+	a.droppedLabel = widget.NewLabel("Dropped: 0")
 	a.errorsLabel = widget.NewLabel("Errors: 0")
 	a.lastFlushLabel = widget.NewLabel("Last Flush: Never")
 
@@ -154,6 +156,7 @@ func (a *App) createStatisticsCard() {
 		a.bookLevelsLabel,
 		a.rawBookEventsLabel,
 		widget.NewSeparator(),
+		a.droppedLabel,
 		a.errorsLabel,
 		a.lastFlushLabel,
 	)
@@ -312,6 +315,8 @@ func (a *App) updateStatistics() {
 	a.tradesLabel.SetText(fmt.Sprintf("Trades: %d", stats.TradesReceived))
 	a.bookLevelsLabel.SetText(fmt.Sprintf("Book Levels: %d", stats.BookLevelsReceived))
 	a.rawBookEventsLabel.SetText(fmt.Sprintf("Raw Book Events: %d", stats.RawBookEventsReceived))
+	a.droppedLabel.SetText(fmt.Sprintf("Dropped: %d",
+		stats.TickersDropped+stats.TradesDropped+stats.BookLevelsDropped+stats.RawBookEventsDropped))
 	a.errorsLabel.SetText(fmt.Sprintf("Errors: %d", stats.Errors))
 
 	if !stats.LastFlushTime.IsZero() {
@@ -378,4 +383,4 @@ func (a *App) SetRunning(running bool) {
 		a.stopButton.Disable()
 		a.statusLabel.SetText("Status: Stopped")
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,89 @@
+package parquet
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+const (
+	// writeBatchRows is how many rows a ChannelWriter buffers before handing
+	// them to the parquet writer in one call.
+	writeBatchRows = 4096
+
+	// defaultRowGroupRows caps a row group while there is neither a
+	// flush_row_count nor a size estimate to go by.
+	defaultRowGroupRows = 100000
+)
+
+// rowBatch buffers the rows of one parquet file and writes them to the
+// underlying parquet writer in large slices.
+type rowBatch interface {
+	add(row interface{}) error
+	buffered() int
+	// write hands the buffered rows to the parquet writer.
+	write() error
+	// cut writes the buffered rows and ends the current row group.
+	cut() error
+	close() error
+	// setMetadata sets a key-value pair of the footer written by close.
+	setMetadata(key, value string)
+}
+
+type batch[T any] struct {
+	writer *parquet.GenericWriter[T]
+	rows   []T
+}
+
+func newBatch[T any](w io.Writer, options ...parquet.WriterOption) *batch[T] {
+	options = append(append([]parquet.WriterOption{rowSchema[T]()}, layoutOptions()...), options...)
+	return &batch[T]{
+		writer: parquet.NewGenericWriter[T](w, options...),
+		rows:   make([]T, 0, writeBatchRows),
+	}
+}
+
+func (b *batch[T]) add(row interface{}) error {
+	v, ok := row.(*T)
+	if !ok {
+		return fmt.Errorf("unsupported data type: %T", row)
+	}
+	b.rows = append(b.rows, *v)
+	return nil
+}
+
+func (b *batch[T]) buffered() int {
+	return len(b.rows)
+}
+
+func (b *batch[T]) write() error {
+	if len(b.rows) == 0 {
+		return nil
+	}
+	if _, err := b.writer.Write(b.rows); err != nil {
+		return err
+	}
+	// Drop references held by the old rows before the slice is reused.
+	clear(b.rows)
+	b.rows = b.rows[:0]
+	return nil
+}
+
+func (b *batch[T]) cut() error {
+	if err := b.write(); err != nil {
+		return err
+	}
+	return b.writer.Flush()
+}
+
+func (b *batch[T]) close() error {
+	if err := b.write(); err != nil {
+		return err
+	}
+	return b.writer.Close()
+}
+
+func (b *batch[T]) setMetadata(key, value string) {
+	b.writer.SetKeyValueMetadata(key, value)
+}
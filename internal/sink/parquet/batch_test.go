@@ -0,0 +1,184 @@
+package parquet
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/internal/config"
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+// benchRowGroupRows matches the flush_row_count of config.yml.
+const benchRowGroupRows = 100000
+
+// rawBookEvents returns n R0 updates for one symbol, one per microsecond, as
+// a busy book produces them at peak rates.
+func rawBookEvents(n int) []schema.RawBookEvent {
+	start := time.Date(2025, 1, 2, 3, 0, 0, 0, time.UTC).UnixNano()
+	events := make([]schema.RawBookEvent, n)
+	for i := range events {
+		seq := int64(i + 1)
+		side, amount := schema.SideBid, 0.5+float64(i%7)/10
+		if i%2 == 1 {
+			side, amount = schema.SideAsk, -amount
+		}
+		op := schema.OperationUpsert
+		if i%5 == 4 {
+			op = schema.OperationDelete
+		}
+		events[i] = schema.RawBookEvent{
+			CommonFields: schema.CommonFields{
+				Exchange:       schema.ExchangeBitfinex,
+				Channel:        schema.ChannelRawBooks,
+				Symbol:         "tBTCUSD",
+				PairOrCurrency: "BTCUSD",
+				ConnID:         "conn-0",
+				ChanID:         17,
+				ConfFlags:      229376,
+				Seq:            &seq,
+				RecvTS:         start + int64(i)*int64(time.Microsecond),
+			},
+			OrderID: 140000000000 + int64(i%5000),
+			Price:   95000 + float64(i%400)/2,
+			Amount:  amount,
+			Op:      op,
+			Side:    side,
+		}
+	}
+	return events
+}
+
+func createBenchFile(b *testing.B) (*os.File, *bufio.Writer) {
+	b.Helper()
+	file, err := os.Create(filepath.Join(b.TempDir(), "raw_books.parquet"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	return file, bufio.NewWriterSize(file, 256*1024)
+}
+
+func benchCompression(b *testing.B) parquet.WriterOption {
+	b.Helper()
+	codec, _, err := newCodec("zstd", 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return parquet.Compression(codec)
+}
+
+// BenchmarkWriteRawBookEvent writes raw book events the way ChannelWriter
+// does: buffered in a batch, handed over writeBatchRows at a time and cut
+// into row groups of benchRowGroupRows.
+func BenchmarkWriteRawBookEvent(b *testing.B) {
+	events := rawBookEvents(benchRowGroupRows)
+	file, buf := createBenchFile(b)
+	defer file.Close()
+
+	rows := newBatch[schema.RawBookEvent](buf, benchCompression(b))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	groupRows := 0
+	for i := 0; i < b.N; i++ {
+		if err := rows.add(&events[i%len(events)]); err != nil {
+			b.Fatal(err)
+		}
+		groupRows++
+		if groupRows >= benchRowGroupRows {
+			if err := rows.cut(); err != nil {
+				b.Fatal(err)
+			}
+			groupRows = 0
+		} else if rows.buffered() >= writeBatchRows {
+			if err := rows.write(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	if err := rows.close(); err != nil {
+		b.Fatal(err)
+	}
+	if err := buf.Flush(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "rows/s")
+}
+
+// BenchmarkWriteRawBookEventPerRow is the path writeRow took before
+// batching: one GenericWriter.Write call with a one-element slice per event.
+func BenchmarkWriteRawBookEventPerRow(b *testing.B) {
+	events := rawBookEvents(benchRowGroupRows)
+	file, buf := createBenchFile(b)
+	defer file.Close()
+
+	options := append(append([]parquet.WriterOption{rowSchema[schema.RawBookEvent]()}, layoutOptions()...), benchCompression(b))
+	writer := parquet.NewGenericWriter[schema.RawBookEvent](buf, options...)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	groupRows := 0
+	for i := 0; i < b.N; i++ {
+		if _, err := writer.Write([]schema.RawBookEvent{events[i%len(events)]}); err != nil {
+			b.Fatal(err)
+		}
+		groupRows++
+		if groupRows >= benchRowGroupRows {
+			if err := writer.Flush(); err != nil {
+				b.Fatal(err)
+			}
+			groupRows = 0
+		}
+	}
+	if err := writer.Close(); err != nil {
+		b.Fatal(err)
+	}
+	if err := buf.Flush(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "rows/s")
+}
+
+// BenchmarkWriterWriteRawBookEvent measures Writer.WriteRawBookEvent end to
+// end, with segment routing, stats and the row group index, but no WAL.
+func BenchmarkWriterWriteRawBookEvent(b *testing.B) {
+	cfg := &config.Config{
+		Storage: config.Storage{
+			BasePath:      b.TempDir(),
+			SegmentSizeMB: 1024,
+			Compression:   "zstd",
+			Durability:    string(DurabilityNone),
+			Parquet: config.ParquetConfig{
+				RowGroupSizeMB: 128,
+				FlushRowCount:  benchRowGroupRows,
+			},
+		},
+	}
+	writer := NewWriter(cfg, zap.NewNop())
+	events := rawBookEvents(benchRowGroupRows)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		// WriteRawBookEvent stamps the event, so write a copy.
+		event := events[i%len(events)]
+		if err := writer.WriteRawBookEvent(&event); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "rows/s")
+}
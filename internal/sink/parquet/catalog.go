@@ -0,0 +1,239 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+// catalogName is the dataset catalog at each storage root: one JSON line per
+// closed segment, in the order they closed.
+const catalogName = "catalog.jsonl"
+
+// catalogEntry summarizes the manifest of the segment in dir for the catalog
+// of root.
+func catalogEntry(root, dir string, manifest *schema.SegmentManifest) (schema.CatalogEntry, error) {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return schema.CatalogEntry{}, fmt.Errorf("failed to resolve segment path: %w", err)
+	}
+
+	entry := schema.CatalogEntry{
+		SchemaVersion: manifest.SchemaVersion,
+		Channel:       manifest.Channel,
+		Symbol:        manifest.Symbol,
+		Path:          filepath.ToSlash(rel),
+		UTCStart:      manifest.Segment.UTCStart,
+		UTCEnd:        manifest.Segment.UTCEnd,
+		Seq:           manifest.Seq,
+		Bytes:         manifest.Segment.Bytes,
+		Files:         manifest.Segment.Files,
+		Flags:         manifest.Quality.Flags(),
+	}
+	for _, stats := range manifest.Segment.FileStats {
+		entry.Rows += stats.Rows
+	}
+	if manifest.Recovered {
+		entry.Flags = append(entry.Flags, "recovered")
+	}
+	if manifest.Compaction != nil {
+		entry.Replaces = manifest.Compaction.From
+	}
+	return entry, nil
+}
+
+// readManifest loads the manifest of the segment in dir. A missing manifest
+// is reported with an error satisfying os.IsNotExist.
+func readManifest(dir string) (*schema.SegmentManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	var manifest schema.SegmentManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest of %s: %w", dir, err)
+	}
+	return &manifest, nil
+}
+
+// appendCatalog adds the entry of a closed segment to the catalog of root.
+// Each entry is a single write of a whole line followed by an fsync, so the
+// catalog only ever gains complete lines; a line torn by a crash is cut off
+// before the next one is appended.
+func (w *Writer) appendCatalog(root, dir string, manifest *schema.SegmentManifest) error {
+	entry, err := catalogEntry(root, dir, manifest)
+	if err != nil {
+		return err
+	}
+	return w.appendCatalogEntry(root, entry)
+}
+
+// catalogDeleted records in the catalog of root that the segment in dir has
+// left it.
+func (w *Writer) catalogDeleted(root, dir string, manifest *schema.SegmentManifest) {
+	entry, err := catalogEntry(root, dir, manifest)
+	if err == nil {
+		entry.Deleted = true
+		err = w.appendCatalogEntry(root, entry)
+	}
+	if err != nil {
+		w.logger.Error("Failed to update catalog", zap.String("path", dir), zap.Error(err))
+	}
+}
+
+func (w *Writer) appendCatalogEntry(root string, entry schema.CatalogEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal catalog entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	w.catalogMutex.Lock()
+	defer w.catalogMutex.Unlock()
+
+	file, err := os.OpenFile(filepath.Join(root, catalogName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open catalog: %w", err)
+	}
+	defer file.Close()
+
+	if err := trimTornLine(file); err != nil {
+		return fmt.Errorf("failed to repair catalog: %w", err)
+	}
+	if _, err := file.Write(line); err != nil {
+		return fmt.Errorf("failed to append to catalog: %w", err)
+	}
+	return file.Sync()
+}
+
+// trimTornLine truncates file after its last newline.
+func trimTornLine(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	end := info.Size()
+	buf := make([]byte, 4096)
+	for offset := end; offset > 0; {
+		n := int64(len(buf))
+		if n > offset {
+			n = offset
+		}
+		offset -= n
+		if _, err := file.ReadAt(buf[:n], offset); err != nil && err != io.EOF {
+			return err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			if keep := offset + int64(i) + 1; keep < end {
+				return file.Truncate(keep)
+			}
+			return nil
+		}
+	}
+	if end > 0 {
+		return file.Truncate(0)
+	}
+	return nil
+}
+
+// RebuildCatalog regenerates the catalog of every storage root from the
+// manifests below it, ordered by segment start. Segments without a manifest
+// are left out. The new catalog replaces the old one atomically; segments
+// closed by a running collector while it is rebuilt may be missing from it.
+// It returns the number of entries written.
+func (w *Writer) RebuildCatalog() (int, error) {
+	total := 0
+	for _, basePath := range w.basePaths() {
+		dirs, err := w.segmentDirs(filepath.Join(basePath, "bitfinex", "v2"))
+		if err != nil {
+			return total, err
+		}
+
+		entries := make([]schema.CatalogEntry, 0, len(dirs))
+		for _, dir := range dirs {
+			manifest, err := readManifest(dir)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					w.logger.Warn("Failed to read manifest", zap.String("path", dir), zap.Error(err))
+				}
+				continue
+			}
+
+			entry, err := catalogEntry(basePath, dir, manifest)
+			if err != nil {
+				return total, err
+			}
+			entries = append(entries, entry)
+		}
+
+		sort.SliceStable(entries, func(i, j int) bool {
+			if !entries[i].UTCStart.Equal(entries[j].UTCStart) {
+				return entries[i].UTCStart.Before(entries[j].UTCStart)
+			}
+			return entries[i].Path < entries[j].Path
+		})
+
+		if err := w.writeCatalog(basePath, entries); err != nil {
+			return total, err
+		}
+		total += len(entries)
+
+		w.logger.Info("Rebuilt catalog",
+			zap.String("base_path", basePath),
+			zap.Int("segments", len(entries)))
+	}
+	return total, nil
+}
+
+// writeCatalog replaces the catalog of root with entries.
+func (w *Writer) writeCatalog(root string, entries []schema.CatalogEntry) error {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return fmt.Errorf("failed to create storage root: %w", err)
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return fmt.Errorf("failed to marshal catalog entry: %w", err)
+		}
+	}
+
+	w.catalogMutex.Lock()
+	defer w.catalogMutex.Unlock()
+
+	path := filepath.Join(root, catalogName)
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create catalog: %w", err)
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write catalog: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to sync catalog: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close catalog: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace catalog: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package parquet
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+func TestCatalogListsClosedSegments(t *testing.T) {
+	cfg := testConfig(t)
+	w := newTestWriter(cfg)
+	writeTrades(t, w, 1, 150, testHour)
+	gap := &schema.Control{
+		CommonFields: schema.CommonFields{Channel: schema.ChannelTrades, Symbol: testSymbol,
+			ConnID: "conn-1", RecvTS: testHour.UnixNano()},
+		Type: schema.ControlTypeGap,
+	}
+	if err := w.WriteControl(gap); err != nil {
+		t.Fatal(err)
+	}
+	// Rows of the next hour close the first one.
+	writeTrades(t, w, 151, 10, testHour.Add(time.Hour+2*time.Minute))
+	if err := w.FlushAll(); err != nil {
+		t.Fatal(err)
+	}
+	if entries := readCatalog(t, cfg.Storage.BasePath); len(entries) != 1 {
+		t.Fatalf("catalog has %d entries while one segment is closed", len(entries))
+	}
+	closeWriters(t, w)
+
+	dirs := tradeSegments(t, cfg.Storage.BasePath)
+	entries := readCatalog(t, cfg.Storage.BasePath)
+	if len(entries) != 2 || len(dirs) != 2 {
+		t.Fatalf("catalog %+v of segments %v, want two", entries, dirs)
+	}
+	for i, entry := range entries {
+		manifest, err := readManifest(dirs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel, _ := filepath.Rel(cfg.Storage.BasePath, dirs[i])
+		if entry.Path != filepath.ToSlash(rel) || entry.Channel != "trades" || entry.Symbol != testSymbol {
+			t.Errorf("entry %d is %s %s at %s, want trades of %s at %s", i, entry.Channel, entry.Symbol, entry.Path, testSymbol, rel)
+		}
+		if entry.Bytes != manifest.Segment.Bytes || !slices.Equal(entry.Files, manifest.Segment.Files) ||
+			!entry.UTCStart.Equal(manifest.Segment.UTCStart) || !entry.UTCEnd.Equal(manifest.Segment.UTCEnd) {
+			t.Errorf("entry %d %+v does not match its manifest", i, entry)
+		}
+	}
+
+	first, second := entries[0], entries[1]
+	// The first segment also holds the gap control.
+	if first.Rows != 151 || first.Seq == nil || first.Seq.Last != 150 || !slices.Equal(first.Flags, []string{"gaps"}) {
+		t.Errorf("first entry rows %d seq %+v flags %v", first.Rows, first.Seq, first.Flags)
+	}
+	if second.Rows != 10 || second.Seq == nil || second.Seq.First != 151 || len(second.Flags) != 0 {
+		t.Errorf("second entry rows %d seq %+v flags %v", second.Rows, second.Seq, second.Flags)
+	}
+}
+
+func TestCatalogTrimsTornLine(t *testing.T) {
+	tests := []struct {
+		name string
+		// before is how many entries are complete before the torn one.
+		before int
+	}{
+		{"after an entry", 1},
+		{"only line", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			for i := 0; i < tt.before; i++ {
+				w := newTestWriter(cfg)
+				writeTrades(t, w, int64(i*10+1), 10, testHour.Add(time.Duration(i)*time.Hour))
+				closeWriters(t, w)
+			}
+
+			// The process died halfway through appending an entry.
+			path := filepath.Join(cfg.Storage.BasePath, catalogName)
+			file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := file.WriteString(`{"schema_version":"1","channel":"tra`); err != nil {
+				t.Fatal(err)
+			}
+			file.Close()
+
+			w := newTestWriter(cfg)
+			writeTrades(t, w, 1000, 10, testHour.Add(5*time.Hour))
+			closeWriters(t, w)
+
+			entries := readCatalog(t, cfg.Storage.BasePath)
+			if len(entries) != tt.before+1 {
+				t.Fatalf("catalog has %d entries, want %d", len(entries), tt.before+1)
+			}
+			if last := entries[len(entries)-1]; last.Seq == nil || last.Seq.First != 1000 {
+				t.Errorf("last entry %+v is not the segment closed after the tear", last)
+			}
+		})
+	}
+}
+
+func TestRebuildCatalog(t *testing.T) {
+	cfg := testConfig(t)
+	w := newTestWriter(cfg)
+	writeTrades(t, w, 1, 10, testHour.Add(time.Hour))
+	writeTrades(t, w, 11, 10, testHour)
+	closeWriters(t, w)
+
+	// A segment left by a crash has no manifest yet.
+	crashed := newTestWriter(cfg)
+	writeTrades(t, crashed, 21, 10, testHour.Add(2*time.Hour))
+	crashed.FlushAll()
+	crash(crashed)
+
+	path := filepath.Join(cfg.Storage.BasePath, catalogName)
+	if err := os.WriteFile(path, []byte("not a catalog\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := newTestWriter(cfg).RebuildCatalog()
+	if err != nil {
+		t.Fatalf("RebuildCatalog: %v", err)
+	}
+	entries := readCatalog(t, cfg.Storage.BasePath)
+	if n != 2 || len(entries) != 2 {
+		t.Fatalf("rebuilt %d entries %+v, want the two closed segments", n, entries)
+	}
+	// Entries are ordered by segment start, not by when they closed.
+	if !entries[0].UTCStart.Equal(testHour) || !entries[1].UTCStart.Equal(testHour.Add(time.Hour)) {
+		t.Errorf("rebuilt entries start at %s and %s", entries[0].UTCStart, entries[1].UTCStart)
+	}
+}
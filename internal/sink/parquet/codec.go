@@ -0,0 +1,82 @@
+package parquet
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/parquet-go/parquet-go/compress"
+	"github.com/parquet-go/parquet-go/compress/brotli"
+	"github.com/parquet-go/parquet-go/compress/gzip"
+	"github.com/parquet-go/parquet-go/compress/lz4"
+	"github.com/parquet-go/parquet-go/compress/snappy"
+	parquetzstd "github.com/parquet-go/parquet-go/compress/zstd"
+
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+// lz4Levels are the LZ4 high compression levels 1-9.
+var lz4Levels = []lz4.Level{
+	lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4, lz4.Level5,
+	lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9,
+}
+
+// newCodec maps storage.compression and storage.compression_level to a
+// parquet codec. A level of 0 picks the codec's default. It also returns the
+// codec and level as recorded in the manifest; snappy has no levels and is
+// recorded with level 0.
+func newCodec(name string, level int) (compress.Codec, schema.CompressionInfo, error) {
+	info := schema.CompressionInfo{Codec: name, Level: level}
+
+	switch name {
+	case "zstd", "":
+		// Levels follow the zstd command line; the encoder rounds them to its
+		// four speeds.
+		if level == 0 {
+			level = 3
+		}
+		if level < 1 || level > 22 {
+			return nil, info, fmt.Errorf("zstd compression_level must be 1-22, got %d", level)
+		}
+		info.Codec, info.Level = "zstd", level
+		return &parquetzstd.Codec{Level: zstd.EncoderLevelFromZstd(level)}, info, nil
+
+	case "gzip":
+		if level == 0 {
+			level = 6
+		}
+		if level < 1 || level > 9 {
+			return nil, info, fmt.Errorf("gzip compression_level must be 1-9, got %d", level)
+		}
+		info.Level = level
+		return &gzip.Codec{Level: level}, info, nil
+
+	case "brotli":
+		if level == 0 {
+			level = 6
+		}
+		if level < 1 || level > 11 {
+			return nil, info, fmt.Errorf("brotli compression_level must be 1-11, got %d", level)
+		}
+		info.Level = level
+		return &brotli.Codec{Quality: level}, info, nil
+
+	case "lz4_raw", "lz4":
+		info.Codec = "lz4_raw"
+		// Without a level the plain LZ4 block compressor is used, which is
+		// the fast one. Levels 1-9 select the slower high compression mode.
+		if level == 0 {
+			return &lz4.Codec{Level: lz4.Fastest}, info, nil
+		}
+		if level < 1 || level > 9 {
+			return nil, info, fmt.Errorf("lz4_raw compression_level must be 1-9, got %d", level)
+		}
+		return &lz4.Codec{Level: lz4Levels[level-1]}, info, nil
+
+	case "snappy":
+		info.Level = 0
+		return &snappy.Codec{}, info, nil
+
+	default:
+		return nil, info, fmt.Errorf("unsupported compression %q", name)
+	}
+}
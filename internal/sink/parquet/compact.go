@@ -0,0 +1,587 @@
+package parquet
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+const (
+	// compactedHour is the hour= partition of a compacted day, which spans
+	// every hour.
+	compactedHour = "hour=all"
+
+	compactStagingSuffix = ".compact"
+)
+
+// ErrAlreadyCompacted is returned by CompactDay for a day that is already a
+// single compacted segment and has nothing to deduplicate.
+var ErrAlreadyCompacted = errors.New("day is already compacted")
+
+// sourceSegment is a closed segment read by compaction.
+type sourceSegment struct {
+	dir      string
+	manifest schema.SegmentManifest
+}
+
+// CompactDay merges every segment of channel and symbol on the UTC date of
+// day into one segment under dt={day}/hour=all. Its files hold the rows of
+// each kind merged by recv_ts and then seq; with dedup, repeated trade keys
+// and identical rows are dropped. Rows are streamed from the source files, so
+// memory does not grow with the day. The merged files are read back and their
+// row counts checked before they replace the day's segments.
+//
+// Only days that ended at least expiredSegmentGrace ago can be compacted, and
+// every segment of the day must have a manifest. A compaction interrupted by
+// a crash is finished by the next CompactDay for the same day.
+func (w *Writer) CompactDay(channel schema.Channel, symbol string, day time.Time, dedup bool) (*schema.CompactionInfo, error) {
+	day = day.UTC().Truncate(24 * time.Hour)
+	if day.AddDate(0, 0, 1).Add(expiredSegmentGrace).After(time.Now()) {
+		return nil, fmt.Errorf("day %s is not closed yet", day.Format("2006-01-02"))
+	}
+
+	root := w.cfg.Storage.ForChannel(string(channel)).BasePath
+	symbolDir := filepath.Join(root, "bitfinex", "v2", string(channel), symbol)
+	dayName := fmt.Sprintf("dt=%s", day.Format("2006-01-02"))
+	dayDir := filepath.Join(symbolDir, dayName)
+	stagingDir := filepath.Join(symbolDir, "."+dayName+compactStagingSuffix)
+
+	if err := w.finishCompactions(root, dayDir); err != nil {
+		return nil, err
+	}
+	// Whatever an interrupted run left in staging was never published.
+	if err := os.RemoveAll(stagingDir); err != nil {
+		return nil, fmt.Errorf("failed to clear staging directory: %w", err)
+	}
+
+	sources, err := w.compactionSources(dayDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(sources) == 1 && sources[0].manifest.Compaction != nil && !dedup {
+		return nil, ErrAlreadyCompacted
+	}
+
+	info := &schema.CompactionInfo{Dedup: dedup}
+	for _, source := range sources {
+		rel, err := filepath.Rel(root, source.dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve segment path: %w", err)
+		}
+		info.From = append(info.From, filepath.ToSlash(rel))
+	}
+
+	segment, kept, err := w.writeCompacted(channel, symbol, stagingDir, sources, info)
+	if err != nil {
+		os.RemoveAll(stagingDir)
+		return nil, err
+	}
+	if err := verifyCompacted(segment, kept); err != nil {
+		os.RemoveAll(stagingDir)
+		return nil, err
+	}
+
+	// Moving the finished segment next to the ones it replaces is what
+	// commits the compaction; completeCompaction does the rest.
+	finalDir := filepath.Join(dayDir, compactedHour, filepath.Base(segment.DirPath))
+	if err := os.MkdirAll(filepath.Dir(finalDir), 0755); err != nil {
+		os.RemoveAll(stagingDir)
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := os.Rename(segment.DirPath, finalDir); err != nil {
+		os.RemoveAll(stagingDir)
+		return nil, fmt.Errorf("failed to move compacted segment into place: %w", err)
+	}
+	os.RemoveAll(stagingDir)
+
+	if err := w.completeCompaction(root, finalDir, segment.Manifest); err != nil {
+		return nil, err
+	}
+
+	w.logger.Info("Compacted day",
+		zap.String("channel", string(channel)),
+		zap.String("symbol", symbol),
+		zap.String("day", day.Format("2006-01-02")),
+		zap.Int("segments", len(sources)),
+		zap.Int64("rows_in", info.RowsIn),
+		zap.Int64("duplicates", info.Duplicates),
+		zap.String("path", finalDir))
+
+	return info, nil
+}
+
+// completeCompaction publishes the compacted segment in dir, which already
+// sits next to the segments it replaces. With Delta enabled the table swaps
+// their files for the new ones in one commit. The segment is then added to
+// the catalog, and the replaced segments are deleted last. Until then every
+// row stays readable through the old segments, and a crash is picked up by
+// finishCompactions.
+func (w *Writer) completeCompaction(root, dir string, manifest *schema.SegmentManifest) error {
+	var sources []string
+	for _, rel := range manifest.Compaction.From {
+		sourceDir := filepath.Join(root, filepath.FromSlash(rel))
+		if _, err := os.Stat(sourceDir); err == nil {
+			sources = append(sources, sourceDir)
+		}
+	}
+
+	if w.cfg.Storage.Delta.Enabled {
+		if err := w.commitCompactionToDelta(root, dir, manifest, sources); err != nil {
+			return fmt.Errorf("failed to commit compaction to delta table: %w", err)
+		}
+	}
+
+	if err := w.appendCatalog(root, dir, manifest); err != nil {
+		w.logger.Error("Failed to update catalog", zap.String("path", dir), zap.Error(err))
+	}
+
+	for _, sourceDir := range sources {
+		if err := os.RemoveAll(sourceDir); err != nil {
+			return fmt.Errorf("failed to remove compacted segment %s: %w", sourceDir, err)
+		}
+		// The hour= directory goes too once it is empty.
+		os.Remove(filepath.Dir(sourceDir))
+	}
+	return nil
+}
+
+// finishCompactions completes the compactions of the day in dayDir that were
+// interrupted after their segment was moved into place, as seen from the
+// replaced segments still on disk.
+func (w *Writer) finishCompactions(root, dayDir string) error {
+	dirs, err := filepath.Glob(filepath.Join(dayDir, compactedHour, "seg=*"))
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		manifest, err := readManifest(dir)
+		if err != nil || manifest.Compaction == nil {
+			continue
+		}
+
+		pending := false
+		for _, rel := range manifest.Compaction.From {
+			if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(rel))); err == nil {
+				pending = true
+				break
+			}
+		}
+		if !pending {
+			continue
+		}
+
+		w.logger.Info("Finishing interrupted compaction", zap.String("path", dir))
+		if err := w.completeCompaction(root, dir, manifest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactionSources reads the manifests of the segments in dayDir, ordered by
+// start time.
+func (w *Writer) compactionSources(dayDir string) ([]sourceSegment, error) {
+	dirs, err := w.segmentDirs(dayDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no segments under %s", dayDir)
+	}
+
+	sources := make([]sourceSegment, 0, len(dirs))
+	for _, dir := range dirs {
+		manifest, err := readManifest(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("segment %s has no manifest; it must be recovered first", dir)
+			}
+			return nil, fmt.Errorf("failed to read manifest: %w", err)
+		}
+		sources = append(sources, sourceSegment{dir: dir, manifest: *manifest})
+	}
+
+	sort.SliceStable(sources, func(i, j int) bool {
+		return sources[i].manifest.Segment.UTCStart.Before(sources[j].manifest.Segment.UTCStart)
+	})
+	return sources, nil
+}
+
+// mergeHead is a source file in a rowMerge with its next row.
+type mergeHead struct {
+	rows     rowCursor
+	path     string
+	expected int64
+	order    int
+	row      interface{}
+}
+
+// rowMerge reads the files of one kind from every source segment as a single
+// stream ordered by recv_ts and then seq, rows without a seq first. A file
+// holds its rows in the order they were received, so only the next row of
+// each file is kept in memory. Rows that tie come in source order.
+type rowMerge struct {
+	heads []*mergeHead
+	// total counts the rows of the files read to the end.
+	total int64
+}
+
+// openMerge opens the files of sources that hold fileChannel rows. Files
+// whose row count differs from their manifest stats are an error once read.
+func openMerge(sources []sourceSegment, channel, kind schema.Channel) (*rowMerge, error) {
+	m := &rowMerge{}
+	order := 0
+	for _, source := range sources {
+		expected := make(map[string]int64, len(source.manifest.Segment.FileStats))
+		for _, stats := range source.manifest.Segment.FileStats {
+			expected[stats.Name] = stats.Rows
+		}
+
+		for _, name := range source.manifest.Segment.Files {
+			if fileChannel(channel, name) != kind {
+				continue
+			}
+			path := filepath.Join(source.dir, name)
+			rows, err := openRows(kind, path)
+			if err != nil {
+				m.close()
+				return nil, fmt.Errorf("failed to read %s: %w", path, err)
+			}
+
+			head := &mergeHead{rows: rows, path: path, expected: -1, order: order}
+			if want, exists := expected[name]; exists {
+				head.expected = want
+			}
+			order++
+
+			more, err := m.advance(head)
+			if err != nil {
+				rows.close()
+				m.close()
+				return nil, err
+			}
+			if more {
+				m.heads = append(m.heads, head)
+			}
+		}
+	}
+
+	heap.Init(m)
+	return m, nil
+}
+
+// next returns the next row of the merge, or io.EOF after the last one.
+func (m *rowMerge) next() (interface{}, error) {
+	if len(m.heads) == 0 {
+		return nil, io.EOF
+	}
+
+	head := m.heads[0]
+	row := head.row
+	more, err := m.advance(head)
+	if err != nil {
+		return nil, err
+	}
+	if more {
+		heap.Fix(m, 0)
+	} else {
+		heap.Pop(m)
+	}
+	return row, nil
+}
+
+// advance reads the next row of head. At the end of the file it checks the
+// row count, closes the file and reports false.
+func (m *rowMerge) advance(head *mergeHead) (bool, error) {
+	row, err := head.rows.next()
+	if err == nil {
+		head.row = row
+		return true, nil
+	}
+	if err != io.EOF {
+		return false, fmt.Errorf("failed to read %s: %w", head.path, err)
+	}
+
+	n := head.rows.read()
+	head.rows.close()
+	head.row = nil
+	if head.expected >= 0 && n != head.expected {
+		return false, fmt.Errorf("%s has %d rows, its manifest %d", head.path, n, head.expected)
+	}
+	m.total += n
+	return false, nil
+}
+
+func (m *rowMerge) close() {
+	for _, head := range m.heads {
+		head.rows.close()
+	}
+	m.heads = nil
+}
+
+func (m *rowMerge) Len() int { return len(m.heads) }
+
+func (m *rowMerge) Less(i, j int) bool {
+	a, b := m.heads[i], m.heads[j]
+	if rowBefore(a.row, b.row) {
+		return true
+	}
+	if rowBefore(b.row, a.row) {
+		return false
+	}
+	return a.order < b.order
+}
+
+func (m *rowMerge) Swap(i, j int) { m.heads[i], m.heads[j] = m.heads[j], m.heads[i] }
+
+func (m *rowMerge) Push(x any) { m.heads = append(m.heads, x.(*mergeHead)) }
+
+func (m *rowMerge) Pop() any {
+	head := m.heads[len(m.heads)-1]
+	m.heads = m.heads[:len(m.heads)-1]
+	return head
+}
+
+// rowBefore orders rows by recv_ts and then seq, rows without a seq first.
+func rowBefore(x, y interface{}) bool {
+	a, b := commonFields(x), commonFields(y)
+	if a.RecvTS != b.RecvTS {
+		return a.RecvTS < b.RecvTS
+	}
+	if a.Seq == nil || b.Seq == nil {
+		return a.Seq == nil && b.Seq != nil
+	}
+	return *a.Seq < *b.Seq
+}
+
+// rowDedup drops duplicates from merged rows, keeping the first. Trades are
+// duplicates when their trade key is among the last size trade keys, as in
+// the live dedup window, so a trade's "te" and "tu" are both kept. Other rows
+// are duplicates when every column matches a row of the current run: the
+// rows that share its recv_ts and seq, which the merge puts next to each
+// other.
+type rowDedup struct {
+	size int
+	keys []schema.TradeKey
+	next int
+	seen map[schema.TradeKey]struct{}
+	run  []interface{}
+}
+
+func newRowDedup(size int) *rowDedup {
+	if size <= 0 {
+		size = 10000
+	}
+	return &rowDedup{
+		size: size,
+		keys: make([]schema.TradeKey, 0, size),
+		seen: make(map[schema.TradeKey]struct{}, size),
+	}
+}
+
+// duplicate reports whether row was already seen and records it if not.
+func (d *rowDedup) duplicate(row interface{}) bool {
+	if trade, ok := row.(*schema.Trade); ok {
+		key := trade.Key()
+		if _, dup := d.seen[key]; dup {
+			return true
+		}
+		if len(d.keys) < d.size {
+			d.keys = append(d.keys, key)
+		} else {
+			delete(d.seen, d.keys[d.next])
+			d.keys[d.next] = key
+			d.next = (d.next + 1) % d.size
+		}
+		d.seen[key] = struct{}{}
+		return false
+	}
+
+	if len(d.run) > 0 && !sameKey(commonFields(d.run[0]), commonFields(row)) {
+		clear(d.run)
+		d.run = d.run[:0]
+	}
+	for _, other := range d.run {
+		if reflect.DeepEqual(other, row) {
+			return true
+		}
+	}
+	d.run = append(d.run, row)
+	return false
+}
+
+func sameKey(a, b *schema.CommonFields) bool {
+	if a.RecvTS != b.RecvTS || (a.Seq == nil) != (b.Seq == nil) {
+		return false
+	}
+	return a.Seq == nil || *a.Seq == *b.Seq
+}
+
+// writeCompacted merges the rows of sources into a closed segment under
+// stagingDir with a manifest merged from theirs. It fills in the row counts
+// of info and returns the number of rows written.
+func (w *Writer) writeCompacted(channel schema.Channel, symbol, stagingDir string, sources []sourceSegment, info *schema.CompactionInfo) (*Segment, int64, error) {
+	first, last := sources[0].manifest, sources[len(sources)-1].manifest
+	start, end := first.Segment.UTCStart, first.Segment.UTCEnd
+	for _, source := range sources {
+		end = laterOf(end, source.manifest.Segment.UTCEnd)
+	}
+
+	dirName := fmt.Sprintf("seg=%s--%s--compacted~%s",
+		start.UTC().Format("2006-01-02T15:04:05Z"),
+		end.UTC().Format("2006-01-02T15:04:05Z"),
+		time.Now().UTC().Format("20060102T150405Z"))
+	dirPath := filepath.Join(stagingDir, compactedHour, dirName)
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		return nil, 0, fmt.Errorf("failed to create directory %s: %w", dirPath, err)
+	}
+
+	segment := w.newSegment(channel, symbol, dirPath, start)
+	segment.EndTime = end
+
+	// The subscription is the latest one, as in a live segment; the ingest
+	// ID is that of the earliest segment.
+	manifest := segment.Manifest
+	manifest.IngestID = first.IngestID
+	manifest.PairOrCurrency = last.PairOrCurrency
+	manifest.ChanID = last.ChanID
+	manifest.SubID = last.SubID
+	manifest.ConfFlags = last.ConfFlags
+	manifest.Book = last.Book
+	manifest.Segment.BytesTarget = 0
+	manifest.Compaction = info
+	for _, source := range sources {
+		m := source.manifest
+		if m.Seq != nil {
+			if manifest.Seq == nil {
+				manifest.Seq = &schema.SeqInfo{First: m.Seq.First}
+			}
+			manifest.Seq.Last = m.Seq.Last
+		}
+		addQuality(&manifest.Quality, m.Quality)
+		manifest.Recovered = manifest.Recovered || m.Recovered
+		manifest.Endpoints = append(manifest.Endpoints, m.Endpoints...)
+		for _, connID := range m.ConnIDs {
+			segment.trackConn(connID)
+		}
+	}
+
+	// Rows are written in a fixed channel order so the files come out the
+	// same on every run.
+	var channels []schema.Channel
+	for _, source := range sources {
+		for _, name := range source.manifest.Segment.Files {
+			if kind := fileChannel(channel, name); !slices.Contains(channels, kind) {
+				channels = append(channels, kind)
+			}
+		}
+	}
+	slices.Sort(channels)
+
+	var kept int64
+	for _, kind := range channels {
+		n, err := w.mergeInto(segment, channel, kind, symbol, sources, info)
+		if err != nil {
+			return nil, 0, err
+		}
+		kept += n
+	}
+
+	if err := w.closeSegment(segment); err != nil {
+		return nil, 0, err
+	}
+	return segment, kept, nil
+}
+
+// mergeInto writes the kind rows of sources to segment in merged order,
+// dropping duplicates when info.Dedup is set, and returns how many it wrote.
+func (w *Writer) mergeInto(segment *Segment, channel, kind schema.Channel, symbol string, sources []sourceSegment, info *schema.CompactionInfo) (int64, error) {
+	merge, err := openMerge(sources, channel, kind)
+	if err != nil {
+		return 0, err
+	}
+	defer merge.close()
+
+	var dedup *rowDedup
+	if info.Dedup {
+		dedup = newRowDedup(w.cfg.Channels.Trades.DedupWindow)
+	}
+
+	var writer *ChannelWriter
+	var kept int64
+	for {
+		row, err := merge.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return kept, err
+		}
+		if dedup != nil && dedup.duplicate(row) {
+			info.Duplicates++
+			continue
+		}
+
+		if writer == nil {
+			writer, err = segment.getOrCreateWriter(kind, symbol)
+			if err != nil {
+				return kept, fmt.Errorf("failed to get writer: %w", err)
+			}
+		}
+		if err := writer.writeRow(row); err != nil {
+			return kept, err
+		}
+		kept++
+	}
+
+	info.RowsIn += merge.total
+	return kept, nil
+}
+
+// verifyCompacted reads back every file of a compacted segment and checks
+// the rows add up to expected, both on disk and in the manifest.
+func verifyCompacted(segment *Segment, expected int64) error {
+	var read, recorded int64
+	for _, stats := range segment.Manifest.Segment.FileStats {
+		path := filepath.Join(segment.DirPath, stats.Name)
+		n, err := scanRows(fileChannel(segment.Channel, stats.Name), path, func(interface{}) {})
+		if err != nil {
+			return fmt.Errorf("failed to read back %s: %w", path, err)
+		}
+		read += n
+		recorded += stats.Rows
+	}
+	if read != expected || recorded != expected {
+		return fmt.Errorf("compacted segment has %d rows (%d in manifest), expected %d", read, recorded, expected)
+	}
+	return nil
+}
+
+func addQuality(total *schema.QualityMetrics, q schema.QualityMetrics) {
+	total.ChecksumMismatch += q.ChecksumMismatch
+	total.HBMissed += q.HBMissed
+	total.Reconnects += q.Reconnects
+	total.TradesDedupDropped += q.TradesDedupDropped
+	total.BookUpdatesDedupDropped += q.BookUpdatesDedupDropped
+	total.Gaps += q.Gaps
+	total.Dropped += q.Dropped
+}
+
+func laterOf(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,266 @@
+package parquet
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+// writeInterleaved writes trades first to first+n-1 through two writers, as
+// two collectors of one symbol would: odd IDs through a and even IDs through
+// b, each received a millisecond after the one before.
+func writeInterleaved(t *testing.T, a, b *Writer, first int64, n int, start time.Time) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		id := first + int64(i)
+		w := a
+		if id%2 == 0 {
+			w = b
+		}
+		if err := w.WriteTrade(testTrade(id, start.Add(time.Duration(i)*time.Millisecond))); err != nil {
+			t.Fatalf("WriteTrade %d: %v", id, err)
+		}
+	}
+}
+
+func closeWriters(t *testing.T, writers ...*Writer) {
+	t.Helper()
+	for _, w := range writers {
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+}
+
+func TestCompactDayMergesOverlappingSegments(t *testing.T) {
+	cfg := testConfig(t)
+	a, b := newTestWriter(cfg), newTestWriter(cfg)
+	writeInterleaved(t, a, b, 1, 250, testHour)
+	writeInterleaved(t, a, b, 251, 50, testHour.Add(time.Hour))
+	closeWriters(t, a, b)
+
+	sources := tradeSegments(t, cfg.Storage.BasePath)
+	if len(sources) != 4 {
+		t.Fatalf("got segments %v, want two per hour", sources)
+	}
+
+	w := newTestWriter(cfg)
+	info, err := w.CompactDay(schema.ChannelTrades, testSymbol, testHour, false)
+	if err != nil {
+		t.Fatalf("CompactDay: %v", err)
+	}
+	if info.RowsIn != 300 || info.Duplicates != 0 || len(info.From) != 4 {
+		t.Errorf("compaction info %+v, want 300 rows in from 4 segments", info)
+	}
+
+	dirs := tradeSegments(t, cfg.Storage.BasePath)
+	if len(dirs) != 1 || filepath.Base(filepath.Dir(dirs[0])) != compactedHour {
+		t.Fatalf("got segments %v, want one under %s", dirs, compactedHour)
+	}
+	checkTradeIDs(t, readTrades(t, dirs[0]), 1, 300)
+
+	manifest, err := readManifest(dirs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Compaction == nil || manifest.Seq == nil || manifest.Seq.First != 1 {
+		t.Errorf("manifest compaction %+v seq %+v", manifest.Compaction, manifest.Seq)
+	}
+
+	if _, err := w.CompactDay(schema.ChannelTrades, testSymbol, testHour, false); !errors.Is(err, ErrAlreadyCompacted) {
+		t.Errorf("second compaction returned %v, want ErrAlreadyCompacted", err)
+	}
+}
+
+func TestCompactDayDedupCounts(t *testing.T) {
+	cfg := testConfig(t)
+
+	// Both collectors saw trades 101-150, with the same receive times.
+	a, b := newTestWriter(cfg), newTestWriter(cfg)
+	writeTrades(t, a, 1, 150, testHour)
+	writeTrades(t, b, 101, 100, testHour.Add(100*time.Millisecond))
+	// A trade's "tu" follows its "te" and is not a duplicate of it.
+	tu := testTrade(7, testHour.Add(time.Minute))
+	tu.MsgType = schema.MessageTypeTU
+	if err := a.WriteTrade(tu); err != nil {
+		t.Fatal(err)
+	}
+	closeWriters(t, a, b)
+
+	info, err := newTestWriter(cfg).CompactDay(schema.ChannelTrades, testSymbol, testHour, true)
+	if err != nil {
+		t.Fatalf("CompactDay: %v", err)
+	}
+	if info.RowsIn != 251 || info.Duplicates != 50 || !info.Dedup {
+		t.Errorf("compaction info %+v, want 251 rows in and 50 duplicates", info)
+	}
+
+	dirs := tradeSegments(t, cfg.Storage.BasePath)
+	trades := readTrades(t, dirs[0])
+	if len(trades) != 201 {
+		t.Fatalf("got %d trades, want 201", len(trades))
+	}
+	checkTradeIDs(t, trades[:200], 1, 200)
+	if last := trades[200]; last.TradeID != 7 || last.MsgType != schema.MessageTypeTU {
+		t.Errorf("last trade is %d %s, want the tu of 7", last.TradeID, last.MsgType)
+	}
+}
+
+// TestCompactDayFinishesAfterCrash stops a compaction right after the
+// compacted segment was moved into place, before the segments it replaces
+// were removed, and leaves a staging directory behind as a second run
+// interrupted earlier would.
+func TestCompactDayFinishesAfterCrash(t *testing.T) {
+	cfg := testConfig(t)
+	a, b := newTestWriter(cfg), newTestWriter(cfg)
+	writeInterleaved(t, a, b, 1, 200, testHour)
+	closeWriters(t, a, b)
+
+	w := newTestWriter(cfg)
+	root := cfg.Storage.BasePath
+	symbolDir := filepath.Join(root, "bitfinex", "v2", "trades", testSymbol)
+	dayDir := filepath.Join(symbolDir, "dt="+testHour.Format("2006-01-02"))
+	stagingDir := filepath.Join(symbolDir, ".dt="+testHour.Format("2006-01-02")+compactStagingSuffix)
+
+	sources, err := w.compactionSources(dayDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &schema.CompactionInfo{}
+	for _, source := range sources {
+		rel, _ := filepath.Rel(root, source.dir)
+		info.From = append(info.From, filepath.ToSlash(rel))
+	}
+	segment, _, err := w.writeCompacted(schema.ChannelTrades, testSymbol, stagingDir, sources, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finalDir := filepath.Join(dayDir, compactedHour, filepath.Base(segment.DirPath))
+	if err := os.MkdirAll(filepath.Dir(finalDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(segment.DirPath, finalDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(stagingDir, "partial"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Until the compaction is finished, its rows are there twice.
+	if dirs := tradeSegments(t, root); len(dirs) != 3 {
+		t.Fatalf("got segments %v before finishing, want the sources and the compacted one", dirs)
+	}
+
+	_, err = w.CompactDay(schema.ChannelTrades, testSymbol, testHour, false)
+	if !errors.Is(err, ErrAlreadyCompacted) {
+		t.Fatalf("CompactDay after the crash returned %v, want ErrAlreadyCompacted", err)
+	}
+
+	dirs := tradeSegments(t, root)
+	if len(dirs) != 1 || dirs[0] != finalDir {
+		t.Fatalf("got segments %v, want only %s", dirs, finalDir)
+	}
+	checkTradeIDs(t, readTrades(t, finalDir), 1, 200)
+	for _, source := range sources {
+		if _, err := os.Stat(source.dir); !os.IsNotExist(err) {
+			t.Errorf("replaced segment %s still there: %v", source.dir, err)
+		}
+	}
+	if _, err := os.Stat(stagingDir); !os.IsNotExist(err) {
+		t.Errorf("staging directory still there: %v", err)
+	}
+}
+
+func TestVerifyCompacted(t *testing.T) {
+	cfg := testConfig(t)
+	w := newTestWriter(cfg)
+	writeTrades(t, w, 1, 150, testHour)
+
+	var segment *Segment
+	for _, s := range w.segments {
+		segment = s
+	}
+	closeWriters(t, w)
+
+	if err := verifyCompacted(segment, 150); err != nil {
+		t.Errorf("intact segment: %v", err)
+	}
+	if err := verifyCompacted(segment, 149); err == nil {
+		t.Error("row count off by one was not caught")
+	}
+
+	path := filepath.Join(segment.DirPath, segment.Manifest.Segment.FileStats[0].Name)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()/2); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyCompacted(segment, 150); err == nil || !strings.Contains(err.Error(), "read back") {
+		t.Errorf("truncated file returned %v, want a read back error", err)
+	}
+}
+
+func TestRowDedup(t *testing.T) {
+	d := newRowDedup(3)
+	trade := func(id int64, msgType schema.MessageType) *schema.Trade {
+		trade := testTrade(id, testHour)
+		trade.MsgType = msgType
+		return trade
+	}
+
+	steps := []struct {
+		row  interface{}
+		want bool
+	}{
+		{trade(1, schema.MessageTypeTE), false},
+		{trade(1, schema.MessageTypeTU), false},
+		{trade(1, schema.MessageTypeTE), true},
+		{trade(2, schema.MessageTypeTE), false},
+		{trade(3, schema.MessageTypeTE), false},
+		// The window holds three keys, so the te of 1 has left it.
+		{trade(1, schema.MessageTypeTE), false},
+		{trade(3, schema.MessageTypeTE), true},
+	}
+	for i, step := range steps {
+		if got := d.duplicate(step.row); got != step.want {
+			t.Errorf("step %d: duplicate = %v, want %v", i, got, step.want)
+		}
+	}
+
+	seq := int64(9)
+	level := func(recv time.Time, price float64) *schema.BookLevel {
+		return &schema.BookLevel{
+			CommonFields: schema.CommonFields{Symbol: testSymbol, RecvTS: recv.UnixNano(), Seq: &seq},
+			Price:        price,
+			Count:        1,
+			Amount:       0.5,
+		}
+	}
+
+	d = newRowDedup(3)
+	levels := []struct {
+		row  interface{}
+		want bool
+	}{
+		{level(testHour, 100), false},
+		// Same frame, another level.
+		{level(testHour, 101), false},
+		{level(testHour, 100), true},
+		// The same level again in a later frame is a new update.
+		{level(testHour.Add(time.Millisecond), 100), false},
+		// The run has moved on; the first frame is not remembered.
+		{level(testHour, 101), false},
+	}
+	for i, step := range levels {
+		if got := d.duplicate(step.row); got != step.want {
+			t.Errorf("level %d: duplicate = %v, want %v", i, got, step.want)
+		}
+	}
+}
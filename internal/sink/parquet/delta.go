@@ -0,0 +1,701 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/parquet-go/parquet-go"
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+const (
+	deltaLogDir            = "_delta_log"
+	deltaLastCheckpoint    = "_last_checkpoint"
+	deltaCommitAttempts    = 10
+	defaultDeltaCheckpoint = 10
+
+	// deltaTombstoneRetention is how long removed files stay listed in
+	// checkpoints, matching Delta's default deletedFileRetentionDuration.
+	deltaTombstoneRetention = 7 * 24 * time.Hour
+)
+
+// errDeltaConflict is returned for a commit that would remove a file another
+// writer has already removed.
+var errDeltaConflict = errors.New("delta commit conflicts with a concurrent commit")
+
+// deltaPartitionColumns are taken from the dt= and hour= directories of each
+// file. They are not columns of the parquet files.
+var deltaPartitionColumns = []string{"dt", "hour"}
+
+// deltaAction is one line of a Delta commit and one row of a checkpoint.
+// Exactly one field is set.
+type deltaAction struct {
+	Protocol   *deltaProtocol         `json:"protocol,omitempty" parquet:"protocol,optional"`
+	MetaData   *deltaMetaData         `json:"metaData,omitempty" parquet:"metaData,optional"`
+	Add        *deltaAdd              `json:"add,omitempty" parquet:"add,optional"`
+	Remove     *deltaRemove           `json:"remove,omitempty" parquet:"remove,optional"`
+	CommitInfo map[string]interface{} `json:"commitInfo,omitempty" parquet:"-"`
+}
+
+type deltaProtocol struct {
+	MinReaderVersion int32 `json:"minReaderVersion" parquet:"minReaderVersion"`
+	MinWriterVersion int32 `json:"minWriterVersion" parquet:"minWriterVersion"`
+}
+
+type deltaFormat struct {
+	Provider string            `json:"provider" parquet:"provider"`
+	Options  map[string]string `json:"options" parquet:"options"`
+}
+
+type deltaMetaData struct {
+	ID               string            `json:"id" parquet:"id"`
+	Format           deltaFormat       `json:"format" parquet:"format"`
+	SchemaString     string            `json:"schemaString" parquet:"schemaString"`
+	PartitionColumns []string          `json:"partitionColumns" parquet:"partitionColumns,list"`
+	Configuration    map[string]string `json:"configuration" parquet:"configuration"`
+	CreatedTime      int64             `json:"createdTime" parquet:"createdTime"`
+}
+
+type deltaAdd struct {
+	Path             string            `json:"path" parquet:"path"`
+	PartitionValues  map[string]string `json:"partitionValues" parquet:"partitionValues"`
+	Size             int64             `json:"size" parquet:"size"`
+	ModificationTime int64             `json:"modificationTime" parquet:"modificationTime"`
+	DataChange       bool              `json:"dataChange" parquet:"dataChange"`
+	Stats            string            `json:"stats,omitempty" parquet:"stats,optional"`
+}
+
+type deltaRemove struct {
+	Path                 string            `json:"path" parquet:"path"`
+	DeletionTimestamp    int64             `json:"deletionTimestamp" parquet:"deletionTimestamp"`
+	DataChange           bool              `json:"dataChange" parquet:"dataChange"`
+	ExtendedFileMetadata bool              `json:"extendedFileMetadata" parquet:"extendedFileMetadata"`
+	PartitionValues      map[string]string `json:"partitionValues" parquet:"partitionValues"`
+	Size                 int64             `json:"size" parquet:"size"`
+}
+
+// deltaStats is the per-file statistics JSON of an add action.
+type deltaStats struct {
+	NumRecords int64                  `json:"numRecords"`
+	MinValues  map[string]interface{} `json:"minValues"`
+	MaxValues  map[string]interface{} `json:"maxValues"`
+}
+
+type deltaLastCheckpointInfo struct {
+	Version int64 `json:"version"`
+	Size    int64 `json:"size"`
+}
+
+// deltaTableRoot is the Delta table of channel below a storage root.
+func deltaTableRoot(root string, channel schema.Channel) string {
+	return filepath.Join(root, "bitfinex", "v2", string(channel))
+}
+
+// deltaFiles describes the data files of the segment in dir, as recorded in
+// its manifest. controls.parquet has a different schema and is left out of
+// the table.
+func deltaFiles(root, dir string, manifest *schema.SegmentManifest) ([]deltaAdd, error) {
+	channel := schema.Channel(manifest.Channel)
+	tableRoot := deltaTableRoot(root, channel)
+
+	files := make([]deltaAdd, 0, len(manifest.Segment.FileStats))
+	for _, stats := range manifest.Segment.FileStats {
+		if fileChannel(channel, stats.Name) != channel {
+			continue
+		}
+
+		path := filepath.Join(dir, stats.Name)
+		rel, err := filepath.Rel(tableRoot, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return nil, fmt.Errorf("%s is outside the table at %s", path, tableRoot)
+		}
+
+		modified := manifest.Segment.UTCEnd
+		if info, err := os.Stat(path); err == nil {
+			modified = info.ModTime()
+		}
+
+		statsJSON, err := json.Marshal(fileDeltaStats(manifest.Symbol, stats))
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, deltaAdd{
+			Path:             deltaPath(rel),
+			PartitionValues:  deltaPartitionValues(rel),
+			Size:             stats.Bytes,
+			ModificationTime: modified.UnixMilli(),
+			Stats:            string(statsJSON),
+		})
+	}
+	return files, nil
+}
+
+// fileDeltaStats turns the manifest stats of a file into Delta statistics.
+// recv_ts is a long in the table, srv_mts a timestamp.
+func fileDeltaStats(symbol string, stats schema.FileStats) deltaStats {
+	out := deltaStats{
+		NumRecords: stats.Rows,
+		MinValues:  map[string]interface{}{"symbol": symbol},
+		MaxValues:  map[string]interface{}{"symbol": symbol},
+	}
+	if stats.RecvTSMin != 0 {
+		out.MinValues["recv_ts"] = stats.RecvTSMin
+		out.MaxValues["recv_ts"] = stats.RecvTSMax
+	}
+	if stats.SrvMTSMin != nil && stats.SrvMTSMax != nil {
+		out.MinValues["srv_mts"] = deltaTimestamp(*stats.SrvMTSMin)
+		out.MaxValues["srv_mts"] = deltaTimestamp(*stats.SrvMTSMax)
+	}
+	return out
+}
+
+func deltaTimestamp(mts int64) string {
+	return time.UnixMilli(mts).UTC().Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+// deltaPath escapes a path relative to the table root as a relative URI.
+// Colons are escaped too, since Hadoop based readers reject them in paths.
+func deltaPath(rel string) string {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i, part := range parts {
+		parts[i] = strings.ReplaceAll(url.PathEscape(part), ":", "%3A")
+	}
+	return strings.Join(parts, "/")
+}
+
+func deltaPartitionValues(rel string) map[string]string {
+	values := make(map[string]string, len(deltaPartitionColumns))
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		for _, column := range deltaPartitionColumns {
+			if value, ok := strings.CutPrefix(part, column+"="); ok {
+				values[column] = value
+			}
+		}
+	}
+	return values
+}
+
+// deltaSchema is the Spark schema JSON of channel's table: the columns of its
+// row type followed by the partition columns.
+func deltaSchema(channel schema.Channel) (string, error) {
+	var rows *parquet.Schema
+	switch channel {
+	case schema.ChannelRawBooks:
+		rows = rowSchema[schema.RawBookEvent]()
+	case schema.ChannelBooks:
+		rows = rowSchema[schema.BookLevel]()
+	case schema.ChannelTrades:
+		rows = rowSchema[schema.Trade]()
+	case schema.ChannelTicker:
+		rows = rowSchema[schema.Ticker]()
+	default:
+		return "", fmt.Errorf("unsupported channel type: %s", channel)
+	}
+
+	type field struct {
+		Name     string            `json:"name"`
+		Type     string            `json:"type"`
+		Nullable bool              `json:"nullable"`
+		Metadata map[string]string `json:"metadata"`
+	}
+	fields := make([]field, 0, len(rows.Fields())+len(deltaPartitionColumns))
+	for _, f := range rows.Fields() {
+		fields = append(fields, field{Name: f.Name(), Type: deltaType(f), Nullable: f.Optional(), Metadata: map[string]string{}})
+	}
+	for _, column := range deltaPartitionColumns {
+		fields = append(fields, field{Name: column, Type: "string", Nullable: true, Metadata: map[string]string{}})
+	}
+
+	data, err := json.Marshal(struct {
+		Type   string  `json:"type"`
+		Fields []field `json:"fields"`
+	}{Type: "struct", Fields: fields})
+	return string(data), err
+}
+
+// deltaType maps a parquet column to a Spark type. Nanosecond timestamps are
+// declared as long, since Spark cannot read them as timestamps.
+func deltaType(node parquet.Node) string {
+	if logical := node.Type().LogicalType(); logical != nil {
+		switch {
+		case logical.Timestamp != nil && logical.Timestamp.Unit.Nanos != nil:
+			return "long"
+		case logical.Timestamp != nil:
+			return "timestamp"
+		case logical.UTF8 != nil, logical.Enum != nil:
+			return "string"
+		}
+	}
+	switch node.Type().Kind() {
+	case parquet.Boolean:
+		return "boolean"
+	case parquet.Int32:
+		return "integer"
+	case parquet.Int64:
+		return "long"
+	case parquet.Float:
+		return "float"
+	case parquet.Double:
+		return "double"
+	default:
+		return "binary"
+	}
+}
+
+// commitDelta adds actions to the Delta table of channel below root as the
+// next version. Versions are claimed by hard-linking a complete commit file
+// into place, so concurrent writers never overwrite each other; a writer that
+// loses the race reads the log again and retries after its newest version,
+// unless a commit in between already removed a file it removes. Version 0
+// also creates the table. A checkpoint follows every checkpoint_interval
+// versions.
+func (w *Writer) commitDelta(root string, channel schema.Channel, operation string, actions []deltaAction) (int64, error) {
+	w.deltaMutex.Lock()
+	defer w.deltaMutex.Unlock()
+
+	logDir := filepath.Join(deltaTableRoot(root, channel), deltaLogDir)
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create delta log: %w", err)
+	}
+
+	version, known := w.deltaVersions[logDir]
+	if !known {
+		var err error
+		if version, err = latestDeltaVersion(logDir); err != nil {
+			return 0, err
+		}
+	}
+
+	commitInfo := deltaAction{CommitInfo: map[string]interface{}{
+		"timestamp":  time.Now().UnixMilli(),
+		"operation":  operation,
+		"engineInfo": "data-controller",
+		"ingestId":   w.ingestID,
+	}}
+
+	for attempt := 0; attempt < deltaCommitAttempts; attempt++ {
+		version++
+
+		commit := actions
+		if version == 0 {
+			create, err := w.deltaCreateActions(channel)
+			if err != nil {
+				return 0, err
+			}
+			commit = append(create, actions...)
+		}
+		commit = append(commit[:len(commit):len(commit)], commitInfo)
+
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		for _, action := range commit {
+			if err := encoder.Encode(action); err != nil {
+				return 0, fmt.Errorf("failed to marshal delta action: %w", err)
+			}
+		}
+
+		err := putIfAbsent(filepath.Join(logDir, fmt.Sprintf("%020d.json", version)), buf.Bytes())
+		if errors.Is(err, os.ErrExist) {
+			latest, err := latestDeltaVersion(logDir)
+			if err != nil {
+				delete(w.deltaVersions, logDir)
+				return 0, err
+			}
+			if err := checkDeltaRemoves(logDir, version, latest, actions); err != nil {
+				delete(w.deltaVersions, logDir)
+				return 0, err
+			}
+			version = latest
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to write delta commit: %w", err)
+		}
+
+		w.deltaVersions[logDir] = version
+		if version > 0 && version%w.deltaCheckpointInterval() == 0 {
+			if err := writeDeltaCheckpoint(logDir, version); err != nil {
+				w.logger.Warn("Failed to write delta checkpoint",
+					zap.String("path", logDir),
+					zap.Int64("version", version),
+					zap.Error(err))
+			}
+		}
+		return version, nil
+	}
+
+	delete(w.deltaVersions, logDir)
+	return 0, fmt.Errorf("delta log %s: gave up after %d conflicting commits", logDir, deltaCommitAttempts)
+}
+
+func (w *Writer) deltaCheckpointInterval() int64 {
+	if interval := w.cfg.Storage.Delta.CheckpointInterval; interval > 0 {
+		return int64(interval)
+	}
+	return defaultDeltaCheckpoint
+}
+
+// deltaCreateActions are the protocol and metadata of a new table.
+func (w *Writer) deltaCreateActions(channel schema.Channel) ([]deltaAction, error) {
+	schemaString, err := deltaSchema(channel)
+	if err != nil {
+		return nil, err
+	}
+	return []deltaAction{
+		{Protocol: &deltaProtocol{MinReaderVersion: 1, MinWriterVersion: 2}},
+		{MetaData: &deltaMetaData{
+			ID:               uuid.New().String(),
+			Format:           deltaFormat{Provider: "parquet", Options: map[string]string{}},
+			SchemaString:     schemaString,
+			PartitionColumns: deltaPartitionColumns,
+			Configuration: map[string]string{
+				"delta.checkpointInterval": strconv.FormatInt(w.deltaCheckpointInterval(), 10),
+			},
+			CreatedTime: time.Now().UnixMilli(),
+		}},
+	}, nil
+}
+
+// checkDeltaRemoves fails with errDeltaConflict when one of the commits from
+// version from to version to removed a file that actions remove too, as when
+// retention and compaction both take the same segment off the table.
+func checkDeltaRemoves(logDir string, from, to int64, actions []deltaAction) error {
+	removing := make(map[string]bool)
+	for _, action := range actions {
+		if action.Remove != nil {
+			removing[action.Remove.Path] = true
+		}
+	}
+	if len(removing) == 0 {
+		return nil
+	}
+
+	for v := from; v <= to; v++ {
+		commit, err := readDeltaCommit(logDir, v)
+		if err != nil {
+			return err
+		}
+		for _, action := range commit {
+			if action.Remove != nil && removing[action.Remove.Path] {
+				return fmt.Errorf("%w: version %d already removed %s", errDeltaConflict, v, action.Remove.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// readDeltaCommit returns the actions of version v in logDir.
+func readDeltaCommit(logDir string, v int64) ([]deltaAction, error) {
+	data, err := os.ReadFile(filepath.Join(logDir, fmt.Sprintf("%020d.json", v)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read delta commit %d: %w", v, err)
+	}
+
+	var actions []deltaAction
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for decoder.More() {
+		var action deltaAction
+		if err := decoder.Decode(&action); err != nil {
+			return nil, fmt.Errorf("failed to parse delta commit %d: %w", v, err)
+		}
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+// latestDeltaVersion is the newest version in logDir, or -1 for a new table.
+// It starts from the last checkpoint and probes the versions after it.
+func latestDeltaVersion(logDir string) (int64, error) {
+	version := int64(-1)
+	if checkpoint, err := readLastCheckpoint(logDir); err == nil {
+		version = checkpoint.Version
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	for {
+		_, err := os.Stat(filepath.Join(logDir, fmt.Sprintf("%020d.json", version+1)))
+		if os.IsNotExist(err) {
+			return version, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		version++
+	}
+}
+
+func readLastCheckpoint(logDir string) (deltaLastCheckpointInfo, error) {
+	var checkpoint deltaLastCheckpointInfo
+	data, err := os.ReadFile(filepath.Join(logDir, deltaLastCheckpoint))
+	if err != nil {
+		return checkpoint, err
+	}
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return checkpoint, fmt.Errorf("failed to parse %s: %w", deltaLastCheckpoint, err)
+	}
+	return checkpoint, nil
+}
+
+// putIfAbsent creates path with data, failing with os.ErrExist if it is
+// already there. Readers never see a partial file.
+func putIfAbsent(path string, data []byte) error {
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+"."+uuid.New().String()+".tmp")
+	if err := writeSynced(tmpPath, data); err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	return os.Link(tmpPath, path)
+}
+
+// replaceFile atomically replaces path with data.
+func replaceFile(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	if err := writeSynced(tmpPath, data); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+func writeSynced(path string, data []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// writeDeltaCheckpoint writes the state of the table at version as a
+// checkpoint and points _last_checkpoint at it.
+func writeDeltaCheckpoint(logDir string, version int64) error {
+	actions, err := deltaSnapshot(logDir, version)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	writer := parquet.NewGenericWriter[deltaAction](&buf)
+	if _, err := writer.Write(actions); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := replaceFile(filepath.Join(logDir, fmt.Sprintf("%020d.checkpoint.parquet", version)), buf.Bytes()); err != nil {
+		return err
+	}
+
+	last, err := json.Marshal(deltaLastCheckpointInfo{Version: version, Size: int64(len(actions))})
+	if err != nil {
+		return err
+	}
+	return replaceFile(filepath.Join(logDir, deltaLastCheckpoint), last)
+}
+
+// deltaSnapshot replays the log up to version, starting from the last
+// checkpoint before it, and returns the table state as checkpoint actions:
+// protocol, metadata, the live files and recent tombstones.
+func deltaSnapshot(logDir string, version int64) ([]deltaAction, error) {
+	var (
+		protocol *deltaProtocol
+		metaData *deltaMetaData
+		adds     = make(map[string]*deltaAdd)
+		removes  = make(map[string]*deltaRemove)
+	)
+	apply := func(action deltaAction) {
+		switch {
+		case action.Protocol != nil:
+			protocol = action.Protocol
+		case action.MetaData != nil:
+			metaData = action.MetaData
+		case action.Add != nil:
+			adds[action.Add.Path] = action.Add
+			delete(removes, action.Add.Path)
+		case action.Remove != nil:
+			delete(adds, action.Remove.Path)
+			removes[action.Remove.Path] = action.Remove
+		}
+	}
+
+	start := int64(0)
+	if checkpoint, err := readLastCheckpoint(logDir); err == nil && checkpoint.Version < version {
+		actions, err := parquet.ReadFile[deltaAction](filepath.Join(logDir, fmt.Sprintf("%020d.checkpoint.parquet", checkpoint.Version)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read checkpoint %d: %w", checkpoint.Version, err)
+		}
+		for _, action := range actions {
+			apply(action)
+		}
+		start = checkpoint.Version + 1
+	}
+
+	for v := start; v <= version; v++ {
+		commit, err := readDeltaCommit(logDir, v)
+		if err != nil {
+			return nil, err
+		}
+		for _, action := range commit {
+			apply(action)
+		}
+	}
+
+	if protocol == nil || metaData == nil {
+		return nil, fmt.Errorf("delta log %s has no protocol or metadata", logDir)
+	}
+
+	actions := []deltaAction{{Protocol: protocol}, {MetaData: metaData}}
+	paths := make([]string, 0, len(adds))
+	for path := range adds {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		actions = append(actions, deltaAction{Add: adds[path]})
+	}
+
+	cutoff := time.Now().Add(-deltaTombstoneRetention).UnixMilli()
+	paths = paths[:0]
+	for path, remove := range removes {
+		if remove.DeletionTimestamp >= cutoff {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		actions = append(actions, deltaAction{Remove: removes[path]})
+	}
+	return actions, nil
+}
+
+// commitSegmentToDelta adds the data files of a closed segment to its
+// channel's table.
+func (w *Writer) commitSegmentToDelta(segment *Segment) error {
+	files, err := deltaFiles(segment.storage.BasePath, segment.DirPath, segment.Manifest)
+	if err != nil || len(files) == 0 {
+		return err
+	}
+
+	actions := make([]deltaAction, len(files))
+	for i := range files {
+		files[i].DataChange = true
+		actions[i] = deltaAction{Add: &files[i]}
+	}
+
+	version, err := w.commitDelta(segment.storage.BasePath, segment.Channel, "WRITE", actions)
+	if err != nil {
+		return err
+	}
+	w.logger.Debug("Committed segment to delta table",
+		zap.String("segment_id", segment.ID),
+		zap.Int64("version", version))
+	return nil
+}
+
+// commitCompactionToDelta swaps the data files of the segments in sources for
+// those of the compacted segment in dir. Neither side changes the table's
+// data, so both are committed with dataChange false.
+func (w *Writer) commitCompactionToDelta(root, dir string, manifest *schema.SegmentManifest, sources []string) error {
+	files, err := deltaFiles(root, dir, manifest)
+	if err != nil {
+		return err
+	}
+
+	actions := make([]deltaAction, 0, len(files)+len(sources))
+	for i := range files {
+		actions = append(actions, deltaAction{Add: &files[i]})
+	}
+
+	now := time.Now().UnixMilli()
+	for _, sourceDir := range sources {
+		source, err := readManifest(sourceDir)
+		if err != nil {
+			return fmt.Errorf("failed to read manifest: %w", err)
+		}
+		removed, err := deltaRemoves(root, sourceDir, source, now, false)
+		if err != nil {
+			return err
+		}
+		actions = append(actions, removed...)
+	}
+
+	_, err = w.commitDelta(root, schema.Channel(manifest.Channel), "OPTIMIZE", actions)
+	return err
+}
+
+// commitRetentionToDelta removes the data files of the segment in dir, which
+// retention has moved off root, from its table.
+func (w *Writer) commitRetentionToDelta(root, dir string, manifest *schema.SegmentManifest) error {
+	actions, err := deltaRemoves(root, dir, manifest, time.Now().UnixMilli(), true)
+	if err != nil {
+		return err
+	}
+	_, err = w.commitDelta(root, schema.Channel(manifest.Channel), "DELETE", actions)
+	return err
+}
+
+// commitArchiveToDelta adds the data files of the archived segment in dir to
+// the table of its channel under archiveRoot.
+func (w *Writer) commitArchiveToDelta(archiveRoot, dir string, manifest *schema.SegmentManifest) error {
+	files, err := deltaFiles(archiveRoot, dir, manifest)
+	if err != nil {
+		return err
+	}
+	actions := make([]deltaAction, 0, len(files))
+	for i := range files {
+		actions = append(actions, deltaAction{Add: &files[i]})
+	}
+	_, err = w.commitDelta(archiveRoot, schema.Channel(manifest.Channel), "WRITE", actions)
+	return err
+}
+
+// deltaRemoves builds the remove actions for the data files of the segment in
+// dir. The files need not exist any more.
+func deltaRemoves(root, dir string, manifest *schema.SegmentManifest, now int64, dataChange bool) ([]deltaAction, error) {
+	files, err := deltaFiles(root, dir, manifest)
+	if err != nil {
+		return nil, err
+	}
+	actions := make([]deltaAction, 0, len(files))
+	for _, file := range files {
+		actions = append(actions, deltaAction{Remove: &deltaRemove{
+			Path:                 file.Path,
+			DeletionTimestamp:    now,
+			DataChange:           dataChange,
+			ExtendedFileMetadata: true,
+			PartitionValues:      file.PartitionValues,
+			Size:                 file.Size,
+		}})
+	}
+	return actions, nil
+}
@@ -0,0 +1,86 @@
+package parquet
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/internal/config"
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+func deltaTestWriter(root string) *Writer {
+	cfg := &config.Config{Storage: config.Storage{
+		BasePath: root,
+		Delta:    config.DeltaConfig{Enabled: true},
+	}}
+	return NewWriter(cfg, zap.NewNop())
+}
+
+func deltaAddAction(path string) deltaAction {
+	return deltaAction{Add: &deltaAdd{Path: path, PartitionValues: map[string]string{}, DataChange: true}}
+}
+
+func deltaRemoveAction(path string) deltaAction {
+	return deltaAction{Remove: &deltaRemove{Path: path, PartitionValues: map[string]string{}, DataChange: true}}
+}
+
+// TestDeltaCommitCatchesUpWithOtherWriter has a second writer commit more
+// versions than deltaCommitAttempts behind the back of the first, whose
+// cached version is then stale.
+func TestDeltaCommitCatchesUpWithOtherWriter(t *testing.T) {
+	root := t.TempDir()
+	first, second := deltaTestWriter(root), deltaTestWriter(root)
+
+	if _, err := first.commitDelta(root, schema.ChannelTrades, "WRITE", []deltaAction{deltaAddAction("a.parquet")}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2*deltaCommitAttempts; i++ {
+		if _, err := second.commitDelta(root, schema.ChannelTrades, "WRITE", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	version, err := first.commitDelta(root, schema.ChannelTrades, "WRITE", []deltaAction{deltaAddAction("b.parquet")})
+	if err != nil {
+		t.Fatalf("commit after the other writer: %v", err)
+	}
+	if want := int64(2*deltaCommitAttempts + 1); version != want {
+		t.Errorf("committed version %d, want %d", version, want)
+	}
+
+	logDir := filepath.Join(deltaTableRoot(root, schema.ChannelTrades), deltaLogDir)
+	if latest, err := latestDeltaVersion(logDir); err != nil || latest != version {
+		t.Errorf("latest version %d (%v), want %d", latest, err, version)
+	}
+}
+
+// TestDeltaCommitRefusesDoubleRemove has two writers remove the same file,
+// as retention and compaction of one segment would.
+func TestDeltaCommitRefusesDoubleRemove(t *testing.T) {
+	root := t.TempDir()
+	first, second := deltaTestWriter(root), deltaTestWriter(root)
+
+	if _, err := first.commitDelta(root, schema.ChannelTrades, "WRITE", []deltaAction{deltaAddAction("a.parquet")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.commitDelta(root, schema.ChannelTrades, "DELETE", []deltaAction{deltaRemoveAction("a.parquet")}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := first.commitDelta(root, schema.ChannelTrades, "OPTIMIZE",
+		[]deltaAction{deltaAddAction("c.parquet"), deltaRemoveAction("a.parquet")})
+	if !errors.Is(err, errDeltaConflict) {
+		t.Fatalf("second remove of a.parquet returned %v, want a conflict", err)
+	}
+
+	// Removes of other files still go through after the stale cache.
+	if _, err := first.commitDelta(root, schema.ChannelTrades, "WRITE", []deltaAction{deltaAddAction("d.parquet")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.commitDelta(root, schema.ChannelTrades, "DELETE", []deltaAction{deltaRemoveAction("d.parquet")}); err != nil {
+		t.Fatalf("remove of d.parquet: %v", err)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin
+
+package parquet
+
+import "syscall"
+
+// diskFree is the space available to unprivileged writers on the file system
+// holding path.
+func diskFree(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
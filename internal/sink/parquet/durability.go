@@ -0,0 +1,161 @@
+package parquet
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+// Durability selects when segment files are fsynced.
+type Durability string
+
+const (
+	// DurabilityNone leaves writing back to the OS. A power loss can leave
+	// renamed files empty.
+	DurabilityNone Durability = "none"
+	// DurabilityOnClose syncs a segment's data files, WAL, manifest and
+	// directories when it closes.
+	DurabilityOnClose Durability = "on-close"
+	// DurabilityOnFlush also syncs the WAL and data files on every flush.
+	DurabilityOnFlush Durability = "on-flush"
+)
+
+// manifestPendingSuffix names the file a manifest is written to before it is
+// renamed into place. It must not end in .tmp, which recovery salvages as
+// parquet.
+const manifestPendingSuffix = ".new"
+
+func ParseDurability(s string) (Durability, error) {
+	switch d := Durability(s); d {
+	case "":
+		return DurabilityOnClose, nil
+	case DurabilityNone, DurabilityOnClose, DurabilityOnFlush:
+		return d, nil
+	default:
+		return "", fmt.Errorf("unknown durability %q", s)
+	}
+}
+
+// fsyncMetrics records the latency of the fsyncs done for durability.
+type fsyncMetrics struct {
+	count      atomic.Int64
+	errors     atomic.Int64
+	totalNanos atomic.Int64
+	maxNanos   atomic.Int64
+}
+
+func (m *fsyncMetrics) observe(d time.Duration, err error) {
+	m.count.Add(1)
+	if err != nil {
+		m.errors.Add(1)
+	}
+	m.totalNanos.Add(int64(d))
+	for {
+		max := m.maxNanos.Load()
+		if int64(d) <= max || m.maxNanos.CompareAndSwap(max, int64(d)) {
+			return
+		}
+	}
+}
+
+func (m *fsyncMetrics) stats() map[string]interface{} {
+	count := m.count.Load()
+	avg := 0.0
+	if count > 0 {
+		avg = float64(m.totalNanos.Load()) / float64(count) / 1e6
+	}
+	return map[string]interface{}{
+		"count":  count,
+		"errors": m.errors.Load(),
+		"avg_ms": avg,
+		"max_ms": float64(m.maxNanos.Load()) / 1e6,
+	}
+}
+
+func (m *fsyncMetrics) syncFile(file *os.File) error {
+	start := time.Now()
+	err := file.Sync()
+	m.observe(time.Since(start), err)
+	return err
+}
+
+// syncDir makes the entries of dir durable, so files renamed or created in it
+// survive a power loss. Windows cannot sync directories; there it does
+// nothing.
+func (m *fsyncMetrics) syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return m.syncFile(file)
+}
+
+// syncDirs syncs dir and its parents up to and including root.
+func (m *fsyncMetrics) syncDirs(dir, root string) error {
+	for {
+		if err := m.syncDir(dir); err != nil {
+			return fmt.Errorf("failed to sync directory %s: %w", dir, err)
+		}
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return nil
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// writeManifest writes the manifest of the segment in dir. It is written
+// beside manifest.json and renamed over it, so readers see either the old
+// manifest or the complete new one. Unless durability is none, the data is
+// synced before the rename and the directory after it.
+func (w *Writer) writeManifest(dir string, manifest *schema.SegmentManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+
+	path := filepath.Join(dir, manifestName)
+	pendingPath := path + manifestPendingSuffix
+	file, err := os.Create(pendingPath)
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(pendingPath)
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if w.durability != DurabilityNone {
+		if err := w.fsync.syncFile(file); err != nil {
+			file.Close()
+			os.Remove(pendingPath)
+			return fmt.Errorf("failed to sync manifest: %w", err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(pendingPath)
+		return fmt.Errorf("failed to close manifest: %w", err)
+	}
+	if err := os.Rename(pendingPath, path); err != nil {
+		os.Remove(pendingPath)
+		return fmt.Errorf("failed to rename manifest: %w", err)
+	}
+
+	if w.durability != DurabilityNone {
+		if err := w.fsync.syncDir(dir); err != nil {
+			return fmt.Errorf("failed to sync segment directory: %w", err)
+		}
+	}
+	return nil
+}
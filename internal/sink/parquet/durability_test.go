@@ -0,0 +1,86 @@
+package parquet
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseDurability(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want Durability
+	}{
+		{"", DurabilityOnClose},
+		{"none", DurabilityNone},
+		{"on-close", DurabilityOnClose},
+		{"on-flush", DurabilityOnFlush},
+	} {
+		if got, err := ParseDurability(tt.in); err != nil || got != tt.want {
+			t.Errorf("ParseDurability(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := ParseDurability("always"); err == nil {
+		t.Error("unknown durability was accepted")
+	}
+}
+
+func TestDurabilityModes(t *testing.T) {
+	tests := []struct {
+		durability Durability
+		// onFlush is how many fsyncs a flush does: the trades file, its row
+		// group index and the WAL.
+		onFlush int64
+		onClose bool
+	}{
+		{DurabilityNone, 0, false},
+		{DurabilityOnClose, 0, true},
+		{DurabilityOnFlush, 3, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.durability), func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.Storage.Durability = string(tt.durability)
+			cfg.Storage.WAL.Enabled = true
+			w := newTestWriter(cfg)
+			if w.durability != tt.durability {
+				t.Fatalf("writer durability %q", w.durability)
+			}
+
+			writeTrades(t, w, 1, 150, testHour)
+			if n := w.fsync.count.Load(); n != 0 {
+				t.Errorf("%d fsyncs before the flush", n)
+			}
+			if err := w.FlushAll(); err != nil {
+				t.Fatal(err)
+			}
+			flushed := w.fsync.count.Load()
+			if flushed != tt.onFlush {
+				t.Errorf("%d fsyncs after the flush, want %d", flushed, tt.onFlush)
+			}
+
+			closeWriters(t, w)
+			closed := w.fsync.count.Load() - flushed
+			if tt.onClose != (closed > 0) {
+				t.Errorf("%d fsyncs on close", closed)
+			}
+			if n := w.fsync.errors.Load(); n != 0 {
+				t.Errorf("%d fsyncs failed", n)
+			}
+			if stats := w.GetStats(); stats["durability"] != string(tt.durability) ||
+				stats["fsync"].(map[string]interface{})["count"] != w.fsync.count.Load() {
+				t.Errorf("stats %v", stats)
+			}
+
+			dir := tradeSegments(t, cfg.Storage.BasePath)[0]
+			checkTradeIDs(t, readTrades(t, dir), 1, 150)
+			if _, err := readManifest(dir); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, manifestName+manifestPendingSuffix)); !os.IsNotExist(err) {
+				t.Errorf("pending manifest left behind: %v", err)
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package parquet
 
 import (
+	"errors"
+	"fmt"
+	"slices"
 	"sync"
 	"time"
 
@@ -18,38 +21,104 @@ type Handler struct {
 	stopCh      chan struct{}
 	wg          sync.WaitGroup
 	stats       *Statistics
+	manager     *storageManager
+
+	// shards split the segments by channel and symbol across
+	// performance.worker_count workers. writer is the first shard's Writer.
+	shards      []*writerShard
+	shardsMutex sync.RWMutex
+	running     bool
 }
 
 type Statistics struct {
-	mu                   sync.RWMutex
-	TickersReceived      int64
-	TradesReceived       int64
-	BookLevelsReceived   int64
+	mu                    sync.RWMutex
+	TickersReceived       int64
+	TradesReceived        int64
+	BookLevelsReceived    int64
 	RawBookEventsReceived int64
-	ControlsReceived     int64
-	TotalBytesWritten    int64
-	LastFlushTime        time.Time
-	Errors               int64
+	ControlsReceived      int64
+	TickersDropped        int64
+	TradesDropped         int64
+	BookLevelsDropped     int64
+	RawBookEventsDropped  int64
+	TotalBytesWritten     int64
+	LastFlushTime         time.Time
+	Errors                int64
 }
 
 func NewHandler(cfg *config.Config, logger *zap.Logger) *Handler {
+	writer := NewWriter(cfg, logger)
+
+	workers := cfg.Performance.WorkerCount
+	if workers < 1 {
+		workers = 1
+	}
+	shards := make([]*writerShard, workers)
+	for i := range shards {
+		shardWriter := writer
+		if i > 0 {
+			shardWriter = writer.shard()
+		}
+		shards[i] = &writerShard{writer: shardWriter}
+	}
+
 	return &Handler{
 		cfg:    cfg,
 		logger: logger,
-		writer: NewWriter(cfg, logger),
+		writer: writer,
 		stats:  &Statistics{},
 		stopCh: make(chan struct{}),
+		shards: shards,
 	}
 }
 
 func (h *Handler) Start() error {
 	h.logger.Info("Starting Parquet handler")
 
-	h.flushTicker = time.NewTicker(h.cfg.Storage.Parquet.FlushInterval)
+	if _, err := ParsePartitionTime(h.cfg.Storage.PartitionTime); err != nil {
+		return err
+	}
+	if _, err := ParseDurability(h.cfg.Storage.Durability); err != nil {
+		return err
+	}
+
+	if v := h.cfg.Metadata.SchemaVersion; v != "" && v != schema.SchemaVersion {
+		h.logger.Warn("Configured schema_version does not match the rows written; manifests record the latter",
+			zap.String("configured", v),
+			zap.String("written", schema.SchemaVersion))
+	}
+
+	if err := validateStorage(h.cfg.Storage); err != nil {
+		return err
+	}
+
+	if h.cfg.Storage.WAL.Enabled {
+		if _, err := walName(h.cfg.Storage.WAL.Compression); err != nil {
+			return err
+		}
+	}
+	if err := h.writer.Recover(); err != nil {
+		return fmt.Errorf("failed to recover unfinished segments: %w", err)
+	}
+	h.pruneWAL()
+
+	h.startShards()
+	h.logger.Info("Started writer workers", zap.Int("workers", len(h.shards)))
+
+	h.flushTicker = time.NewTicker(flushTick(h.cfg.Storage))
 
 	h.wg.Add(1)
 	go h.flushRoutine()
 
+	if h.cfg.Storage.Manager.Enabled {
+		h.manager = newStorageManager(h.cfg.Storage, h.writer, h.storageControl, h.logger)
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			h.manager.run(h.stopCh)
+		}()
+	}
+
 	return nil
 }
 
@@ -64,9 +133,18 @@ func (h *Handler) Stop() error {
 
 	h.wg.Wait()
 
-	if err := h.writer.Close(); err != nil {
-		h.logger.Error("Failed to close writer", zap.Error(err))
-		return err
+	// Rows already queued on the shards are written before they close.
+	h.stopShards()
+
+	var closeErr error
+	for _, shard := range h.shards {
+		if err := shard.writer.Close(); err != nil {
+			h.logger.Error("Failed to close writer", zap.Error(err))
+			closeErr = errors.Join(closeErr, err)
+		}
+	}
+	if closeErr != nil {
+		return closeErr
 	}
 
 	h.logger.Info("Parquet handler stopped")
@@ -78,19 +156,25 @@ func (h *Handler) HandleTicker(ticker *schema.Ticker) {
 	h.stats.TickersReceived++
 	h.stats.mu.Unlock()
 
+	if h.paused(schema.ChannelTicker) {
+		return
+	}
+
 	h.logger.Debug("Received ticker data",
 		zap.String("symbol", ticker.Symbol),
 		zap.Float64("bid", ticker.Bid),
 		zap.Float64("ask", ticker.Ask))
 
-	if err := h.writer.WriteTicker(ticker); err != nil {
-		h.logger.Error("Failed to write ticker",
-			zap.String("symbol", ticker.Symbol),
-			zap.Error(err))
-		h.incrementError()
-	} else {
-		h.logger.Debug("Successfully wrote ticker data", zap.String("symbol", ticker.Symbol))
-	}
+	h.dispatch(h.shardFor(schema.ChannelTicker, ticker.Symbol), func(w *Writer) {
+		if err := w.WriteTicker(ticker); err != nil {
+			h.logger.Error("Failed to write ticker",
+				zap.String("symbol", ticker.Symbol),
+				zap.Error(err))
+			h.incrementError()
+		} else {
+			h.logger.Debug("Successfully wrote ticker data", zap.String("symbol", ticker.Symbol))
+		}
+	})
 }
 
 func (h *Handler) HandleTrade(trade *schema.Trade) {
@@ -98,13 +182,19 @@ func (h *Handler) HandleTrade(trade *schema.Trade) {
 	h.stats.TradesReceived++
 	h.stats.mu.Unlock()
 
-	if err := h.writer.WriteTrade(trade); err != nil {
-		h.logger.Error("Failed to write trade",
-			zap.String("symbol", trade.Symbol),
-			zap.Int64("trade_id", trade.TradeID),
-			zap.Error(err))
-		h.incrementError()
+	if h.paused(schema.ChannelTrades) {
+		return
 	}
+
+	h.dispatch(h.shardFor(schema.ChannelTrades, trade.Symbol), func(w *Writer) {
+		if err := w.WriteTrade(trade); err != nil {
+			h.logger.Error("Failed to write trade",
+				zap.String("symbol", trade.Symbol),
+				zap.Int64("trade_id", trade.TradeID),
+				zap.Error(err))
+			h.incrementError()
+		}
+	})
 }
 
 func (h *Handler) HandleBookLevel(level *schema.BookLevel) {
@@ -112,13 +202,19 @@ func (h *Handler) HandleBookLevel(level *schema.BookLevel) {
 	h.stats.BookLevelsReceived++
 	h.stats.mu.Unlock()
 
-	if err := h.writer.WriteBookLevel(level); err != nil {
-		h.logger.Error("Failed to write book level",
-			zap.String("symbol", level.Symbol),
-			zap.Float64("price", level.Price),
-			zap.Error(err))
-		h.incrementError()
+	if h.paused(schema.ChannelBooks) {
+		return
 	}
+
+	h.dispatch(h.shardFor(schema.ChannelBooks, level.Symbol), func(w *Writer) {
+		if err := w.WriteBookLevel(level); err != nil {
+			h.logger.Error("Failed to write book level",
+				zap.String("symbol", level.Symbol),
+				zap.Float64("price", level.Price),
+				zap.Error(err))
+			h.incrementError()
+		}
+	})
 }
 
 func (h *Handler) HandleRawBookEvent(event *schema.RawBookEvent) {
@@ -126,43 +222,211 @@ func (h *Handler) HandleRawBookEvent(event *schema.RawBookEvent) {
 	h.stats.RawBookEventsReceived++
 	h.stats.mu.Unlock()
 
-	if err := h.writer.WriteRawBookEvent(event); err != nil {
-		h.logger.Error("Failed to write raw book event",
-			zap.String("symbol", event.Symbol),
-			zap.Int64("order_id", event.OrderID),
-			zap.Error(err))
-		h.incrementError()
+	if h.paused(schema.ChannelRawBooks) {
+		return
 	}
+
+	h.dispatch(h.shardFor(schema.ChannelRawBooks, event.Symbol), func(w *Writer) {
+		if err := w.WriteRawBookEvent(event); err != nil {
+			h.logger.Error("Failed to write raw book event",
+				zap.String("symbol", event.Symbol),
+				zap.Int64("order_id", event.OrderID),
+				zap.Error(err))
+			h.incrementError()
+		}
+	})
 }
 
 func (h *Handler) HandleControl(control *schema.Control) {
 	h.stats.mu.Lock()
 	h.stats.ControlsReceived++
+	if control.Type == schema.ControlTypeDrop {
+		switch control.Channel {
+		case schema.ChannelTicker:
+			h.stats.TickersDropped++
+		case schema.ChannelTrades:
+			h.stats.TradesDropped++
+		case schema.ChannelBooks:
+			h.stats.BookLevelsDropped++
+		case schema.ChannelRawBooks:
+			h.stats.RawBookEventsDropped++
+		}
+	}
 	h.stats.mu.Unlock()
 
 	h.logger.Debug("Received control message",
-		zap.String("type", control.Type),
+		zap.String("type", string(control.Type)),
 		zap.String("reason", control.Reason))
+
+	write := func(w *Writer, control *schema.Control) {
+		if err := w.WriteControl(control); err != nil {
+			h.logger.Error("Failed to write control",
+				zap.String("type", string(control.Type)),
+				zap.String("symbol", control.Symbol),
+				zap.Error(err))
+			h.incrementError()
+		}
+	}
+
+	if control.Symbol != "" && slices.Contains(storageChannels, control.Channel) {
+		h.dispatch(h.shardFor(control.Channel, control.Symbol), func(w *Writer) {
+			write(w, control)
+		})
+		return
+	}
+
+	// Connection-wide controls concern segments on every shard. Each shard
+	// writes its own copy.
+	h.broadcast(func(w *Writer) {
+		copied := *control
+		write(w, &copied)
+	})
+}
+
+// storageControl records a storage manager event on the shards that may
+// hold open segments of channel, or of channel and symbol.
+func (h *Handler) storageControl(channel schema.Channel, symbol string, controlType schema.ControlType, reason string) {
+	op := func(w *Writer) {
+		w.writeStorageControl(channel, symbol, controlType, reason)
+	}
+	if symbol != "" {
+		h.dispatch(h.shardFor(channel, symbol), op)
+		return
+	}
+	h.broadcast(op)
+}
+
+// startShards starts the worker of every shard.
+func (h *Handler) startShards() {
+	h.shardsMutex.Lock()
+	defer h.shardsMutex.Unlock()
+
+	if h.running {
+		return
+	}
+	for _, shard := range h.shards {
+		shard.ops = make(chan func(*Writer), shardQueueSize)
+		shard.done = make(chan struct{})
+		go shard.run()
+	}
+	h.running = true
+}
+
+// stopShards waits for the workers to finish what is queued and stops them.
+func (h *Handler) stopShards() {
+	h.shardsMutex.Lock()
+	if !h.running {
+		h.shardsMutex.Unlock()
+		return
+	}
+	h.running = false
+	for _, shard := range h.shards {
+		close(shard.ops)
+	}
+	h.shardsMutex.Unlock()
+
+	for _, shard := range h.shards {
+		<-shard.done
+	}
+}
+
+// shardFor returns the shard that owns the segments of channel and symbol.
+func (h *Handler) shardFor(channel schema.Channel, symbol string) *writerShard {
+	return h.shards[shardIndex(channel, symbol, len(h.shards))]
+}
+
+// dispatch queues op on shard. While the workers are not running, before
+// Start and after Stop, op runs on the caller.
+func (h *Handler) dispatch(shard *writerShard, op func(*Writer)) {
+	h.shardsMutex.RLock()
+	defer h.shardsMutex.RUnlock()
+
+	if !h.running {
+		op(shard.writer)
+		return
+	}
+	shard.ops <- op
+}
+
+func (h *Handler) broadcast(op func(*Writer)) {
+	for _, shard := range h.shards {
+		h.dispatch(shard, op)
+	}
+}
+
+// each runs op on every shard, after what is already queued there, and waits
+// for all of them.
+func (h *Handler) each(op func(*Writer) error) error {
+	errs := make([]error, len(h.shards))
+	var wg sync.WaitGroup
+	for i, shard := range h.shards {
+		wg.Add(1)
+		h.dispatch(shard, func(w *Writer) {
+			defer wg.Done()
+			errs[i] = op(w)
+		})
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// paused reports whether the storage manager has paused channel, counting the
+// row as dropped if so.
+func (h *Handler) paused(channel schema.Channel) bool {
+	if !h.manager.drop(channel) {
+		return false
+	}
+
+	h.stats.mu.Lock()
+	switch channel {
+	case schema.ChannelTicker:
+		h.stats.TickersDropped++
+	case schema.ChannelTrades:
+		h.stats.TradesDropped++
+	case schema.ChannelBooks:
+		h.stats.BookLevelsDropped++
+	case schema.ChannelRawBooks:
+		h.stats.RawBookEventsDropped++
+	}
+	h.stats.mu.Unlock()
+	return true
 }
 
 func (h *Handler) flushRoutine() {
 	defer h.wg.Done()
 
+	pruneTicker := time.NewTicker(time.Hour)
+	defer pruneTicker.Stop()
+
 	for {
 		select {
 		case <-h.stopCh:
 			h.logger.Info("Flush routine stopping")
 			return
 		case <-h.flushTicker.C:
-			h.flush()
+			h.flush(false)
+		case <-pruneTicker.C:
+			h.pruneWAL()
 		}
 	}
 }
 
-func (h *Handler) flush() {
+func (h *Handler) pruneWAL() {
+	if err := h.writer.PruneWAL(); err != nil {
+		h.logger.Error("Failed to prune WAL files", zap.Error(err))
+		h.incrementError()
+	}
+}
+
+// flush flushes the segments that are due, or all of them.
+func (h *Handler) flush(all bool) {
 	start := time.Now()
 
-	if err := h.writer.FlushAll(); err != nil {
+	flush := (*Writer).FlushDue
+	if all {
+		flush = (*Writer).FlushAll
+	}
+	if err := h.each(flush); err != nil {
 		h.logger.Error("Failed to flush data", zap.Error(err))
 		h.incrementError()
 		return
@@ -195,18 +459,81 @@ func (h *Handler) GetStatistics() *Statistics {
 		BookLevelsReceived:    h.stats.BookLevelsReceived,
 		RawBookEventsReceived: h.stats.RawBookEventsReceived,
 		ControlsReceived:      h.stats.ControlsReceived,
+		TickersDropped:        h.stats.TickersDropped,
+		TradesDropped:         h.stats.TradesDropped,
+		BookLevelsDropped:     h.stats.BookLevelsDropped,
+		RawBookEventsDropped:  h.stats.RawBookEventsDropped,
 		TotalBytesWritten:     h.stats.TotalBytesWritten,
 		LastFlushTime:         h.stats.LastFlushTime,
 		Errors:                h.stats.Errors,
 	}
 }
 
+// GetWriterStats merges the stats of the shards' writers.
 func (h *Handler) GetWriterStats() map[string]interface{} {
-	return h.writer.GetStats()
+	stats := h.writer.GetStats()
+	for _, shard := range h.shards[1:] {
+		shardStats := shard.writer.GetStats()
+		stats["segments_count"] = stats["segments_count"].(int) + shardStats["segments_count"].(int)
+		stats["segments"] = append(stats["segments"].([]map[string]interface{}),
+			shardStats["segments"].([]map[string]interface{})...)
+	}
+	stats["workers"] = len(h.shards)
+	return stats
 }
 
 func (h *Handler) ForceFlush() error {
 	h.logger.Info("Force flushing all data")
-	h.flush()
+	h.flush(true)
 	return nil
-}
\ No newline at end of file
+}
+
+// storageChannels are the channels storage.channels may override.
+var storageChannels = []schema.Channel{
+	schema.ChannelTicker,
+	schema.ChannelTrades,
+	schema.ChannelBooks,
+	schema.ChannelRawBooks,
+}
+
+// validateStorage checks the storage settings of every channel, so a bad
+// override fails at startup rather than when its first segment opens.
+func validateStorage(storage config.Storage) error {
+	for name := range storage.Channels {
+		if !slices.Contains(storageChannels, schema.Channel(name)) {
+			return fmt.Errorf("storage.channels: unknown channel %q", name)
+		}
+	}
+
+	if _, _, err := newCodec(storage.Compression, storage.CompressionLevel); err != nil {
+		return fmt.Errorf("storage: %w", err)
+	}
+	if storage.Parquet.FlushInterval <= 0 {
+		return fmt.Errorf("storage.parquet: flush_interval must be positive")
+	}
+	for _, channel := range storageChannels {
+		resolved := storage.ForChannel(string(channel))
+		if _, _, err := newCodec(resolved.Compression, resolved.CompressionLevel); err != nil {
+			return fmt.Errorf("storage.channels.%s: %w", channel, err)
+		}
+		if resolved.Parquet.FlushInterval <= 0 {
+			return fmt.Errorf("storage.channels.%s: flush_interval must be positive", channel)
+		}
+	}
+	if storage.Manager.Enabled {
+		return validateManager(storage.Manager)
+	}
+	return nil
+}
+
+// flushTick is how often the flush routine checks for due segments: the
+// shortest flush_interval of any channel.
+func flushTick(storage config.Storage) time.Duration {
+	tick := storage.Parquet.FlushInterval
+	for _, channel := range storageChannels {
+		if interval := storage.ForChannel(string(channel)).Parquet.FlushInterval; interval < tick {
+			tick = interval
+		}
+	}
+	return tick
+}
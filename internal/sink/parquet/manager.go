@@ -0,0 +1,425 @@
+package parquet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/internal/config"
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+const (
+	defaultManagerCheckInterval = time.Minute
+
+	// retentionInterval is how often retention runs while free space is
+	// above low_free_gb.
+	retentionInterval = time.Hour
+)
+
+// channelPause is the pause state of one channel. Rows of a paused channel
+// are dropped before they reach the writer.
+type channelPause struct {
+	paused  atomic.Bool
+	dropped atomic.Int64
+}
+
+// storageManager watches free space on the storage roots and applies segment
+// retention. When a root runs low it pauses the channels stored there, least
+// important first, and resumes them once space is back. Everything it does
+// is recorded as Control rows.
+type storageManager struct {
+	cfg     config.StorageManagerConfig
+	storage config.Storage
+	writer  *Writer
+	logger  *zap.Logger
+
+	// control records an event in the open segments of a channel, or of a
+	// channel and symbol when the symbol is set.
+	control func(channel schema.Channel, symbol string, controlType schema.ControlType, reason string)
+
+	// pauses is filled once and only read afterwards.
+	pauses map[schema.Channel]*channelPause
+
+	// Only the run goroutine touches these.
+	low           map[string]bool
+	lastRetention time.Time
+}
+
+func newStorageManager(storage config.Storage, writer *Writer,
+	control func(schema.Channel, string, schema.ControlType, string), logger *zap.Logger) *storageManager {
+	pauses := make(map[schema.Channel]*channelPause, len(storageChannels))
+	for _, channel := range storageChannels {
+		pauses[channel] = &channelPause{}
+	}
+	return &storageManager{
+		cfg:     storage.Manager,
+		storage: storage,
+		writer:  writer,
+		control: control,
+		logger:  logger.With(zap.String("component", "storage_manager")),
+		pauses:  pauses,
+		low:     make(map[string]bool),
+	}
+}
+
+// drop reports whether rows of channel are dropped because it is paused, and
+// counts the row if so. A nil manager never drops.
+func (m *storageManager) drop(channel schema.Channel) bool {
+	if m == nil {
+		return false
+	}
+	pause, exists := m.pauses[channel]
+	if !exists || !pause.paused.Load() {
+		return false
+	}
+	pause.dropped.Add(1)
+	return true
+}
+
+func (m *storageManager) run(stopCh <-chan struct{}) {
+	interval := m.cfg.CheckInterval
+	if interval <= 0 {
+		interval = defaultManagerCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	m.check(time.Now())
+	for {
+		select {
+		case <-stopCh:
+			return
+		case now := <-ticker.C:
+			m.check(now)
+		}
+	}
+}
+
+// check measures free space on every storage root, runs retention when due
+// or when a root is low, and pauses or resumes at most one channel.
+func (m *storageManager) check(now time.Time) {
+	freeGB := make(map[string]float64)
+	anyLow := false
+	for _, root := range m.writer.basePaths() {
+		free, err := diskFree(root)
+		if err != nil {
+			m.logger.Debug("Failed to read free space", zap.String("path", root), zap.Error(err))
+			continue
+		}
+		gb := float64(free) / (1 << 30)
+		freeGB[root] = gb
+
+		low := gb < m.cfg.LowFreeGB
+		if low && !m.low[root] {
+			m.logger.Warn("Storage root is low on space",
+				zap.String("path", root),
+				zap.Float64("free_gb", gb))
+			for _, channel := range m.channelsOn(root) {
+				m.control(channel, "", schema.ControlTypeDiskLow,
+					fmt.Sprintf("%.1f GB free on %s, below low_free_gb %.1f", gb, root, m.cfg.LowFreeGB))
+			}
+		}
+		m.low[root] = low
+		anyLow = anyLow || low
+	}
+
+	if anyLow || now.Sub(m.lastRetention) >= retentionInterval {
+		m.applyRetention(now)
+		m.lastRetention = now
+	}
+
+	// Pause the least important running channel on a root below the hard
+	// threshold; otherwise resume the most important paused channel whose
+	// root has recovered.
+	for _, name := range m.cfg.PauseOrder {
+		channel := schema.Channel(name)
+		root := m.storage.ForChannel(name).BasePath
+		gb, known := freeGB[root]
+		if !known || gb >= m.cfg.HardFreeGB || m.pauses[channel].paused.Load() {
+			continue
+		}
+		m.pauses[channel].dropped.Store(0)
+		m.pauses[channel].paused.Store(true)
+		m.logger.Error("Paused channel: storage root is almost full",
+			zap.String("channel", name),
+			zap.String("path", root),
+			zap.Float64("free_gb", gb))
+		m.control(channel, "", schema.ControlTypeChannelPaused,
+			fmt.Sprintf("%.1f GB free on %s, below hard_free_gb %.1f", gb, root, m.cfg.HardFreeGB))
+		return
+	}
+
+	for i := len(m.cfg.PauseOrder) - 1; i >= 0; i-- {
+		name := m.cfg.PauseOrder[i]
+		channel := schema.Channel(name)
+		root := m.storage.ForChannel(name).BasePath
+		gb, known := freeGB[root]
+		if !known || gb < m.cfg.LowFreeGB || !m.pauses[channel].paused.Load() {
+			continue
+		}
+		m.pauses[channel].paused.Store(false)
+		dropped := m.pauses[channel].dropped.Load()
+		m.logger.Info("Resumed channel",
+			zap.String("channel", name),
+			zap.Float64("free_gb", gb),
+			zap.Int64("dropped_rows", dropped))
+		m.control(channel, "", schema.ControlTypeChannelResumed,
+			fmt.Sprintf("%.1f GB free on %s; %d rows dropped while paused", gb, root, dropped))
+		return
+	}
+}
+
+// channelsOn lists the channels stored under root.
+func (m *storageManager) channelsOn(root string) []schema.Channel {
+	channels := make([]schema.Channel, 0, len(storageChannels))
+	for _, channel := range storageChannels {
+		if m.storage.ForChannel(string(channel)).BasePath == root {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// applyRetention moves the closed segments that have outlived their
+// channel's retention to the archive path, or deletes them without one.
+func (m *storageManager) applyRetention(now time.Time) {
+	for name, keep := range m.cfg.Retention {
+		if keep <= 0 {
+			continue
+		}
+		channel := schema.Channel(name)
+		root := m.storage.ForChannel(name).BasePath
+		cutoff := now.Add(-keep)
+
+		dirs, err := m.writer.segmentDirs(filepath.Join(root, "bitfinex", "v2", name))
+		if err != nil {
+			m.logger.Error("Failed to list segments for retention", zap.Error(err))
+			continue
+		}
+
+		for _, dir := range dirs {
+			manifest, err := readManifest(dir)
+			if err != nil {
+				// Unfinished segments are left to recovery.
+				continue
+			}
+			end := manifest.Segment.UTCEnd
+			if end.IsZero() || !end.Before(cutoff) {
+				continue
+			}
+
+			controlType := schema.ControlTypeSegmentDeleted
+			if m.cfg.ArchivePath != "" {
+				controlType = schema.ControlTypeSegmentArchived
+				err = m.writer.archiveSegment(root, m.cfg.ArchivePath, dir, manifest)
+			} else {
+				err = m.writer.deleteSegment(root, dir, manifest)
+			}
+			if err != nil {
+				m.logger.Error("Failed to apply retention",
+					zap.String("path", dir),
+					zap.Error(err))
+				continue
+			}
+
+			rel, _ := filepath.Rel(root, dir)
+			m.logger.Info("Applied retention",
+				zap.String("type", string(controlType)),
+				zap.String("path", dir))
+			m.control(channel, manifest.Symbol, controlType,
+				fmt.Sprintf("%s ended %s, older than %s", filepath.ToSlash(rel), end.Format(time.RFC3339), keep))
+		}
+	}
+}
+
+// writeStorageControl records a storage manager event in controls.parquet of
+// the open segments of channel, or of channel and symbol when symbol is set.
+// Segments are not opened for it.
+func (w *Writer) writeStorageControl(channel schema.Channel, symbol string, controlType schema.ControlType, reason string) {
+	w.segmentsMutex.RLock()
+	symbols := make([]string, 0)
+	for _, segment := range w.segments {
+		if segment.IsOpen && segment.Channel == channel && (symbol == "" || segment.Symbol == symbol) &&
+			!slices.Contains(symbols, segment.Symbol) {
+			symbols = append(symbols, segment.Symbol)
+		}
+	}
+	w.segmentsMutex.RUnlock()
+
+	now := time.Now().UTC()
+	for _, s := range symbols {
+		control := &schema.Control{
+			CommonFields: schema.CommonFields{
+				Exchange: schema.ExchangeBitfinex,
+				Channel:  channel,
+				Symbol:   s,
+				RecvTS:   now.UnixNano(),
+			},
+			Type:      controlType,
+			Reason:    reason,
+			Timestamp: now,
+		}
+		if err := w.WriteControl(control); err != nil {
+			w.logger.Error("Failed to write storage control",
+				zap.String("type", string(controlType)),
+				zap.String("symbol", s),
+				zap.Error(err))
+		}
+	}
+}
+
+// archiveSegment moves the closed segment in dir from root to the same place
+// under archiveRoot and records the move in its manifest. Across file
+// systems the segment is copied to a hidden directory first and renamed into
+// place, so the archive never holds a partial segment.
+func (w *Writer) archiveSegment(root, archiveRoot, dir string, manifest *schema.SegmentManifest) error {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve segment path: %w", err)
+	}
+	target := filepath.Join(archiveRoot, rel)
+
+	archived := *manifest
+	archivedAt := time.Now().UTC()
+	archived.ArchivedAt = &archivedAt
+	manifestData, err := json.MarshalIndent(&archived, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
+	}
+
+	// A target that exists was archived by an earlier pass that stopped
+	// before removing the source.
+	if _, err := os.Stat(target); os.IsNotExist(err) {
+		if err := os.Rename(dir, target); err == nil {
+			if err := replaceFile(filepath.Join(target, manifestName), manifestData); err != nil {
+				return fmt.Errorf("failed to update manifest: %w", err)
+			}
+		} else if err := copySegment(dir, target, manifestData); err != nil {
+			return err
+		}
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove archived segment: %w", err)
+	}
+	os.Remove(filepath.Dir(dir))
+
+	if err := w.appendCatalog(archiveRoot, target, &archived); err != nil {
+		w.logger.Error("Failed to update archive catalog", zap.String("path", target), zap.Error(err))
+	}
+	w.catalogDeleted(root, dir, manifest)
+
+	if w.cfg.Storage.Delta.Enabled {
+		if err := w.commitRetentionToDelta(root, dir, manifest); err != nil {
+			w.logger.Error("Failed to remove archived segment from delta table", zap.Error(err))
+		}
+		if err := w.commitArchiveToDelta(archiveRoot, target, &archived); err != nil {
+			w.logger.Error("Failed to add archived segment to delta table", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// deleteSegment removes the closed segment in dir from root.
+func (w *Writer) deleteSegment(root, dir string, manifest *schema.SegmentManifest) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove segment: %w", err)
+	}
+	os.Remove(filepath.Dir(dir))
+
+	w.catalogDeleted(root, dir, manifest)
+	if w.cfg.Storage.Delta.Enabled {
+		if err := w.commitRetentionToDelta(root, dir, manifest); err != nil {
+			w.logger.Error("Failed to remove deleted segment from delta table", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// copySegment copies the files of dir to target, with manifestData as the
+// manifest.
+func copySegment(dir, target string, manifestData []byte) error {
+	staging := filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".tmp")
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list segment: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || entry.Name() == manifestName {
+			continue
+		}
+		if err := copyFile(filepath.Join(dir, entry.Name()), filepath.Join(staging, entry.Name())); err != nil {
+			os.RemoveAll(staging)
+			return fmt.Errorf("failed to copy %s: %w", entry.Name(), err)
+		}
+	}
+	if err := writeSynced(filepath.Join(staging, manifestName), manifestData); err != nil {
+		os.RemoveAll(staging)
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	if err := os.Rename(staging, target); err != nil {
+		os.RemoveAll(staging)
+		return fmt.Errorf("failed to move archived segment into place: %w", err)
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// validateManager checks the storage manager settings.
+func validateManager(cfg config.StorageManagerConfig) error {
+	for _, name := range cfg.PauseOrder {
+		if !slices.Contains(storageChannels, schema.Channel(name)) {
+			return fmt.Errorf("storage.manager.pause_order: unknown channel %q", name)
+		}
+	}
+	for name := range cfg.Retention {
+		if !slices.Contains(storageChannels, schema.Channel(name)) {
+			return fmt.Errorf("storage.manager.retention: unknown channel %q", name)
+		}
+	}
+	if cfg.HardFreeGB > cfg.LowFreeGB {
+		return fmt.Errorf("storage.manager: hard_free_gb must not exceed low_free_gb")
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package parquet
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/internal/config"
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+// managerControl is a control recorded by the storage manager.
+type managerControl struct {
+	channel     schema.Channel
+	symbol      string
+	controlType schema.ControlType
+	reason      string
+}
+
+// testManager returns a storage manager over w that records its controls in
+// controls.
+func testManager(cfg *config.Config, w *Writer, controls *[]managerControl) *storageManager {
+	control := func(channel schema.Channel, symbol string, controlType schema.ControlType, reason string) {
+		*controls = append(*controls, managerControl{channel, symbol, controlType, reason})
+	}
+	return newStorageManager(cfg.Storage, w, control, zap.NewNop())
+}
+
+func TestStorageManagerPausesAndResumes(t *testing.T) {
+	cfg := testConfig(t)
+	// No disk has this much free space, so the root is low and almost full.
+	cfg.Storage.Manager = config.StorageManagerConfig{
+		Enabled:    true,
+		LowFreeGB:  1 << 30,
+		HardFreeGB: 1 << 30,
+		PauseOrder: []string{"raw_books", "books", "trades"},
+	}
+	if err := validateManager(cfg.Storage.Manager); err != nil {
+		t.Fatal(err)
+	}
+	var controls []managerControl
+	m := testManager(cfg, newTestWriter(cfg), &controls)
+	now := time.Now()
+
+	// Each check pauses one channel, least important first.
+	m.check(now)
+	if !m.drop(schema.ChannelRawBooks) || m.drop(schema.ChannelBooks) || m.drop(schema.ChannelTrades) {
+		t.Fatal("first check did not pause raw_books alone")
+	}
+	var diskLow int
+	for _, c := range controls {
+		if c.controlType == schema.ControlTypeDiskLow {
+			diskLow++
+		}
+	}
+	if diskLow != len(storageChannels) {
+		t.Errorf("got %d disk low controls, want one per channel on the root", diskLow)
+	}
+	last := controls[len(controls)-1]
+	if last.channel != schema.ChannelRawBooks || last.controlType != schema.ControlTypeChannelPaused {
+		t.Errorf("last control %+v, want raw_books paused", last)
+	}
+
+	m.check(now.Add(time.Minute))
+	if !m.drop(schema.ChannelBooks) || m.drop(schema.ChannelTrades) {
+		t.Fatal("second check did not pause books")
+	}
+	// The root stays low; it is reported once.
+	if c := controls[len(controls)-1]; c.controlType != schema.ControlTypeChannelPaused || len(controls) != diskLow+2 {
+		t.Errorf("controls after the second check %+v", controls[diskLow:])
+	}
+	for i := 0; i < 4; i++ {
+		m.drop(schema.ChannelRawBooks)
+	}
+
+	// Space is back: the most important paused channel resumes first.
+	m.cfg.LowFreeGB, m.cfg.HardFreeGB = 0, 0
+	m.check(now.Add(2 * time.Minute))
+	if m.drop(schema.ChannelBooks) || !m.drop(schema.ChannelRawBooks) {
+		t.Fatal("third check did not resume books alone")
+	}
+	m.check(now.Add(3 * time.Minute))
+	if m.drop(schema.ChannelRawBooks) {
+		t.Fatal("fourth check did not resume raw_books")
+	}
+	resumed := controls[len(controls)-1]
+	if resumed.channel != schema.ChannelRawBooks || resumed.controlType != schema.ControlTypeChannelResumed ||
+		!strings.Contains(resumed.reason, "; 6 rows dropped") {
+		t.Errorf("last control %+v, want raw_books resumed after 6 dropped rows", resumed)
+	}
+}
+
+func TestStorageManagerRetention(t *testing.T) {
+	for _, archive := range []bool{false, true} {
+		name := "delete"
+		if archive {
+			name = "archive"
+		}
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.Storage.Manager = config.StorageManagerConfig{
+				Enabled:   true,
+				Retention: map[string]time.Duration{"trades": 24 * time.Hour},
+			}
+			if archive {
+				cfg.Storage.Manager.ArchivePath = t.TempDir()
+			}
+			w := newTestWriter(cfg)
+			writeTrades(t, w, 1, 10, testHour)
+			writeTrades(t, w, 11, 10, testHour.Add(47*time.Hour))
+			closeWriters(t, w)
+			root := cfg.Storage.BasePath
+			dirs := tradeSegments(t, root)
+			if len(dirs) != 2 {
+				t.Fatalf("got segments %v, want two", dirs)
+			}
+
+			var controls []managerControl
+			m := testManager(cfg, w, &controls)
+			m.check(testHour.Add(48 * time.Hour))
+
+			if kept := tradeSegments(t, root); len(kept) != 1 || kept[0] != dirs[1] {
+				t.Fatalf("segments left %v, want only %s", kept, dirs[1])
+			}
+			want := schema.ControlTypeSegmentDeleted
+			if archive {
+				want = schema.ControlTypeSegmentArchived
+			}
+			if len(controls) != 1 || controls[0].controlType != want || controls[0].symbol != testSymbol {
+				t.Errorf("controls %+v, want one %s of %s", controls, want, testSymbol)
+			}
+
+			entries := readCatalog(t, root)
+			if last := entries[len(entries)-1]; !last.Deleted || last.Seq == nil || last.Seq.First != 1 {
+				t.Errorf("last catalog entry %+v, want the old segment marked deleted", last)
+			}
+
+			if !archive {
+				return
+			}
+			rel, _ := filepath.Rel(root, dirs[0])
+			target := filepath.Join(cfg.Storage.Manager.ArchivePath, rel)
+			checkTradeIDs(t, readTrades(t, target), 1, 10)
+			manifest, err := readManifest(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if manifest.ArchivedAt == nil {
+				t.Error("archived manifest has no archived_at")
+			}
+			archived := readCatalog(t, cfg.Storage.Manager.ArchivePath)
+			if len(archived) != 1 || archived[0].Path != filepath.ToSlash(rel) || archived[0].Deleted {
+				t.Errorf("archive catalog %+v, want the segment at %s", archived, rel)
+			}
+			if _, err := os.Stat(dirs[0]); !os.IsNotExist(err) {
+				t.Errorf("archived segment still in the storage root: %v", err)
+			}
+		})
+	}
+}
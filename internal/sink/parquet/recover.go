@@ -0,0 +1,843 @@
+package parquet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/encoding/thrift"
+	"github.com/parquet-go/parquet-go/format"
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+const (
+	// rowGroupIndexSuffix names the file next to a .tmp parquet file that
+	// lists the row groups cut so far, so they can be salvaged without the
+	// footer.
+	rowGroupIndexSuffix = ".groups"
+
+	quarantineDirName = "quarantine"
+	salvageSuffix     = ".salvage"
+)
+
+var parquetMagic = []byte("PAR1")
+
+// rowGroupEntry is one line of a row group index.
+type rowGroupEntry struct {
+	Rows  int64                   `json:"rows"`
+	Codec format.CompressionCodec `json:"codec"`
+}
+
+// Recover finishes segments left without a manifest by an earlier run.
+// The complete row groups of their .tmp files are salvaged into valid parquet
+// files; for segments with a WAL, the rows it logged past them are appended.
+// Either way the manifest is written with recovered set. Files and segments that cannot be
+// recovered are moved under {base_path}/quarantine.
+func (w *Writer) Recover() error {
+	for _, basePath := range w.basePaths() {
+		if err := w.recoverRoot(filepath.Join(basePath, "bitfinex", "v2")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) recoverRoot(root string) error {
+	dirs, err := w.segmentDirs(root)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if _, err := os.Stat(filepath.Join(dir, manifestName)); err == nil {
+			continue
+		}
+
+		if walPath := findWAL(dir); walPath != "" {
+			err = w.replaySegment(root, dir, walPath)
+		} else {
+			err = w.salvageSegment(root, dir)
+		}
+		if err != nil {
+			w.logger.Error("Failed to recover segment",
+				zap.String("path", dir),
+				zap.Error(err))
+			w.quarantine(dir)
+		}
+	}
+
+	return nil
+}
+
+// segmentFromPath resolves the channel and symbol of a segment directory
+// below root.
+func segmentFromPath(root, dir string) (schema.Channel, string, error) {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to resolve segment path: %w", err)
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	if len(parts) < 2 {
+		return "", "", fmt.Errorf("unexpected segment path %s", dir)
+	}
+	return schema.Channel(parts[0]), parts[1], nil
+}
+
+// fileChannel is the channel whose rows a parquet file of a segment holds.
+func fileChannel(segmentChannel schema.Channel, name string) schema.Channel {
+	if strings.HasPrefix(name, "controls.parquet") {
+		return schema.ChannelControls
+	}
+	return segmentChannel
+}
+
+// observeRecovered folds a recovered row into the segment's time range,
+// connections and quality counters.
+func (s *Segment) observeRecovered(row interface{}) {
+	common := commonFields(row)
+	if common.RecvTS != 0 {
+		recvTS := time.Unix(0, common.RecvTS).UTC()
+		if s.StartTime.IsZero() || recvTS.Before(s.StartTime) {
+			s.StartTime = recvTS
+			s.Manifest.Segment.UTCStart = recvTS
+		}
+		if recvTS.After(s.EndTime) {
+			s.EndTime = recvTS
+		}
+	}
+	control, ok := row.(*schema.Control)
+	if !ok {
+		s.track(common)
+		return
+	}
+	if common.ConnID != "" {
+		s.trackConn(common.ConnID)
+	}
+	s.recordQuality(control)
+	s.recordSubscription(control)
+}
+
+// scanRecovered reads a recovered parquet file into segment and records its
+// file stats under name. The file is read through once first, so a file that
+// turns out to be damaged leaves nothing behind in the manifest.
+func (s *Segment) scanRecovered(channel schema.Channel, path, name string) (int64, error) {
+	if _, err := scanRows(channel, path, func(interface{}) {}); err != nil {
+		return 0, err
+	}
+
+	stats := schema.FileStats{Name: name}
+	rows, err := scanRows(channel, path, func(row interface{}) {
+		stats.Observe(commonFields(row))
+		s.observeRecovered(row)
+	})
+	if err != nil {
+		return rows, err
+	}
+	s.fileStats = append(s.fileStats, stats)
+	return rows, nil
+}
+
+// keepFinished adds the parquet files of dir that were already renamed into
+// place to segment and returns their channels. Files that do not read back
+// are quarantined.
+func (w *Writer) keepFinished(segment *Segment, dir string) (map[schema.Channel]struct{}, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.parquet"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list parquet files: %w", err)
+	}
+
+	kept := make(map[schema.Channel]struct{})
+	for _, path := range files {
+		channel := fileChannel(segment.Channel, filepath.Base(path))
+		if _, err := segment.scanRecovered(channel, path, filepath.Base(path)); err != nil {
+			w.logger.Warn("Finished parquet file is unreadable",
+				zap.String("path", path),
+				zap.Error(err))
+			w.quarantine(path)
+			continue
+		}
+		kept[channel] = struct{}{}
+		segment.Manifest.Segment.Files = append(segment.Manifest.Segment.Files, filepath.Base(path))
+	}
+	return kept, nil
+}
+
+// salvageSegment rebuilds a segment that has no WAL from what its parquet
+// files hold on disk.
+func (w *Writer) salvageSegment(root, dir string) error {
+	channel, symbol, err := segmentFromPath(root, dir)
+	if err != nil {
+		return err
+	}
+
+	segment := w.newSegment(channel, symbol, dir, time.Time{})
+	segment.Manifest.Recovered = true
+
+	if _, err := w.keepFinished(segment, dir); err != nil {
+		return err
+	}
+
+	tmpFiles, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		return fmt.Errorf("failed to list temp files: %w", err)
+	}
+
+	var salvaged int64
+	for _, tmpPath := range tmpFiles {
+		// Nothing reached the file before the crash, so nothing is lost.
+		if info, err := os.Stat(tmpPath); err == nil && info.Size() == 0 {
+			os.Remove(tmpPath)
+			os.Remove(tmpPath + rowGroupIndexSuffix)
+			continue
+		}
+
+		finalPath := strings.TrimSuffix(tmpPath, ".tmp")
+		rows, err := w.salvageFile(segment, tmpPath, finalPath)
+		if err != nil {
+			w.logger.Warn("Failed to salvage parquet file",
+				zap.String("path", tmpPath),
+				zap.Error(err))
+			w.quarantine(tmpPath)
+			w.quarantine(tmpPath + rowGroupIndexSuffix)
+			continue
+		}
+
+		salvaged += rows
+		segment.Manifest.Segment.Files = append(segment.Manifest.Segment.Files, filepath.Base(finalPath))
+	}
+
+	if len(segment.Manifest.Segment.Files) == 0 {
+		return errors.New("no recoverable parquet files")
+	}
+
+	if err := w.closeSegment(segment); err != nil {
+		return err
+	}
+
+	w.logger.Info("Salvaged segment",
+		zap.String("path", dir),
+		zap.String("channel", string(channel)),
+		zap.String("symbol", symbol),
+		zap.Int64("rows", salvaged),
+		zap.Int("files", len(segment.Manifest.Segment.Files)))
+
+	return nil
+}
+
+// salvageFile writes the complete row groups of tmpPath, as listed in its
+// row group index, to finalPath with a new footer. The result is read back in
+// full before it replaces the temp file.
+func (w *Writer) salvageFile(segment *Segment, tmpPath, finalPath string) (int64, error) {
+	channel := fileChannel(segment.Channel, filepath.Base(tmpPath))
+
+	salvagePath := finalPath + salvageSuffix
+	groups, listed, err := w.salvageRowGroups(channel, tmpPath, salvagePath)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := segment.scanRecovered(channel, salvagePath, filepath.Base(finalPath))
+	if err != nil {
+		os.Remove(salvagePath)
+		return 0, fmt.Errorf("salvaged file does not read back: %w", err)
+	}
+
+	if err := os.Rename(salvagePath, finalPath); err != nil {
+		return 0, fmt.Errorf("failed to rename salvaged file: %w", err)
+	}
+	os.Remove(tmpPath)
+	os.Remove(tmpPath + rowGroupIndexSuffix)
+
+	w.logger.Info("Salvaged parquet file",
+		zap.String("path", finalPath),
+		zap.Int("row_groups", groups),
+		zap.Int("row_groups_listed", listed),
+		zap.Int64("rows", rows))
+
+	return rows, nil
+}
+
+// salvageRowGroups writes the complete row groups of tmpPath, as listed in
+// its row group index, to salvagePath with a new footer. It returns how many
+// row groups were salvaged and how many the index listed.
+func (w *Writer) salvageRowGroups(channel schema.Channel, tmpPath, salvagePath string) (int, int, error) {
+	entries, err := readRowGroupIndex(tmpPath + rowGroupIndexSuffix)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	template, err := footerTemplate(channel)
+	if err != nil {
+		return 0, 0, err
+	}
+	leaves, err := leafColumns(template.Schema)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	in, err := os.Open(tmpPath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open %s: %w", tmpPath, err)
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to stat %s: %w", tmpPath, err)
+	}
+
+	magic := make([]byte, len(parquetMagic))
+	if _, err := in.ReadAt(magic, 0); err != nil || string(magic) != string(parquetMagic) {
+		return 0, 0, errors.New("missing parquet header")
+	}
+
+	metadata := *template
+	metadata.RowGroups = nil
+	metadata.NumRows = 0
+
+	var sorting []format.SortingColumn
+	for i, leaf := range leaves {
+		if leaf.path[0] == sortColumn {
+			sorting = append(sorting, format.SortingColumn{ColumnIdx: int32(i)})
+		}
+	}
+
+	end := int64(len(parquetMagic))
+	for i, entry := range entries {
+		group, groupEnd, err := readRowGroup(in, info.Size(), end, leaves, entry)
+		if err != nil {
+			// The rest of the file never made it to disk.
+			w.logger.Debug("Row group is incomplete",
+				zap.String("path", tmpPath),
+				zap.Int("row_group", i),
+				zap.Error(err))
+			break
+		}
+		group.Ordinal = int16(i)
+		group.SortingColumns = sorting
+		metadata.RowGroups = append(metadata.RowGroups, group)
+		metadata.NumRows += group.NumRows
+		end = groupEnd
+	}
+
+	if len(metadata.RowGroups) == 0 {
+		return 0, len(entries), errors.New("no complete row groups")
+	}
+
+	footer, err := thrift.Marshal(new(thrift.CompactProtocol), &metadata)
+	if err != nil {
+		return 0, len(entries), fmt.Errorf("failed to encode footer: %w", err)
+	}
+
+	var fsync *fsyncMetrics
+	if w.durability != DurabilityNone {
+		fsync = w.fsync
+	}
+	if err := writeSalvaged(salvagePath, in, end, footer, fsync); err != nil {
+		os.Remove(salvagePath)
+		return 0, len(entries), err
+	}
+	return len(metadata.RowGroups), len(entries), nil
+}
+
+// writeSalvaged writes the salvaged file, syncing it when fsync is set.
+func writeSalvaged(path string, in io.ReaderAt, size int64, footer []byte, fsync *fsyncMetrics) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+
+	if _, err := io.Copy(out, io.NewSectionReader(in, 0, size)); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy row groups: %w", err)
+	}
+
+	trailer := make([]byte, 4, 4+len(parquetMagic))
+	binary.LittleEndian.PutUint32(trailer, uint32(len(footer)))
+	trailer = append(trailer, parquetMagic...)
+
+	if _, err := out.Write(append(footer, trailer...)); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to write footer: %w", err)
+	}
+
+	if fsync != nil {
+		if err := fsync.syncFile(out); err != nil {
+			out.Close()
+			return fmt.Errorf("failed to sync %s: %w", path, err)
+		}
+	}
+
+	return out.Close()
+}
+
+func readRowGroupIndex(path string) ([]rowGroupEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open row group index: %w", err)
+	}
+	defer file.Close()
+
+	entries := make([]rowGroupEntry, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry rowGroupEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Rows <= 0 {
+			// A torn last line; the row group it describes is incomplete.
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+type leafColumn struct {
+	path []string
+	typ  format.Type
+	// filtered is set for columns written with a bloom filter.
+	filtered bool
+}
+
+// leafColumns lists the leaf columns of a flat schema in file order.
+func leafColumns(elements []format.SchemaElement) ([]leafColumn, error) {
+	if len(elements) == 0 {
+		return nil, errors.New("empty schema")
+	}
+
+	leaves := make([]leafColumn, 0, len(elements)-1)
+	for _, element := range elements[1:] {
+		if element.NumChildren > 0 || element.Type == nil {
+			return nil, fmt.Errorf("nested column %s cannot be salvaged", element.Name)
+		}
+		if element.RepetitionType != nil && *element.RepetitionType == format.Repeated {
+			return nil, fmt.Errorf("repeated column %s cannot be salvaged", element.Name)
+		}
+		leaves = append(leaves, leafColumn{
+			path:     []string{element.Name},
+			typ:      *element.Type,
+			filtered: slices.Contains(bloomFilterColumns, element.Name),
+		})
+	}
+	return leaves, nil
+}
+
+// readRowGroup walks the pages of one row group starting at offset. Each
+// column chunk holds entry.Rows values, one per row, since the schema is flat.
+// The bloom filters written after the column chunks are skipped over.
+func readRowGroup(r io.ReaderAt, size, offset int64, leaves []leafColumn, entry rowGroupEntry) (format.RowGroup, int64, error) {
+	group := format.RowGroup{
+		FileOffset: offset,
+		NumRows:    entry.Rows,
+		Columns:    make([]format.ColumnChunk, 0, len(leaves)),
+	}
+
+	for _, leaf := range leaves {
+		chunk := format.ColumnChunk{
+			FileOffset: offset,
+			MetaData: format.ColumnMetaData{
+				Type:         leaf.typ,
+				PathInSchema: leaf.path,
+				Codec:        entry.Codec,
+			},
+		}
+		meta := &chunk.MetaData
+		encodings := make(map[format.Encoding]struct{})
+
+		for meta.NumValues < entry.Rows {
+			header, headerLen, err := readPageHeader(r, size, offset)
+			if err != nil {
+				return group, 0, err
+			}
+			pageEnd := offset + headerLen + int64(header.CompressedPageSize)
+			if pageEnd > size {
+				return group, 0, io.ErrUnexpectedEOF
+			}
+
+			switch {
+			case header.Type == format.DictionaryPage && header.DictionaryPageHeader != nil:
+				if meta.DataPageOffset != 0 {
+					return group, 0, errors.New("dictionary page after data pages")
+				}
+				meta.DictionaryPageOffset = offset
+				encodings[header.DictionaryPageHeader.Encoding] = struct{}{}
+			case header.Type == format.DataPage && header.DataPageHeader != nil:
+				if meta.DataPageOffset == 0 {
+					meta.DataPageOffset = offset
+				}
+				meta.NumValues += int64(header.DataPageHeader.NumValues)
+				encodings[header.DataPageHeader.Encoding] = struct{}{}
+				encodings[header.DataPageHeader.DefinitionLevelEncoding] = struct{}{}
+			case header.Type == format.DataPageV2 && header.DataPageHeaderV2 != nil:
+				if meta.DataPageOffset == 0 {
+					meta.DataPageOffset = offset
+				}
+				meta.NumValues += int64(header.DataPageHeaderV2.NumValues)
+				encodings[header.DataPageHeaderV2.Encoding] = struct{}{}
+				encodings[format.RLE] = struct{}{}
+			default:
+				return group, 0, fmt.Errorf("unexpected page type %s", header.Type)
+			}
+
+			meta.TotalUncompressedSize += headerLen + int64(header.UncompressedPageSize)
+			meta.TotalCompressedSize += headerLen + int64(header.CompressedPageSize)
+			offset = pageEnd
+		}
+
+		if meta.NumValues != entry.Rows {
+			return group, 0, fmt.Errorf("column %s has %d values, expected %d",
+				strings.Join(leaf.path, "."), meta.NumValues, entry.Rows)
+		}
+
+		for encoding := range encodings {
+			meta.Encoding = append(meta.Encoding, encoding)
+		}
+		sort.Slice(meta.Encoding, func(i, j int) bool { return meta.Encoding[i] < meta.Encoding[j] })
+
+		group.TotalByteSize += meta.TotalUncompressedSize
+		group.TotalCompressedSize += meta.TotalCompressedSize
+		group.Columns = append(group.Columns, chunk)
+	}
+
+	for i, leaf := range leaves {
+		if !leaf.filtered {
+			continue
+		}
+		var header format.BloomFilterHeader
+		headerLen, err := decodeAt(r, size, offset, &header)
+		if err != nil {
+			return group, 0, fmt.Errorf("failed to decode bloom filter header at %d: %w", offset, err)
+		}
+		filterEnd := offset + headerLen + int64(header.NumBytes)
+		if filterEnd > size {
+			return group, 0, io.ErrUnexpectedEOF
+		}
+		group.Columns[i].MetaData.BloomFilterOffset = offset
+		offset = filterEnd
+	}
+
+	return group, offset, nil
+}
+
+// countingReader counts the bytes the thrift decoder consumes, which is the
+// length of the page or bloom filter header.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func readPageHeader(r io.ReaderAt, size, offset int64) (format.PageHeader, int64, error) {
+	var header format.PageHeader
+	n, err := decodeAt(r, size, offset, &header)
+	if err != nil {
+		return header, 0, fmt.Errorf("failed to decode page header at %d: %w", offset, err)
+	}
+	return header, n, nil
+}
+
+// decodeAt decodes the thrift struct at offset into v and returns its
+// encoded length.
+func decodeAt(r io.ReaderAt, size, offset int64, v interface{}) (int64, error) {
+	counter := &countingReader{r: bufio.NewReaderSize(io.NewSectionReader(r, offset, size-offset), 1024)}
+	decoder := thrift.NewDecoder(new(thrift.CompactProtocol).NewReader(counter))
+	if err := decoder.Decode(v); err != nil {
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+// footerTemplate is the footer of an empty file of channel's row type. It
+// supplies the schema and writer details for salvaged footers.
+func footerTemplate(channel schema.Channel) (*format.FileMetaData, error) {
+	switch channel {
+	case schema.ChannelRawBooks:
+		return emptyFooter[schema.RawBookEvent]()
+	case schema.ChannelBooks:
+		return emptyFooter[schema.BookLevel]()
+	case schema.ChannelTrades:
+		return emptyFooter[schema.Trade]()
+	case schema.ChannelTicker:
+		return emptyFooter[schema.Ticker]()
+	case schema.ChannelControls:
+		return emptyFooter[schema.Control]()
+	default:
+		return nil, fmt.Errorf("unsupported channel type: %s", channel)
+	}
+}
+
+func emptyFooter[T any]() (*format.FileMetaData, error) {
+	rows := newBatch[T](io.Discard)
+	if err := rows.close(); err != nil {
+		return nil, err
+	}
+	return rows.writer.File().Metadata(), nil
+}
+
+// scanRows reads every row of the parquet file at path and passes it to fn.
+func scanRows(channel schema.Channel, path string, fn func(row interface{})) (int64, error) {
+	switch channel {
+	case schema.ChannelRawBooks:
+		return scanFile[schema.RawBookEvent](path, fn)
+	case schema.ChannelBooks:
+		return scanFile[schema.BookLevel](path, fn)
+	case schema.ChannelTrades:
+		return scanFile[schema.Trade](path, fn)
+	case schema.ChannelTicker:
+		return scanFile[schema.Ticker](path, fn)
+	case schema.ChannelControls:
+		return scanFile[schema.Control](path, fn)
+	default:
+		return 0, fmt.Errorf("unsupported channel type: %s", channel)
+	}
+}
+
+func scanFile[T any](path string, fn func(row interface{})) (int64, error) {
+	rows, err := openFileRows[T](path)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.close()
+
+	for {
+		row, err := rows.next()
+		if err == io.EOF {
+			return rows.read(), nil
+		}
+		if err != nil {
+			return rows.read(), err
+		}
+		fn(row)
+	}
+}
+
+// rowCursor reads the rows of a parquet file one at a time.
+type rowCursor interface {
+	// next returns the next row, or io.EOF once every row has been read.
+	next() (interface{}, error)
+	// read is the number of rows next has returned.
+	read() int64
+	close() error
+}
+
+// openRows opens the parquet file at path for reading row by row.
+func openRows(channel schema.Channel, path string) (rowCursor, error) {
+	switch channel {
+	case schema.ChannelRawBooks:
+		return openFileRows[schema.RawBookEvent](path)
+	case schema.ChannelBooks:
+		return openFileRows[schema.BookLevel](path)
+	case schema.ChannelTrades:
+		return openFileRows[schema.Trade](path)
+	case schema.ChannelTicker:
+		return openFileRows[schema.Ticker](path)
+	case schema.ChannelControls:
+		return openFileRows[schema.Control](path)
+	default:
+		return nil, fmt.Errorf("unsupported channel type: %s", channel)
+	}
+}
+
+// fileRows is a rowCursor that decodes a buffer of rows from one row group
+// at a time.
+type fileRows[T any] struct {
+	file      *os.File
+	pf        *parquet.File
+	rowSchema *parquet.Schema
+	pointers  map[int][]int
+	groups    []parquet.RowGroup
+	rows      parquet.Rows
+	buf       []parquet.Row
+	pos       int
+	n         int
+	total     int64
+}
+
+func openFileRows[T any](path string) (*fileRows[T], error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	pf, err := parquet.OpenFile(file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &fileRows[T]{
+		file:      file,
+		pf:        pf,
+		rowSchema: parquet.SchemaOf(new(T)),
+		pointers:  pointerColumns(reflect.TypeOf(new(T)).Elem(), pf.Schema()),
+		groups:    pf.RowGroups(),
+		buf:       make([]parquet.Row, 1024),
+	}, nil
+}
+
+func (r *fileRows[T]) next() (interface{}, error) {
+	for r.pos == r.n {
+		if err := r.fill(); err != nil {
+			return nil, err
+		}
+	}
+
+	values := r.buf[r.pos]
+	r.pos++
+	row := new(T)
+	if err := r.rowSchema.Reconstruct(row, values); err != nil {
+		return nil, err
+	}
+	clearNulls(reflect.ValueOf(row).Elem(), values, r.pointers)
+	r.total++
+	return row, nil
+}
+
+// fill reads the next buffer of rows, moving on to the next row group when
+// the current one is done. It returns io.EOF after the last row group.
+func (r *fileRows[T]) fill() error {
+	if r.rows == nil {
+		if len(r.groups) == 0 {
+			if r.total != r.pf.NumRows() {
+				return fmt.Errorf("read %d of %d rows", r.total, r.pf.NumRows())
+			}
+			return io.EOF
+		}
+		r.rows = r.groups[0].Rows()
+		r.groups = r.groups[1:]
+	}
+
+	n, err := r.rows.ReadRows(r.buf)
+	r.pos, r.n = 0, n
+	if err == io.EOF {
+		r.rows.Close()
+		r.rows = nil
+		return nil
+	}
+	return err
+}
+
+func (r *fileRows[T]) read() int64 {
+	return r.total
+}
+
+func (r *fileRows[T]) close() error {
+	if r.rows != nil {
+		r.rows.Close()
+		r.rows = nil
+	}
+	return r.file.Close()
+}
+
+// pointerColumns maps the leaf columns of a file to the pointer fields of
+// rowType they fill. parquet-go reconstructs a null as a pointer to a zero
+// value when the field sits in an embedded struct, like CommonFields, so
+// clearNulls puts the nil back.
+func pointerColumns(rowType reflect.Type, fileSchema *parquet.Schema) map[int][]int {
+	fields := make(map[string][]int)
+	var walk func(t reflect.Type, index []int)
+	walk = func(t reflect.Type, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			path := append(append([]int(nil), index...), i)
+			if field.Anonymous && field.Type.Kind() == reflect.Struct {
+				walk(field.Type, path)
+				continue
+			}
+			if field.Type.Kind() != reflect.Ptr {
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("parquet"), ",")
+			if name == "" {
+				name = field.Name
+			}
+			fields[name] = path
+		}
+	}
+	walk(rowType, nil)
+
+	columns := make(map[int][]int)
+	for i, path := range fileSchema.Columns() {
+		if len(path) != 1 {
+			continue
+		}
+		if index, exists := fields[path[0]]; exists {
+			columns[i] = index
+		}
+	}
+	return columns
+}
+
+func clearNulls(row reflect.Value, values parquet.Row, pointers map[int][]int) {
+	for _, value := range values {
+		if !value.IsNull() {
+			continue
+		}
+		if index, exists := pointers[value.Column()]; exists {
+			field := row.FieldByIndex(index)
+			field.Set(reflect.Zero(field.Type()))
+		}
+	}
+}
+
+// quarantine moves path to the same place under the quarantine directory of
+// the base path it is in.
+func (w *Writer) quarantine(path string) {
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+
+	// The innermost base path wins when one is nested in another.
+	basePath, rel := w.basePath, filepath.Base(path)
+	matched := ""
+	for _, candidate := range w.basePaths() {
+		r, err := filepath.Rel(candidate, path)
+		if err == nil && !strings.HasPrefix(r, "..") && len(candidate) > len(matched) {
+			basePath, rel, matched = candidate, r, candidate
+		}
+	}
+
+	target := filepath.Join(basePath, quarantineDirName, rel)
+	for n := 1; ; n++ {
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			break
+		}
+		target = filepath.Join(basePath, quarantineDirName, fmt.Sprintf("%s.%d", rel, n))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		w.logger.Error("Failed to create quarantine directory", zap.Error(err))
+		return
+	}
+	if err := os.Rename(path, target); err != nil {
+		w.logger.Error("Failed to quarantine", zap.String("path", path), zap.Error(err))
+		return
+	}
+
+	w.logger.Warn("Quarantined unrecoverable data",
+		zap.String("path", path),
+		zap.String("quarantine_path", target))
+}
@@ -0,0 +1,214 @@
+package parquet
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tradesTmpFile is the .tmp file of the trades writer of w's only segment.
+func tradesTmpFile(t *testing.T, w *Writer) string {
+	t.Helper()
+	for _, segment := range w.segments {
+		for _, cw := range segment.Writers {
+			return cw.TempFilePath
+		}
+	}
+	t.Fatal("no open trades writer")
+	return ""
+}
+
+// writeRowGroups writes groups row groups of 100 trades and returns the .tmp
+// file with its size after each of them.
+func writeRowGroups(t *testing.T, w *Writer, groups int) (string, []int64) {
+	t.Helper()
+	var sizes []int64
+	for g := 0; g < groups; g++ {
+		writeTrades(t, w, int64(g*100+1), 100, testHour.Add(time.Duration(g)*100*time.Millisecond))
+		info, err := os.Stat(tradesTmpFile(t, w))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, info.Size())
+	}
+	return tradesTmpFile(t, w), sizes
+}
+
+func TestRecoverSalvagesTornTmpFile(t *testing.T) {
+	tests := []struct {
+		name string
+		// cut is where the file ends, given its size after each row group.
+		cut    func(sizes []int64) int64
+		groups int
+	}{
+		{"after all row groups", func(sizes []int64) int64 { return sizes[2] }, 3},
+		{"after two row groups", func(sizes []int64) int64 { return sizes[1] }, 2},
+		{"mid-page", func(sizes []int64) int64 { return (sizes[1] + sizes[2]) / 2 }, 2},
+		// The trade_id bloom filter ends each row group.
+		{"inside a bloom filter", func(sizes []int64) int64 { return sizes[2] - 16 }, 2},
+		{"after one row group", func(sizes []int64) int64 { return sizes[0] + 3 }, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			w := newTestWriter(cfg)
+			tmpPath, sizes := writeRowGroups(t, w, 3)
+			crash(w)
+			if err := os.Truncate(tmpPath, tt.cut(sizes)); err != nil {
+				t.Fatal(err)
+			}
+
+			checkPath := tmpPath + ".check"
+			groups, listed, err := w.salvageRowGroups("trades", tmpPath, checkPath)
+			if err != nil {
+				t.Fatalf("salvageRowGroups: %v", err)
+			}
+			os.Remove(checkPath)
+			if groups != tt.groups || listed != 3 {
+				t.Errorf("salvaged %d of %d listed row groups, want %d of 3", groups, listed, tt.groups)
+			}
+
+			if err := newTestWriter(cfg).Recover(); err != nil {
+				t.Fatalf("Recover: %v", err)
+			}
+
+			dirs := tradeSegments(t, cfg.Storage.BasePath)
+			if len(dirs) != 1 {
+				t.Fatalf("got segments %v, want one", dirs)
+			}
+			rows := int64(tt.groups * 100)
+			checkTradeIDs(t, readTrades(t, dirs[0]), 1, rows)
+
+			manifest, err := readManifest(dirs[0])
+			if err != nil {
+				t.Fatalf("no manifest after recovery: %v", err)
+			}
+			if !manifest.Recovered {
+				t.Error("manifest is not marked recovered")
+			}
+			if len(manifest.Segment.FileStats) != 1 || manifest.Segment.FileStats[0].Rows != rows {
+				t.Errorf("manifest file stats %+v, want one file of %d rows", manifest.Segment.FileStats, rows)
+			}
+			if leftover, _ := filepath.Glob(filepath.Join(dirs[0], "*.tmp*")); len(leftover) > 0 {
+				t.Errorf("temp files left behind: %v", leftover)
+			}
+		})
+	}
+}
+
+func TestRecoverReplaysWALWithTornTail(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Storage.WAL.Enabled = true
+	w := newTestWriter(cfg)
+
+	// Two row groups are cut; the flush pushes the rest of the 250 rows to
+	// the WAL but not to a row group. The last 5 stay in the WAL's buffer,
+	// which they do not fill.
+	writeTrades(t, w, 1, 250, testHour)
+	if err := w.FlushAll(); err != nil {
+		t.Fatal(err)
+	}
+	writeTrades(t, w, 251, 5, testHour.Add(time.Second))
+
+	var walPath string
+	for _, segment := range w.segments {
+		walPath = segment.WAL.path
+	}
+	crash(w)
+
+	// The process died halfway through writing an entry.
+	wal, err := os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wal.WriteString(`{"channel":"trades","row":{"trade_id":25`); err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+
+	if err := newTestWriter(cfg).Recover(); err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+
+	dirs := tradeSegments(t, cfg.Storage.BasePath)
+	if len(dirs) != 1 {
+		t.Fatalf("got segments %v, want one", dirs)
+	}
+	checkTradeIDs(t, readTrades(t, dirs[0]), 1, 250)
+
+	manifest, err := readManifest(dirs[0])
+	if err != nil {
+		t.Fatalf("no manifest after recovery: %v", err)
+	}
+	if !manifest.Recovered || manifest.Seq == nil {
+		t.Errorf("manifest recovered %v seq %+v, want recovered with seq", manifest.Recovered, manifest.Seq)
+	}
+}
+
+func TestRecoverQuarantinesUnreadableFile(t *testing.T) {
+	cfg := testConfig(t)
+	w := newTestWriter(cfg)
+	writeRowGroups(t, w, 2)
+	crash(w)
+
+	dir := tradeSegments(t, cfg.Storage.BasePath)[0]
+	bogus := filepath.Join(dir, "part-trades-"+testSymbol+"-bogus.parquet")
+	if err := os.WriteFile(bogus, []byte("PAR1 not really"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := newTestWriter(cfg).Recover(); err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+
+	rel, _ := filepath.Rel(cfg.Storage.BasePath, bogus)
+	if _, err := os.Stat(filepath.Join(cfg.Storage.BasePath, quarantineDirName, rel)); err != nil {
+		t.Errorf("unreadable file not quarantined: %v", err)
+	}
+	if _, err := os.Stat(bogus); !os.IsNotExist(err) {
+		t.Errorf("unreadable file still in the segment: %v", err)
+	}
+
+	checkTradeIDs(t, readTrades(t, dir), 1, 200)
+	manifest, err := readManifest(dir)
+	if err != nil {
+		t.Fatalf("no manifest after recovery: %v", err)
+	}
+	for _, name := range manifest.Segment.Files {
+		if strings.Contains(name, "bogus") {
+			t.Errorf("manifest lists the quarantined file: %v", manifest.Segment.Files)
+		}
+	}
+}
+
+func TestRecoverQuarantinesUnrecoverableSegment(t *testing.T) {
+	cfg := testConfig(t)
+	w := newTestWriter(cfg)
+	tmpPath, _ := writeRowGroups(t, w, 1)
+	crash(w)
+
+	// Not even the first row group made it to disk.
+	if err := os.Truncate(tmpPath, 64); err != nil {
+		t.Fatal(err)
+	}
+	dir := tradeSegments(t, cfg.Storage.BasePath)[0]
+
+	if err := newTestWriter(cfg).Recover(); err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("unrecoverable segment left in place: %v", err)
+	}
+	rel, _ := filepath.Rel(cfg.Storage.BasePath, dir)
+	quarantined := filepath.Join(cfg.Storage.BasePath, quarantineDirName, rel)
+	if _, err := os.Stat(filepath.Join(quarantined, filepath.Base(tmpPath))); err != nil {
+		t.Errorf("segment not quarantined with its temp file: %v", err)
+	}
+	if dirs := tradeSegments(t, cfg.Storage.BasePath); len(dirs) != 0 {
+		t.Errorf("segments left after quarantine: %v", dirs)
+	}
+}
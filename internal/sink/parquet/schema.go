@@ -0,0 +1,99 @@
+package parquet
+
+import (
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+	"github.com/parquet-go/parquet-go/encoding"
+
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+const (
+	// sortColumn is declared as the sort order of every row group. Rows
+	// arrive in receive order; one that does not starts a new row group.
+	sortColumn = "recv_ts"
+
+	// bloomFilterBitsPerValue sizes the split block bloom filters for about
+	// a 1% false positive rate.
+	bloomFilterBitsPerValue = 10
+
+	// pageBufferSize caps the uncompressed size of a data page. Smaller pages
+	// let readers skip more of a column chunk through the page index.
+	pageBufferSize = 64 * 1024
+)
+
+// bloomFilterColumns get a bloom filter in every row group of the files that
+// have them.
+var bloomFilterColumns = []string{"order_id", "trade_id"}
+
+// layoutOptions are the writer options every parquet file is written with,
+// whatever its row type. Column and offset indexes are always written by
+// parquet-go.
+func layoutOptions() []parquet.WriterOption {
+	filters := make([]parquet.BloomFilterColumn, len(bloomFilterColumns))
+	for i, column := range bloomFilterColumns {
+		filters[i] = parquet.SplitBlockFilter(bloomFilterBitsPerValue, column)
+	}
+	return []parquet.WriterOption{
+		parquet.SortingWriterConfig(parquet.SortingColumns(parquet.Ascending(sortColumn))),
+		parquet.BloomFilters(filters...),
+		parquet.PageBufferSize(pageBufferSize),
+		parquet.KeyValueMetadata(schema.MetadataSchemaVersion, schema.SchemaVersion),
+	}
+}
+
+// optionalColumns are the logical types and encodings of the optional
+// columns. parquet-go only takes those from the struct tags of non-pointer
+// fields, so the pointer fields of the schema types get theirs here.
+var optionalColumns = map[string]parquet.Node{
+	"sub_id":   parquet.Encoded(parquet.Int(64), &parquet.DeltaBinaryPacked),
+	"seq":      parquet.Encoded(parquet.Int(64), &parquet.DeltaBinaryPacked),
+	"srv_mts":  parquet.Encoded(parquet.Timestamp(parquet.Millisecond), &parquet.DeltaBinaryPacked),
+	"ws_ts":    parquet.Encoded(parquet.Timestamp(parquet.Millisecond), &parquet.DeltaBinaryPacked),
+	"batch_id": parquet.Encoded(parquet.Int(64), &parquet.DeltaBinaryPacked),
+	"line_no":  parquet.Encoded(parquet.Int(64), &parquet.DeltaBinaryPacked),
+	"last_seq": parquet.Encoded(parquet.Int(64), &parquet.DeltaBinaryPacked),
+}
+
+// rowSchema is the schema files of row type T are written with: the schema
+// of T's struct tags, with optionalColumns applied. Columns keep their order,
+// so rows read back with the plain schema of T.
+func rowSchema[T any]() *parquet.Schema {
+	base := parquet.SchemaOf(new(T))
+
+	fields := base.Fields()
+	retyped := make([]parquet.Field, len(fields))
+	for i, field := range fields {
+		if node, ok := optionalColumns[field.Name()]; ok && field.Optional() {
+			field = &retypedField{Field: field, node: parquet.Optional(node)}
+		}
+		retyped[i] = field
+	}
+
+	return parquet.NewSchema(base.Name(), &rowGroup{Node: base, fields: retyped})
+}
+
+// rowGroup is a struct node with some of its fields replaced.
+type rowGroup struct {
+	parquet.Node
+	fields []parquet.Field
+}
+
+func (g *rowGroup) Fields() []parquet.Field { return g.fields }
+
+// retypedField keeps the name and Go value of a struct field but describes
+// the column with node.
+type retypedField struct {
+	parquet.Field
+	node parquet.Node
+}
+
+func (f *retypedField) String() string              { return f.node.String() }
+func (f *retypedField) Type() parquet.Type          { return f.node.Type() }
+func (f *retypedField) Optional() bool              { return f.node.Optional() }
+func (f *retypedField) Repeated() bool              { return f.node.Repeated() }
+func (f *retypedField) Required() bool              { return f.node.Required() }
+func (f *retypedField) Leaf() bool                  { return f.node.Leaf() }
+func (f *retypedField) Fields() []parquet.Field     { return f.node.Fields() }
+func (f *retypedField) Encoding() encoding.Encoding { return f.node.Encoding() }
+func (f *retypedField) Compression() compress.Codec { return f.node.Compression() }
@@ -0,0 +1,37 @@
+package parquet
+
+import (
+	"hash/fnv"
+
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+// shardQueueSize is the number of operations a shard buffers before the
+// callers queuing on it block.
+const shardQueueSize = 1024
+
+// writerShard is a worker goroutine and the Writer whose segments it owns.
+// Operations on the Writer run on the worker in the order they were queued,
+// so the segments of a shard are never written concurrently.
+type writerShard struct {
+	writer *Writer
+	ops    chan func(*Writer)
+	done   chan struct{}
+}
+
+func (s *writerShard) run() {
+	defer close(s.done)
+	for op := range s.ops {
+		op(s.writer)
+	}
+}
+
+// shardIndex picks which of n shards owns the segments of channel and
+// symbol.
+func shardIndex(channel schema.Channel, symbol string, n int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(channel))
+	hash.Write([]byte{0})
+	hash.Write([]byte(symbol))
+	return int(hash.Sum32() % uint32(n))
+}
@@ -0,0 +1,118 @@
+package parquet
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+func TestShardIndex(t *testing.T) {
+	const n = 4
+	used := make(map[int]bool)
+	for i := 0; i < 64; i++ {
+		symbol := fmt.Sprintf("tSYM%dUSD", i)
+		index := shardIndex(schema.ChannelTrades, symbol, n)
+		if index < 0 || index >= n {
+			t.Fatalf("shardIndex(%s) = %d, out of range", symbol, index)
+		}
+		if again := shardIndex(schema.ChannelTrades, symbol, n); again != index {
+			t.Fatalf("shardIndex(%s) moved from %d to %d", symbol, index, again)
+		}
+		used[index] = true
+	}
+	if len(used) != n {
+		t.Errorf("64 symbols use shards %v of %d", used, n)
+	}
+	if shardIndex(schema.ChannelTrades, testSymbol, 1) != 0 {
+		t.Error("a single shard is not shard 0")
+	}
+}
+
+func TestHandlerShardsByChannelAndSymbol(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Performance.WorkerCount = 4
+	h := NewHandler(cfg, zap.NewNop())
+	if len(h.shards) != 4 || h.shards[0].writer != h.writer {
+		t.Fatalf("got %d shards, want 4 with the handler's writer first", len(h.shards))
+	}
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	symbols := make([]string, 8)
+	for i := range symbols {
+		symbols[i] = fmt.Sprintf("tSYM%dUSD", i)
+	}
+	for id := int64(1); id <= 50; id++ {
+		for _, symbol := range symbols {
+			trade := testTrade(id, testHour.Add(time.Duration(id)*time.Millisecond))
+			trade.Symbol = symbol
+			h.HandleTrade(trade)
+		}
+	}
+	for _, symbol := range symbols {
+		ticker := testTicker(testHour)
+		ticker.Symbol = symbol
+		h.HandleTicker(ticker)
+	}
+	// A connection-wide control is written by every shard.
+	h.HandleControl(&schema.Control{
+		CommonFields: schema.CommonFields{ConnID: "conn-1", RecvTS: testHour.Add(time.Second).UnixNano()},
+		Type:         schema.ControlTypeReconnect,
+		Reason:       "wss://a.example/ws/2",
+	})
+
+	// Wait for the queues to drain.
+	if err := h.each(func(*Writer) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	owners := make(map[string]int)
+	used := 0
+	for i, shard := range h.shards {
+		shard.writer.segmentsMutex.RLock()
+		for _, segment := range shard.writer.segments {
+			if want := shardIndex(segment.Channel, segment.Symbol, len(h.shards)); i != want {
+				t.Errorf("%s %s is on shard %d, want %d", segment.Channel, segment.Symbol, i, want)
+			}
+			owners[string(segment.Channel)+" "+segment.Symbol]++
+		}
+		if len(shard.writer.segments) > 0 {
+			used++
+		}
+		shard.writer.segmentsMutex.RUnlock()
+	}
+	if used < 2 {
+		t.Errorf("16 segments all on one shard")
+	}
+	for _, channel := range []schema.Channel{schema.ChannelTrades, schema.ChannelTicker} {
+		for _, symbol := range symbols {
+			if n := owners[string(channel)+" "+symbol]; n != 1 {
+				t.Errorf("%s %s has %d open segments, want one", channel, symbol, n)
+			}
+		}
+	}
+
+	if err := h.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+
+	for _, symbol := range symbols {
+		dirs, err := filepath.Glob(filepath.Join(cfg.Storage.BasePath, "bitfinex", "v2", "trades", symbol, "dt=*", "hour=*", "seg=*"))
+		if err != nil || len(dirs) != 1 {
+			t.Fatalf("got %s segments %v (%v), want one", symbol, dirs, err)
+		}
+		checkTradeIDs(t, readTrades(t, dirs[0]), 1, 50)
+		manifest, err := readManifest(dirs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if manifest.Quality.Reconnects != 1 {
+			t.Errorf("%s recorded %d reconnects, want 1", symbol, manifest.Quality.Reconnects)
+		}
+	}
+}
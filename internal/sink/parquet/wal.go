@@ -0,0 +1,504 @@
+package parquet
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/internal/config"
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+const (
+	walFileName     = "wal.jsonl"
+	walZstdFileName = "wal.jsonl.zst"
+	manifestName    = "manifest.json"
+)
+
+// walEntry is one line of a segment WAL: the channel tells replay which row
+// type to decode.
+type walEntry struct {
+	Channel schema.Channel  `json:"channel"`
+	Row     json.RawMessage `json:"row"`
+}
+
+// walWriter appends every row of a segment to a JSON lines log before the row
+// reaches the parquet writer. Unlike a .tmp parquet file, whatever was flushed
+// to the WAL is still readable after a crash. Entries are buffered until the
+// next flush, on the flush tick or before a row group is cut; a crash loses
+// the ones appended since.
+type walWriter struct {
+	path    string
+	file    *os.File
+	encoder *zstd.Encoder
+	writer  *bufio.Writer
+	mu      sync.Mutex
+
+	// fsync, when set, syncs the WAL before it is closed.
+	fsync *fsyncMetrics
+}
+
+// walName maps storage.wal.compression to the WAL file name.
+func walName(compression string) (string, error) {
+	switch compression {
+	case "zstd":
+		return walZstdFileName, nil
+	case "", "none":
+		return walFileName, nil
+	default:
+		return "", fmt.Errorf("unsupported WAL compression %q", compression)
+	}
+}
+
+func newWALWriter(dirPath string, cfg config.WALConfig) (*walWriter, error) {
+	name, err := walName(cfg.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dirPath, name)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WAL %s: %w", path, err)
+	}
+
+	wal := &walWriter{path: path, file: file}
+
+	var out io.Writer = file
+	if name == walZstdFileName {
+		encoder, err := zstd.NewWriter(file, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to create WAL encoder: %w", err)
+		}
+		wal.encoder = encoder
+		out = encoder
+	}
+	wal.writer = bufio.NewWriter(out)
+
+	return wal, nil
+}
+
+func (wl *walWriter) append(channel schema.Channel, row interface{}) error {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return fmt.Errorf("failed to marshal WAL row: %w", err)
+	}
+
+	line, err := json.Marshal(walEntry{Channel: channel, Row: data})
+	if err != nil {
+		return fmt.Errorf("failed to marshal WAL entry: %w", err)
+	}
+
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+
+	if wl.writer == nil {
+		return fmt.Errorf("WAL %s is closed", wl.path)
+	}
+	if _, err := wl.writer.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to append to WAL %s: %w", wl.path, err)
+	}
+	return nil
+}
+
+// flush pushes buffered entries to the file. For zstd this completes the
+// current block, so everything appended so far survives a crash.
+func (wl *walWriter) flush() error {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+
+	if wl.writer == nil {
+		return nil
+	}
+	if err := wl.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush WAL %s: %w", wl.path, err)
+	}
+	if wl.encoder != nil {
+		if err := wl.encoder.Flush(); err != nil {
+			return fmt.Errorf("failed to flush WAL %s: %w", wl.path, err)
+		}
+	}
+	return nil
+}
+
+// sync makes what has been flushed durable.
+func (wl *walWriter) sync(m *fsyncMetrics) error {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+
+	if wl.writer == nil {
+		return nil
+	}
+	if err := m.syncFile(wl.file); err != nil {
+		return fmt.Errorf("failed to sync WAL %s: %w", wl.path, err)
+	}
+	return nil
+}
+
+func (wl *walWriter) close() error {
+	if err := wl.flush(); err != nil {
+		return err
+	}
+
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+
+	if wl.writer == nil {
+		return nil
+	}
+	wl.writer = nil
+
+	if wl.encoder != nil {
+		if err := wl.encoder.Close(); err != nil {
+			wl.file.Close()
+			return fmt.Errorf("failed to close WAL encoder %s: %w", wl.path, err)
+		}
+	}
+	if wl.fsync != nil {
+		if err := wl.fsync.syncFile(wl.file); err != nil {
+			wl.file.Close()
+			return fmt.Errorf("failed to sync WAL %s: %w", wl.path, err)
+		}
+	}
+	if err := wl.file.Close(); err != nil {
+		return fmt.Errorf("failed to close WAL %s: %w", wl.path, err)
+	}
+	return nil
+}
+
+// findWAL returns the WAL file in dirPath, if any.
+func findWAL(dirPath string) string {
+	for _, name := range []string{walZstdFileName, walFileName} {
+		path := filepath.Join(dirPath, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// readWAL calls fn for every entry of the WAL at path. A torn tail left by a
+// crash ends the read without an error; the entries before it are kept.
+func readWAL(path string, fn func(walEntry) error) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open WAL %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var in io.Reader = file
+	if strings.HasSuffix(path, ".zst") {
+		decoder, err := zstd.NewReader(file, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return 0, fmt.Errorf("failed to create WAL decoder: %w", err)
+		}
+		defer decoder.Close()
+		in = decoder
+	}
+
+	count := 0
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e walEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			break
+		}
+		if err := fn(e); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	// A truncated zstd block surfaces as a read error here; the entries
+	// decoded before it are all we can recover.
+	return count, nil
+}
+
+// decodeWALRow turns a WAL entry back into the row type its channel stores.
+func decodeWALRow(e walEntry) (interface{}, error) {
+	var row interface{}
+	switch e.Channel {
+	case schema.ChannelRawBooks:
+		row = &schema.RawBookEvent{}
+	case schema.ChannelBooks:
+		row = &schema.BookLevel{}
+	case schema.ChannelTrades:
+		row = &schema.Trade{}
+	case schema.ChannelTicker:
+		row = &schema.Ticker{}
+	case schema.ChannelControls:
+		row = &schema.Control{}
+	default:
+		return nil, fmt.Errorf("unknown WAL channel %q", e.Channel)
+	}
+
+	if err := json.Unmarshal(e.Row, row); err != nil {
+		return nil, fmt.Errorf("failed to decode %s WAL row: %w", e.Channel, err)
+	}
+	return row, nil
+}
+
+// replaySegment rebuilds the parquet files of dir from what reached its
+// .tmp files and its WAL. Files that were already renamed into place are kept
+// and their channels skipped in the WAL. The WAL is only flushed on the flush
+// tick, so row groups cut since then can hold rows it never received, while
+// rows still buffered in a parquet writer are only in the WAL. Both are
+// kept: the indexed row groups are salvaged first, then the WAL entries of
+// each channel past the salvaged rows are appended, in the order they were
+// written.
+func (w *Writer) replaySegment(root, dir, walPath string) error {
+	channel, symbol, err := segmentFromPath(root, dir)
+	if err != nil {
+		return err
+	}
+
+	segment := w.newSegment(channel, symbol, dir, time.Time{})
+	segment.Manifest.Recovered = true
+
+	kept, err := w.keepFinished(segment, dir)
+	if err != nil {
+		return err
+	}
+
+	salvaged, err := w.salvageForReplay(segment, dir, kept)
+	if err != nil {
+		return err
+	}
+
+	// Salvaged rows go through the segment's writers first, so each channel
+	// ends up in one file.
+	replayed := make(map[schema.Channel]int64)
+	for _, salvagePath := range salvaged {
+		fileCh := fileChannel(channel, strings.TrimSuffix(filepath.Base(salvagePath), salvageSuffix))
+		writer, err := segment.getOrCreateWriter(fileCh, symbol)
+		if err != nil {
+			return fmt.Errorf("failed to get writer: %w", err)
+		}
+
+		var writeErr error
+		rows, err := scanRows(fileCh, salvagePath, func(row interface{}) {
+			if writeErr != nil {
+				return
+			}
+			segment.observeRecovered(row)
+			writeErr = writer.writeRow(row)
+		})
+		if err == nil {
+			err = writeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to copy salvaged rows of %s: %w", salvagePath, err)
+		}
+		replayed[fileCh] += rows
+	}
+
+	seen := make(map[schema.Channel]int64)
+	count := 0
+	_, err = readWAL(walPath, func(e walEntry) error {
+		if _, exists := kept[e.Channel]; exists {
+			return nil
+		}
+		seen[e.Channel]++
+		if seen[e.Channel] <= replayed[e.Channel] {
+			return nil
+		}
+
+		row, err := decodeWALRow(e)
+		if err != nil {
+			return err
+		}
+		segment.observeRecovered(row)
+
+		writer, err := segment.getOrCreateWriter(e.Channel, symbol)
+		if err != nil {
+			return fmt.Errorf("failed to get writer: %w", err)
+		}
+		count++
+		return writer.writeRow(row)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := w.closeSegment(segment); err != nil {
+		return err
+	}
+	for _, salvagePath := range salvaged {
+		os.Remove(salvagePath)
+	}
+
+	var salvagedRows int64
+	for _, rows := range replayed {
+		salvagedRows += rows
+	}
+	w.logger.Info("Replayed WAL into segment",
+		zap.String("path", dir),
+		zap.String("channel", string(channel)),
+		zap.String("symbol", symbol),
+		zap.Int64("salvaged_rows", salvagedRows),
+		zap.Int("wal_rows", count),
+		zap.Int("kept_files", len(kept)))
+
+	return nil
+}
+
+// salvageForReplay salvages the .tmp files of dir into .salvage files beside
+// them and removes the .tmp files, whose names the segment's writers are
+// about to reuse. It returns the .salvage files to replay. If .salvage files
+// are already there, an earlier recovery stopped after this step: they are
+// used as they are, and the .tmp files, written by that recovery from them
+// and the WAL, are dropped.
+func (w *Writer) salvageForReplay(segment *Segment, dir string, kept map[schema.Channel]struct{}) ([]string, error) {
+	salvaged, err := filepath.Glob(filepath.Join(dir, "*"+salvageSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list salvaged files: %w", err)
+	}
+	tmpFiles, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list temp files: %w", err)
+	}
+	interrupted := len(salvaged) > 0
+
+	for _, tmpPath := range tmpFiles {
+		finalPath := strings.TrimSuffix(tmpPath, ".tmp")
+		fileCh := fileChannel(segment.Channel, filepath.Base(finalPath))
+
+		_, isKept := kept[fileCh]
+		info, err := os.Stat(tmpPath)
+		if !interrupted && !isKept && err == nil && info.Size() > 0 {
+			salvagePath := finalPath + salvageSuffix
+			if _, _, err := w.salvageRowGroups(fileCh, tmpPath, salvagePath); err != nil {
+				// The WAL holds whatever this file had.
+				w.logger.Debug("Nothing to salvage before WAL replay",
+					zap.String("path", tmpPath),
+					zap.Error(err))
+			} else if _, err := scanRows(fileCh, salvagePath, func(interface{}) {}); err != nil {
+				w.logger.Warn("Salvaged file does not read back; replaying the WAL alone",
+					zap.String("path", tmpPath),
+					zap.Error(err))
+				os.Remove(salvagePath)
+			} else {
+				salvaged = append(salvaged, salvagePath)
+			}
+		}
+
+		if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove temp file %s: %w", tmpPath, err)
+		}
+		os.Remove(tmpPath + rowGroupIndexSuffix)
+	}
+	return salvaged, nil
+}
+
+// PruneWAL removes WAL files of finalized segments older than
+// storage.wal.retention_hours. WALs of unfinalized segments are kept for
+// recovery regardless of age.
+func (w *Writer) PruneWAL() error {
+	retention := time.Duration(w.cfg.Storage.WAL.RetentionHours) * time.Hour
+	if retention <= 0 {
+		return nil
+	}
+
+	var dirs []string
+	for _, basePath := range w.basePaths() {
+		found, err := w.segmentDirs(filepath.Join(basePath, "bitfinex", "v2"))
+		if err != nil {
+			return err
+		}
+		dirs = append(dirs, found...)
+	}
+
+	cutoff := time.Now().Add(-retention)
+	for _, dir := range dirs {
+		if _, err := os.Stat(filepath.Join(dir, manifestName)); err != nil {
+			continue
+		}
+
+		walPath := findWAL(dir)
+		if walPath == "" {
+			continue
+		}
+
+		info, err := os.Stat(walPath)
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		if err := os.Remove(walPath); err != nil {
+			w.logger.Warn("Failed to prune WAL", zap.String("path", walPath), zap.Error(err))
+			continue
+		}
+		w.logger.Info("Pruned WAL", zap.String("path", walPath))
+	}
+
+	return nil
+}
+
+// segmentDirs lists every seg=* directory below root that is not currently
+// open in this writer.
+func (w *Writer) segmentDirs(root string) ([]string, error) {
+	w.segmentsMutex.RLock()
+	open := make(map[string]struct{}, len(w.segments))
+	for _, segment := range w.segments {
+		if segment.IsOpen {
+			open[segment.DirPath] = struct{}{}
+		}
+	}
+	w.segmentsMutex.RUnlock()
+
+	dirs := make([]string, 0)
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		// Hidden directories are compaction staging areas.
+		if path != root && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !strings.HasPrefix(d.Name(), "seg=") {
+			return nil
+		}
+		if _, exists := open[path]; !exists {
+			dirs = append(dirs, path)
+		}
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan segments under %s: %w", root, err)
+	}
+	return dirs, nil
+}
+
+func commonFields(row interface{}) *schema.CommonFields {
+	switch v := row.(type) {
+	case *schema.RawBookEvent:
+		return &v.CommonFields
+	case *schema.BookLevel:
+		return &v.CommonFields
+	case *schema.Trade:
+		return &v.CommonFields
+	case *schema.Ticker:
+		return &v.CommonFields
+	case *schema.Control:
+		return &v.CommonFields
+	}
+	return &schema.CommonFields{}
+}
@@ -0,0 +1,110 @@
+package parquet
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/trade-engine/data-controller/internal/config"
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+// walTrades reads the trades logged in the WAL at path.
+func walTrades(t *testing.T, path string) []*schema.Trade {
+	t.Helper()
+	var trades []*schema.Trade
+	_, err := readWAL(path, func(e walEntry) error {
+		row, err := decodeWALRow(e)
+		if err != nil {
+			return err
+		}
+		trades = append(trades, row.(*schema.Trade))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("readWAL: %v", err)
+	}
+	return trades
+}
+
+func TestWALLogsRowsAheadOfParquet(t *testing.T) {
+	for _, tt := range []struct {
+		compression string
+		name        string
+	}{
+		{"zstd", walZstdFileName},
+		{"none", walFileName},
+	} {
+		t.Run(tt.compression, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.Storage.WAL = config.WALConfig{Enabled: true, Compression: tt.compression}
+			w := newTestWriter(cfg)
+
+			// The first row group is cut at row 100, and the WAL is flushed
+			// before it so it never falls behind the parquet file. Its
+			// buffer may have pushed out more since.
+			writeTrades(t, w, 1, 150, testHour)
+			dir := tradeSegments(t, cfg.Storage.BasePath)[0]
+			walPath := filepath.Join(dir, tt.name)
+			if n := len(walTrades(t, walPath)); n < 100 {
+				t.Errorf("WAL holds %d rows after the first row group, want at least 100", n)
+			}
+
+			if err := w.FlushAll(); err != nil {
+				t.Fatal(err)
+			}
+			logged := walTrades(t, walPath)
+			if len(logged) != 150 {
+				t.Fatalf("WAL holds %d rows after a flush, want 150", len(logged))
+			}
+			want := testTrade(150, testHour.Add(149*time.Millisecond))
+			if got := logged[149]; got.TradeID != want.TradeID || got.RecvTS != want.RecvTS ||
+				got.Price != want.Price || *got.Seq != *want.Seq || got.IngestID != w.ingestID {
+				t.Errorf("WAL row %+v does not match the trade written %+v", got, want)
+			}
+
+			closeWriters(t, w)
+			if _, err := os.Stat(walPath); err != nil {
+				t.Errorf("WAL of a closed segment is gone before retention: %v", err)
+			}
+			checkTradeIDs(t, readTrades(t, dir), 1, 150)
+		})
+	}
+}
+
+func TestPruneWALKeepsUnfinishedSegments(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Storage.WAL = config.WALConfig{Enabled: true, Compression: "zstd", RetentionHours: 1}
+
+	// One segment is closed, the other is left by a crash.
+	closed := newTestWriter(cfg)
+	writeTrades(t, closed, 1, 10, testHour)
+	closeWriters(t, closed)
+	crashed := newTestWriter(cfg)
+	writeTrades(t, crashed, 11, 10, testHour.Add(time.Hour))
+	crashed.FlushAll()
+	crash(crashed)
+
+	dirs := tradeSegments(t, cfg.Storage.BasePath)
+	if len(dirs) != 2 {
+		t.Fatalf("got segments %v, want two", dirs)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	for _, dir := range dirs {
+		if err := os.Chtimes(filepath.Join(dir, walZstdFileName), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := newTestWriter(cfg).PruneWAL(); err != nil {
+		t.Fatalf("PruneWAL: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dirs[0], walZstdFileName)); !os.IsNotExist(err) {
+		t.Errorf("WAL of the closed segment was not pruned: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dirs[1], walZstdFileName)); err != nil {
+		t.Errorf("WAL of the unfinished segment was pruned: %v", err)
+	}
+}
@@ -1,15 +1,24 @@
 package parquet
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/format"
 	"go.uber.org/zap"
 
 	"github.com/trade-engine/data-controller/internal/config"
@@ -17,13 +26,57 @@ import (
 )
 
 type Writer struct {
-	cfg            *config.Config
-	logger         *zap.Logger
-	segments       map[string]*Segment
-	segmentsMutex  sync.RWMutex
-	basePath       string
-	segmentSizeMB  int64
-	ingestID       string
+	cfg           *config.Config
+	logger        *zap.Logger
+	segments      map[string]*Segment
+	segmentsMutex sync.RWMutex
+	basePath      string
+	ingestID      string
+	partitionTime PartitionTime
+	durability    Durability
+	fsync         *fsyncMetrics
+
+	// The fields below are shared by the shards of a Writer.
+
+	// endpoints maps connection IDs to the URL they connected to, as seen in
+	// connected and reconnect controls.
+	endpoints      map[string]string
+	endpointsMutex *sync.Mutex
+
+	// catalogMutex serializes appends to the catalogs of the storage roots.
+	catalogMutex *sync.Mutex
+
+	// deltaVersions caches the latest version of each Delta log committed
+	// to, keyed by log directory.
+	deltaVersions map[string]int64
+	deltaMutex    *sync.Mutex
+
+	// watermark is the newest row time seen, in Unix nanoseconds.
+	watermark *atomic.Int64
+}
+
+// expiredSegmentGrace is how long after its hour a segment stays open for
+// late rows before a flush closes it.
+const expiredSegmentGrace = time.Minute
+
+// PartitionTime selects which timestamp places a row in its dt=/hour=
+// partition.
+type PartitionTime string
+
+const (
+	PartitionRecvTime     PartitionTime = "recv"
+	PartitionExchangeTime PartitionTime = "exchange"
+)
+
+func ParsePartitionTime(s string) (PartitionTime, error) {
+	switch pt := PartitionTime(s); pt {
+	case "":
+		return PartitionRecvTime, nil
+	case PartitionRecvTime, PartitionExchangeTime:
+		return pt, nil
+	default:
+		return "", fmt.Errorf("unknown partition time %q", s)
+	}
 }
 
 type Segment struct {
@@ -32,58 +85,177 @@ type Segment struct {
 	Symbol        string
 	StartTime     time.Time
 	EndTime       time.Time
+	Hour          time.Time
+	LastEventTime time.Time
 	DirPath       string
 	Writers       map[string]*ChannelWriter
 	WritersMutex  sync.RWMutex
 	CurrentSizeMB int64
 	Manifest      *schema.SegmentManifest
+	ConnIDs       map[string]struct{}
+	connOrder     []string
+	endpoints     map[string]string
+	fileStats     []schema.FileStats
+	WAL           *walWriter
 	IsOpen        bool
 	Mutex         sync.Mutex
+
+	// storage is cfg.Storage with the override of the segment's channel
+	// applied. It also governs the segment's controls.parquet.
+	storage    config.Storage
+	lastFlush  time.Time
+	durability Durability
+	fsync      *fsyncMetrics
 }
 
 type ChannelWriter struct {
 	FilePath     string
-	Writer       interface{}
+	Writer       rowBatch
 	RowCount     int64
 	LastFlush    time.Time
 	TempFilePath string
+	File         *os.File
 	Mutex        sync.Mutex
+	counter      *countingWriter
+	buf          *bufio.Writer
+	index        *os.File
+	codec        format.CompressionCodec
+	compression  schema.CompressionInfo
+	stats        schema.FileStats
+
+	// Row groups are cut after maxGroupRows rows or once they reach about
+	// maxGroupBytes on disk, whichever comes first.
+	maxGroupRows  int64
+	maxGroupBytes int64
+	groupRows     int64
+	groupStart    int64
+	bytesPerRow   int64
+
+	// lastRecvTS is the recv_ts of the last row written. Row groups declare
+	// recv_ts as their sort order.
+	lastRecvTS int64
+
+	durability Durability
+	fsync      *fsyncMetrics
+
+	// wal is the segment's WAL, flushed before every row group is cut.
+	wal *walWriter
+}
+
+// countingWriter sits between a parquet writer and its file and counts the
+// compressed bytes actually written.
+type countingWriter struct {
+	w io.Writer
+	n atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
 }
 
 type FlushStats struct {
-	Channel     schema.Channel
-	Symbol      string
-	RowCount    int64
-	FileSizeMB  float64
-	Duration    time.Duration
-	Timestamp   time.Time
+	Channel    schema.Channel
+	Symbol     string
+	RowCount   int64
+	FileSizeMB float64
+	Duration   time.Duration
+	Timestamp  time.Time
+}
+
+// basePaths lists the storage roots in use: base_path and those of the
+// per-channel overrides.
+func (w *Writer) basePaths() []string {
+	paths := []string{w.basePath}
+	for _, override := range w.cfg.Storage.Channels {
+		if override.BasePath != "" && !slices.Contains(paths, override.BasePath) {
+			paths = append(paths, override.BasePath)
+		}
+	}
+	return paths
 }
 
 func NewWriter(cfg *config.Config, logger *zap.Logger) *Writer {
+	// Handler.Start rejects unknown modes.
+	durability, _ := ParseDurability(cfg.Storage.Durability)
+	return &Writer{
+		cfg:            cfg,
+		logger:         logger,
+		segments:       make(map[string]*Segment),
+		basePath:       cfg.Storage.BasePath,
+		ingestID:       uuid.New().String(),
+		partitionTime:  PartitionTime(cfg.Storage.PartitionTime),
+		durability:     durability,
+		fsync:          &fsyncMetrics{},
+		endpoints:      make(map[string]string),
+		endpointsMutex: &sync.Mutex{},
+		catalogMutex:   &sync.Mutex{},
+		deltaVersions:  make(map[string]int64),
+		deltaMutex:     &sync.Mutex{},
+		watermark:      &atomic.Int64{},
+	}
+}
+
+// shard returns a Writer with segments of its own that shares w's ingest ID,
+// connection endpoints, catalogs, Delta logs, fsync metrics and watermark.
+// Each (channel, symbol) must only be written through one shard.
+func (w *Writer) shard() *Writer {
 	return &Writer{
-		cfg:           cfg,
-		logger:        logger,
-		segments:      make(map[string]*Segment),
-		basePath:      cfg.Storage.BasePath,
-		segmentSizeMB: int64(cfg.Storage.SegmentSizeMB),
-		ingestID:      uuid.New().String(),
+		cfg:            w.cfg,
+		logger:         w.logger,
+		segments:       make(map[string]*Segment),
+		basePath:       w.basePath,
+		ingestID:       w.ingestID,
+		partitionTime:  w.partitionTime,
+		durability:     w.durability,
+		fsync:          w.fsync,
+		endpoints:      w.endpoints,
+		endpointsMutex: w.endpointsMutex,
+		catalogMutex:   w.catalogMutex,
+		deltaVersions:  w.deltaVersions,
+		deltaMutex:     w.deltaMutex,
+		watermark:      w.watermark,
 	}
 }
 
+// eventTime is the time that partitions a row: the exchange timestamp when
+// partition_time is "exchange" and one was received, else the receive time.
+func (w *Writer) eventTime(fields *schema.CommonFields) time.Time {
+	if w.partitionTime == PartitionExchangeTime {
+		if fields.SrvMTS != nil {
+			return time.UnixMilli(*fields.SrvMTS).UTC()
+		}
+		if fields.WSTS != nil {
+			return time.UnixMilli(*fields.WSTS).UTC()
+		}
+	}
+	if fields.RecvTS > 0 {
+		return time.Unix(0, fields.RecvTS).UTC()
+	}
+	return time.Now().UTC()
+}
+
 func (w *Writer) WriteRawBookEvent(event *schema.RawBookEvent) error {
 	event.IngestID = w.ingestID
 	event.SourceFile = "websocket"
 
-	segment, err := w.getOrCreateSegment(schema.ChannelRawBooks, event.Symbol)
+	segment, err := w.getOrCreateSegment(schema.ChannelRawBooks, event.Symbol, w.eventTime(&event.CommonFields))
 	if err != nil {
 		return fmt.Errorf("failed to get segment: %w", err)
 	}
 
-	writer, err := segment.getOrCreateWriter(schema.ChannelRawBooks, event.Symbol, w.cfg)
+	segment.track(&event.CommonFields)
+
+	writer, err := segment.getOrCreateWriter(schema.ChannelRawBooks, event.Symbol)
 	if err != nil {
 		return fmt.Errorf("failed to get writer: %w", err)
 	}
 
+	if err := segment.appendWAL(schema.ChannelRawBooks, event); err != nil {
+		return err
+	}
+
 	return writer.writeRow(event)
 }
 
@@ -91,16 +263,22 @@ func (w *Writer) WriteBookLevel(level *schema.BookLevel) error {
 	level.IngestID = w.ingestID
 	level.SourceFile = "websocket"
 
-	segment, err := w.getOrCreateSegment(schema.ChannelBooks, level.Symbol)
+	segment, err := w.getOrCreateSegment(schema.ChannelBooks, level.Symbol, w.eventTime(&level.CommonFields))
 	if err != nil {
 		return fmt.Errorf("failed to get segment: %w", err)
 	}
 
-	writer, err := segment.getOrCreateWriter(schema.ChannelBooks, level.Symbol, w.cfg)
+	segment.track(&level.CommonFields)
+
+	writer, err := segment.getOrCreateWriter(schema.ChannelBooks, level.Symbol)
 	if err != nil {
 		return fmt.Errorf("failed to get writer: %w", err)
 	}
 
+	if err := segment.appendWAL(schema.ChannelBooks, level); err != nil {
+		return err
+	}
+
 	return writer.writeRow(level)
 }
 
@@ -108,16 +286,22 @@ func (w *Writer) WriteTrade(trade *schema.Trade) error {
 	trade.IngestID = w.ingestID
 	trade.SourceFile = "websocket"
 
-	segment, err := w.getOrCreateSegment(schema.ChannelTrades, trade.Symbol)
+	segment, err := w.getOrCreateSegment(schema.ChannelTrades, trade.Symbol, w.eventTime(&trade.CommonFields))
 	if err != nil {
 		return fmt.Errorf("failed to get segment: %w", err)
 	}
 
-	writer, err := segment.getOrCreateWriter(schema.ChannelTrades, trade.Symbol, w.cfg)
+	segment.track(&trade.CommonFields)
+
+	writer, err := segment.getOrCreateWriter(schema.ChannelTrades, trade.Symbol)
 	if err != nil {
 		return fmt.Errorf("failed to get writer: %w", err)
 	}
 
+	if err := segment.appendWAL(schema.ChannelTrades, trade); err != nil {
+		return err
+	}
+
 	return writer.writeRow(trade)
 }
 
@@ -125,54 +309,386 @@ func (w *Writer) WriteTicker(ticker *schema.Ticker) error {
 	ticker.IngestID = w.ingestID
 	ticker.SourceFile = "websocket"
 
-	segment, err := w.getOrCreateSegment(schema.ChannelTicker, ticker.Symbol)
+	segment, err := w.getOrCreateSegment(schema.ChannelTicker, ticker.Symbol, w.eventTime(&ticker.CommonFields))
 	if err != nil {
 		return fmt.Errorf("failed to get segment: %w", err)
 	}
 
-	writer, err := segment.getOrCreateWriter(schema.ChannelTicker, ticker.Symbol, w.cfg)
+	segment.track(&ticker.CommonFields)
+
+	writer, err := segment.getOrCreateWriter(schema.ChannelTicker, ticker.Symbol)
 	if err != nil {
 		return fmt.Errorf("failed to get writer: %w", err)
 	}
 
+	if err := segment.appendWAL(schema.ChannelTicker, ticker); err != nil {
+		return err
+	}
+
 	return writer.writeRow(ticker)
 }
 
-func (w *Writer) getOrCreateSegment(channel schema.Channel, symbol string) (*Segment, error) {
-	segmentKey := fmt.Sprintf("%s_%s", channel, symbol)
+// WriteControl appends a control row to controls.parquet of the segment it
+// concerns and updates that segment's quality counters. Connection-wide
+// controls (no channel) go to every open segment fed by that connection.
+func (w *Writer) WriteControl(control *schema.Control) error {
+	control.IngestID = w.ingestID
+	control.SourceFile = "websocket"
+
+	w.noteEndpoint(control)
+
+	segments, err := w.controlSegments(control)
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		segment.recordQuality(control)
+		segment.recordSubscription(control)
+
+		writer, err := segment.getOrCreateWriter(schema.ChannelControls, segment.Symbol)
+		if err != nil {
+			return fmt.Errorf("failed to get writer: %w", err)
+		}
+
+		if err := segment.appendWAL(schema.ChannelControls, control); err != nil {
+			return err
+		}
+
+		if err := writer.writeRow(control); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *Writer) controlSegments(control *schema.Control) ([]*Segment, error) {
+	switch control.Channel {
+	case schema.ChannelTicker, schema.ChannelTrades, schema.ChannelBooks, schema.ChannelRawBooks:
+		if control.Symbol == "" {
+			break
+		}
+		segment, err := w.getOrCreateSegment(control.Channel, control.Symbol, w.eventTime(&control.CommonFields))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get segment: %w", err)
+		}
+		if control.ConnID != "" {
+			segment.trackConn(control.ConnID)
+		}
+		return []*Segment{segment}, nil
+	}
+
+	w.segmentsMutex.RLock()
+	defer w.segmentsMutex.RUnlock()
+
+	// While an hour's segment stays open for late rows, the next hour's may
+	// already be open too; the control goes to the latest of each stream.
+	latest := make(map[string]*Segment)
+	for _, segment := range w.segments {
+		if !segment.IsOpen || !segment.hasConn(control.ConnID) {
+			continue
+		}
+		stream := fmt.Sprintf("%s_%s", segment.Channel, segment.Symbol)
+		if current, exists := latest[stream]; !exists || segment.Hour.After(current.Hour) {
+			latest[stream] = segment
+		}
+	}
+
+	segments := make([]*Segment, 0, len(latest))
+	for _, segment := range latest {
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// appendWAL logs row to the segment WAL, if enabled. It must succeed before the
+// row is handed to the parquet writer.
+func (s *Segment) appendWAL(channel schema.Channel, row interface{}) error {
+	if s.WAL == nil {
+		return nil
+	}
+	return s.WAL.append(channel, row)
+}
+
+func (s *Segment) trackConn(connID string) {
+	s.Mutex.Lock()
+	s.trackConnLocked(connID)
+	s.Mutex.Unlock()
+}
+
+func (s *Segment) trackConnLocked(connID string) {
+	if _, exists := s.ConnIDs[connID]; !exists {
+		s.ConnIDs[connID] = struct{}{}
+		s.connOrder = append(s.connOrder, connID)
+	}
+}
+
+// track records the connection, conf flags, channel and sequence numbers of
+// a data row for the manifest.
+func (s *Segment) track(fields *schema.CommonFields) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	s.trackConnLocked(fields.ConnID)
+
+	manifest := s.Manifest
+	if fields.ConfFlags != 0 {
+		manifest.ConfFlags = fields.ConfFlags
+	}
+	if fields.ChanID != 0 {
+		manifest.ChanID = fields.ChanID
+	}
+	if fields.SubID != nil {
+		manifest.SubID = fields.SubID
+	}
+	if fields.PairOrCurrency != "" {
+		manifest.PairOrCurrency = fields.PairOrCurrency
+	}
+	if fields.Seq != nil {
+		if manifest.Seq == nil {
+			manifest.Seq = &schema.SeqInfo{First: *fields.Seq}
+		}
+		manifest.Seq.Last = *fields.Seq
+	}
+}
+
+// noteEndpoint remembers the URL a connection uses. Connections usually come
+// up before any segment they feed exists.
+func (w *Writer) noteEndpoint(control *schema.Control) {
+	switch control.Type {
+	case schema.ControlTypeConnected, schema.ControlTypeReconnect:
+	default:
+		return
+	}
+	if control.ConnID == "" || control.Reason == "" {
+		return
+	}
+
+	w.endpointsMutex.Lock()
+	w.endpoints[control.ConnID] = control.Reason
+	w.endpointsMutex.Unlock()
+}
+
+func (w *Writer) endpoint(connID string) (string, bool) {
+	w.endpointsMutex.Lock()
+	defer w.endpointsMutex.Unlock()
+
+	url, exists := w.endpoints[connID]
+	return url, exists
+}
+
+// recordSubscription takes the channel ID, subId and book parameters of the
+// segment's subscription from its subscribed control. The book parameters
+// are the prec=, freq= and len= fields of the reason.
+func (s *Segment) recordSubscription(control *schema.Control) {
+	switch control.Type {
+	case schema.ControlTypeConnected, schema.ControlTypeReconnect:
+		s.Mutex.Lock()
+		if control.ConnID != "" && control.Reason != "" {
+			s.endpoints[control.ConnID] = control.Reason
+		}
+		s.Mutex.Unlock()
+		return
+	case schema.ControlTypeSubscribed:
+	default:
+		return
+	}
+
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	manifest := s.Manifest
+	manifest.ChanID = control.ChanID
+	manifest.SubID = control.SubID
+	if control.ConfFlags != 0 {
+		manifest.ConfFlags = control.ConfFlags
+	}
+	if control.PairOrCurrency != "" {
+		manifest.PairOrCurrency = control.PairOrCurrency
+	}
+
+	if control.Channel != schema.ChannelBooks && control.Channel != schema.ChannelRawBooks {
+		return
+	}
+
+	book := &schema.BookSubscription{}
+	for _, field := range strings.Fields(control.Reason) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "prec":
+			book.Prec = value
+		case "freq":
+			book.Freq = value
+		case "len":
+			book.Len, _ = strconv.Atoi(value)
+		}
+	}
+	if book.Prec != "" {
+		manifest.Book = book
+	}
+}
+
+// subscription is the subscription recorded in the footers of the segment's
+// files. It must be called with s.Mutex held.
+func (s *Segment) subscription() schema.Subscription {
+	manifest := s.Manifest
+	return schema.Subscription{
+		Channel:        manifest.Channel,
+		Symbol:         manifest.Symbol,
+		PairOrCurrency: manifest.PairOrCurrency,
+		ChanID:         manifest.ChanID,
+		SubID:          manifest.SubID,
+		ConfFlags:      manifest.ConfFlags,
+		Book:           manifest.Book,
+	}
+}
+
+func (s *Segment) hasConn(connID string) bool {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	_, exists := s.ConnIDs[connID]
+	return exists
+}
+
+func (s *Segment) recordQuality(control *schema.Control) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	switch control.Type {
+	case schema.ControlTypeChecksumMismatch:
+		s.Manifest.Quality.ChecksumMismatch++
+	case schema.ControlTypeHeartbeatMissed:
+		s.Manifest.Quality.HBMissed++
+	case schema.ControlTypeReconnect:
+		s.Manifest.Quality.Reconnects++
+	case schema.ControlTypeDedup:
+		count := int(max(control.Count, 1))
+		if control.Channel == schema.ChannelTrades {
+			s.Manifest.Quality.TradesDedupDropped += count
+		} else {
+			s.Manifest.Quality.BookUpdatesDedupDropped += count
+		}
+	case schema.ControlTypeGap:
+		s.Manifest.Quality.Gaps++
+	case schema.ControlTypeDrop:
+		s.Manifest.Quality.Dropped++
+	}
+}
+
+// getOrCreateSegment returns the open segment of channel and symbol for the
+// UTC hour of eventTime, opening one in that hour's dt=/hour= partition if
+// there is none. Each hour has its own segment, so a row that arrives late
+// for an earlier hour goes to that hour: to its segment while it is still
+// open, else to a new seg= beside the closed ones.
+func (w *Writer) getOrCreateSegment(channel schema.Channel, symbol string, eventTime time.Time) (*Segment, error) {
+	hour := eventTime.UTC().Truncate(time.Hour)
+	segmentKey := fmt.Sprintf("%s_%s_%s", channel, symbol, hour.Format("2006-01-02T15"))
+	w.advanceWatermark(eventTime)
 
 	w.segmentsMutex.RLock()
 	segment, exists := w.segments[segmentKey]
 	w.segmentsMutex.RUnlock()
 
+	if exists && segment.IsOpen && !w.shouldRotate(segment) {
+		segment.observe(eventTime)
+		return segment, nil
+	}
+
+	// Re-check under the write lock so concurrent writers rotate only once.
+	w.segmentsMutex.Lock()
+	defer w.segmentsMutex.Unlock()
+
+	segment, exists = w.segments[segmentKey]
 	if exists && segment.IsOpen {
-		segment.Mutex.Lock()
-		if segment.CurrentSizeMB < w.segmentSizeMB {
-			segment.Mutex.Unlock()
+		if !w.shouldRotate(segment) {
+			segment.observe(eventTime)
 			return segment, nil
 		}
-		segment.Mutex.Unlock()
 
 		if err := w.closeSegment(segment); err != nil {
 			w.logger.Error("Failed to close segment", zap.Error(err))
 		}
 	}
 
-	return w.createNewSegment(channel, symbol, segmentKey)
+	segment, err := w.createNewSegment(channel, symbol, segmentKey, eventTime)
+	if err != nil {
+		return nil, err
+	}
+	segment.observe(eventTime)
+	return segment, nil
 }
 
-func (w *Writer) createNewSegment(channel schema.Channel, symbol string, segmentKey string) (*Segment, error) {
-	now := time.Now().UTC()
+// shouldRotate reports whether segment has reached its segment_size_mb. A
+// segment's hour ending does not rotate it: closeExpiredSegments closes it
+// once late rows for the hour are no longer expected.
+func (w *Writer) shouldRotate(segment *Segment) bool {
+	if segment.storage.SegmentSizeMB <= 0 {
+		return false
+	}
+	return segment.sizeBytes() >= int64(segment.storage.SegmentSizeMB)*1024*1024
+}
 
-	dirName := fmt.Sprintf("seg=%s--%s--size~%dMB",
-		now.Format("2006-01-02T15:04:05Z"),
-		now.Add(time.Hour).Format("2006-01-02T15:04:05Z"),
-		w.segmentSizeMB)
+// observe records eventTime as the latest row time seen by the segment.
+func (s *Segment) observe(eventTime time.Time) {
+	s.Mutex.Lock()
+	if eventTime.After(s.LastEventTime) {
+		s.LastEventTime = eventTime
+	}
+	s.Mutex.Unlock()
+}
+
+// sizeBytes is the compressed size of the segment's parquet files so far.
+// Rows still buffered in a writer are not counted until they are flushed.
+func (s *Segment) sizeBytes() int64 {
+	s.WritersMutex.RLock()
+	defer s.WritersMutex.RUnlock()
+
+	var total int64
+	for _, writer := range s.Writers {
+		total += writer.counter.n.Load()
+	}
+	return total
+}
+
+func (s *Segment) updateSize() int64 {
+	size := s.sizeBytes()
 
-	dirPath := filepath.Join(w.basePath, "bitfinex", "v2", string(channel), symbol,
-		fmt.Sprintf("dt=%s", now.Format("2006-01-02")),
-		fmt.Sprintf("hour=%02d", now.Hour()),
-		dirName)
+	s.Mutex.Lock()
+	s.CurrentSizeMB = size / (1024 * 1024)
+	s.Mutex.Unlock()
+
+	return size
+}
+
+// createNewSegment must be called with segmentsMutex held. The segment is
+// placed in the dt=/hour= partition of start and ends at the next hour.
+func (w *Writer) createNewSegment(channel schema.Channel, symbol string, segmentKey string, start time.Time) (*Segment, error) {
+	start = start.UTC()
+	hour := start.Truncate(time.Hour)
+	storage := w.cfg.Storage.ForChannel(string(channel))
+
+	dirName := fmt.Sprintf("seg=%s--%s--size~%dMB",
+		start.Format("2006-01-02T15:04:05Z"),
+		hour.Add(time.Hour).Format("2006-01-02T15:04:05Z"),
+		storage.SegmentSizeMB)
+
+	partitionPath := filepath.Join(storage.BasePath, "bitfinex", "v2", string(channel), symbol,
+		fmt.Sprintf("dt=%s", hour.Format("2006-01-02")),
+		fmt.Sprintf("hour=%02d", hour.Hour()))
+
+	// Size rotation can open several segments within one second.
+	dirPath := filepath.Join(partitionPath, dirName)
+	for n := 1; ; n++ {
+		if _, err := os.Stat(dirPath); os.IsNotExist(err) {
+			break
+		}
+		dirPath = filepath.Join(partitionPath, fmt.Sprintf("%s--%d", dirName, n))
+	}
 
 	w.logger.Info("Creating new segment directory",
 		zap.String("path", dirPath),
@@ -188,46 +704,67 @@ func (w *Writer) createNewSegment(channel schema.Channel, symbol string, segment
 
 	w.logger.Info("Successfully created directory", zap.String("path", dirPath))
 
-	segment := &Segment{
-		ID:        uuid.New().String(),
-		Channel:   channel,
-		Symbol:    symbol,
-		StartTime: now,
-		DirPath:   dirPath,
-		Writers:   make(map[string]*ChannelWriter),
-		IsOpen:    true,
+	segment := w.newSegment(channel, symbol, dirPath, start)
+	segment.Hour = hour
+
+	if w.cfg.Storage.WAL.Enabled {
+		wal, err := newWALWriter(dirPath, w.cfg.Storage.WAL)
+		if err != nil {
+			return nil, err
+		}
+		if w.durability != DurabilityNone {
+			wal.fsync = w.fsync
+		}
+		segment.WAL = wal
+	}
+
+	w.segments[segmentKey] = segment
+
+	w.logger.Info("Created new segment",
+		zap.String("segment_id", segment.ID),
+		zap.String("channel", string(channel)),
+		zap.String("symbol", symbol),
+		zap.String("path", dirPath))
+
+	return segment, nil
+}
+
+func (w *Writer) newSegment(channel schema.Channel, symbol string, dirPath string, start time.Time) *Segment {
+	storage := w.cfg.Storage.ForChannel(string(channel))
+	return &Segment{
+		ID:         uuid.New().String(),
+		Channel:    channel,
+		Symbol:     symbol,
+		StartTime:  start,
+		DirPath:    dirPath,
+		Writers:    make(map[string]*ChannelWriter),
+		ConnIDs:    make(map[string]struct{}),
+		endpoints:  make(map[string]string),
+		IsOpen:     true,
+		storage:    storage,
+		lastFlush:  time.Now(),
+		durability: w.durability,
+		fsync:      w.fsync,
 		Manifest: &schema.SegmentManifest{
-			SchemaVersion:  "bfx.v1",
+			SchemaVersion:  schema.SchemaVersion,
 			Exchange:       "bitfinex",
 			Channel:        string(channel),
 			Symbol:         symbol,
 			PairOrCurrency: symbol,
-			WSURL:          "wss://api-pub.bitfinex.com/ws/2",
-			ConnID:         w.ingestID,
+			WSURL:          w.cfg.WebSocket.URL,
+			IngestID:       w.ingestID,
 			ConfFlags:      w.cfg.WebSocket.ConfFlags,
 			Segment: schema.SegmentInfo{
-				BytesTarget: w.segmentSizeMB * 1024 * 1024,
-				UTCStart:    now,
+				BytesTarget: int64(storage.SegmentSizeMB) * 1024 * 1024,
+				UTCStart:    start,
 				Files:       make([]string, 0),
 			},
 			Quality: schema.QualityMetrics{},
 		},
 	}
-
-	w.segmentsMutex.Lock()
-	w.segments[segmentKey] = segment
-	w.segmentsMutex.Unlock()
-
-	w.logger.Info("Created new segment",
-		zap.String("segment_id", segment.ID),
-		zap.String("channel", string(channel)),
-		zap.String("symbol", symbol),
-		zap.String("path", dirPath))
-
-	return segment, nil
 }
 
-func (s *Segment) getOrCreateWriter(channel schema.Channel, symbol string, cfg *config.Config) (*ChannelWriter, error) {
+func (s *Segment) getOrCreateWriter(channel schema.Channel, symbol string) (*ChannelWriter, error) {
 	writerKey := fmt.Sprintf("%s_%s", channel, symbol)
 
 	s.WritersMutex.RLock()
@@ -238,121 +775,217 @@ func (s *Segment) getOrCreateWriter(channel schema.Channel, symbol string, cfg *
 		return writer, nil
 	}
 
-	return s.createNewWriter(channel, symbol, cfg, writerKey)
+	if !s.IsOpen {
+		return nil, fmt.Errorf("segment %s is closed", s.DirPath)
+	}
+
+	return s.createNewWriter(channel, symbol, writerKey)
 }
 
-func (s *Segment) createNewWriter(channel schema.Channel, symbol string, cfg *config.Config, writerKey string) (*ChannelWriter, error) {
+func (s *Segment) createNewWriter(channel schema.Channel, symbol string, writerKey string) (*ChannelWriter, error) {
+	s.WritersMutex.Lock()
+	defer s.WritersMutex.Unlock()
+
+	if writer, exists := s.Writers[writerKey]; exists {
+		return writer, nil
+	}
+
 	now := time.Now().UTC()
 	filename := fmt.Sprintf("part-%s-%s-%s-seq.parquet",
 		channel, symbol, now.Format("20060102T150405Z"))
+	if channel == schema.ChannelControls {
+		filename = "controls.parquet"
+	}
 
 	filePath := filepath.Join(s.DirPath, filename)
 	tempFilePath := filePath + ".tmp"
 
-	// Use basic compression options
-	var compressionOpt parquet.WriterOption
-	switch cfg.Storage.Compression {
-	case "zstd":
-		compressionOpt = parquet.Compression(&parquet.Zstd)
-	case "gzip":
-		compressionOpt = parquet.Compression(&parquet.Gzip)
-	case "snappy":
-		compressionOpt = parquet.Compression(&parquet.Snappy)
-	default:
-		compressionOpt = parquet.Compression(&parquet.Zstd)
+	codec, compression, err := newCodec(s.storage.Compression, s.storage.CompressionLevel)
+	if err != nil {
+		return nil, err
 	}
+	compressionOpt := parquet.Compression(codec)
+	// Buffering is done here instead of inside the parquet writer, so a row
+	// group can be pushed to the file as soon as it is cut.
+	bufferOpt := parquet.WriteBufferSize(0)
+	ingestOpt := parquet.KeyValueMetadata(schema.MetadataIngestID, s.Manifest.IngestID)
 
 	file, err := os.Create(tempFilePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create temp file %s: %w", tempFilePath, err)
 	}
 
-	var parquetWriter interface{}
+	index, err := os.Create(tempFilePath + rowGroupIndexSuffix)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to create row group index: %w", err)
+	}
+
+	buf := bufio.NewWriterSize(file, 256*1024)
+	counter := &countingWriter{w: buf}
+
+	var rows rowBatch
 	switch channel {
 	case schema.ChannelRawBooks:
-		parquetWriter = parquet.NewGenericWriter[schema.RawBookEvent](file, compressionOpt)
+		rows = newBatch[schema.RawBookEvent](counter, compressionOpt, bufferOpt, ingestOpt)
 	case schema.ChannelBooks:
-		parquetWriter = parquet.NewGenericWriter[schema.BookLevel](file, compressionOpt)
+		rows = newBatch[schema.BookLevel](counter, compressionOpt, bufferOpt, ingestOpt)
 	case schema.ChannelTrades:
-		parquetWriter = parquet.NewGenericWriter[schema.Trade](file, compressionOpt)
+		rows = newBatch[schema.Trade](counter, compressionOpt, bufferOpt, ingestOpt)
 	case schema.ChannelTicker:
-		parquetWriter = parquet.NewGenericWriter[schema.Ticker](file, compressionOpt)
+		rows = newBatch[schema.Ticker](counter, compressionOpt, bufferOpt, ingestOpt)
+	case schema.ChannelControls:
+		rows = newBatch[schema.Control](counter, compressionOpt, bufferOpt, ingestOpt)
 	default:
 		file.Close()
+		index.Close()
 		return nil, fmt.Errorf("unsupported channel type: %s", channel)
 	}
 
 	writer := &ChannelWriter{
-		FilePath:     filePath,
-		TempFilePath: tempFilePath,
-		Writer:       parquetWriter,
-		LastFlush:    now,
+		FilePath:      filePath,
+		TempFilePath:  tempFilePath,
+		Writer:        rows,
+		File:          file,
+		LastFlush:     now,
+		counter:       counter,
+		buf:           buf,
+		index:         index,
+		codec:         codec.CompressionCodec(),
+		compression:   compression,
+		maxGroupRows:  int64(s.storage.Parquet.FlushRowCount),
+		maxGroupBytes: int64(s.storage.Parquet.RowGroupSizeMB) * 1024 * 1024,
+		durability:    s.durability,
+		fsync:         s.fsync,
+		wal:           s.WAL,
 	}
 
-	s.WritersMutex.Lock()
 	s.Writers[writerKey] = writer
-	s.WritersMutex.Unlock()
 
 	return writer, nil
 }
 
+// writeRow buffers data and writes it out in batches. Rows only reach the
+// file when a row group is cut; until then the WAL is what keeps them.
 func (cw *ChannelWriter) writeRow(data interface{}) error {
 	cw.Mutex.Lock()
 	defer cw.Mutex.Unlock()
 
-	var err error
-	switch v := data.(type) {
-	case *schema.RawBookEvent:
-		if w, ok := cw.Writer.(*parquet.GenericWriter[schema.RawBookEvent]); ok {
-			_, err = w.Write([]schema.RawBookEvent{*v})
+	if cw.Writer == nil {
+		return fmt.Errorf("writer for %s is closed", cw.FilePath)
+	}
+
+	common := commonFields(data)
+	if cw.groupRows > 0 && common.RecvTS < cw.lastRecvTS {
+		// Keep each row group sorted by recv_ts.
+		if err := cw.cutRowGroup(); err != nil {
+			return fmt.Errorf("failed to write row group: %w", err)
 		}
-	case *schema.BookLevel:
-		if w, ok := cw.Writer.(*parquet.GenericWriter[schema.BookLevel]); ok {
-			_, err = w.Write([]schema.BookLevel{*v})
+	}
+	cw.lastRecvTS = common.RecvTS
+
+	if err := cw.Writer.add(data); err != nil {
+		return err
+	}
+	cw.stats.Observe(common)
+	cw.RowCount++
+	cw.groupRows++
+
+	if cw.groupRows >= cw.rowGroupLimit() {
+		if err := cw.cutRowGroup(); err != nil {
+			return fmt.Errorf("failed to write row group: %w", err)
 		}
-	case *schema.Trade:
-		if w, ok := cw.Writer.(*parquet.GenericWriter[schema.Trade]); ok {
-			_, err = w.Write([]schema.Trade{*v})
+		return nil
+	}
+
+	if cw.Writer.buffered() >= writeBatchRows {
+		if err := cw.Writer.write(); err != nil {
+			return fmt.Errorf("failed to write rows: %w", err)
+		}
+	}
+	return nil
+}
+
+// rowGroupLimit is the row count at which the current row group is cut. The
+// size limit is turned into rows using the bytes per row seen in the groups
+// written so far.
+func (cw *ChannelWriter) rowGroupLimit() int64 {
+	limit := cw.maxGroupRows
+	if cw.maxGroupBytes > 0 && cw.bytesPerRow > 0 {
+		bySize := cw.maxGroupBytes / cw.bytesPerRow
+		if bySize < 1 {
+			bySize = 1
 		}
-	case *schema.Ticker:
-		if w, ok := cw.Writer.(*parquet.GenericWriter[schema.Ticker]); ok {
-			_, err = w.Write([]schema.Ticker{*v})
+		if limit <= 0 || bySize < limit {
+			limit = bySize
 		}
-	default:
-		return fmt.Errorf("unsupported data type: %T", data)
+	}
+	if limit <= 0 {
+		limit = defaultRowGroupRows
+	}
+	return limit
+}
+
+// cutRowGroup must be called with cw.Mutex held.
+func (cw *ChannelWriter) cutRowGroup() error {
+	// Rows reach the WAL before the parquet writer, so flushing it first
+	// keeps every row of an indexed row group in the WAL as well.
+	if cw.wal != nil {
+		if err := cw.wal.flush(); err != nil {
+			return err
+		}
+	}
+
+	if err := cw.Writer.cut(); err != nil {
+		return err
+	}
+	if err := cw.buf.Flush(); err != nil {
+		return err
 	}
 
+	// The index lets recovery find this row group if the footer is never
+	// written.
+	entry, err := json.Marshal(rowGroupEntry{Rows: cw.groupRows, Codec: cw.codec})
 	if err != nil {
-		return fmt.Errorf("failed to write row: %w", err)
+		return err
+	}
+	if _, err := cw.index.Write(append(entry, '\n')); err != nil {
+		return fmt.Errorf("failed to write row group index: %w", err)
 	}
 
-	cw.RowCount++
+	written := cw.counter.n.Load()
+	if cw.groupRows > 0 && written > cw.groupStart {
+		cw.bytesPerRow = (written - cw.groupStart) / cw.groupRows
+		if cw.bytesPerRow < 1 {
+			cw.bytesPerRow = 1
+		}
+	}
+	cw.groupStart = written
+	cw.groupRows = 0
+	cw.LastFlush = time.Now()
 	return nil
 }
 
+// flush hands buffered rows to the parquet writer without cutting a row
+// group, so the periodic flush does not leave many small row groups behind.
 func (cw *ChannelWriter) flush() error {
 	cw.Mutex.Lock()
 	defer cw.Mutex.Unlock()
 
 	if cw.Writer != nil {
-		// Type assertion for different writer types
-		switch w := cw.Writer.(type) {
-		case *parquet.GenericWriter[schema.RawBookEvent]:
-			if err := w.Flush(); err != nil {
-				return fmt.Errorf("failed to flush writer: %w", err)
-			}
-		case *parquet.GenericWriter[schema.BookLevel]:
-			if err := w.Flush(); err != nil {
-				return fmt.Errorf("failed to flush writer: %w", err)
-			}
-		case *parquet.GenericWriter[schema.Trade]:
-			if err := w.Flush(); err != nil {
-				return fmt.Errorf("failed to flush writer: %w", err)
-			}
-		case *parquet.GenericWriter[schema.Ticker]:
-			if err := w.Flush(); err != nil {
-				return fmt.Errorf("failed to flush writer: %w", err)
-			}
+		if err := cw.Writer.write(); err != nil {
+			return fmt.Errorf("failed to flush writer: %w", err)
+		}
+	}
+
+	// Only row groups already cut are in the file; with the index they are
+	// what recovery can salvage.
+	if cw.durability == DurabilityOnFlush && cw.File != nil {
+		if err := cw.fsync.syncFile(cw.File); err != nil {
+			return fmt.Errorf("failed to sync file: %w", err)
+		}
+		if err := cw.fsync.syncFile(cw.index); err != nil {
+			return fmt.Errorf("failed to sync row group index: %w", err)
 		}
 	}
 
@@ -360,37 +993,53 @@ func (cw *ChannelWriter) flush() error {
 	return nil
 }
 
+// setMetadata sets a key-value pair of the file's footer.
+func (cw *ChannelWriter) setMetadata(key, value string) {
+	cw.Mutex.Lock()
+	defer cw.Mutex.Unlock()
+
+	if cw.Writer != nil {
+		cw.Writer.setMetadata(key, value)
+	}
+}
+
 func (cw *ChannelWriter) close() error {
 	cw.Mutex.Lock()
 	defer cw.Mutex.Unlock()
 
 	if cw.Writer != nil {
-		// Type assertion for different writer types
-		switch w := cw.Writer.(type) {
-		case *parquet.GenericWriter[schema.RawBookEvent]:
-			if err := w.Close(); err != nil {
-				return fmt.Errorf("failed to close writer: %w", err)
-			}
-		case *parquet.GenericWriter[schema.BookLevel]:
-			if err := w.Close(); err != nil {
-				return fmt.Errorf("failed to close writer: %w", err)
-			}
-		case *parquet.GenericWriter[schema.Trade]:
-			if err := w.Close(); err != nil {
-				return fmt.Errorf("failed to close writer: %w", err)
-			}
-		case *parquet.GenericWriter[schema.Ticker]:
-			if err := w.Close(); err != nil {
-				return fmt.Errorf("failed to close writer: %w", err)
-			}
+		if err := cw.Writer.close(); err != nil {
+			return fmt.Errorf("failed to close writer: %w", err)
 		}
 		cw.Writer = nil
+
+		if err := cw.buf.Flush(); err != nil {
+			return fmt.Errorf("failed to flush file: %w", err)
+		}
+	}
+
+	if cw.File != nil {
+		if cw.durability != DurabilityNone {
+			if err := cw.fsync.syncFile(cw.File); err != nil {
+				return fmt.Errorf("failed to sync file: %w", err)
+			}
+		}
+		if err := cw.File.Close(); err != nil {
+			return fmt.Errorf("failed to close file: %w", err)
+		}
+		cw.File = nil
 	}
 
 	if err := os.Rename(cw.TempFilePath, cw.FilePath); err != nil {
 		return fmt.Errorf("failed to rename temp file: %w", err)
 	}
 
+	if cw.index != nil {
+		cw.index.Close()
+		os.Remove(cw.index.Name())
+		cw.index = nil
+	}
+
 	return nil
 }
 
@@ -398,30 +1047,80 @@ func (w *Writer) closeSegment(segment *Segment) error {
 	segment.Mutex.Lock()
 	defer segment.Mutex.Unlock()
 
-	segment.EndTime = time.Now().UTC()
+	if !segment.IsOpen {
+		return nil
+	}
+
+	// UTCEnd is the time of the last row; replayed segments set it directly.
+	if segment.EndTime.IsZero() {
+		segment.EndTime = segment.LastEventTime
+	}
+	if segment.EndTime.IsZero() {
+		segment.EndTime = time.Now().UTC()
+	}
 	segment.IsOpen = false
 
+	subscription, err := json.Marshal(segment.subscription())
+	if err != nil {
+		return fmt.Errorf("failed to marshal subscription: %w", err)
+	}
+
 	segment.WritersMutex.Lock()
 	for _, writer := range segment.Writers {
+		writer.setMetadata(schema.MetadataSubscription, string(subscription))
 		if err := writer.close(); err != nil {
 			w.logger.Error("Failed to close writer", zap.Error(err))
 		}
 
 		filename := filepath.Base(writer.FilePath)
 		segment.Manifest.Segment.Files = append(segment.Manifest.Segment.Files, filename)
+
+		stats := writer.stats
+		stats.Name = filename
+		compression := writer.compression
+		stats.Compression = &compression
+		segment.fileStats = append(segment.fileStats, stats)
 	}
 	segment.WritersMutex.Unlock()
 
+	if segment.WAL != nil {
+		if err := segment.WAL.close(); err != nil {
+			w.logger.Error("Failed to close WAL", zap.Error(err))
+		}
+	}
+
 	segment.Manifest.Segment.UTCEnd = segment.EndTime
+	w.completeManifest(segment)
+	segment.CurrentSizeMB = segment.Manifest.Segment.Bytes / (1024 * 1024)
 
-	manifestPath := filepath.Join(segment.DirPath, "manifest.json")
-	manifestData, err := json.MarshalIndent(segment.Manifest, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal manifest: %w", err)
+	manifestPath := filepath.Join(segment.DirPath, manifestName)
+	if err := w.writeManifest(segment.DirPath, segment.Manifest); err != nil {
+		return err
 	}
 
-	if err := os.WriteFile(manifestPath, manifestData, 0644); err != nil {
-		return fmt.Errorf("failed to write manifest: %w", err)
+	// The segment directory and the partitions above it may be new.
+	if w.durability != DurabilityNone {
+		if err := w.fsync.syncDirs(filepath.Dir(segment.DirPath), segment.storage.BasePath); err != nil {
+			w.logger.Error("Failed to sync segment directories", zap.Error(err))
+		}
+	}
+
+	// The manifest is authoritative; a segment missing from the catalog is
+	// picked up again by a rebuild. Compacted segments are written to a
+	// staging directory and cataloged once they are swapped into place.
+	if segment.Manifest.Compaction == nil {
+		if err := w.appendCatalog(segment.storage.BasePath, segment.DirPath, segment.Manifest); err != nil {
+			w.logger.Error("Failed to update catalog",
+				zap.String("segment_id", segment.ID),
+				zap.Error(err))
+		}
+		if w.cfg.Storage.Delta.Enabled {
+			if err := w.commitSegmentToDelta(segment); err != nil {
+				w.logger.Error("Failed to commit segment to delta table",
+					zap.String("segment_id", segment.ID),
+					zap.Error(err))
+			}
+		}
 	}
 
 	w.logger.Info("Closed segment",
@@ -434,7 +1133,89 @@ func (w *Writer) closeSegment(segment *Segment) error {
 	return nil
 }
 
+// completeManifest fills in what is only known once the segment's files are
+// final: their sizes and digests, and the connections that fed the segment.
+// It must be called with segment.Mutex held.
+func (w *Writer) completeManifest(segment *Segment) {
+	manifest := segment.Manifest
+
+	manifest.Segment.Bytes = 0
+	manifest.Segment.FileStats = make([]schema.FileStats, 0, len(segment.fileStats))
+	for _, stats := range segment.fileStats {
+		path := filepath.Join(segment.DirPath, stats.Name)
+		size, digest, err := fileDigest(path)
+		if err != nil {
+			w.logger.Error("Failed to hash segment file", zap.String("path", path), zap.Error(err))
+		}
+		stats.Bytes = size
+		stats.SHA256 = digest
+		manifest.Segment.Bytes += size
+		manifest.Segment.FileStats = append(manifest.Segment.FileStats, stats)
+	}
+
+	manifest.ConnIDs = append([]string(nil), segment.connOrder...)
+	if len(manifest.ConnIDs) > 0 {
+		manifest.ConnID = manifest.ConnIDs[0]
+	}
+
+	// Endpoints already in the manifest, as carried over by compaction, are
+	// kept.
+	known := manifest.Endpoints
+	manifest.Endpoints = make([]string, 0)
+	seen := make(map[string]struct{})
+	for _, url := range known {
+		if _, dup := seen[url]; !dup {
+			seen[url] = struct{}{}
+			manifest.Endpoints = append(manifest.Endpoints, url)
+		}
+	}
+	for _, connID := range segment.connOrder {
+		url, exists := segment.endpoints[connID]
+		if !exists {
+			url, exists = w.endpoint(connID)
+		}
+		if !exists {
+			continue
+		}
+		if _, dup := seen[url]; !dup {
+			seen[url] = struct{}{}
+			manifest.Endpoints = append(manifest.Endpoints, url)
+		}
+	}
+	if len(manifest.Endpoints) > 0 {
+		manifest.WSURL = manifest.Endpoints[0]
+	}
+}
+
+func fileDigest(path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return size, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// FlushAll flushes the WAL and writers of every segment.
 func (w *Writer) FlushAll() error {
+	return w.flushSegments(true)
+}
+
+// FlushDue flushes the segments whose flush_interval has passed since they
+// were last flushed.
+func (w *Writer) FlushDue() error {
+	return w.flushSegments(false)
+}
+
+func (w *Writer) flushSegments(all bool) error {
+	now := time.Now()
+
 	w.segmentsMutex.RLock()
 	segments := make([]*Segment, 0, len(w.segments))
 	for _, segment := range w.segments {
@@ -443,6 +1224,16 @@ func (w *Writer) FlushAll() error {
 	w.segmentsMutex.RUnlock()
 
 	for _, segment := range segments {
+		segment.Mutex.Lock()
+		due := all || now.Sub(segment.lastFlush) >= segment.storage.Parquet.FlushInterval
+		if due {
+			segment.lastFlush = now
+		}
+		segment.Mutex.Unlock()
+		if !due {
+			continue
+		}
+
 		segment.WritersMutex.RLock()
 		writers := make([]*ChannelWriter, 0, len(segment.Writers))
 		for _, writer := range segment.Writers {
@@ -450,16 +1241,70 @@ func (w *Writer) FlushAll() error {
 		}
 		segment.WritersMutex.RUnlock()
 
+		// The WAL goes first so it is never behind the parquet files.
+		if segment.WAL != nil {
+			if err := segment.WAL.flush(); err != nil {
+				w.logger.Error("Failed to flush WAL", zap.Error(err))
+			} else if w.durability == DurabilityOnFlush {
+				if err := segment.WAL.sync(w.fsync); err != nil {
+					w.logger.Error("Failed to sync WAL", zap.Error(err))
+				}
+			}
+		}
+
 		for _, writer := range writers {
 			if err := writer.flush(); err != nil {
 				w.logger.Error("Failed to flush writer", zap.Error(err))
 			}
 		}
+
+		segment.updateSize()
 	}
 
+	w.closeExpiredSegments()
+
 	return nil
 }
 
+// advanceWatermark raises the watermark to eventTime.
+func (w *Writer) advanceWatermark(eventTime time.Time) {
+	nanos := eventTime.UnixNano()
+	for {
+		current := w.watermark.Load()
+		if nanos <= current || w.watermark.CompareAndSwap(current, nanos) {
+			return
+		}
+	}
+}
+
+// closeExpiredSegments finalizes segments whose hour ended more than
+// expiredSegmentGrace before the newest row written by any shard, so a quiet
+// symbol does not keep an old hour open until its next row. Going by row time
+// rather than the wall clock keeps replays of old tapes from closing live
+// segments.
+func (w *Writer) closeExpiredSegments() {
+	w.segmentsMutex.Lock()
+	defer w.segmentsMutex.Unlock()
+
+	watermark := w.watermark.Load()
+	if watermark == 0 {
+		return
+	}
+	cutoff := time.Unix(0, watermark).UTC().Add(-expiredSegmentGrace)
+
+	for key, segment := range w.segments {
+		if segment.Hour.IsZero() || segment.Hour.Add(time.Hour).After(cutoff) {
+			continue
+		}
+		if err := w.closeSegment(segment); err != nil {
+			w.logger.Error("Failed to close expired segment", zap.Error(err))
+		}
+		// Segments are kept per hour; drop finished hours so the map does
+		// not grow with uptime.
+		delete(w.segments, key)
+	}
+}
+
 func (w *Writer) Close() error {
 	w.segmentsMutex.RLock()
 	segments := make([]*Segment, 0, len(w.segments))
@@ -484,25 +1329,29 @@ func (w *Writer) GetStats() map[string]interface{} {
 	stats := map[string]interface{}{
 		"segments_count": len(w.segments),
 		"ingest_id":      w.ingestID,
+		"durability":     string(w.durability),
+		"fsync":          w.fsync.stats(),
 		"segments":       make([]map[string]interface{}, 0),
 	}
 
 	for _, segment := range w.segments {
+		segment.Mutex.Lock()
 		segment.WritersMutex.RLock()
 		segmentStats := map[string]interface{}{
-			"id":           segment.ID,
-			"channel":      string(segment.Channel),
-			"symbol":       segment.Symbol,
-			"start_time":   segment.StartTime,
-			"end_time":     segment.EndTime,
-			"is_open":      segment.IsOpen,
-			"writers_count": len(segment.Writers),
+			"id":              segment.ID,
+			"channel":         string(segment.Channel),
+			"symbol":          segment.Symbol,
+			"start_time":      segment.StartTime,
+			"end_time":        segment.EndTime,
+			"is_open":         segment.IsOpen,
+			"writers_count":   len(segment.Writers),
 			"current_size_mb": segment.CurrentSizeMB,
 		}
 		segment.WritersMutex.RUnlock()
+		segment.Mutex.Unlock()
 
 		stats["segments"] = append(stats["segments"].([]map[string]interface{}), segmentStats)
 	}
 
 	return stats
-}
\ No newline at end of file
+}
@@ -0,0 +1,533 @@
+package parquet
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/internal/config"
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+const testSymbol = "tBTCUSD"
+
+// testHour is the hour the test rows are received in.
+var testHour = time.Date(2025, 1, 2, 3, 0, 0, 0, time.UTC)
+
+// testConfig stores under a temp dir and cuts a row group every 100 rows.
+// Flushes only happen when a test asks for them.
+func testConfig(t *testing.T) *config.Config {
+	t.Helper()
+	return &config.Config{Storage: config.Storage{
+		BasePath: t.TempDir(),
+		Parquet:  config.ParquetConfig{FlushRowCount: 100, FlushInterval: time.Hour},
+	}}
+}
+
+func newTestWriter(cfg *config.Config) *Writer {
+	return NewWriter(cfg, zap.NewNop())
+}
+
+// testTrade is a trade of testSymbol with ID id received at recv.
+func testTrade(id int64, recv time.Time) *schema.Trade {
+	mts := recv.UnixMilli()
+	seq := id
+	return &schema.Trade{
+		CommonFields: schema.CommonFields{
+			Exchange:       schema.ExchangeBitfinex,
+			Channel:        schema.ChannelTrades,
+			Symbol:         testSymbol,
+			PairOrCurrency: "BTCUSD",
+			ConnID:         "conn-1",
+			ChanID:         17,
+			Seq:            &seq,
+			RecvTS:         recv.UnixNano(),
+			SrvMTS:         &mts,
+		},
+		TradeID: id,
+		MTS:     mts,
+		Amount:  0.01 * float64(id%7+1),
+		Price:   95000 + float64(id%50),
+		MsgType: schema.MessageTypeTE,
+	}
+}
+
+// writeTrades writes trades first to first+n-1, one millisecond apart from
+// start.
+func writeTrades(t *testing.T, w *Writer, first int64, n int, start time.Time) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		id := first + int64(i)
+		if err := w.WriteTrade(testTrade(id, start.Add(time.Duration(i)*time.Millisecond))); err != nil {
+			t.Fatalf("WriteTrade %d: %v", id, err)
+		}
+	}
+}
+
+// crash leaves the open segments of w as a killed process would: their .tmp
+// files, row group indexes and WALs hold what was written out to them, and
+// whatever was still buffered in memory is lost.
+func crash(w *Writer) {
+	for _, segment := range w.segments {
+		for _, cw := range segment.Writers {
+			cw.File.Close()
+			cw.index.Close()
+		}
+		if segment.WAL != nil {
+			segment.WAL.file.Close()
+		}
+	}
+}
+
+// tradeSegments lists the trades segment directories of testSymbol under
+// root.
+func tradeSegments(t *testing.T, root string) []string {
+	t.Helper()
+	return channelSegments(t, root, schema.ChannelTrades)
+}
+
+// channelSegments lists the segment directories of channel under root, in
+// name order.
+func channelSegments(t *testing.T, root string, channel schema.Channel) []string {
+	t.Helper()
+	dirs, err := filepath.Glob(filepath.Join(root, "bitfinex", "v2", string(channel), testSymbol, "dt=*", "hour=*", "seg=*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// readTrades reads the trades files of the segment in dir back with
+// parquet-go, which fails on anything that is not a complete parquet file.
+func readTrades(t *testing.T, dir string) []schema.Trade {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "part-trades-*.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var trades []schema.Trade
+	for _, path := range files {
+		rows, err := parquet.ReadFile[schema.Trade](path)
+		if err != nil {
+			t.Fatalf("%s does not read back: %v", path, err)
+		}
+		trades = append(trades, rows...)
+	}
+	return trades
+}
+
+// checkTradeIDs fails unless trades are exactly the IDs first to last, in
+// order.
+func checkTradeIDs(t *testing.T, trades []schema.Trade, first, last int64) {
+	t.Helper()
+	if want := int(last - first + 1); len(trades) != want {
+		t.Fatalf("got %d trades, want %d (IDs %d-%d)", len(trades), want, first, last)
+	}
+	for i, trade := range trades {
+		if want := first + int64(i); trade.TradeID != want {
+			t.Fatalf("trade %d has ID %d, want %d", i, trade.TradeID, want)
+		}
+	}
+}
+
+// testTicker is a ticker of testSymbol received at recv.
+func testTicker(recv time.Time) *schema.Ticker {
+	return &schema.Ticker{
+		CommonFields: schema.CommonFields{
+			Exchange: schema.ExchangeBitfinex,
+			Channel:  schema.ChannelTicker,
+			Symbol:   testSymbol,
+			ConnID:   "conn-1",
+			RecvTS:   recv.UnixNano(),
+		},
+		Bid: 100,
+		Ask: 101,
+	}
+}
+
+// readCatalog reads the catalog entries of root.
+func readCatalog(t *testing.T, root string) []schema.CatalogEntry {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(root, catalogName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []schema.CatalogEntry
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		var entry schema.CatalogEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("catalog line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestSegmentRotatesAtSize(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Storage.SegmentSizeMB = 1
+	cfg.Storage.Parquet.FlushRowCount = 1000
+	w := newTestWriter(cfg)
+
+	// Random prices and amounts keep the rows from compressing away.
+	rng := rand.New(rand.NewSource(1))
+	var written int64
+	for written < 200000 && len(tradeSegments(t, cfg.Storage.BasePath)) < 3 {
+		for i := 0; i < 1000; i++ {
+			written++
+			trade := testTrade(written, testHour.Add(time.Duration(written)*time.Microsecond))
+			trade.Price = 90000 + rng.Float64()*10000
+			trade.Amount = rng.Float64() - 0.5
+			if err := w.WriteTrade(trade); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	closeWriters(t, w)
+
+	dirs := tradeSegments(t, cfg.Storage.BasePath)
+	if len(dirs) < 3 {
+		t.Fatalf("got %d segments after %d rows, want rotation at 1MB", len(dirs), written)
+	}
+
+	var next int64 = 1
+	for i, dir := range dirs {
+		if !strings.Contains(filepath.Base(dir), "--size~1MB") {
+			t.Errorf("segment %s is not named for its size target", dir)
+		}
+		manifest, err := readManifest(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if manifest.Segment.BytesTarget != 1024*1024 {
+			t.Errorf("segment %d has bytes_target %d", i, manifest.Segment.BytesTarget)
+		}
+		// Every segment but the last was rotated once a row group took it
+		// past 1MB.
+		if i < len(dirs)-1 && manifest.Segment.Bytes < 1024*1024 {
+			t.Errorf("segment %d rotated at %d bytes, before 1MB", i, manifest.Segment.Bytes)
+		}
+		if manifest.Segment.Bytes > 2*1024*1024 {
+			t.Errorf("segment %d grew to %d bytes", i, manifest.Segment.Bytes)
+		}
+
+		trades := readTrades(t, dir)
+		checkTradeIDs(t, trades, next, next+int64(len(trades))-1)
+		next += int64(len(trades))
+	}
+	if next-1 != written {
+		t.Errorf("segments hold %d trades, want %d", next-1, written)
+	}
+}
+
+// hourSegments lists the trades segments of testSymbol in the hour= partition
+// of hour.
+func hourSegments(t *testing.T, root string, hour time.Time) []string {
+	t.Helper()
+	dirs, err := filepath.Glob(filepath.Join(root, "bitfinex", "v2", "trades", testSymbol,
+		"dt="+hour.Format("2006-01-02"), fmt.Sprintf("hour=%02d", hour.Hour()), "seg=*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+func tradeIDs(trades []schema.Trade) []int64 {
+	ids := make([]int64, len(trades))
+	for i, trade := range trades {
+		ids[i] = trade.TradeID
+	}
+	return ids
+}
+
+func TestSegmentsFollowEventHour(t *testing.T) {
+	cfg := testConfig(t)
+	w := newTestWriter(cfg)
+	next := testHour.Add(time.Hour)
+
+	// Trades 1-5 are received before the hour ends and 6-10 after it.
+	writeTrades(t, w, 1, 10, next.Add(-5*time.Millisecond))
+	// 11 is late for the previous hour, whose segment is still open.
+	writeTrades(t, w, 11, 1, next.Add(-time.Second))
+	if err := w.FlushAll(); err != nil {
+		t.Fatal(err)
+	}
+	// Once rows are past the hour's grace, a flush closes its segment and 13,
+	// late again, opens a new one beside it.
+	writeTrades(t, w, 12, 1, next.Add(2*time.Minute))
+	if err := w.FlushAll(); err != nil {
+		t.Fatal(err)
+	}
+	writeTrades(t, w, 13, 1, testHour.Add(30*time.Minute))
+	closeWriters(t, w)
+
+	root := cfg.Storage.BasePath
+	earlier, later := hourSegments(t, root, testHour), hourSegments(t, root, next)
+	if len(earlier) != 2 || len(later) != 1 {
+		t.Fatalf("got segments %v and %v, want two in hour 03 and one in hour 04", earlier, later)
+	}
+
+	// Segments are named by their first row, so the late one sorts first.
+	want := map[string][]int64{
+		earlier[0]: {13},
+		earlier[1]: {1, 2, 3, 4, 5, 11},
+		later[0]:   {6, 7, 8, 9, 10, 12},
+	}
+	for dir, ids := range want {
+		if got := tradeIDs(readTrades(t, dir)); !slices.Equal(got, ids) {
+			t.Errorf("%s holds trades %v, want %v", dir, got, ids)
+		}
+	}
+
+	manifest, err := readManifest(earlier[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if end := next.Add(-time.Millisecond); !manifest.Segment.UTCEnd.Equal(end) {
+		t.Errorf("hour 03 segment ends at %s, want its last row at %s", manifest.Segment.UTCEnd, end)
+	}
+}
+
+func TestSegmentsFollowExchangeHour(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Storage.PartitionTime = string(PartitionExchangeTime)
+	w := newTestWriter(cfg)
+
+	// Executed just before the hour, received just after it.
+	next := testHour.Add(time.Hour)
+	trade := testTrade(1, next.Add(500*time.Millisecond))
+	mts := next.Add(-100 * time.Millisecond).UnixMilli()
+	trade.SrvMTS, trade.MTS = &mts, mts
+	if err := w.WriteTrade(trade); err != nil {
+		t.Fatal(err)
+	}
+	closeWriters(t, w)
+
+	if dirs := hourSegments(t, cfg.Storage.BasePath, testHour); len(dirs) != 1 {
+		t.Errorf("got hour 03 segments %v, want the trade there by its exchange time", dirs)
+	}
+	if dirs := hourSegments(t, cfg.Storage.BasePath, next); len(dirs) != 0 {
+		t.Errorf("got hour 04 segments %v, want none", dirs)
+	}
+}
+
+func TestManifestDescribesSegment(t *testing.T) {
+	cfg := testConfig(t)
+	w := newTestWriter(cfg)
+
+	const urlA, urlB = "wss://a.example/ws/2", "wss://b.example/ws/2"
+	subID := int64(42)
+	controls := []*schema.Control{
+		{CommonFields: schema.CommonFields{ConnID: "conn-1", RecvTS: testHour.UnixNano()},
+			Type: schema.ControlTypeConnected, Reason: urlA},
+		{CommonFields: schema.CommonFields{ConnID: "conn-2", RecvTS: testHour.UnixNano()},
+			Type: schema.ControlTypeConnected, Reason: urlB},
+		{CommonFields: schema.CommonFields{Channel: schema.ChannelTrades, Symbol: testSymbol, PairOrCurrency: "BTCUSD",
+			ConnID: "conn-1", ChanID: 17, SubID: &subID, RecvTS: testHour.UnixNano()},
+			Type: schema.ControlTypeSubscribed, Reason: "trades " + testSymbol},
+	}
+	for _, control := range controls {
+		if err := w.WriteControl(control); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeTrades(t, w, 1, 150, testHour)
+	for id := int64(151); id <= 160; id++ {
+		trade := testTrade(id, testHour.Add(time.Duration(id)*time.Millisecond))
+		trade.ConnID = "conn-2"
+		if err := w.WriteTrade(trade); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	controls = []*schema.Control{
+		{CommonFields: schema.CommonFields{Channel: schema.ChannelTrades, Symbol: testSymbol,
+			ConnID: "conn-1", RecvTS: testHour.Add(time.Second).UnixNano()},
+			Type: schema.ControlTypeGap},
+		{CommonFields: schema.CommonFields{ConnID: "conn-1", RecvTS: testHour.Add(time.Second).UnixNano()},
+			Type: schema.ControlTypeReconnect, Reason: urlA},
+	}
+	for _, control := range controls {
+		if err := w.WriteControl(control); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeWriters(t, w)
+
+	dir := tradeSegments(t, cfg.Storage.BasePath)[0]
+	manifest, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if manifest.SchemaVersion != schema.SchemaVersion || manifest.IngestID != w.ingestID {
+		t.Errorf("schema version %q ingest ID %q", manifest.SchemaVersion, manifest.IngestID)
+	}
+	if manifest.ConnID != "conn-1" || !slices.Equal(manifest.ConnIDs, []string{"conn-1", "conn-2"}) {
+		t.Errorf("conn ID %q conn IDs %v", manifest.ConnID, manifest.ConnIDs)
+	}
+	if manifest.WSURL != urlA || !slices.Equal(manifest.Endpoints, []string{urlA, urlB}) {
+		t.Errorf("ws_url %q endpoints %v", manifest.WSURL, manifest.Endpoints)
+	}
+	if manifest.ChanID != 17 || manifest.SubID == nil || *manifest.SubID != subID || manifest.PairOrCurrency != "BTCUSD" {
+		t.Errorf("subscription chan %d sub %v pair %q", manifest.ChanID, manifest.SubID, manifest.PairOrCurrency)
+	}
+	if manifest.Seq == nil || manifest.Seq.First != 1 || manifest.Seq.Last != 160 {
+		t.Errorf("seq %+v, want 1-160", manifest.Seq)
+	}
+	if q := manifest.Quality; q.Gaps != 1 || q.Reconnects != 1 || q.ChecksumMismatch != 0 {
+		t.Errorf("quality %+v, want one gap and one reconnect", q)
+	}
+	if !manifest.Segment.UTCStart.Equal(testHour) || !manifest.Segment.UTCEnd.Equal(testHour.Add(time.Second)) {
+		t.Errorf("segment spans %s to %s", manifest.Segment.UTCStart, manifest.Segment.UTCEnd)
+	}
+
+	if len(manifest.Segment.FileStats) != 2 {
+		t.Fatalf("file stats %+v, want trades and controls", manifest.Segment.FileStats)
+	}
+	var total int64
+	for _, stats := range manifest.Segment.FileStats {
+		size, digest, err := fileDigest(filepath.Join(dir, stats.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Bytes != size || stats.SHA256 != digest {
+			t.Errorf("%s recorded as %d bytes %s, is %d bytes %s", stats.Name, stats.Bytes, stats.SHA256, size, digest)
+		}
+		if stats.Compression == nil || stats.Compression.Codec != "zstd" || stats.Compression.Level != 3 {
+			t.Errorf("%s compression %+v", stats.Name, stats.Compression)
+		}
+		total += size
+
+		if stats.Name == "controls.parquet" {
+			if stats.Rows != 3 {
+				t.Errorf("controls.parquet has %d rows, want the subscribed, gap and reconnect", stats.Rows)
+			}
+			continue
+		}
+		first, last := testHour, testHour.Add(160*time.Millisecond)
+		if stats.Rows != 160 || stats.RecvTSMin != first.UnixNano() || stats.RecvTSMax != last.UnixNano() {
+			t.Errorf("%s stats %+v", stats.Name, stats)
+		}
+		if stats.SrvMTSMin == nil || *stats.SrvMTSMin != first.UnixMilli() ||
+			stats.SrvMTSMax == nil || *stats.SrvMTSMax != last.UnixMilli() {
+			t.Errorf("%s srv_mts range %v-%v", stats.Name, stats.SrvMTSMin, stats.SrvMTSMax)
+		}
+	}
+	if manifest.Segment.Bytes != total {
+		t.Errorf("segment bytes %d, files add up to %d", manifest.Segment.Bytes, total)
+	}
+}
+
+func TestManifestRecordsBookSubscription(t *testing.T) {
+	cfg := testConfig(t)
+	w := newTestWriter(cfg)
+
+	control := &schema.Control{
+		CommonFields: schema.CommonFields{Channel: schema.ChannelBooks, Symbol: testSymbol,
+			ConnID: "conn-1", ChanID: 23, RecvTS: testHour.UnixNano()},
+		Type:   schema.ControlTypeSubscribed,
+		Reason: "book " + testSymbol + " prec=P1 freq=F0 len=100",
+	}
+	if err := w.WriteControl(control); err != nil {
+		t.Fatal(err)
+	}
+	closeWriters(t, w)
+
+	dirs := channelSegments(t, cfg.Storage.BasePath, schema.ChannelBooks)
+	if len(dirs) != 1 {
+		t.Fatalf("got book segments %v, want one", dirs)
+	}
+	manifest, err := readManifest(dirs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := schema.BookSubscription{Prec: "P1", Freq: "F0", Len: 100}
+	if manifest.Book == nil || *manifest.Book != want || manifest.ChanID != 23 {
+		t.Errorf("book %+v chan %d, want %+v on chan 23", manifest.Book, manifest.ChanID, want)
+	}
+}
+
+func TestChannelOverrides(t *testing.T) {
+	cfg := testConfig(t)
+	tradesRoot := t.TempDir()
+	cfg.Storage.SegmentSizeMB = 512
+	cfg.Storage.Channels = map[string]config.StorageOverride{
+		"trades": {BasePath: tradesRoot, Compression: "gzip", SegmentSizeMB: 64},
+	}
+	if err := validateStorage(cfg.Storage); err != nil {
+		t.Fatalf("validateStorage: %v", err)
+	}
+	w := newTestWriter(cfg)
+	writeTrades(t, w, 1, 10, testHour)
+	if err := w.WriteTicker(testTicker(testHour)); err != nil {
+		t.Fatal(err)
+	}
+	closeWriters(t, w)
+
+	if dirs := channelSegments(t, cfg.Storage.BasePath, schema.ChannelTrades); len(dirs) != 0 {
+		t.Errorf("trades segments %v under the shared base path", dirs)
+	}
+	if dirs := channelSegments(t, tradesRoot, schema.ChannelTicker); len(dirs) != 0 {
+		t.Errorf("ticker segments %v under the trades base path", dirs)
+	}
+
+	tests := []struct {
+		channel schema.Channel
+		root    string
+		sizeMB  int
+		codec   string
+		level   int
+	}{
+		{schema.ChannelTrades, tradesRoot, 64, "gzip", 6},
+		{schema.ChannelTicker, cfg.Storage.BasePath, 512, "zstd", 3},
+	}
+	for _, tt := range tests {
+		dirs := channelSegments(t, tt.root, tt.channel)
+		if len(dirs) != 1 {
+			t.Fatalf("got %s segments %v, want one under %s", tt.channel, dirs, tt.root)
+		}
+		if want := fmt.Sprintf("--size~%dMB", tt.sizeMB); !strings.HasSuffix(dirs[0], want) {
+			t.Errorf("%s segment %s, want it named %s", tt.channel, filepath.Base(dirs[0]), want)
+		}
+
+		manifest, err := readManifest(dirs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if manifest.Segment.BytesTarget != int64(tt.sizeMB)*1024*1024 {
+			t.Errorf("%s bytes target %d, want %d MB", tt.channel, manifest.Segment.BytesTarget, tt.sizeMB)
+		}
+		for _, stats := range manifest.Segment.FileStats {
+			if stats.Compression == nil || stats.Compression.Codec != tt.codec || stats.Compression.Level != tt.level {
+				t.Errorf("%s compression %+v, want %s level %d", stats.Name, stats.Compression, tt.codec, tt.level)
+			}
+		}
+
+		// Each root keeps the catalog of its own segments.
+		entries := readCatalog(t, tt.root)
+		if len(entries) != 1 || entries[0].Channel != string(tt.channel) {
+			t.Errorf("catalog of the %s root %+v, want its one segment", tt.channel, entries)
+		}
+	}
+	checkTradeIDs(t, readTrades(t, tradeSegments(t, tradesRoot)[0]), 1, 10)
+
+	cfg.Storage.Channels["trades"] = config.StorageOverride{Compression: "gzip", CompressionLevel: 12}
+	if err := validateStorage(cfg.Storage); err == nil || !strings.Contains(err.Error(), "storage.channels.trades") {
+		t.Errorf("bad trades override returned %v, want it rejected", err)
+	}
+}
@@ -0,0 +1,135 @@
+package tape
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxFieldLen guards against reading garbage lengths from a damaged tape.
+const maxFieldLen = 64 * 1024 * 1024
+
+// Reader reads the frames of a single tape file in recording order.
+type Reader struct {
+	file    *os.File
+	decoder *zstd.Decoder
+	in      *bufio.Reader
+}
+
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tape %s: %w", path, err)
+	}
+
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(file, magic); err != nil || string(magic) != Magic {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a tape file", path)
+	}
+
+	decoder, err := zstd.NewReader(file, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to create tape decoder: %w", err)
+	}
+
+	return &Reader{
+		file:    file,
+		decoder: decoder,
+		in:      bufio.NewReaderSize(decoder, 256*1024),
+	}, nil
+}
+
+// Next returns the next frame, or io.EOF at the end of the tape. A tape cut
+// short by a crash ends with io.ErrUnexpectedEOF.
+func (r *Reader) Next() (Frame, error) {
+	var frame Frame
+
+	var ts [8]byte
+	if _, err := io.ReadFull(r.in, ts[:]); err != nil {
+		if err == io.EOF {
+			return frame, io.EOF
+		}
+		return frame, io.ErrUnexpectedEOF
+	}
+	frame.RecvTS = int64(binary.BigEndian.Uint64(ts[:]))
+
+	connID, err := r.readField()
+	if err != nil {
+		return frame, err
+	}
+	endpoint, err := r.readField()
+	if err != nil {
+		return frame, err
+	}
+	data, err := r.readField()
+	if err != nil {
+		return frame, err
+	}
+
+	frame.ConnID = string(connID)
+	frame.Endpoint = string(endpoint)
+	frame.Data = data
+	return frame, nil
+}
+
+func (r *Reader) readField() ([]byte, error) {
+	n, err := binary.ReadUvarint(r.in)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if n > maxFieldLen {
+		return nil, fmt.Errorf("tape field of %d bytes exceeds limit", n)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.in, b); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, nil
+}
+
+func (r *Reader) Close() error {
+	r.decoder.Close()
+	return r.file.Close()
+}
+
+// Files resolves path to the tape files to read. A directory yields every
+// tape in it, including a .tmp left by a crash, in recording order.
+func Files(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !(strings.HasSuffix(name, FileExt) || strings.HasSuffix(name, FileExt+".tmp")) {
+			continue
+		}
+		files = append(files, filepath.Join(path, name))
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no tape files found in %s", path)
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
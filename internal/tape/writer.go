@@ -0,0 +1,266 @@
+package tape
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+)
+
+// Magic starts every tape file, before the zstd stream.
+const Magic = "BFXTAPE1"
+
+const (
+	// FileExt is the extension of finished tape files.
+	FileExt = ".tape.zst"
+
+	defaultRotateMB = 256
+	flushInterval   = time.Second
+)
+
+// Frame is one inbound WebSocket message exactly as it came off the wire.
+type Frame struct {
+	RecvTS   int64
+	ConnID   string
+	Endpoint string
+	Data     []byte
+}
+
+// Writer appends frames to zstd-compressed tape files under dir, starting a
+// new file once rotateMB of frame data has been written. A file is written as
+// .tmp and renamed on rotation, so finished tapes are always complete.
+//
+// Files are named tape-{UTC time}-{seq}, with seq a zero-padded counter that
+// carries on from the files already in dir, so sorting the names puts the
+// tapes in the order they were written.
+type Writer struct {
+	dir         string
+	rotateBytes int64
+	logger      *zap.Logger
+	seq         uint64
+
+	mu      sync.Mutex
+	file    *os.File
+	encoder *zstd.Encoder
+	buf     *bufio.Writer
+	written int64
+	scratch []byte
+	closed  bool
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+	once   sync.Once
+}
+
+func NewWriter(dir string, rotateMB int, logger *zap.Logger) (*Writer, error) {
+	if rotateMB <= 0 {
+		rotateMB = defaultRotateMB
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create tape directory %s: %w", dir, err)
+	}
+
+	seq, err := lastSeq(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tape directory %s: %w", dir, err)
+	}
+
+	w := &Writer{
+		dir:         dir,
+		rotateBytes: int64(rotateMB) * 1024 * 1024,
+		logger:      logger.With(zap.String("component", "tape")),
+		seq:         seq,
+		stopCh:      make(chan struct{}),
+	}
+
+	w.wg.Add(1)
+	go w.flushRoutine()
+
+	return w, nil
+}
+
+// Record appends one frame. It is called from the read loop before the frame
+// is parsed, so a failure is logged rather than returned.
+func (w *Writer) Record(frame Frame) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return
+	}
+	if err := w.record(frame); err != nil {
+		w.logger.Error("Failed to record frame", zap.Error(err))
+	}
+}
+
+func (w *Writer) record(frame Frame) error {
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+
+	b := w.scratch[:0]
+	b = binary.BigEndian.AppendUint64(b, uint64(frame.RecvTS))
+	b = binary.AppendUvarint(b, uint64(len(frame.ConnID)))
+	b = append(b, frame.ConnID...)
+	b = binary.AppendUvarint(b, uint64(len(frame.Endpoint)))
+	b = append(b, frame.Endpoint...)
+	b = binary.AppendUvarint(b, uint64(len(frame.Data)))
+	w.scratch = b
+
+	if _, err := w.buf.Write(b); err != nil {
+		return fmt.Errorf("failed to write frame header: %w", err)
+	}
+	if _, err := w.buf.Write(frame.Data); err != nil {
+		return fmt.Errorf("failed to write frame: %w", err)
+	}
+
+	w.written += int64(len(frame.Data))
+	if w.written >= w.rotateBytes {
+		return w.closeFile()
+	}
+	return nil
+}
+
+// lastSeq returns the highest file sequence number among the tapes in dir.
+func lastSeq(dir string) (uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var last uint64
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".tmp")
+		if e.IsDir() || !strings.HasPrefix(name, "tape-") || !strings.HasSuffix(name, FileExt) {
+			continue
+		}
+		name = strings.TrimSuffix(name, FileExt)
+		seq, err := strconv.ParseUint(name[strings.LastIndexByte(name, '-')+1:], 10, 64)
+		if err == nil && seq > last {
+			last = seq
+		}
+	}
+	return last, nil
+}
+
+func (w *Writer) open() error {
+	w.seq++
+	path := filepath.Join(w.dir, fmt.Sprintf("tape-%s-%09d%s.tmp",
+		time.Now().UTC().Format("20060102T150405Z"), w.seq, FileExt))
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create tape file %s: %w", path, err)
+	}
+
+	if _, err := file.WriteString(Magic); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write tape header: %w", err)
+	}
+
+	encoder, err := zstd.NewWriter(file, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to create tape encoder: %w", err)
+	}
+
+	w.file = file
+	w.encoder = encoder
+	w.buf = bufio.NewWriterSize(encoder, 256*1024)
+	w.written = 0
+
+	w.logger.Info("Opened tape file", zap.String("path", path))
+	return nil
+}
+
+func (w *Writer) flush() error {
+	if w.file == nil {
+		return nil
+	}
+	if err := w.buf.Flush(); err != nil {
+		return fmt.Errorf("failed to flush tape: %w", err)
+	}
+	if err := w.encoder.Flush(); err != nil {
+		return fmt.Errorf("failed to flush tape encoder: %w", err)
+	}
+	return nil
+}
+
+func (w *Writer) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+
+	tmpPath := w.file.Name()
+	flushErr := w.buf.Flush()
+	encErr := w.encoder.Close()
+	closeErr := w.file.Close()
+
+	w.file = nil
+	w.encoder = nil
+	w.buf = nil
+
+	if flushErr != nil {
+		return fmt.Errorf("failed to flush tape %s: %w", tmpPath, flushErr)
+	}
+	if encErr != nil {
+		return fmt.Errorf("failed to close tape encoder %s: %w", tmpPath, encErr)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("failed to close tape %s: %w", tmpPath, closeErr)
+	}
+
+	path := tmpPath[:len(tmpPath)-len(".tmp")]
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename tape %s: %w", tmpPath, err)
+	}
+
+	w.logger.Info("Closed tape file", zap.String("path", path))
+	return nil
+}
+
+// flushRoutine bounds how much of the tape a crash can lose.
+func (w *Writer) flushRoutine() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if err := w.flush(); err != nil {
+				w.logger.Error("Failed to flush tape", zap.Error(err))
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+func (w *Writer) Close() error {
+	var err error
+	w.once.Do(func() {
+		close(w.stopCh)
+		w.wg.Wait()
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.closed = true
+		err = w.closeFile()
+	})
+	return err
+}
@@ -0,0 +1,416 @@
+package ws
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type BackpressurePolicy string
+
+const (
+	PolicyBlock      BackpressurePolicy = "block"
+	PolicyDropNewest BackpressurePolicy = "drop_newest"
+	PolicyDropOldest BackpressurePolicy = "drop_oldest"
+	PolicySpill      BackpressurePolicy = "spill"
+)
+
+func ParseBackpressurePolicy(s string) (BackpressurePolicy, error) {
+	switch policy := BackpressurePolicy(s); policy {
+	case "":
+		return PolicyBlock, nil
+	case PolicyBlock, PolicyDropNewest, PolicyDropOldest, PolicySpill:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown backpressure policy %q", s)
+	}
+}
+
+type QueueStats struct {
+	Name      string
+	Policy    BackpressurePolicy
+	Depth     int
+	Capacity  int
+	Delivered int64
+	Dropped   int64
+	Spilled   int64
+	Lag       time.Duration
+}
+
+// entry carries the enqueue time with each item so the consumer side can
+// report how far behind the router it is running.
+type entry[T any] struct {
+	Item     T     `json:"item"`
+	Enqueued int64 `json:"enqueued"`
+}
+
+// queue is a bounded FIFO between the router and a consumer. What happens when
+// it is full depends on its policy; every discarded item is passed to onDrop.
+type queue[T any] struct {
+	name   string
+	policy BackpressurePolicy
+	ch     chan entry[T]
+	done   chan struct{}
+	onDrop func(item T)
+	logger *zap.Logger
+
+	// closing tells the spill drainer to replay what is left on disk and
+	// exit; done is only closed after that.
+	closing chan struct{}
+
+	mu    sync.Mutex
+	spill *spillBuffer[T]
+
+	delivered atomic.Int64
+	dropped   atomic.Int64
+	spilled   atomic.Int64
+	lag       atomic.Int64
+	inflight  atomic.Int64
+	wg        sync.WaitGroup
+	closed    sync.Once
+}
+
+func newQueue[T any](name string, policy BackpressurePolicy, size int, spillDir string, logger *zap.Logger, onDrop func(T)) *queue[T] {
+	q := &queue[T]{
+		name:    name,
+		policy:  policy,
+		ch:      make(chan entry[T], size),
+		done:    make(chan struct{}),
+		onDrop:  onDrop,
+		logger:  logger.With(zap.String("queue", name)),
+		closing: make(chan struct{}),
+	}
+
+	if policy == PolicySpill {
+		q.spill = &spillBuffer[T]{
+			dir:    spillDir,
+			prefix: fmt.Sprintf("%s-%d", name, time.Now().UnixNano()),
+			wake:   make(chan struct{}, 1),
+		}
+
+		// Files left by an earlier run are replayed before anything new.
+		leftover := q.spill.leftover(name)
+		if len(leftover) > 0 {
+			q.logger.Info("Replaying spill files from a previous run", zap.Int("files", len(leftover)))
+			q.spill.active = true
+		}
+
+		q.wg.Add(1)
+		go q.drainSpill(leftover)
+	}
+
+	return q
+}
+
+func (q *queue[T]) push(item T) {
+	e := entry[T]{Item: item, Enqueued: time.Now().UnixNano()}
+
+	select {
+	case <-q.done:
+		// The consumer is gone; nothing would deliver the item.
+		q.drop(item)
+		return
+	default:
+	}
+
+	switch q.policy {
+	case PolicyDropNewest:
+		select {
+		case q.ch <- e:
+		default:
+			q.drop(item)
+		}
+	case PolicyDropOldest:
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		for {
+			select {
+			case q.ch <- e:
+				return
+			default:
+			}
+			select {
+			case old := <-q.ch:
+				q.drop(old.Item)
+			default:
+			}
+		}
+	case PolicySpill:
+		q.pushSpill(e)
+	default:
+		select {
+		case q.ch <- e:
+		case <-q.done:
+			q.drop(item)
+		}
+	}
+}
+
+func (q *queue[T]) pushSpill(e entry[T]) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Once the drainer has replayed the spill for close, nothing would read a
+	// new file, so wait for the consumer like the block policy does.
+	if q.spill.drained {
+		select {
+		case q.ch <- e:
+		case <-q.done:
+			q.drop(e.Item)
+		}
+		return
+	}
+
+	// Once anything is on disk, newer items must queue behind it to keep order.
+	if !q.spill.active {
+		select {
+		case q.ch <- e:
+			return
+		default:
+		}
+	}
+
+	if err := q.spill.write(e); err != nil {
+		q.logger.Error("Failed to spill message to disk", zap.Error(err))
+		q.drop(e.Item)
+		return
+	}
+	q.spilled.Add(1)
+
+	select {
+	case q.spill.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *queue[T]) drop(item T) {
+	q.dropped.Add(1)
+	q.logger.Warn("Queue full, dropping message", zap.String("policy", string(q.policy)))
+	if q.onDrop != nil {
+		q.onDrop(item)
+	}
+}
+
+// drainSpill replays spill files into the channel in the order they were
+// written, starting with leftover files from an earlier run. When the queue
+// closes it replays whatever is still on disk before returning, so the
+// consumer sees every spilled message before done is closed.
+func (q *queue[T]) drainSpill(leftover []string) {
+	defer q.wg.Done()
+
+	for _, path := range leftover {
+		q.replaySpill(path)
+	}
+
+	for {
+		closing := false
+		select {
+		case <-q.closing:
+			closing = true
+		case <-q.spill.wake:
+		}
+
+		for {
+			q.mu.Lock()
+			path, err := q.spill.rotate()
+			if path == "" && closing {
+				q.spill.drained = true
+			}
+			q.mu.Unlock()
+
+			if err != nil {
+				q.logger.Error("Failed to rotate spill file", zap.Error(err))
+			}
+			if path == "" {
+				break
+			}
+			q.replaySpill(path)
+		}
+
+		if closing {
+			return
+		}
+	}
+}
+
+// replaySpill sends the messages of a spill file to the consumer and removes
+// the file. Lines that cannot be decoded are counted as dropped.
+func (q *queue[T]) replaySpill(path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		q.logger.Error("Failed to open spill file", zap.String("path", path), zap.Error(err))
+		return
+	}
+	defer file.Close()
+
+	var lost int64
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxSpillLine)
+	for scanner.Scan() {
+		var e entry[T]
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			lost++
+			continue
+		}
+		q.ch <- e
+	}
+	if err := scanner.Err(); err != nil {
+		// The rest of the file cannot be read; count it as one lost message.
+		q.logger.Error("Failed to read spill file", zap.String("path", path), zap.Error(err))
+		lost++
+	}
+	if lost > 0 {
+		q.dropped.Add(lost)
+		q.logger.Error("Spilled messages lost", zap.String("path", path), zap.Int64("count", lost))
+	}
+
+	if err := os.Remove(path); err != nil {
+		q.logger.Warn("Failed to remove spill file", zap.String("path", path), zap.Error(err))
+	}
+}
+
+func (q *queue[T]) consume(handle func(T)) {
+	for {
+		select {
+		case e := <-q.ch:
+			q.deliver(e, handle)
+		case <-q.done:
+			for {
+				select {
+				case e := <-q.ch:
+					q.deliver(e, handle)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (q *queue[T]) deliver(e entry[T], handle func(T)) {
+	q.lag.Store(time.Now().UnixNano() - e.Enqueued)
+	q.inflight.Store(e.Enqueued)
+	handle(e.Item)
+	q.inflight.Store(0)
+	q.delivered.Add(1)
+}
+
+// close stops the queue. A spill queue first hands everything still on disk
+// to the consumer, which must keep running until done is closed.
+func (q *queue[T]) close() {
+	q.closed.Do(func() {
+		close(q.closing)
+		q.wg.Wait()
+		close(q.done)
+	})
+}
+
+func (q *queue[T]) stats() QueueStats {
+	// A handler stuck on an item is lagging by at least that item's age.
+	lag := time.Duration(q.lag.Load())
+	if enqueued := q.inflight.Load(); enqueued != 0 {
+		if age := time.Duration(time.Now().UnixNano() - enqueued); age > lag {
+			lag = age
+		}
+	}
+
+	return QueueStats{
+		Name:      q.name,
+		Policy:    q.policy,
+		Depth:     len(q.ch),
+		Capacity:  cap(q.ch),
+		Delivered: q.delivered.Load(),
+		Dropped:   q.dropped.Load(),
+		Spilled:   q.spilled.Load(),
+		Lag:       lag,
+	}
+}
+
+// maxSpillLine bounds one spilled message when it is read back.
+const maxSpillLine = 16 * 1024 * 1024
+
+// spillBuffer holds overflow for a spill queue as JSON lines on disk. Writes go
+// to the current file; rotate hands the current file to the drainer.
+type spillBuffer[T any] struct {
+	dir     string
+	prefix  string
+	seq     int
+	file    *os.File
+	writer  *bufio.Writer
+	encoder *json.Encoder
+	active  bool
+	// drained is set once the drainer has exited for close.
+	drained bool
+	wake    chan struct{}
+}
+
+// leftover lists the spill files a previous run of the queue called name did
+// not replay, oldest first. File names are the queue name, the start time in
+// nanoseconds and a six digit sequence, so they sort in write order.
+func (s *spillBuffer[T]) leftover(name string) []string {
+	paths, err := filepath.Glob(filepath.Join(s.dir, name+"-*.jsonl"))
+	if err != nil {
+		return nil
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (s *spillBuffer[T]) write(e entry[T]) error {
+	if s.file == nil {
+		if err := os.MkdirAll(s.dir, 0755); err != nil {
+			return fmt.Errorf("failed to create spill directory %s: %w", s.dir, err)
+		}
+
+		s.seq++
+		path := filepath.Join(s.dir, fmt.Sprintf("%s-%06d.jsonl", s.prefix, s.seq))
+		file, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("failed to create spill file %s: %w", path, err)
+		}
+
+		s.file = file
+		s.writer = bufio.NewWriter(file)
+		s.encoder = json.NewEncoder(s.writer)
+	}
+
+	if err := s.encoder.Encode(e); err != nil {
+		return fmt.Errorf("failed to encode spilled message: %w", err)
+	}
+
+	s.active = true
+	return nil
+}
+
+// rotate closes the current spill file and returns its path. An empty path
+// means nothing is left on disk and the queue may go back to direct sends.
+func (s *spillBuffer[T]) rotate() (string, error) {
+	if s.file == nil {
+		s.active = false
+		return "", nil
+	}
+
+	path := s.file.Name()
+	flushErr := s.writer.Flush()
+	closeErr := s.file.Close()
+
+	s.file = nil
+	s.writer = nil
+	s.encoder = nil
+
+	if flushErr != nil {
+		return path, fmt.Errorf("failed to flush spill file %s: %w", path, flushErr)
+	}
+	if closeErr != nil {
+		return path, fmt.Errorf("failed to close spill file %s: %w", path, closeErr)
+	}
+	return path, nil
+}
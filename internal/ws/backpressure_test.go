@@ -0,0 +1,95 @@
+package ws
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// consumeAll runs q's consumer and returns what it delivered once q closes.
+func consumeAll(q *queue[int], delay time.Duration) func() []int {
+	var got []int
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.consume(func(v int) {
+			time.Sleep(delay)
+			got = append(got, v)
+		})
+	}()
+	return func() []int {
+		<-done
+		return got
+	}
+}
+
+func checkInOrder(t *testing.T, got []int, first, n int) {
+	t.Helper()
+	if len(got) != n {
+		t.Fatalf("delivered %d messages, want %d", len(got), n)
+	}
+	for i, v := range got {
+		if v != first+i {
+			t.Fatalf("message %d is %d, want %d", i, v, first+i)
+		}
+	}
+}
+
+func TestSpillQueueDeliversSpillOnClose(t *testing.T) {
+	dir := t.TempDir()
+	q := newQueue[int]("trades", PolicySpill, 4, dir, zap.NewNop(), nil)
+	wait := consumeAll(q, 10*time.Microsecond)
+
+	for i := 0; i < 5000; i++ {
+		q.push(i)
+	}
+	q.close()
+
+	checkInOrder(t, wait(), 0, 5000)
+	if stats := q.stats(); stats.Spilled == 0 || stats.Dropped != 0 {
+		t.Errorf("spilled %d and dropped %d, want some spilled and none dropped", stats.Spilled, stats.Dropped)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("spill files left after close: %v", files)
+	}
+}
+
+func TestSpillQueueReplaysLeftoverFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"trades-1000-000001.jsonl": `{"item":1,"enqueued":1}` + "\n" + `{"item":2,"enqueued":1}` + "\nnot json\n",
+		"trades-1000-000002.jsonl": `{"item":3,"enqueued":1}` + "\n",
+		// Another queue's file in the same directory is left alone.
+		"raw_trades-1000-000001.jsonl": `{"item":99,"enqueued":1}` + "\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q := newQueue[int]("trades", PolicySpill, 4, dir, zap.NewNop(), nil)
+	wait := consumeAll(q, 0)
+	for i := 4; i < 100; i++ {
+		q.push(i)
+	}
+	q.close()
+
+	// Leftovers come first, in the order they were written.
+	checkInOrder(t, wait(), 1, 99)
+	if dropped := q.stats().Dropped; dropped != 1 {
+		t.Errorf("dropped %d, want the undecodable line counted", dropped)
+	}
+	left, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(left) != 1 || filepath.Base(left[0]) != "raw_trades-1000-000001.jsonl" {
+		t.Errorf("spill files left: %v", left)
+	}
+
+	q.push(100)
+	if dropped := q.stats().Dropped; dropped != 2 {
+		t.Errorf("push after close not counted as dropped")
+	}
+}
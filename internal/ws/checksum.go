@@ -0,0 +1,210 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// checksumDepth is the number of levels per side covered by Bitfinex's
+// OB_CHECKSUM value.
+const checksumDepth = 25
+
+type ChecksumResult int
+
+const (
+	ChecksumUnknown ChecksumResult = iota
+	ChecksumOK
+	ChecksumMismatch
+)
+
+// bookTracker mirrors every book and raw book channel from the routed deltas
+// so that "cs" frames can be verified against what we actually recorded.
+type bookTracker struct {
+	mu    sync.Mutex
+	books map[string]*bookState
+}
+
+type bookState struct {
+	bids     map[string]bookEntry
+	asks     map[string]bookEntry
+	verified bool
+}
+
+// bookEntry keeps the key and amount as received so the checksum string is
+// built from the exact text Bitfinex hashed.
+type bookEntry struct {
+	key    string
+	price  float64
+	id     int64
+	amount string
+}
+
+func newBookTracker() *bookTracker {
+	return &bookTracker{
+		books: make(map[string]*bookState),
+	}
+}
+
+func bookKey(connID string, chanID int32) string {
+	return fmt.Sprintf("%s/%d", connID, chanID)
+}
+
+// expect drops the mirror of a channel that was just subscribed, so that its
+// next frame of entries is taken as the snapshot.
+func (t *bookTracker) expect(connID string, chanID int32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.books, bookKey(connID, chanID))
+}
+
+// startSnapshot reports whether a frame of entries on the channel is its
+// snapshot, which is the case for the first one since it was subscribed. It
+// then starts an empty mirror for the snapshot to fill. Later frames of
+// entries are BULK_UPDATES batches of deltas.
+func (t *bookTracker) startSnapshot(connID string, chanID int32) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := bookKey(connID, chanID)
+	if _, exists := t.books[key]; exists {
+		return false
+	}
+	t.books[key] = &bookState{
+		bids: make(map[string]bookEntry),
+		asks: make(map[string]bookEntry),
+	}
+	return true
+}
+
+func (t *bookTracker) forget(connID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prefix := connID + "/"
+	for key := range t.books {
+		if strings.HasPrefix(key, prefix) {
+			delete(t.books, key)
+		}
+	}
+}
+
+// applyLevel applies a P0-P4 entry [PRICE, COUNT, AMOUNT].
+func (t *bookTracker) applyLevel(connID string, chanID int32, entry []json.RawMessage, price float64, count int32, amount float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	book, exists := t.books[bookKey(connID, chanID)]
+	if !exists {
+		return
+	}
+
+	side := book.bids
+	if amount < 0 {
+		side = book.asks
+	}
+
+	key := string(entry[0])
+	if count == 0 {
+		delete(side, key)
+		return
+	}
+	side[key] = bookEntry{key: key, price: price, amount: string(entry[2])}
+}
+
+// applyOrder applies an R0 entry [ORDER_ID, PRICE, AMOUNT].
+func (t *bookTracker) applyOrder(connID string, chanID int32, entry []json.RawMessage, orderID int64, price float64, amount float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	book, exists := t.books[bookKey(connID, chanID)]
+	if !exists {
+		return
+	}
+
+	key := string(entry[0])
+	delete(book.bids, key)
+	delete(book.asks, key)
+	if price == 0 {
+		return
+	}
+
+	side := book.bids
+	if amount < 0 {
+		side = book.asks
+	}
+	side[key] = bookEntry{key: key, price: price, id: orderID, amount: string(entry[2])}
+}
+
+// verify compares the server checksum with one computed over the mirrored
+// book. changed reports whether the book moved between verified and broken.
+func (t *bookTracker) verify(connID string, chanID int32, checksum int32) (result ChecksumResult, computed int32, changed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	book, exists := t.books[bookKey(connID, chanID)]
+	if !exists {
+		return ChecksumUnknown, 0, false
+	}
+
+	computed = book.checksum()
+	if computed != checksum {
+		book.verified = false
+		return ChecksumMismatch, computed, true
+	}
+
+	changed = !book.verified
+	book.verified = true
+	return ChecksumOK, computed, changed
+}
+
+func (b *bookState) checksum() int32 {
+	bids := sortedEntries(b.bids, func(x, y bookEntry) bool {
+		if x.price != y.price {
+			return x.price > y.price
+		}
+		return x.id < y.id
+	})
+	asks := sortedEntries(b.asks, func(x, y bookEntry) bool {
+		if x.price != y.price {
+			return x.price < y.price
+		}
+		return x.id < y.id
+	})
+
+	parts := make([]string, 0, checksumDepth*4)
+	for i := 0; i < checksumDepth; i++ {
+		if i < len(bids) {
+			parts = append(parts, bids[i].key, bids[i].amount)
+		}
+		if i < len(asks) {
+			parts = append(parts, asks[i].key, asks[i].amount)
+		}
+	}
+
+	return int32(crc32.ChecksumIEEE([]byte(strings.Join(parts, ":"))))
+}
+
+func sortedEntries(side map[string]bookEntry, less func(x, y bookEntry) bool) []bookEntry {
+	entries := make([]bookEntry, 0, len(side))
+	for _, e := range side {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return less(entries[i], entries[j]) })
+	return entries
+}
+
+func (r ChecksumResult) String() string {
+	switch r {
+	case ChecksumOK:
+		return "ok"
+	case ChecksumMismatch:
+		return "mismatch"
+	default:
+		return "unknown"
+	}
+}
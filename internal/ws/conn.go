@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -12,44 +13,57 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/trade-engine/data-controller/internal/config"
+	"github.com/trade-engine/data-controller/internal/tape"
+	"github.com/trade-engine/data-controller/pkg/schema"
 )
 
 type ConnectionManager struct {
-	cfg       *config.Config
-	logger    *zap.Logger
-	connMutex sync.RWMutex
+	cfg         *config.Config
+	logger      *zap.Logger
+	connMutex   sync.RWMutex
 	connections map[string]*Connection
-	router    *Router
-	ctx       context.Context
-	cancel    context.CancelFunc
+	router      *Router
+	tape        *tape.Writer
+	ctx         context.Context
+	cancel      context.CancelFunc
 }
 
 type Connection struct {
-	ID              string
-	URL             string
-	conn            *websocket.Conn
-	connMutex       sync.RWMutex
-	channels        map[int32]*ChannelInfo
-	channelsMutex   sync.RWMutex
-	lastHeartbeat   map[int32]time.Time
-	heartbeatMutex  sync.RWMutex
-	reconnectChan   chan struct{}
-	done            chan struct{}
-	logger          *zap.Logger
-	confFlags       int64
-	isConnected     bool
-	subscribeQueue  []SubscribeRequest
-	queueMutex      sync.Mutex
-	router          *Router
+	ID             string
+	URL            string
+	conn           wsConn
+	connMutex      sync.RWMutex
+	channels       map[int32]*ChannelInfo
+	channelsMutex  sync.RWMutex
+	lastHeartbeat  map[int32]time.Time
+	heartbeatMutex sync.RWMutex
+	reconnectChan  chan struct{}
+	done           chan struct{}
+	logger         *zap.Logger
+	confFlags      int64
+	isConnected    bool
+	subscribeQueue []SubscribeRequest
+	queueMutex     sync.Mutex
+	router         *Router
+	lastSeq        *int64
+	hasConnected   bool
+	tape           *tape.Writer
+	faults         *config.NetworkFaultsConfig
+	faultSessions  int
+	faultConn      *faultConn
+	faultTotals    FaultStats
+	reconnectDelay time.Duration
+	resubscribing  map[int32]bool
+	replayTS       int64 // recv_ts of the frame being replayed, zero when live
 }
 
 type ChannelInfo struct {
-	ID       int32
-	Channel  string
-	Symbol   string
-	Pair     string
-	SubID    *int64
-	SubReq   SubscribeRequest
+	ID      int32
+	Channel string
+	Symbol  string
+	Pair    string
+	SubID   *int64
+	SubReq  SubscribeRequest
 }
 
 type SubscribeRequest struct {
@@ -62,29 +76,65 @@ type SubscribeRequest struct {
 	SubID   *int64  `json:"subId,omitempty"`
 }
 
+const (
+	confFlagTimestamp = 32768
+	confFlagSeqAll    = 65536
+)
+
 type ConfMessage struct {
 	Event string `json:"event"`
 	Flags int64  `json:"flags"`
 }
 
 type InfoMessage struct {
-	Event   string      `json:"event"`
-	Version float64     `json:"version"`
-	ServID  string      `json:"serverId"`
-	Code    *int        `json:"code,omitempty"`
-	Msg     *string     `json:"msg,omitempty"`
+	Event   string  `json:"event"`
+	Version float64 `json:"version"`
+	ServID  string  `json:"serverId"`
+	Code    *int    `json:"code,omitempty"`
+	Msg     *string `json:"msg,omitempty"`
+}
+
+type EventMessage struct {
+	Event string `json:"event"`
+}
+
+type ErrorMessage struct {
+	Event   string `json:"event"`
+	Msg     string `json:"msg"`
+	Code    int    `json:"code"`
+	Channel string `json:"channel,omitempty"`
+	Symbol  string `json:"symbol,omitempty"`
+	SubID   *int64 `json:"subId,omitempty"`
 }
 
 type SubscribeResponse struct {
-	Event    string `json:"event"`
-	Channel  string `json:"channel"`
-	ChanID   int32  `json:"chanId"`
-	Symbol   string `json:"symbol"`
-	Pair     string `json:"pair"`
-	Prec     string `json:"prec,omitempty"`
-	Freq     string `json:"freq,omitempty"`
-	Len      string `json:"len,omitempty"`
-	SubID    *int64 `json:"subId,omitempty"`
+	Event   string `json:"event"`
+	Channel string `json:"channel"`
+	ChanID  int32  `json:"chanId"`
+	Symbol  string `json:"symbol"`
+	Pair    string `json:"pair"`
+	Prec    string `json:"prec,omitempty"`
+	Freq    string `json:"freq,omitempty"`
+	Len     string `json:"len,omitempty"`
+	SubID   *int64 `json:"subId,omitempty"`
+}
+
+// StorageChannel maps a Bitfinex channel to the dataset it is stored in; raw
+// books are "book" subscriptions with R0 precision.
+func (ci *ChannelInfo) StorageChannel() schema.Channel {
+	switch ci.Channel {
+	case "ticker":
+		return schema.ChannelTicker
+	case "trades":
+		return schema.ChannelTrades
+	case "book":
+		if ci.SubReq.Prec != nil && *ci.SubReq.Prec == "R0" {
+			return schema.ChannelRawBooks
+		}
+		return schema.ChannelBooks
+	default:
+		return schema.Channel(ci.Channel)
+	}
 }
 
 func NewConnectionManager(cfg *config.Config, logger *zap.Logger, router *Router) *ConnectionManager {
@@ -102,6 +152,24 @@ func NewConnectionManager(cfg *config.Config, logger *zap.Logger, router *Router
 func (cm *ConnectionManager) Start() error {
 	cm.logger.Info("Starting connection manager")
 
+	if cm.cfg.Debug.SimulateNetworkIssues {
+		cm.logger.Warn("Network fault injection enabled",
+			zap.Any("faults", cm.cfg.Debug.NetworkFaults))
+	}
+
+	if cm.cfg.Debug.SaveRawMessages {
+		dir := cm.cfg.Debug.RawTapePath
+		if dir == "" {
+			dir = filepath.Join(cm.cfg.Storage.BasePath, "tape")
+		}
+
+		tapeWriter, err := tape.NewWriter(dir, cm.cfg.Debug.RawTapeRotateMB, cm.logger)
+		if err != nil {
+			return fmt.Errorf("failed to create raw tape: %w", err)
+		}
+		cm.tape = tapeWriter
+	}
+
 	symbolsPerConn := make([][]string, 0)
 	maxChannelsPerConn := 30 // Bitfinex limit
 	channelsNeeded := 0
@@ -134,6 +202,7 @@ func (cm *ConnectionManager) Start() error {
 		symbolsPerConn = append(symbolsPerConn, cm.cfg.Symbols[i:end])
 	}
 
+	conns := make([]*Connection, 0, len(symbolsPerConn))
 	for i, symbols := range symbolsPerConn {
 		connID := fmt.Sprintf("conn-%d", i)
 		conn, err := cm.createConnection(connID, symbols)
@@ -145,12 +214,29 @@ func (cm *ConnectionManager) Start() error {
 		cm.connections[connID] = conn
 		cm.connMutex.Unlock()
 
+		conns = append(conns, conn)
+	}
+
+	setGlobalSubRequests(cm.subscribeRequests())
+
+	for _, conn := range conns {
 		go conn.run(cm.ctx)
 	}
 
 	return nil
 }
 
+func (cm *ConnectionManager) subscribeRequests() []SubscribeRequest {
+	cm.connMutex.RLock()
+	defer cm.connMutex.RUnlock()
+
+	requests := make([]SubscribeRequest, 0)
+	for _, conn := range cm.connections {
+		requests = append(requests, conn.subscribeQueue...)
+	}
+	return requests
+}
+
 func (cm *ConnectionManager) createConnection(connID string, symbols []string) (*Connection, error) {
 	conn := &Connection{
 		ID:             connID,
@@ -159,10 +245,21 @@ func (cm *ConnectionManager) createConnection(connID string, symbols []string) (
 		lastHeartbeat:  make(map[int32]time.Time),
 		reconnectChan:  make(chan struct{}, 1),
 		done:           make(chan struct{}),
+		reconnectDelay: cm.cfg.WebSocket.ReconnectInterval,
+		resubscribing:  make(map[int32]bool),
 		logger:         cm.logger.With(zap.String("conn_id", connID)),
 		confFlags:      cm.cfg.WebSocket.ConfFlags,
 		subscribeQueue: make([]SubscribeRequest, 0),
 		router:         cm.router,
+		tape:           cm.tape,
+	}
+
+	if conn.reconnectDelay <= 0 {
+		conn.reconnectDelay = 5 * time.Second
+	}
+
+	if cm.cfg.Debug.SimulateNetworkIssues {
+		conn.faults = &cm.cfg.Debug.NetworkFaults
 	}
 
 	for _, symbol := range symbols {
@@ -233,10 +330,18 @@ func (c *Connection) run(ctx context.Context) {
 
 		if err := c.connect(); err != nil {
 			c.logger.Error("Failed to connect", zap.Error(err))
-			time.Sleep(5 * time.Second)
+			c.emitControl(schema.ControlTypeConnectError, nil, err.Error())
+			time.Sleep(c.reconnectDelay)
 			continue
 		}
 
+		if c.hasConnected {
+			c.emitControl(schema.ControlTypeReconnect, nil, c.URL)
+		} else {
+			c.emitControl(schema.ControlTypeConnected, nil, c.URL)
+		}
+		c.hasConnected = true
+
 		if err := c.sendConf(); err != nil {
 			c.logger.Error("Failed to send conf", zap.Error(err))
 			c.disconnect()
@@ -254,12 +359,13 @@ func (c *Connection) run(ctx context.Context) {
 
 		c.readLoop(ctx)
 		c.disconnect()
+		c.emitControl(schema.ControlTypeDisconnected, nil, c.URL)
 
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(5 * time.Second):
-			c.logger.Info("Reconnecting after 5 seconds")
+		case <-time.After(c.reconnectDelay):
+			c.logger.Info("Reconnecting", zap.Duration("after", c.reconnectDelay))
 		}
 	}
 }
@@ -278,13 +384,38 @@ func (c *Connection) connect() error {
 
 	c.connMutex.Lock()
 	c.conn = conn
+	if c.faults != nil {
+		c.faultSessions++
+		c.faultConn = newFaultConn(conn, *c.faults, faultSeed(c.faults.Seed, c.ID, c.faultSessions), c.logger)
+		c.conn = c.faultConn
+	}
 	c.isConnected = true
 	c.connMutex.Unlock()
 
+	c.resetSession()
+
 	c.logger.Info("Connected successfully")
 	return nil
 }
 
+// resetSession drops the per-session state: channel IDs, heartbeats, the
+// sequence counter and mirrored books are all only valid for one socket.
+func (c *Connection) resetSession() {
+	c.channelsMutex.Lock()
+	c.channels = make(map[int32]*ChannelInfo)
+	c.resubscribing = make(map[int32]bool)
+	c.channelsMutex.Unlock()
+
+	c.heartbeatMutex.Lock()
+	c.lastHeartbeat = make(map[int32]time.Time)
+	c.heartbeatMutex.Unlock()
+
+	c.lastSeq = nil
+	if c.router != nil {
+		c.router.ForgetBooks(c.ID)
+	}
+}
+
 func (c *Connection) disconnect() {
 	c.connMutex.Lock()
 	defer c.connMutex.Unlock()
@@ -299,6 +430,18 @@ func (c *Connection) disconnect() {
 		c.conn.Close()
 		c.conn = nil
 	}
+	if c.faultConn != nil {
+		stats := c.faultConn.stats()
+		c.faultTotals.add(stats)
+		c.faultConn = nil
+		c.logger.Info("Injected network faults",
+			zap.Int64("frames", stats.Frames),
+			zap.Int64("dropped", stats.Dropped),
+			zap.Int64("duplicated", stats.Duplicated),
+			zap.Int64("reordered", stats.Reordered),
+			zap.Int64("stalled", stats.Stalled),
+			zap.Int64("closed", stats.Closed))
+	}
 	c.isConnected = false
 	c.logger.Info("Disconnected")
 }
@@ -346,6 +489,9 @@ func (c *Connection) readLoop(ctx context.Context) {
 		case <-c.done:
 			c.logger.Info("Read loop received done signal")
 			return
+		case <-c.reconnectChan:
+			c.logger.Info("Read loop received reconnect signal")
+			return
 		default:
 		}
 
@@ -370,14 +516,25 @@ func (c *Connection) readLoop(ctx context.Context) {
 			c.logger.Error("Read error", zap.Error(err))
 			return
 		}
+		recvTS := time.Now().UnixNano()
+
+		// Tape the frame before parsing so a parser bug cannot lose it.
+		if c.tape != nil {
+			c.tape.Record(tape.Frame{
+				RecvTS:   recvTS,
+				ConnID:   c.ID,
+				Endpoint: c.URL,
+				Data:     message,
+			})
+		}
 
-		if err := c.processMessage(message); err != nil {
+		if err := c.processMessage(message, recvTS); err != nil {
 			c.logger.Error("Failed to process message", zap.Error(err))
 		}
 	}
 }
 
-func (c *Connection) processMessage(data []byte) error {
+func (c *Connection) processMessage(data []byte, recvTS int64) error {
 	var rawMsg json.RawMessage
 	if err := json.Unmarshal(data, &rawMsg); err != nil {
 		return fmt.Errorf("failed to unmarshal raw message: %w", err)
@@ -385,17 +542,7 @@ func (c *Connection) processMessage(data []byte) error {
 
 	var array []json.RawMessage
 	if err := json.Unmarshal(rawMsg, &array); err != nil {
-		var info InfoMessage
-		if err := json.Unmarshal(rawMsg, &info); err == nil {
-			return c.handleInfoMessage(&info)
-		}
-
-		var subResp SubscribeResponse
-		if err := json.Unmarshal(rawMsg, &subResp); err == nil {
-			return c.handleSubscribeResponse(&subResp)
-		}
-
-		return fmt.Errorf("unknown message format")
+		return c.handleEventMessage(rawMsg)
 	}
 
 	if len(array) < 2 {
@@ -407,10 +554,22 @@ func (c *Connection) processMessage(data []byte) error {
 		return fmt.Errorf("failed to unmarshal channel ID: %w", err)
 	}
 
+	// Payload ends where the SEQ_ALL / TIMESTAMP trailer begins.
 	var msgType string
-	if err := json.Unmarshal(array[1], &msgType); err != nil {
-		return c.handleDataMessage(chanID, array[1:])
+	payloadEnd := 2
+	if err := json.Unmarshal(array[1], &msgType); err == nil {
+		switch msgType {
+		case "cs", "te", "tu":
+			payloadEnd = 3
+		}
 	}
+	if payloadEnd > len(array) {
+		payloadEnd = len(array)
+	}
+
+	meta := c.parseTrailer(array[payloadEnd:])
+	meta.RecvTS = recvTS
+	c.checkSequence(chanID, meta.Seq)
 
 	switch msgType {
 	case "hb":
@@ -419,16 +578,135 @@ func (c *Connection) processMessage(data []byte) error {
 		if len(array) >= 3 {
 			var checksum int32
 			if err := json.Unmarshal(array[2], &checksum); err == nil {
-				return c.handleChecksum(chanID, checksum)
+				return c.handleChecksum(chanID, checksum, meta)
 			}
 		}
 	default:
-		return c.handleDataMessage(chanID, array[1:])
+		return c.handleDataMessage(chanID, array[1:payloadEnd], meta)
 	}
 
 	return nil
 }
 
+// parseTrailer reads the public sequence number and server timestamp that
+// the SEQ_ALL and TIMESTAMP conf flags append to every channel message.
+func (c *Connection) parseTrailer(trailer []json.RawMessage) FrameMeta {
+	var meta FrameMeta
+
+	if c.confFlags&confFlagSeqAll != 0 && len(trailer) > 0 {
+		var seq int64
+		if err := json.Unmarshal(trailer[0], &seq); err == nil {
+			meta.Seq = &seq
+		}
+		trailer = trailer[1:]
+	}
+
+	if c.confFlags&confFlagTimestamp != 0 && len(trailer) > 0 {
+		var ts int64
+		if err := json.Unmarshal(trailer[len(trailer)-1], &ts); err == nil {
+			meta.SrvTS = &ts
+		}
+	}
+
+	return meta
+}
+
+// checkSequence records a gap control whenever the per-connection public
+// sequence number does not advance by exactly one.
+func (c *Connection) checkSequence(chanID int32, seq *int64) {
+	if seq == nil {
+		return
+	}
+
+	if c.lastSeq != nil && *seq != *c.lastSeq+1 {
+		last := *c.lastSeq
+		c.logger.Warn("Sequence gap detected",
+			zap.Int32("chan_id", chanID),
+			zap.Int64("last_seq", last),
+			zap.Int64("seq", *seq))
+
+		c.channelsMutex.RLock()
+		channelInfo := c.channels[chanID]
+		c.channelsMutex.RUnlock()
+
+		c.emitControl(schema.ControlTypeGap, channelInfo,
+			fmt.Sprintf("expected seq %d, got %d", last+1, *seq),
+			func(control *schema.Control) {
+				control.LastSeq = &last
+				control.Seq = seq
+			})
+	}
+
+	next := *seq
+	c.lastSeq = &next
+}
+
+func (c *Connection) handleEventMessage(rawMsg json.RawMessage) error {
+	var event EventMessage
+	if err := json.Unmarshal(rawMsg, &event); err != nil {
+		return fmt.Errorf("unknown message format")
+	}
+
+	switch event.Event {
+	case "info":
+		var info InfoMessage
+		if err := json.Unmarshal(rawMsg, &info); err != nil {
+			return fmt.Errorf("failed to unmarshal info message: %w", err)
+		}
+		return c.handleInfoMessage(&info)
+	case "subscribed":
+		var subResp SubscribeResponse
+		if err := json.Unmarshal(rawMsg, &subResp); err != nil {
+			return fmt.Errorf("failed to unmarshal subscribe response: %w", err)
+		}
+		return c.handleSubscribeResponse(&subResp)
+	case "unsubscribed":
+		var unsub struct {
+			ChanID int32 `json:"chanId"`
+		}
+		if err := json.Unmarshal(rawMsg, &unsub); err != nil {
+			return fmt.Errorf("failed to unmarshal unsubscribe response: %w", err)
+		}
+
+		c.channelsMutex.Lock()
+		channelInfo := c.channels[unsub.ChanID]
+		delete(c.channels, unsub.ChanID)
+		resubscribe := c.resubscribing[unsub.ChanID]
+		delete(c.resubscribing, unsub.ChanID)
+		c.channelsMutex.Unlock()
+
+		c.heartbeatMutex.Lock()
+		delete(c.lastHeartbeat, unsub.ChanID)
+		c.heartbeatMutex.Unlock()
+
+		if !resubscribe {
+			c.emitControl(schema.ControlTypeUnsubscribed, channelInfo, "unsubscribed")
+			return nil
+		}
+
+		c.emitControl(schema.ControlTypeUnsubscribed, channelInfo, "resubscribe")
+		if channelInfo == nil || channelInfo.SubReq.Event == "" {
+			return fmt.Errorf("no subscribe request to resubscribe channel %d", unsub.ChanID)
+		}
+		if err := c.sendMessage(channelInfo.SubReq); err != nil {
+			return fmt.Errorf("failed to resubscribe to %s:%s: %w", channelInfo.Channel, channelInfo.Symbol, err)
+		}
+		return nil
+	case "error":
+		var errMsg ErrorMessage
+		if err := json.Unmarshal(rawMsg, &errMsg); err != nil {
+			return fmt.Errorf("failed to unmarshal error message: %w", err)
+		}
+		return c.handleErrorMessage(&errMsg)
+	case "conf", "pong":
+		c.logger.Debug("Received event", zap.String("event", event.Event))
+		return nil
+	default:
+		c.logger.Warn("Unknown event", zap.String("event", event.Event))
+		return nil
+	}
+}
+
 func (c *Connection) handleInfoMessage(info *InfoMessage) error {
 	c.logger.Info("Received info message",
 		zap.String("event", info.Event),
@@ -438,6 +716,12 @@ func (c *Connection) handleInfoMessage(info *InfoMessage) error {
 	if info.Code != nil {
 		c.logger.Info("Info code received", zap.Int("code", *info.Code))
 
+		reason := fmt.Sprintf("code %d", *info.Code)
+		if info.Msg != nil {
+			reason = fmt.Sprintf("code %d: %s", *info.Code, *info.Msg)
+		}
+		c.emitControl(schema.ControlTypeInfo, nil, reason)
+
 		if *info.Code == 20051 || *info.Code == 20060 || *info.Code == 20061 {
 			c.logger.Info("Server maintenance or restart, triggering reconnect")
 			select {
@@ -450,6 +734,27 @@ func (c *Connection) handleInfoMessage(info *InfoMessage) error {
 	return nil
 }
 
+func (c *Connection) handleErrorMessage(errMsg *ErrorMessage) error {
+	c.logger.Error("Received error event",
+		zap.Int("code", errMsg.Code),
+		zap.String("msg", errMsg.Msg),
+		zap.String("channel", errMsg.Channel),
+		zap.String("symbol", errMsg.Symbol))
+
+	channelInfo := &ChannelInfo{
+		Channel: errMsg.Channel,
+		Symbol:  errMsg.Symbol,
+		SubID:   errMsg.SubID,
+	}
+	if req := c.findSubscribeRequest(errMsg.Channel, errMsg.Symbol, errMsg.SubID); req != nil {
+		channelInfo.SubReq = *req
+	}
+
+	c.emitControl(schema.ControlTypeSubscribeError, channelInfo,
+		fmt.Sprintf("code %d: %s", errMsg.Code, errMsg.Msg))
+	return nil
+}
+
 func (c *Connection) handleSubscribeResponse(resp *SubscribeResponse) error {
 	c.logger.Info("Channel subscribed",
 		zap.String("channel", resp.Channel),
@@ -465,6 +770,21 @@ func (c *Connection) handleSubscribeResponse(resp *SubscribeResponse) error {
 		SubID:   resp.SubID,
 	}
 
+	if req := c.findSubscribeRequest(resp.Channel, resp.Symbol, resp.SubID); req != nil {
+		channelInfo.SubReq = *req
+	} else if resp.Prec != "" {
+		prec, freq, length := resp.Prec, resp.Freq, resp.Len
+		channelInfo.SubReq = SubscribeRequest{
+			Event:   "subscribe",
+			Channel: resp.Channel,
+			Symbol:  resp.Symbol,
+			Prec:    &prec,
+			Freq:    &freq,
+			Len:     &length,
+			SubID:   resp.SubID,
+		}
+	}
+
 	c.channelsMutex.Lock()
 	c.channels[resp.ChanID] = channelInfo
 	c.channelsMutex.Unlock()
@@ -473,6 +793,37 @@ func (c *Connection) handleSubscribeResponse(resp *SubscribeResponse) error {
 	c.lastHeartbeat[resp.ChanID] = time.Now()
 	c.heartbeatMutex.Unlock()
 
+	if resp.Channel == "book" && c.router != nil {
+		c.router.ExpectSnapshot(c.ID, resp.ChanID)
+	}
+
+	reason := fmt.Sprintf("%s %s", resp.Channel, resp.Symbol)
+	if resp.Prec != "" {
+		reason = fmt.Sprintf("%s %s prec=%s freq=%s len=%s", resp.Channel, resp.Symbol, resp.Prec, resp.Freq, resp.Len)
+	}
+	c.emitControl(schema.ControlTypeSubscribed, channelInfo, reason)
+
+	return nil
+}
+
+// findSubscribeRequest looks up the request behind a subscribe response,
+// first by subId and then by channel and symbol.
+func (c *Connection) findSubscribeRequest(channel, symbol string, subID *int64) *SubscribeRequest {
+	if subID != nil {
+		if req := getSubRequestBySubID(*subID); req != nil {
+			return req
+		}
+	}
+
+	c.queueMutex.Lock()
+	defer c.queueMutex.Unlock()
+
+	for _, req := range c.subscribeQueue {
+		if req.Channel == channel && req.Symbol == symbol && req.SubID == nil {
+			found := req
+			return &found
+		}
+	}
 	return nil
 }
 
@@ -484,15 +835,74 @@ func (c *Connection) handleHeartbeat(chanID int32) error {
 	return nil
 }
 
-func (c *Connection) handleChecksum(chanID int32, checksum int32) error {
+func (c *Connection) handleChecksum(chanID int32, checksum int32, meta FrameMeta) error {
 	c.logger.Debug("Received checksum",
 		zap.Int32("chan_id", chanID),
 		zap.Int32("checksum", checksum))
 
+	if c.router == nil {
+		return nil
+	}
+
+	result, computed, changed := c.router.VerifyChecksum(c.ID, chanID, checksum)
+	if !changed {
+		return nil
+	}
+
+	c.channelsMutex.RLock()
+	channelInfo := c.channels[chanID]
+	c.channelsMutex.RUnlock()
+
+	controlType := schema.ControlTypeChecksumOK
+	if result == ChecksumMismatch {
+		controlType = schema.ControlTypeChecksumMismatch
+		c.logger.Warn("Checksum mismatch",
+			zap.Int32("chan_id", chanID),
+			zap.Int32("expected", checksum),
+			zap.Int32("computed", computed))
+	}
+
+	c.emitControl(controlType, channelInfo,
+		fmt.Sprintf("server %d, computed %d", checksum, computed),
+		func(control *schema.Control) {
+			control.Checksum = &checksum
+			control.Seq = meta.Seq
+			control.WSTS = meta.SrvTS
+		})
+
+	if result == ChecksumMismatch {
+		return c.resubscribe(chanID)
+	}
+	return nil
+}
+
+// resubscribe fetches a fresh snapshot for a channel whose mirrored book no
+// longer matches the server. It unsubscribes first; the subscribe request is
+// sent again once the unsubscribe is confirmed.
+func (c *Connection) resubscribe(chanID int32) error {
+	c.channelsMutex.Lock()
+	if c.resubscribing[chanID] {
+		c.channelsMutex.Unlock()
+		return nil
+	}
+	c.resubscribing[chanID] = true
+	c.channelsMutex.Unlock()
+
+	c.logger.Info("Resubscribing channel", zap.Int32("chan_id", chanID))
+	unsub := map[string]interface{}{
+		"event":  "unsubscribe",
+		"chanId": chanID,
+	}
+	if err := c.sendMessage(unsub); err != nil {
+		c.channelsMutex.Lock()
+		delete(c.resubscribing, chanID)
+		c.channelsMutex.Unlock()
+		return fmt.Errorf("failed to unsubscribe channel %d: %w", chanID, err)
+	}
 	return nil
 }
 
-func (c *Connection) handleDataMessage(chanID int32, data []json.RawMessage) error {
+func (c *Connection) handleDataMessage(chanID int32, data []json.RawMessage, meta FrameMeta) error {
 	c.channelsMutex.RLock()
 	channelInfo, exists := c.channels[chanID]
 	c.channelsMutex.RUnlock()
@@ -510,13 +920,57 @@ func (c *Connection) handleDataMessage(chanID int32, data []json.RawMessage) err
 
 	// Route message to router if available
 	if c.router != nil {
-		return c.router.RouteMessage(chanID, channelInfo, data, c.ID)
+		return c.router.RouteMessage(chanID, channelInfo, data, c.ID, meta)
 	}
 
 	c.logger.Warn("No router available for data routing")
 	return nil
 }
 
+// now is the receive time of events raised by the current frame: the recorded
+// time of the frame during replay and the wall clock when live.
+func (c *Connection) now() time.Time {
+	if c.replayTS != 0 {
+		return time.Unix(0, c.replayTS)
+	}
+	return time.Now()
+}
+
+// emitControl records a connection or channel event as a Control row.
+// channelInfo may be nil for connection-wide events.
+func (c *Connection) emitControl(controlType schema.ControlType, channelInfo *ChannelInfo, reason string, opts ...func(*schema.Control)) {
+	if c.router == nil {
+		return
+	}
+
+	now := c.now()
+	control := &schema.Control{
+		CommonFields: schema.CommonFields{
+			Exchange:  schema.ExchangeBitfinex,
+			ConnID:    c.ID,
+			ConfFlags: c.confFlags,
+			RecvTS:    now.UnixNano(),
+		},
+		Type:      controlType,
+		Reason:    reason,
+		Timestamp: now.UTC(),
+	}
+
+	if channelInfo != nil {
+		control.Channel = channelInfo.StorageChannel()
+		control.Symbol = channelInfo.Symbol
+		control.PairOrCurrency = channelInfo.Pair
+		control.ChanID = channelInfo.ID
+		control.SubID = channelInfo.SubID
+	}
+
+	for _, opt := range opts {
+		opt(control)
+	}
+
+	c.router.EmitControl(control)
+}
+
 func (c *Connection) heartbeatMonitor(ctx context.Context) {
 	ticker := time.NewTicker(15 * time.Second)
 	defer ticker.Stop()
@@ -535,21 +989,36 @@ func (c *Connection) checkHeartbeats() {
 	now := time.Now()
 	timeout := 45 * time.Second
 
+	missed := make(map[int32]time.Duration)
 	c.heartbeatMutex.RLock()
 	for chanID, lastHB := range c.lastHeartbeat {
 		if now.Sub(lastHB) > timeout {
-			c.logger.Warn("Heartbeat timeout",
-				zap.Int32("chan_id", chanID),
-				zap.Duration("since_last", now.Sub(lastHB)))
-
-			select {
-			case c.reconnectChan <- struct{}{}:
-			default:
-			}
-			break
+			missed[chanID] = now.Sub(lastHB)
 		}
 	}
 	c.heartbeatMutex.RUnlock()
+
+	if len(missed) == 0 {
+		return
+	}
+
+	for chanID, since := range missed {
+		c.logger.Warn("Heartbeat timeout",
+			zap.Int32("chan_id", chanID),
+			zap.Duration("since_last", since))
+
+		c.channelsMutex.RLock()
+		channelInfo := c.channels[chanID]
+		c.channelsMutex.RUnlock()
+
+		c.emitControl(schema.ControlTypeHeartbeatMissed, channelInfo,
+			fmt.Sprintf("no heartbeat for %s", since.Round(time.Second)))
+	}
+
+	select {
+	case c.reconnectChan <- struct{}{}:
+	default:
+	}
 }
 
 func (c *Connection) pingRoutine(ctx context.Context) {
@@ -577,6 +1046,24 @@ func (c *Connection) ping() error {
 	return c.sendMessage(pingMsg)
 }
 
+// FaultStats sums what the fault injector did across all connections. It is
+// all zero unless debug.simulate_network_issues is on.
+func (cm *ConnectionManager) FaultStats() FaultStats {
+	cm.connMutex.RLock()
+	defer cm.connMutex.RUnlock()
+
+	var total FaultStats
+	for _, conn := range cm.connections {
+		conn.connMutex.RLock()
+		total.add(conn.faultTotals)
+		if conn.faultConn != nil {
+			total.add(conn.faultConn.stats())
+		}
+		conn.connMutex.RUnlock()
+	}
+	return total
+}
+
 func (cm *ConnectionManager) Stop() {
 	cm.logger.Info("Stopping connection manager")
 	cm.cancel()
@@ -606,5 +1093,11 @@ func (cm *ConnectionManager) Stop() {
 		cm.logger.Info("Connection stopped", zap.String("conn_id", conn.ID))
 	}
 
+	if cm.tape != nil {
+		if err := cm.tape.Close(); err != nil {
+			cm.logger.Error("Failed to close raw tape", zap.Error(err))
+		}
+	}
+
 	cm.logger.Info("All connections stopped")
-}
\ No newline at end of file
+}
@@ -0,0 +1,249 @@
+package ws
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/internal/bfxmock"
+	"github.com/trade-engine/data-controller/internal/config"
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+// waitFor polls the recorded controls until cond holds.
+func (h *recordingHandler) waitFor(t *testing.T, what string, cond func([]schema.Control) bool) []schema.Control {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if controls := h.snapshot(); cond(controls) {
+			return controls
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s; got %s", what, describeControls(h.snapshot()))
+	return nil
+}
+
+func countControls(controls []schema.Control, controlType schema.ControlType, channel schema.Channel) int {
+	n := 0
+	for _, control := range controls {
+		if control.Type == controlType && (channel == "" || control.Channel == channel) {
+			n++
+		}
+	}
+	return n
+}
+
+func hasControl(controlType schema.ControlType, channel schema.Channel) func([]schema.Control) bool {
+	return func(controls []schema.Control) bool {
+		return countControls(controls, controlType, channel) > 0
+	}
+}
+
+// startCollector connects a ConnectionManager for testSymbol's trades and P0
+// book to a mock exchange running scenario.
+func startCollector(t *testing.T, scenario bfxmock.Scenario) (*bfxmock.Server, *recordingHandler) {
+	t.Helper()
+	return startCollectorWithFlags(t, scenario, bfxmock.FlagTimestamp|bfxmock.FlagSeqAll|bfxmock.FlagOBChecksum)
+}
+
+// startCollectorWithFlags is startCollector with the given conf flags.
+func startCollectorWithFlags(t *testing.T, scenario bfxmock.Scenario, confFlags int64) (*bfxmock.Server, *recordingHandler) {
+	t.Helper()
+
+	srv := bfxmock.NewTestServer(bfxmock.Options{
+		HeartbeatInterval: time.Second,
+		UpdateInterval:    20 * time.Millisecond,
+		Scenario:          scenario,
+	})
+
+	cfg := &config.Config{
+		WebSocket: config.WebSocket{
+			URL:               srv.URL(),
+			ReconnectInterval: 100 * time.Millisecond,
+			ConfFlags:         confFlags,
+		},
+		Symbols: []string{testSymbol},
+		Channels: config.Channels{
+			Trades: config.TradesConfig{Enabled: true},
+			Books: config.BooksConfig{
+				Enabled:   true,
+				Precision: "P0",
+				Frequency: "F0",
+				Length:    25,
+			},
+		},
+		Storage: config.Storage{BasePath: t.TempDir()},
+	}
+
+	logger := zap.NewNop()
+	router, err := NewRouter(cfg, logger)
+	if err != nil {
+		t.Fatalf("NewRouter: %v", err)
+	}
+	handler := &recordingHandler{}
+	router.SetHandler(handler)
+
+	cm := NewConnectionManager(cfg, logger, router)
+	if err := cm.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	t.Cleanup(func() {
+		cm.Stop()
+		router.Close()
+		srv.Close()
+	})
+
+	handler.waitFor(t, "connected", hasControl(schema.ControlTypeConnected, ""))
+	return srv, handler
+}
+
+func TestConnectionReconnectsAfterDroppedSocket(t *testing.T) {
+	srv, handler := startCollector(t, bfxmock.Scenario{DropAfterFrames: 30})
+
+	controls := handler.waitFor(t, "reconnect", hasControl(schema.ControlTypeReconnect, ""))
+	if countControls(controls, schema.ControlTypeDisconnected, "") == 0 {
+		t.Errorf("reconnect without a disconnected control: %s", describeControls(controls))
+	}
+
+	// Both channels are subscribed again on the new socket.
+	handler.waitFor(t, "resubscribed channels", func(controls []schema.Control) bool {
+		return countControls(controls, schema.ControlTypeSubscribed, schema.ChannelTrades) >= 2 &&
+			countControls(controls, schema.ControlTypeSubscribed, schema.ChannelBooks) >= 2
+	})
+	if sessions := srv.Sessions(); sessions < 2 {
+		t.Errorf("server saw %d sessions, want at least 2", sessions)
+	}
+}
+
+func TestConnectionReconnectsOnMaintenance(t *testing.T) {
+	srv, handler := startCollector(t, bfxmock.Scenario{})
+
+	handler.waitFor(t, "book subscription", hasControl(schema.ControlTypeSubscribed, schema.ChannelBooks))
+	srv.SendInfo(bfxmock.CodeMaintenanceStart, "Stopping. Please try to reconnect")
+
+	controls := handler.waitFor(t, "reconnect", hasControl(schema.ControlTypeReconnect, ""))
+
+	infoSeen := false
+	for _, control := range controls {
+		if control.Type == schema.ControlTypeReconnect {
+			break
+		}
+		if control.Type == schema.ControlTypeInfo && strings.Contains(control.Reason, "20051") {
+			infoSeen = true
+		}
+	}
+	if !infoSeen {
+		t.Errorf("no 20051 info control before the reconnect: %s", describeControls(controls))
+	}
+	if sessions := srv.Sessions(); sessions < 2 {
+		t.Errorf("server saw %d sessions, want at least 2", sessions)
+	}
+}
+
+func TestConnectionResubscribesOnChecksumMismatch(t *testing.T) {
+	srv, handler := startCollector(t, bfxmock.Scenario{})
+
+	controls := handler.waitFor(t, "verified book", hasControl(schema.ControlTypeChecksumOK, schema.ChannelBooks))
+	var oldChanID int32
+	for _, control := range controls {
+		if control.Type == schema.ControlTypeChecksumOK {
+			oldChanID = control.ChanID
+		}
+	}
+
+	srv.CorruptNextChecksum()
+
+	controls = handler.waitFor(t, "checksum mismatch", hasControl(schema.ControlTypeChecksumMismatch, schema.ChannelBooks))
+	for _, control := range controls {
+		if control.Type != schema.ControlTypeChecksumMismatch {
+			continue
+		}
+		if control.ChanID != oldChanID || control.Checksum == nil || control.Seq == nil {
+			t.Errorf("mismatch control has chan %d checksum %v seq %v, want chan %d with both set",
+				control.ChanID, control.Checksum, control.Seq, oldChanID)
+		}
+		break
+	}
+
+	// The book is unsubscribed, subscribed again on a new chanId and the
+	// fresh snapshot verifies.
+	controls = handler.waitFor(t, "verified resubscribed book", func(controls []schema.Control) bool {
+		for _, control := range controls {
+			if control.Type == schema.ControlTypeChecksumOK && control.ChanID != oldChanID {
+				return true
+			}
+		}
+		return false
+	})
+
+	unsubscribed := false
+	for _, control := range controls {
+		if control.Type == schema.ControlTypeUnsubscribed && control.ChanID == oldChanID {
+			unsubscribed = control.Reason == "resubscribe"
+		}
+	}
+	if !unsubscribed {
+		t.Errorf("chan %d was not unsubscribed for resubscribe: %s", oldChanID, describeControls(controls))
+	}
+	if n := countControls(controls, schema.ControlTypeSubscribed, schema.ChannelBooks); n != 2 {
+		t.Errorf("book subscribed %d times, want 2", n)
+	}
+	if n := countControls(controls, schema.ControlTypeReconnect, ""); n != 0 {
+		t.Errorf("checksum mismatch reconnected the socket %d times", n)
+	}
+	if n := countControls(controls, schema.ControlTypeSubscribed, schema.ChannelTrades); n != 1 {
+		t.Errorf("trades subscribed %d times, want 1", n)
+	}
+}
+
+func TestConnectionAppliesBulkBookUpdates(t *testing.T) {
+	_, handler := startCollectorWithFlags(t, bfxmock.Scenario{},
+		bfxmock.FlagTimestamp|bfxmock.FlagSeqAll|bfxmock.FlagOBChecksum|bfxmock.FlagBulkUpdates)
+
+	handler.waitFor(t, "verified book", hasControl(schema.ControlTypeChecksumOK, schema.ChannelBooks))
+
+	// Every bulk frame is followed by a checksum; treating one as a fresh
+	// snapshot would wipe the mirror and fail it.
+	time.Sleep(time.Second)
+	controls := handler.snapshot()
+	if n := countControls(controls, schema.ControlTypeChecksumMismatch, ""); n != 0 {
+		t.Errorf("got %d checksum mismatches on bulk updates: %s", n, describeControls(controls))
+	}
+	if n := countControls(controls, schema.ControlTypeUnsubscribed, schema.ChannelBooks); n != 0 {
+		t.Errorf("book unsubscribed %d times, want 0", n)
+	}
+	if n := countControls(controls, schema.ControlTypeSubscribed, schema.ChannelBooks); n != 1 {
+		t.Errorf("book subscribed %d times, want 1", n)
+	}
+}
+
+func TestConnectionReportsSequenceGap(t *testing.T) {
+	srv, handler := startCollector(t, bfxmock.Scenario{})
+
+	handler.waitFor(t, "book subscription", hasControl(schema.ControlTypeSubscribed, schema.ChannelBooks))
+	srv.SkipNextSeq()
+
+	controls := handler.waitFor(t, "gap", hasControl(schema.ControlTypeGap, ""))
+	for _, control := range controls {
+		if control.Type != schema.ControlTypeGap {
+			continue
+		}
+		if control.LastSeq == nil || control.Seq == nil {
+			t.Fatalf("gap control without sequence numbers: %+v", control)
+		}
+		if *control.Seq != *control.LastSeq+2 {
+			t.Errorf("gap from %d to %d, want one missing frame", *control.LastSeq, *control.Seq)
+		}
+		if control.Symbol != testSymbol {
+			t.Errorf("gap control symbol %q, want %q", control.Symbol, testSymbol)
+		}
+	}
+	if n := countControls(controls, schema.ControlTypeGap, ""); n != 1 {
+		t.Errorf("got %d gap controls, want 1", n)
+	}
+}
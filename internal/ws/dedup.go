@@ -0,0 +1,125 @@
+package ws
+
+import (
+	"sync"
+
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+// tradeDedup remembers the most recent trade messages per symbol. It is keyed
+// by symbol rather than chanId so the window survives reconnects and catches
+// the trades repeated in the snapshot that follows every resubscribe. Within
+// a symbol, messages are keyed by schema.TradeKey, so the "tu" that follows a
+// "te" is not a duplicate of it. A snapshot trade repeats whichever of the two
+// was delivered, so it matches either; a new one is recorded under the key of
+// the messages msg_type lets through.
+type tradeDedup struct {
+	size    int
+	mu      sync.Mutex
+	symbols map[string]*idWindow
+	runs    map[string]*dedupRun
+	// snapshotUpdate is the Update of the key a snapshot trade is recorded
+	// under: false when only "te" messages are kept.
+	snapshotUpdate bool
+}
+
+type idWindow struct {
+	keys []schema.TradeKey
+	next int
+	seen map[schema.TradeKey]struct{}
+}
+
+// dedupRun collects the duplicates of a symbol dropped since its last
+// delivered trade, so that a repeated snapshot costs one Control row.
+type dedupRun struct {
+	first schema.CommonFields
+	count int64
+	minID int64
+	maxID int64
+}
+
+func newTradeDedup(size int, msgType schema.MessageType) *tradeDedup {
+	if size <= 0 {
+		size = 10000
+	}
+
+	return &tradeDedup{
+		size:           size,
+		symbols:        make(map[string]*idWindow),
+		runs:           make(map[string]*dedupRun),
+		snapshotUpdate: msgType != schema.MessageTypeTE,
+	}
+}
+
+// duplicate reports whether trade was already recorded for its symbol and
+// records it if not. Duplicates are added to the symbol's run. The oldest key
+// is evicted once the window is full.
+func (d *tradeDedup) duplicate(trade *schema.Trade) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	w, exists := d.symbols[trade.Symbol]
+	if !exists {
+		w = &idWindow{
+			keys: make([]schema.TradeKey, 0, d.size),
+			seen: make(map[schema.TradeKey]struct{}, d.size),
+		}
+		d.symbols[trade.Symbol] = w
+	}
+
+	key := trade.Key()
+	var dup bool
+	if trade.IsSnapshot {
+		_, te := w.seen[schema.TradeKey{TradeID: trade.TradeID}]
+		_, tu := w.seen[schema.TradeKey{TradeID: trade.TradeID, Update: true}]
+		dup = te || tu
+		key.Update = d.snapshotUpdate
+	} else {
+		_, dup = w.seen[key]
+	}
+	if dup {
+		run, exists := d.runs[trade.Symbol]
+		if !exists {
+			run = &dedupRun{first: trade.CommonFields, minID: trade.TradeID, maxID: trade.TradeID}
+			d.runs[trade.Symbol] = run
+		}
+		run.count++
+		run.minID = min(run.minID, trade.TradeID)
+		run.maxID = max(run.maxID, trade.TradeID)
+		return true
+	}
+
+	if len(w.keys) < d.size {
+		w.keys = append(w.keys, key)
+	} else {
+		delete(w.seen, w.keys[w.next])
+		w.keys[w.next] = key
+		w.next = (w.next + 1) % d.size
+	}
+	w.seen[key] = struct{}{}
+
+	return false
+}
+
+// takeRun returns and clears the duplicates collected for symbol, or nil.
+func (d *tradeDedup) takeRun(symbol string) *dedupRun {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	run := d.runs[symbol]
+	delete(d.runs, symbol)
+	return run
+}
+
+// takeRuns returns and clears the duplicates collected for every symbol.
+func (d *tradeDedup) takeRuns() []*dedupRun {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	runs := make([]*dedupRun, 0, len(d.runs))
+	for symbol, run := range d.runs {
+		runs = append(runs, run)
+		delete(d.runs, symbol)
+	}
+	return runs
+}
@@ -0,0 +1,184 @@
+package ws
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/internal/config"
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+const testSymbol = "tBTCUSD"
+
+func describeControls(controls []schema.Control) string {
+	parts := make([]string, 0, len(controls))
+	for _, control := range controls {
+		parts = append(parts, string(control.Type)+"("+string(control.Channel)+" "+control.Reason+")")
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+// tradeRecorder keeps the trades and controls the router delivers.
+type tradeRecorder struct {
+	recordingHandler
+	trades []schema.Trade
+}
+
+func (h *tradeRecorder) HandleTrade(trade *schema.Trade) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.trades = append(h.trades, *trade)
+}
+
+func rawFrame(parts ...string) []json.RawMessage {
+	frame := make([]json.RawMessage, len(parts))
+	for i, part := range parts {
+		frame[i] = json.RawMessage(part)
+	}
+	return frame
+}
+
+func TestTradeDedupKeepsUpdatesAndAggregatesDuplicates(t *testing.T) {
+	cfg := &config.Config{Storage: config.Storage{BasePath: t.TempDir()}}
+	router, err := NewRouter(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &tradeRecorder{}
+	router.SetHandler(handler)
+
+	info := &ChannelInfo{ID: 7, Channel: "trades", Symbol: testSymbol, Pair: "BTCUSD"}
+	route := func(data []json.RawMessage) {
+		t.Helper()
+		if err := router.RouteMessage(info.ID, info, data, "conn-0", FrameMeta{RecvTS: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	route(rawFrame(`"te"`, `[1,1700000000000,0.5,100]`))
+	route(rawFrame(`"tu"`, `[1,1700000000000,0.5,100]`))
+	route(rawFrame(`"te"`, `[2,1700000000001,0.5,101]`))
+	route(rawFrame(`"tu"`, `[2,1700000000001,0.5,101]`))
+	// The snapshot after a resubscribe repeats trades 1 and 2.
+	route(rawFrame(`[[3,1700000000002,0.5,102],[2,1700000000001,0.5,101],[1,1700000000000,0.5,100]]`))
+	route(rawFrame(`"tu"`, `[3,1700000000002,0.5,102]`))
+	route(rawFrame(`"tu"`, `[3,1700000000002,0.5,102]`))
+	router.Close()
+
+	want := []schema.MessageType{"te", "tu", "te", "tu", "snapshot"}
+	if len(handler.trades) != len(want) {
+		t.Fatalf("delivered %d trades, want %d", len(handler.trades), len(want))
+	}
+	for i, trade := range handler.trades {
+		if trade.MsgType != want[i] {
+			t.Errorf("trade %d is %s %d, want %s", i, trade.MsgType, trade.TradeID, want[i])
+		}
+	}
+
+	var dedups []schema.Control
+	for _, control := range handler.snapshot() {
+		if control.Type == schema.ControlTypeDedup {
+			dedups = append(dedups, control)
+		}
+	}
+	if len(dedups) != 2 {
+		t.Fatalf("got %d dedup controls, want 2: %s", len(dedups), describeControls(dedups))
+	}
+	if dedups[0].Count != 2 || dedups[0].Reason != "2 duplicate trades, trade_id 1-2" {
+		t.Errorf("snapshot duplicates recorded as count %d %q", dedups[0].Count, dedups[0].Reason)
+	}
+	if dedups[1].Count != 2 || dedups[1].Symbol != testSymbol {
+		t.Errorf("repeated tu recorded as count %d for %q, want 2 for %q", dedups[1].Count, dedups[1].Symbol, testSymbol)
+	}
+}
+
+// TestTradeDedupMatchesSnapshotsToFilter reconnects between trades, so each
+// snapshot arrives on a new channel and repeats trades delivered as "te".
+func TestTradeDedupMatchesSnapshotsToFilter(t *testing.T) {
+	tests := []struct {
+		msgType string
+		frames  [][]json.RawMessage
+		want    []string
+		dropped int64
+	}{
+		{
+			msgType: "te",
+			frames: [][]json.RawMessage{
+				rawFrame(`"te"`, `[1,1700000000000,0.5,100]`),
+				rawFrame(`"tu"`, `[1,1700000000000,0.5,100]`),
+				rawFrame(`"te"`, `[2,1700000000001,0.5,101]`),
+				nil,
+				rawFrame(`[[3,1700000000002,0.5,102],[2,1700000000001,0.5,101],[1,1700000000000,0.5,100]]`),
+				rawFrame(`"te"`, `[4,1700000000003,0.5,103]`),
+				nil,
+				// Trade 3 came in the last snapshot; it is not new either.
+				rawFrame(`[[4,1700000000003,0.5,103],[3,1700000000002,0.5,102]]`),
+			},
+			want:    []string{"te 1", "te 2", "snapshot 3", "te 4"},
+			dropped: 4,
+		},
+		{
+			// The "tu" of trade 2 was not in yet when the connection dropped.
+			msgType: "all",
+			frames: [][]json.RawMessage{
+				rawFrame(`"te"`, `[1,1700000000000,0.5,100]`),
+				rawFrame(`"tu"`, `[1,1700000000000,0.5,100]`),
+				rawFrame(`"te"`, `[2,1700000000001,0.5,101]`),
+				nil,
+				rawFrame(`[[2,1700000000001,0.5,101],[1,1700000000000,0.5,100]]`),
+				rawFrame(`"tu"`, `[2,1700000000001,0.5,101]`),
+			},
+			want:    []string{"te 1", "tu 1", "te 2", "tu 2"},
+			dropped: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.msgType, func(t *testing.T) {
+			cfg := &config.Config{Storage: config.Storage{BasePath: t.TempDir()}}
+			cfg.Channels.Trades.MsgType = tt.msgType
+			router, err := NewRouter(cfg, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := &tradeRecorder{}
+			router.SetHandler(handler)
+
+			info := &ChannelInfo{ID: 7, Channel: "trades", Symbol: testSymbol, Pair: "BTCUSD"}
+			connID := "conn-0"
+			for i, frame := range tt.frames {
+				if frame == nil {
+					info = &ChannelInfo{ID: info.ID + 1, Channel: "trades", Symbol: testSymbol, Pair: "BTCUSD"}
+					connID += "+"
+					continue
+				}
+				if err := router.RouteMessage(info.ID, info, frame, connID, FrameMeta{RecvTS: int64(i + 1)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			router.Close()
+
+			got := make([]string, 0, len(handler.trades))
+			for _, trade := range handler.trades {
+				got = append(got, string(trade.MsgType)+" "+strconv.FormatInt(trade.TradeID, 10))
+			}
+			if strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+				t.Errorf("delivered %v, want %v", got, tt.want)
+			}
+
+			var dropped int64
+			for _, control := range handler.snapshot() {
+				if control.Type == schema.ControlTypeDedup {
+					dropped += control.Count
+				}
+			}
+			if dropped != tt.dropped {
+				t.Errorf("dedup controls count %d trades, want %d", dropped, tt.dropped)
+			}
+		})
+	}
+}
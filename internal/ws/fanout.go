@@ -0,0 +1,255 @@
+package ws
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/internal/config"
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+type HandlerStats struct {
+	Name   string
+	Queues []QueueStats
+	MaxLag time.Duration
+}
+
+// handlerQueues is the private set of queues feeding one registered handler,
+// so a slow consumer only backs up (or drops from) its own queues.
+type handlerQueues struct {
+	name     string
+	handler  MessageHandler
+	tickers  *queue[*schema.Ticker]
+	trades   *queue[*schema.Trade]
+	books    *queue[*schema.BookLevel]
+	rawBooks *queue[*schema.RawBookEvent]
+	controls *queue[*schema.Control]
+	dataWG   sync.WaitGroup
+	ctrlWG   sync.WaitGroup
+}
+
+func parsePolicies(bp config.BackpressureConfig) (map[schema.Channel]BackpressurePolicy, error) {
+	policies := make(map[schema.Channel]BackpressurePolicy)
+	for channel, value := range map[schema.Channel]string{
+		schema.ChannelTicker:   bp.Ticker,
+		schema.ChannelTrades:   bp.Trades,
+		schema.ChannelBooks:    bp.Books,
+		schema.ChannelRawBooks: bp.RawBooks,
+		"controls":             bp.Controls,
+	} {
+		policy, err := ParseBackpressurePolicy(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backpressure policy for %s: %w", channel, err)
+		}
+		policies[channel] = policy
+	}
+	return policies, nil
+}
+
+// AddHandler registers a consumer under name. Each handler gets its own queues
+// sized by performance.buffer_size and governed by the given policies.
+func (r *Router) AddHandler(name string, handler MessageHandler, bp config.BackpressureConfig) error {
+	if name == "" || filepath.Base(name) != name {
+		return fmt.Errorf("invalid handler name %q", name)
+	}
+
+	policies, err := parsePolicies(bp)
+	if err != nil {
+		return err
+	}
+
+	spillDir := filepath.Join(r.spillDir, name)
+	if bp.SpillPath != "" {
+		spillDir = filepath.Join(bp.SpillPath, name)
+	}
+
+	// Hold the lock while the queues are created: a spill queue picks up the
+	// files left in its directory, which must not belong to a live handler.
+	r.handlersMutex.Lock()
+	defer r.handlersMutex.Unlock()
+
+	if _, exists := r.handlers[name]; exists {
+		return fmt.Errorf("handler %q already registered", name)
+	}
+
+	logger := r.logger.With(zap.String("handler", name))
+	hq := &handlerQueues{
+		name:    name,
+		handler: handler,
+	}
+
+	hq.tickers = newQueue(string(schema.ChannelTicker), policies[schema.ChannelTicker], r.bufferSize, spillDir, logger,
+		func(t *schema.Ticker) { hq.recordDrop(&t.CommonFields, policies[schema.ChannelTicker]) })
+	hq.trades = newQueue(string(schema.ChannelTrades), policies[schema.ChannelTrades], r.bufferSize, spillDir, logger,
+		func(t *schema.Trade) { hq.recordDrop(&t.CommonFields, policies[schema.ChannelTrades]) })
+	hq.books = newQueue(string(schema.ChannelBooks), policies[schema.ChannelBooks], r.bufferSize, spillDir, logger,
+		func(l *schema.BookLevel) { hq.recordDrop(&l.CommonFields, policies[schema.ChannelBooks]) })
+	hq.rawBooks = newQueue(string(schema.ChannelRawBooks), policies[schema.ChannelRawBooks], r.bufferSize, spillDir, logger,
+		func(e *schema.RawBookEvent) { hq.recordDrop(&e.CommonFields, policies[schema.ChannelRawBooks]) })
+	hq.controls = newQueue("controls", policies["controls"], r.bufferSize, spillDir, logger,
+		func(c *schema.Control) {
+			logger.Error("Control queue full, control lost",
+				zap.String("type", string(c.Type)),
+				zap.String("reason", c.Reason))
+		})
+
+	hq.start()
+	r.handlers[name] = hq
+	r.listHandlers()
+
+	r.logger.Info("Handler registered", zap.String("handler", name))
+	return nil
+}
+
+// RemoveHandler unregisters name and returns once everything already queued
+// for it has been delivered. Dispatches still blocked on its queues give up
+// when they close, and count what they held as dropped.
+func (r *Router) RemoveHandler(name string) {
+	r.handlersMutex.Lock()
+	hq, exists := r.handlers[name]
+	delete(r.handlers, name)
+	r.listHandlers()
+	r.handlersMutex.Unlock()
+
+	if !exists {
+		return
+	}
+
+	hq.close()
+	r.logger.Info("Handler removed", zap.String("handler", name))
+}
+
+func (r *Router) Stats() []HandlerStats {
+	r.handlersMutex.RLock()
+	defer r.handlersMutex.RUnlock()
+
+	stats := make([]HandlerStats, 0, len(r.handlers))
+	for _, hq := range r.handlers {
+		stats = append(stats, hq.stats())
+	}
+	return stats
+}
+
+func (r *Router) dispatchTicker(ticker *schema.Ticker) {
+	dispatch(r, ticker, func(hq *handlerQueues) *queue[*schema.Ticker] { return hq.tickers })
+}
+
+func (r *Router) dispatchTrade(trade *schema.Trade) {
+	dispatch(r, trade, func(hq *handlerQueues) *queue[*schema.Trade] { return hq.trades })
+}
+
+func (r *Router) dispatchBookLevel(level *schema.BookLevel) {
+	dispatch(r, level, func(hq *handlerQueues) *queue[*schema.BookLevel] { return hq.books })
+}
+
+func (r *Router) dispatchRawBookEvent(event *schema.RawBookEvent) {
+	dispatch(r, event, func(hq *handlerQueues) *queue[*schema.RawBookEvent] { return hq.rawBooks })
+}
+
+func (r *Router) dispatchControl(control *schema.Control) {
+	dispatch(r, control, func(hq *handlerQueues) *queue[*schema.Control] { return hq.controls })
+}
+
+// listHandlers rebuilds the handler list dispatch iterates. It must be called
+// with handlersMutex held for writing whenever r.handlers changes; the old
+// list is left untouched for dispatches still using it.
+func (r *Router) listHandlers() {
+	list := make([]*handlerQueues, 0, len(r.handlers))
+	for _, hq := range r.handlers {
+		list = append(list, hq)
+	}
+	r.handlerList = list
+}
+
+// dispatch pushes item to every registered handler. Handlers may annotate the
+// rows they receive, so all but the first get their own shallow copy. The
+// pushes happen outside handlersMutex: under the block policy a stuck handler
+// must only stall its own queue, not AddHandler or RemoveHandler.
+func dispatch[T any](r *Router, item *T, pick func(*handlerQueues) *queue[*T]) {
+	r.handlersMutex.RLock()
+	handlers := r.handlerList
+	r.handlersMutex.RUnlock()
+
+	first := true
+	for _, hq := range handlers {
+		v := item
+		if !first {
+			c := *item
+			v = &c
+		}
+		first = false
+		pick(hq).push(v)
+	}
+}
+
+func (hq *handlerQueues) start() {
+	hq.dataWG.Add(4)
+	go func() { defer hq.dataWG.Done(); hq.tickers.consume(hq.handler.HandleTicker) }()
+	go func() { defer hq.dataWG.Done(); hq.trades.consume(hq.handler.HandleTrade) }()
+	go func() { defer hq.dataWG.Done(); hq.books.consume(hq.handler.HandleBookLevel) }()
+	go func() { defer hq.dataWG.Done(); hq.rawBooks.consume(hq.handler.HandleRawBookEvent) }()
+
+	hq.ctrlWG.Add(1)
+	go func() { defer hq.ctrlWG.Done(); hq.controls.consume(hq.handler.HandleControl) }()
+}
+
+// close drains the data queues before the control queue so that drops recorded
+// during the drain still reach the handler.
+func (hq *handlerQueues) close() {
+	hq.tickers.close()
+	hq.trades.close()
+	hq.books.close()
+	hq.rawBooks.close()
+	hq.dataWG.Wait()
+
+	hq.controls.close()
+	hq.ctrlWG.Wait()
+}
+
+// recordDrop leaves a Control row for a message that was discarded by a full
+// queue, so gaps in the stored data can be explained later.
+func (hq *handlerQueues) recordDrop(fields *schema.CommonFields, policy BackpressurePolicy) {
+	control := &schema.Control{
+		CommonFields: schema.CommonFields{
+			Exchange:       schema.ExchangeBitfinex,
+			Channel:        fields.Channel,
+			Symbol:         fields.Symbol,
+			PairOrCurrency: fields.PairOrCurrency,
+			ConnID:         fields.ConnID,
+			ChanID:         fields.ChanID,
+			SubID:          fields.SubID,
+			ConfFlags:      fields.ConfFlags,
+			RecvTS:         fields.RecvTS,
+		},
+		Type:      schema.ControlTypeDrop,
+		Reason:    fmt.Sprintf("%s queue of handler %s full (%s)", fields.Channel, hq.name, policy),
+		LastSeq:   fields.Seq,
+		Timestamp: time.Now().UTC(),
+	}
+
+	hq.controls.push(control)
+}
+
+func (hq *handlerQueues) stats() HandlerStats {
+	stats := HandlerStats{
+		Name: hq.name,
+		Queues: []QueueStats{
+			hq.tickers.stats(),
+			hq.trades.stats(),
+			hq.books.stats(),
+			hq.rawBooks.stats(),
+			hq.controls.stats(),
+		},
+	}
+
+	for _, q := range stats.Queues {
+		if q.Lag > stats.MaxLag {
+			stats.MaxLag = q.Lag
+		}
+	}
+	return stats
+}
@@ -0,0 +1,155 @@
+package ws
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/internal/config"
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+// recordingHandler keeps every control row the router delivers.
+type recordingHandler struct {
+	mu       sync.Mutex
+	controls []schema.Control
+}
+
+func (h *recordingHandler) HandleTicker(*schema.Ticker)             {}
+func (h *recordingHandler) HandleTrade(*schema.Trade)               {}
+func (h *recordingHandler) HandleBookLevel(*schema.BookLevel)       {}
+func (h *recordingHandler) HandleRawBookEvent(*schema.RawBookEvent) {}
+
+func (h *recordingHandler) HandleControl(control *schema.Control) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.controls = append(h.controls, *control)
+}
+
+func (h *recordingHandler) snapshot() []schema.Control {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]schema.Control(nil), h.controls...)
+}
+
+// tradeCounter counts trades. A non-nil gate holds each one until it is
+// closed.
+type tradeCounter struct {
+	recordingHandler
+	trades atomic.Int64
+	gate   chan struct{}
+}
+
+func (h *tradeCounter) HandleTrade(*schema.Trade) {
+	if h.gate != nil {
+		<-h.gate
+	}
+	h.trades.Add(1)
+}
+
+func TestStuckHandlerOnlyBlocksItself(t *testing.T) {
+	cfg := &config.Config{
+		Storage:     config.Storage{BasePath: t.TempDir()},
+		Performance: config.Performance{BufferSize: 4},
+	}
+	router, err := NewRouter(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+
+	stuck := &tradeCounter{gate: make(chan struct{})}
+	healthy := &tradeCounter{}
+	bp := config.BackpressureConfig{Trades: string(PolicyBlock)}
+	if err := router.AddHandler("stuck", stuck, bp); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.AddHandler("healthy", healthy, bp); err != nil {
+		t.Fatal(err)
+	}
+
+	// The dispatcher fills the stuck handler's queue and then blocks on it.
+	const trades = 20
+	var dispatched sync.WaitGroup
+	dispatched.Add(1)
+	go func() {
+		defer dispatched.Done()
+		for i := 0; i < trades; i++ {
+			router.dispatchTrade(&schema.Trade{TradeID: int64(i)})
+		}
+	}()
+
+	// Registering and removing other handlers must not wait for it.
+	registered := make(chan error, 1)
+	go func() {
+		err := router.AddHandler("late", &tradeCounter{}, bp)
+		if err == nil {
+			router.RemoveHandler("late")
+		}
+		registered <- err
+	}()
+	select {
+	case err := <-registered:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("AddHandler blocked behind a stuck handler")
+	}
+
+	close(stuck.gate)
+	dispatched.Wait()
+	router.RemoveHandler("stuck")
+	router.RemoveHandler("healthy")
+
+	if n := stuck.trades.Load(); n != trades {
+		t.Errorf("stuck handler got %d trades, want %d", n, trades)
+	}
+	if n := healthy.trades.Load(); n != trades {
+		t.Errorf("healthy handler got %d trades, want %d", n, trades)
+	}
+}
+
+func TestRemoveHandlerReleasesBlockedDispatch(t *testing.T) {
+	cfg := &config.Config{
+		Storage:     config.Storage{BasePath: t.TempDir()},
+		Performance: config.Performance{BufferSize: 1},
+	}
+	router, err := NewRouter(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+
+	stuck := &tradeCounter{gate: make(chan struct{})}
+	if err := router.AddHandler("stuck", stuck, config.BackpressureConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		for i := 0; i < 10; i++ {
+			router.dispatchTrade(&schema.Trade{TradeID: int64(i)})
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	removed := make(chan struct{})
+	go func() {
+		defer close(removed)
+		router.RemoveHandler("stuck")
+	}()
+
+	// Closing the queues lets the blocked dispatch give up.
+	select {
+	case <-dispatched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispatch still blocked after RemoveHandler")
+	}
+	close(stuck.gate)
+	<-removed
+}
@@ -0,0 +1,186 @@
+package ws
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/internal/config"
+)
+
+// wsConn is the part of *websocket.Conn a Connection uses, so the socket can
+// be wrapped by the fault injector.
+type wsConn interface {
+	ReadMessage() (int, []byte, error)
+	WriteMessage(messageType int, data []byte) error
+	WriteJSON(v interface{}) error
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+var errInjectedClose = errors.New("fault injection: socket closed mid-snapshot")
+
+type FaultStats struct {
+	Frames     int64
+	Delayed    int64
+	Dropped    int64
+	Duplicated int64
+	Reordered  int64
+	Stalled    int64
+	Closed     int64
+}
+
+func (s *FaultStats) add(o FaultStats) {
+	s.Frames += o.Frames
+	s.Delayed += o.Delayed
+	s.Dropped += o.Dropped
+	s.Duplicated += o.Duplicated
+	s.Reordered += o.Reordered
+	s.Stalled += o.Stalled
+	s.Closed += o.Closed
+}
+
+type faultCounters struct {
+	frames, delayed, dropped, duplicated, reordered, stalled, closed atomic.Int64
+}
+
+// faultConn sits between Connection.readLoop and the real socket and damages
+// the inbound stream on a random schedule seeded from debug.network_faults,
+// so the same seed reproduces the same faults.
+type faultConn struct {
+	wsConn
+	cfg    config.NetworkFaultsConfig
+	rng    *rand.Rand
+	logger *zap.Logger
+
+	pending [][]byte
+	held    []byte
+
+	counters faultCounters
+}
+
+// faultSeed derives a per-connection, per-session seed so connections do not
+// all fail in lockstep.
+func faultSeed(seed int64, connID string, session int) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(connID))
+	return seed + int64(h.Sum64()>>1) + int64(session)
+}
+
+func newFaultConn(conn wsConn, cfg config.NetworkFaultsConfig, seed int64, logger *zap.Logger) *faultConn {
+	return &faultConn{
+		wsConn: conn,
+		cfg:    cfg,
+		rng:    rand.New(rand.NewSource(seed)),
+		logger: logger.With(zap.String("component", "faults")),
+	}
+}
+
+func (f *faultConn) hit(rate float64) bool {
+	return rate > 0 && f.rng.Float64() < rate
+}
+
+func (f *faultConn) ReadMessage() (int, []byte, error) {
+	if len(f.pending) > 0 {
+		data := f.pending[0]
+		f.pending = f.pending[1:]
+		return 1, data, nil
+	}
+
+	for {
+		messageType, data, err := f.wsConn.ReadMessage()
+		if err != nil {
+			// Hand back a frame held for reordering rather than lose it; the
+			// error will come up again on the next read.
+			if f.held != nil {
+				held := f.held
+				f.held = nil
+				return 1, held, nil
+			}
+			return messageType, data, err
+		}
+		f.counters.frames.Add(1)
+
+		if f.hit(f.cfg.StallRate) {
+			f.counters.stalled.Add(1)
+			f.logger.Debug("Stalling read", zap.Duration("duration", f.cfg.StallDuration))
+			time.Sleep(f.cfg.StallDuration)
+		}
+
+		if f.cfg.Latency > 0 || f.cfg.Jitter > 0 {
+			delay := f.cfg.Latency
+			if f.cfg.Jitter > 0 {
+				delay += time.Duration(f.rng.Int63n(int64(f.cfg.Jitter)))
+			}
+			f.counters.delayed.Add(1)
+			time.Sleep(delay)
+		}
+
+		if isSnapshotFrame(data) && f.hit(f.cfg.CloseMidSnapshotRate) {
+			f.counters.closed.Add(1)
+			f.logger.Warn("Closing socket mid-snapshot")
+			f.wsConn.Close()
+			return messageType, nil, errInjectedClose
+		}
+
+		if f.hit(f.cfg.DropRate) {
+			f.counters.dropped.Add(1)
+			continue
+		}
+
+		if f.held == nil && f.hit(f.cfg.ReorderRate) {
+			f.counters.reordered.Add(1)
+			f.held = data
+			continue
+		}
+		if f.held != nil {
+			f.pending = append(f.pending, f.held)
+			f.held = nil
+		}
+
+		if f.hit(f.cfg.DuplicateRate) {
+			f.counters.duplicated.Add(1)
+			f.pending = append(f.pending, data)
+		}
+
+		return messageType, data, nil
+	}
+}
+
+func (f *faultConn) stats() FaultStats {
+	return FaultStats{
+		Frames:     f.counters.frames.Load(),
+		Delayed:    f.counters.delayed.Load(),
+		Dropped:    f.counters.dropped.Load(),
+		Duplicated: f.counters.duplicated.Load(),
+		Reordered:  f.counters.reordered.Load(),
+		Stalled:    f.counters.stalled.Load(),
+		Closed:     f.counters.closed.Load(),
+	}
+}
+
+// isSnapshotFrame spots [chanId,[[...]...]] without a full parse.
+func isSnapshotFrame(data []byte) bool {
+	depth := 0
+	for i, b := range data {
+		switch b {
+		case '[':
+			depth++
+			if depth == 3 {
+				return true
+			}
+		case ']':
+			depth--
+		case '"', '{':
+			return false
+		}
+		if i > 64 && depth < 2 {
+			return false
+		}
+	}
+	return false
+}
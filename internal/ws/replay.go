@@ -0,0 +1,177 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/internal/config"
+	"github.com/trade-engine/data-controller/internal/tape"
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+// Replayer feeds recorded frames through Connection.processMessage, so a tape
+// goes through exactly the parsing and routing a live socket would.
+type Replayer struct {
+	cfg    *config.Config
+	logger *zap.Logger
+	router *Router
+	conns  map[string]*Connection
+
+	// Speed scales the recorded pacing: 1 replays in real time, 10 ten times
+	// faster, and 0 as fast as possible.
+	Speed float64
+}
+
+type ReplayStats struct {
+	Files  int
+	Frames int64
+	Errors int64
+}
+
+// replaySessionEvent is the part of an event frame the replayer looks at to
+// follow connection sessions and the negotiated conf flags.
+type replaySessionEvent struct {
+	Event   string  `json:"event"`
+	Version float64 `json:"version"`
+	Flags   *int64  `json:"flags"`
+}
+
+func NewReplayer(cfg *config.Config, logger *zap.Logger, router *Router, speed float64) *Replayer {
+	return &Replayer{
+		cfg:    cfg,
+		logger: logger.With(zap.String("component", "replay")),
+		router: router,
+		conns:  make(map[string]*Connection),
+		Speed:  speed,
+	}
+}
+
+// Run replays every tape found at path in order. Truncated tapes are replayed
+// up to the damage.
+func (r *Replayer) Run(ctx context.Context, path string) (ReplayStats, error) {
+	var stats ReplayStats
+
+	files, err := tape.Files(path)
+	if err != nil {
+		return stats, err
+	}
+
+	var firstTS int64
+	var started time.Time
+
+	for _, file := range files {
+		reader, err := tape.Open(file)
+		if err != nil {
+			return stats, err
+		}
+
+		r.logger.Info("Replaying tape", zap.String("path", file))
+		stats.Files++
+
+		for {
+			frame, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				if errors.Is(err, io.ErrUnexpectedEOF) {
+					r.logger.Warn("Tape ends with a partial frame", zap.String("path", file))
+				} else {
+					r.logger.Error("Failed to read tape", zap.String("path", file), zap.Error(err))
+				}
+				break
+			}
+
+			if firstTS == 0 {
+				firstTS = frame.RecvTS
+				started = time.Now()
+			}
+			if r.Speed > 0 {
+				due := started.Add(time.Duration(float64(frame.RecvTS-firstTS) / r.Speed))
+				if wait := time.Until(due); wait > 0 {
+					select {
+					case <-ctx.Done():
+						reader.Close()
+						return stats, ctx.Err()
+					case <-time.After(wait):
+					}
+				}
+			} else if ctx.Err() != nil {
+				reader.Close()
+				return stats, ctx.Err()
+			}
+
+			stats.Frames++
+			if err := r.Feed(frame); err != nil {
+				stats.Errors++
+				r.logger.Debug("Failed to process replayed frame", zap.Error(err))
+			}
+		}
+
+		reader.Close()
+	}
+
+	r.Close()
+	return stats, nil
+}
+
+// Feed processes one recorded frame on the connection it was received on.
+func (r *Replayer) Feed(frame tape.Frame) error {
+	c, exists := r.conns[frame.ConnID]
+	if !exists {
+		c = &Connection{
+			ID:            frame.ConnID,
+			URL:           frame.Endpoint,
+			channels:      make(map[int32]*ChannelInfo),
+			lastHeartbeat: make(map[int32]time.Time),
+			reconnectChan: make(chan struct{}, 1),
+			done:          make(chan struct{}),
+			logger:        r.logger.With(zap.String("conn_id", frame.ConnID)),
+			confFlags:     r.cfg.WebSocket.ConfFlags,
+			router:        r.router,
+		}
+		r.conns[frame.ConnID] = c
+	}
+	c.replayTS = frame.RecvTS
+
+	if len(frame.Data) > 0 && frame.Data[0] == '{' {
+		var event replaySessionEvent
+		if err := json.Unmarshal(frame.Data, &event); err == nil {
+			switch {
+			case event.Event == "info" && event.Version != 0:
+				// The versioned info event opens every socket session.
+				if c.hasConnected {
+					c.emitControl(schema.ControlTypeDisconnected, nil, c.URL)
+					c.emitControl(schema.ControlTypeReconnect, nil, c.URL)
+				} else {
+					c.emitControl(schema.ControlTypeConnected, nil, c.URL)
+				}
+				c.hasConnected = true
+				c.resetSession()
+			case event.Event == "conf" && event.Flags != nil:
+				c.confFlags = *event.Flags
+			}
+		}
+	}
+
+	if err := c.processMessage(frame.Data, frame.RecvTS); err != nil {
+		return fmt.Errorf("conn %s: %w", frame.ConnID, err)
+	}
+	return nil
+}
+
+// Close ends every replayed session.
+func (r *Replayer) Close() {
+	for _, c := range r.conns {
+		if c.hasConnected {
+			c.emitControl(schema.ControlTypeDisconnected, nil, c.URL)
+		}
+	}
+	r.conns = make(map[string]*Connection)
+}
@@ -0,0 +1,61 @@
+package ws
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/internal/config"
+	"github.com/trade-engine/data-controller/internal/tape"
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+func TestReplayedControlsKeepFrameTime(t *testing.T) {
+	cfg := &config.Config{Storage: config.Storage{BasePath: t.TempDir()}}
+	router, err := NewRouter(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := &recordingHandler{}
+	router.SetHandler(handler)
+
+	recorded := time.Date(2025, 1, 1, 3, 0, 0, 0, time.UTC)
+	frames := []tape.Frame{
+		{RecvTS: recorded.UnixNano(), Data: []byte(`{"event":"info","version":2}`)},
+		{RecvTS: recorded.Add(time.Second).UnixNano(), Data: []byte(
+			`{"event":"subscribed","channel":"trades","chanId":17,"symbol":"` + testSymbol + `","pair":"BTCUSD"}`)},
+	}
+
+	replayer := NewReplayer(cfg, zap.NewNop(), router, 0)
+	for _, frame := range frames {
+		frame.ConnID = "conn-1"
+		if err := replayer.Feed(frame); err != nil {
+			t.Fatalf("Feed: %v", err)
+		}
+	}
+	replayer.Close()
+	router.Close()
+
+	want := map[schema.ControlType]time.Time{
+		schema.ControlTypeConnected:    recorded,
+		schema.ControlTypeSubscribed:   recorded.Add(time.Second),
+		schema.ControlTypeDisconnected: recorded.Add(time.Second),
+	}
+	controls := handler.snapshot()
+	if len(controls) != len(want) {
+		t.Fatalf("got %s, want %d controls", describeControls(controls), len(want))
+	}
+	for _, control := range controls {
+		ts, ok := want[control.Type]
+		if !ok {
+			t.Errorf("unexpected %s control", control.Type)
+			continue
+		}
+		if control.RecvTS != ts.UnixNano() || !control.Timestamp.Equal(ts) {
+			t.Errorf("%s control at recv_ts %d, timestamp %s; want the frame time %s",
+				control.Type, control.RecvTS, control.Timestamp, ts)
+		}
+	}
+}
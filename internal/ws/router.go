@@ -2,19 +2,29 @@ package ws
 
 import (
 	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
+
+	"github.com/trade-engine/data-controller/internal/config"
 	"github.com/trade-engine/data-controller/pkg/schema"
 )
 
 type Router struct {
+	cfg           *config.Config
 	logger        *zap.Logger
-	tickerChan    chan *schema.Ticker
-	tradesChan    chan *schema.Trade
-	booksChan     chan *schema.BookLevel
-	rawBooksChan  chan *schema.RawBookEvent
-	controlsChan  chan *schema.Control
+	bufferSize    int
+	spillDir      string
+	handlers      map[string]*handlerQueues
+	handlerList   []*handlerQueues
+	handlersMutex sync.RWMutex
+	tickerSampler *tickerSampler
+	tradesMsgType schema.MessageType
+	tradeDedup    *tradeDedup
+	books         *bookTracker
 }
 
 type MessageHandler interface {
@@ -25,65 +35,88 @@ type MessageHandler interface {
 	HandleControl(control *schema.Control)
 }
 
-func NewRouter(logger *zap.Logger) *Router {
-	return &Router{
-		logger:       logger,
-		tickerChan:   make(chan *schema.Ticker, 10000),
-		tradesChan:   make(chan *schema.Trade, 10000),
-		booksChan:    make(chan *schema.BookLevel, 10000),
-		rawBooksChan: make(chan *schema.RawBookEvent, 10000),
-		controlsChan: make(chan *schema.Control, 1000),
+func NewRouter(cfg *config.Config, logger *zap.Logger) (*Router, error) {
+	if _, err := parsePolicies(cfg.Performance.Backpressure); err != nil {
+		return nil, err
 	}
-}
 
-func (r *Router) SetHandler(handler MessageHandler) {
-	go func() {
-		for ticker := range r.tickerChan {
-			handler.HandleTicker(ticker)
-		}
-	}()
+	bufferSize := cfg.Performance.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = 10000
+	}
 
-	go func() {
-		for trade := range r.tradesChan {
-			handler.HandleTrade(trade)
-		}
-	}()
+	spillDir := cfg.Performance.Backpressure.SpillPath
+	if spillDir == "" {
+		spillDir = filepath.Join(cfg.Storage.BasePath, "spill")
+	}
 
-	go func() {
-		for level := range r.booksChan {
-			handler.HandleBookLevel(level)
-		}
-	}()
+	var tradesMsgType schema.MessageType
+	switch msgType := cfg.Channels.Trades.MsgType; msgType {
+	case "", "all":
+	case string(schema.MessageTypeTE), string(schema.MessageTypeTU):
+		tradesMsgType = schema.MessageType(msgType)
+	default:
+		return nil, fmt.Errorf("unknown trades msg_type %q", msgType)
+	}
 
-	go func() {
-		for event := range r.rawBooksChan {
-			handler.HandleRawBookEvent(event)
-		}
-	}()
+	r := &Router{
+		cfg:           cfg,
+		logger:        logger,
+		bufferSize:    bufferSize,
+		spillDir:      spillDir,
+		handlers:      make(map[string]*handlerQueues),
+		tradesMsgType: tradesMsgType,
+		tradeDedup:    newTradeDedup(cfg.Channels.Trades.DedupWindow, tradesMsgType),
+		books:         newBookTracker(),
+	}
 
-	go func() {
-		for control := range r.controlsChan {
-			handler.HandleControl(control)
+	if cfg.Channels.Ticker.SamplingRate > 0 {
+		sampler, err := newTickerSampler(cfg.Channels.Ticker, r.dispatchTicker)
+		if err != nil {
+			return nil, err
 		}
-	}()
+		r.tickerSampler = sampler
+	}
+
+	return r, nil
 }
 
-func (r *Router) RouteMessage(chanID int32, channelInfo *ChannelInfo, data []json.RawMessage, connID string) error {
-	recvTS := time.Now().UnixNano()
-
-	switch channelInfo.Channel {
-	case "ticker":
-		return r.routeTicker(chanID, channelInfo, data, connID, recvTS)
-	case "trades":
-		return r.routeTrades(chanID, channelInfo, data, connID, recvTS)
-	case "book":
-		if channelInfo.SubID != nil {
-			subReq := getSubRequestBySubID(*channelInfo.SubID)
-			if subReq != nil && subReq.Prec != nil && *subReq.Prec == "R0" {
-				return r.routeRawBooks(chanID, channelInfo, data, connID, recvTS)
-			}
-		}
-		return r.routeBooks(chanID, channelInfo, data, connID, recvTS)
+// SamplingStats reports how many ticker updates the sampler let through and
+// how many it suppressed. It is zero when sampling is disabled.
+func (r *Router) SamplingStats() SamplerStats {
+	if r.tickerSampler == nil {
+		return SamplerStats{}
+	}
+	return r.tickerSampler.statsSnapshot()
+}
+
+// SetHandler registers handler as the "default" consumer using the configured
+// backpressure policies, replacing any previous default handler.
+func (r *Router) SetHandler(handler MessageHandler) {
+	r.RemoveHandler("default")
+	if err := r.AddHandler("default", handler, r.cfg.Performance.Backpressure); err != nil {
+		r.logger.Error("Failed to set handler", zap.Error(err))
+	}
+}
+
+// FrameMeta carries the per-frame fields that Bitfinex appends after the
+// payload when SEQ_ALL and TIMESTAMP are enabled, plus our receive time.
+type FrameMeta struct {
+	RecvTS int64
+	Seq    *int64
+	SrvTS  *int64
+}
+
+func (r *Router) RouteMessage(chanID int32, channelInfo *ChannelInfo, data []json.RawMessage, connID string, meta FrameMeta) error {
+	switch channelInfo.StorageChannel() {
+	case schema.ChannelTicker:
+		return r.routeTicker(chanID, channelInfo, data, connID, meta)
+	case schema.ChannelTrades:
+		return r.routeTrades(chanID, channelInfo, data, connID, meta)
+	case schema.ChannelRawBooks:
+		return r.routeRawBooks(chanID, channelInfo, data, connID, meta)
+	case schema.ChannelBooks:
+		return r.routeBooks(chanID, channelInfo, data, connID, meta)
 	default:
 		r.logger.Warn("Unknown channel type", zap.String("channel", channelInfo.Channel))
 	}
@@ -91,7 +124,67 @@ func (r *Router) RouteMessage(chanID int32, channelInfo *ChannelInfo, data []jso
 	return nil
 }
 
-func (r *Router) routeTicker(chanID int32, channelInfo *ChannelInfo, data []json.RawMessage, connID string, recvTS int64) error {
+// EmitControl sends a control event to every registered handler.
+func (r *Router) EmitControl(control *schema.Control) {
+	if control.Timestamp.IsZero() {
+		control.Timestamp = time.Now().UTC()
+	}
+	r.dispatchControl(control)
+}
+
+// VerifyChecksum checks a "cs" value against the book mirrored from the
+// deltas routed so far on that channel.
+func (r *Router) VerifyChecksum(connID string, chanID int32, checksum int32) (result ChecksumResult, computed int32, changed bool) {
+	return r.books.verify(connID, chanID, checksum)
+}
+
+// ExpectSnapshot marks a book channel as just subscribed, so the next frame of
+// entries routed on it is taken as its snapshot.
+func (r *Router) ExpectSnapshot(connID string, chanID int32) {
+	r.books.expect(connID, chanID)
+}
+
+// ForgetBooks drops the mirrored books of a connection once it goes away.
+func (r *Router) ForgetBooks(connID string) {
+	r.books.forget(connID)
+}
+
+// unwrapEntry returns the entry of a v2 update frame, which nests it as the
+// first element: [[FIELD, ...], SEQ, TS]. Flat frames are returned as is.
+func unwrapEntry(data []json.RawMessage) []json.RawMessage {
+	if len(data) >= 1 {
+		var nested []json.RawMessage
+		if err := json.Unmarshal(data[0], &nested); err == nil {
+			return nested
+		}
+	}
+	return data
+}
+
+// snapshotEntries returns the entries of a snapshot frame, whose payload is an
+// array of entry arrays rather than a single entry.
+func snapshotEntries(data []json.RawMessage) ([]json.RawMessage, bool) {
+	if len(data) < 1 {
+		return nil, false
+	}
+
+	var entries []json.RawMessage
+	if err := json.Unmarshal(data[0], &entries); err != nil {
+		return nil, false
+	}
+	if len(entries) == 0 {
+		return entries, true
+	}
+
+	var first []json.RawMessage
+	if err := json.Unmarshal(entries[0], &first); err != nil {
+		return nil, false
+	}
+	return entries, true
+}
+
+func (r *Router) routeTicker(chanID int32, channelInfo *ChannelInfo, data []json.RawMessage, connID string, meta FrameMeta) error {
+	data = unwrapEntry(data)
 	if len(data) < 10 {
 		r.logger.Warn("Ticker data too short", zap.Int("length", len(data)))
 		return nil
@@ -113,7 +206,9 @@ func (r *Router) routeTicker(chanID int32, channelInfo *ChannelInfo, data []json
 			PairOrCurrency: channelInfo.Pair,
 			ConnID:         connID,
 			ChanID:         chanID,
-			RecvTS:         recvTS,
+			Seq:            meta.Seq,
+			WSTS:           meta.SrvTS,
+			RecvTS:         meta.RecvTS,
 		},
 		Bid:            values[0],
 		BidSize:        values[1],
@@ -127,34 +222,32 @@ func (r *Router) routeTicker(chanID int32, channelInfo *ChannelInfo, data []json
 		Low:            values[9],
 	}
 
-	select {
-	case r.tickerChan <- ticker:
-	default:
-		r.logger.Warn("Ticker channel full, dropping message")
+	if r.tickerSampler != nil {
+		r.tickerSampler.offer(ticker)
+	} else {
+		r.dispatchTicker(ticker)
 	}
 
 	return nil
 }
 
-func (r *Router) routeTrades(chanID int32, channelInfo *ChannelInfo, data []json.RawMessage, connID string, recvTS int64) error {
-	var msgType string
-	var tradeData []json.RawMessage
-	isSnapshot := false
-
-	if len(data) >= 2 {
-		var testArray []json.RawMessage
-		if err := json.Unmarshal(data[0], &testArray); err == nil {
-			isSnapshot = true
-			for _, item := range testArray {
-				var singleTrade [4]json.RawMessage
-				if err := json.Unmarshal(item, &singleTrade); err != nil {
-					continue
-				}
-				r.processSingleTrade(chanID, channelInfo, singleTrade[:], connID, recvTS, isSnapshot, "snapshot")
+func (r *Router) routeTrades(chanID int32, channelInfo *ChannelInfo, data []json.RawMessage, connID string, meta FrameMeta) error {
+	if entries, ok := snapshotEntries(data); ok {
+		for _, item := range entries {
+			var singleTrade [4]json.RawMessage
+			if err := json.Unmarshal(item, &singleTrade); err != nil {
+				continue
 			}
-			return nil
+			r.processSingleTrade(chanID, channelInfo, singleTrade[:], connID, meta, true, "snapshot")
 		}
+		r.recordDuplicateTrades(r.tradeDedup.takeRun(channelInfo.Symbol))
+		return nil
+	}
 
+	var msgType string
+	var tradeData []json.RawMessage
+
+	if len(data) >= 1 {
 		if err := json.Unmarshal(data[0], &msgType); err == nil {
 			if msgType == "te" || msgType == "tu" {
 				tradeData = data[1:]
@@ -165,14 +258,17 @@ func (r *Router) routeTrades(chanID int32, channelInfo *ChannelInfo, data []json
 		}
 	}
 
+	// Current v2 frames nest the trade: ["te", [ID, MTS, AMOUNT, PRICE]]
+	tradeData = unwrapEntry(tradeData)
+
 	if len(tradeData) >= 4 {
-		return r.processSingleTrade(chanID, channelInfo, tradeData, connID, recvTS, isSnapshot, msgType)
+		return r.processSingleTrade(chanID, channelInfo, tradeData, connID, meta, false, msgType)
 	}
 
 	return nil
 }
 
-func (r *Router) processSingleTrade(chanID int32, channelInfo *ChannelInfo, data []json.RawMessage, connID string, recvTS int64, isSnapshot bool, msgType string) error {
+func (r *Router) processSingleTrade(chanID int32, channelInfo *ChannelInfo, data []json.RawMessage, connID string, meta FrameMeta, isSnapshot bool, msgType string) error {
 	if len(data) < 4 {
 		return nil
 	}
@@ -195,6 +291,10 @@ func (r *Router) processSingleTrade(chanID int32, channelInfo *ChannelInfo, data
 		return err
 	}
 
+	if !isSnapshot && r.tradesMsgType != "" && schema.MessageType(msgType) != r.tradesMsgType {
+		return nil
+	}
+
 	trade := &schema.Trade{
 		CommonFields: schema.CommonFields{
 			Exchange:       schema.ExchangeBitfinex,
@@ -203,7 +303,9 @@ func (r *Router) processSingleTrade(chanID int32, channelInfo *ChannelInfo, data
 			PairOrCurrency: channelInfo.Pair,
 			ConnID:         connID,
 			ChanID:         chanID,
-			RecvTS:         recvTS,
+			Seq:            meta.Seq,
+			WSTS:           meta.SrvTS,
+			RecvTS:         meta.RecvTS,
 			SrvMTS:         &mts,
 		},
 		TradeID:    tradeID,
@@ -214,43 +316,62 @@ func (r *Router) processSingleTrade(chanID int32, channelInfo *ChannelInfo, data
 		IsSnapshot: isSnapshot,
 	}
 
-	select {
-	case r.tradesChan <- trade:
-	default:
-		r.logger.Warn("Trades channel full, dropping message")
+	if r.tradeDedup.duplicate(trade) {
+		return nil
 	}
 
+	r.recordDuplicateTrades(r.tradeDedup.takeRun(channelInfo.Symbol))
+	r.dispatchTrade(trade)
+
 	return nil
 }
 
-func (r *Router) routeBooks(chanID int32, channelInfo *ChannelInfo, data []json.RawMessage, connID string, recvTS int64) error {
-	var isSnapshot bool
-	var bookData []json.RawMessage
+// recordDuplicateTrades leaves one Control row for a run of trades dropped by
+// the dedup window. Runs end at the next delivered trade of the symbol, at
+// the end of a snapshot and when the router closes; the sink counts them into
+// the segment's quality metrics.
+func (r *Router) recordDuplicateTrades(run *dedupRun) {
+	if run == nil {
+		return
+	}
+
+	reason := fmt.Sprintf("duplicate trade_id %d", run.minID)
+	if run.count > 1 {
+		reason = fmt.Sprintf("%d duplicate trades, trade_id %d-%d", run.count, run.minID, run.maxID)
+	}
+	r.dispatchControl(&schema.Control{
+		CommonFields: run.first,
+		Type:         schema.ControlTypeDedup,
+		Reason:       reason,
+		Count:        run.count,
+		Timestamp:    time.Unix(0, run.first.RecvTS).UTC(),
+	})
+}
 
-	if len(data) >= 1 {
-		var testArray []json.RawMessage
-		if err := json.Unmarshal(data[0], &testArray); err == nil {
-			isSnapshot = true
-			for _, item := range testArray {
-				var singleLevel [3]json.RawMessage
-				if err := json.Unmarshal(item, &singleLevel); err != nil {
-					continue
-				}
-				r.processSingleBookLevel(chanID, channelInfo, singleLevel[:], connID, recvTS, isSnapshot)
+func (r *Router) routeBooks(chanID int32, channelInfo *ChannelInfo, data []json.RawMessage, connID string, meta FrameMeta) error {
+	if entries, ok := snapshotEntries(data); ok {
+		// Only the first frame of entries after subscribing is the snapshot;
+		// with BULK_UPDATES later ones carry batched deltas.
+		isSnapshot := r.books.startSnapshot(connID, chanID)
+		for _, item := range entries {
+			var singleLevel [3]json.RawMessage
+			if err := json.Unmarshal(item, &singleLevel); err != nil {
+				continue
 			}
-			return nil
+			r.processSingleBookLevel(chanID, channelInfo, singleLevel[:], connID, meta, isSnapshot)
 		}
-		bookData = data
+		return nil
 	}
 
+	bookData := unwrapEntry(data)
 	if len(bookData) >= 3 {
-		return r.processSingleBookLevel(chanID, channelInfo, bookData, connID, recvTS, isSnapshot)
+		return r.processSingleBookLevel(chanID, channelInfo, bookData, connID, meta, false)
 	}
 
 	return nil
 }
 
-func (r *Router) processSingleBookLevel(chanID int32, channelInfo *ChannelInfo, data []json.RawMessage, connID string, recvTS int64, isSnapshot bool) error {
+func (r *Router) processSingleBookLevel(chanID int32, channelInfo *ChannelInfo, data []json.RawMessage, connID string, meta FrameMeta, isSnapshot bool) error {
 	if len(data) < 3 {
 		return nil
 	}
@@ -274,22 +395,20 @@ func (r *Router) processSingleBookLevel(chanID int32, channelInfo *ChannelInfo,
 		side = schema.SideAsk
 	}
 
-	subReq := getSubRequestBySubID(*channelInfo.SubID)
+	subReq := channelInfo.SubReq
 	prec := "P0"
 	freq := "F0"
 	length := int32(25)
 
-	if subReq != nil {
-		if subReq.Prec != nil {
-			prec = *subReq.Prec
-		}
-		if subReq.Freq != nil {
-			freq = *subReq.Freq
-		}
-		if subReq.Len != nil {
-			if len := parseIntFromString(*subReq.Len); len > 0 {
-				length = int32(len)
-			}
+	if subReq.Prec != nil {
+		prec = *subReq.Prec
+	}
+	if subReq.Freq != nil {
+		freq = *subReq.Freq
+	}
+	if subReq.Len != nil {
+		if len := parseIntFromString(*subReq.Len); len > 0 {
+			length = int32(len)
 		}
 	}
 
@@ -302,7 +421,9 @@ func (r *Router) processSingleBookLevel(chanID int32, channelInfo *ChannelInfo,
 			ConnID:         connID,
 			ChanID:         chanID,
 			SubID:          channelInfo.SubID,
-			RecvTS:         recvTS,
+			Seq:            meta.Seq,
+			WSTS:           meta.SrvTS,
+			RecvTS:         meta.RecvTS,
 		},
 		Price:      price,
 		Count:      count,
@@ -314,43 +435,34 @@ func (r *Router) processSingleBookLevel(chanID int32, channelInfo *ChannelInfo,
 		IsSnapshot: isSnapshot,
 	}
 
-	select {
-	case r.booksChan <- level:
-	default:
-		r.logger.Warn("Books channel full, dropping message")
-	}
+	r.books.applyLevel(connID, chanID, data, price, count, amount)
+	r.dispatchBookLevel(level)
 
 	return nil
 }
 
-func (r *Router) routeRawBooks(chanID int32, channelInfo *ChannelInfo, data []json.RawMessage, connID string, recvTS int64) error {
-	var isSnapshot bool
-	var bookData []json.RawMessage
-
-	if len(data) >= 1 {
-		var testArray []json.RawMessage
-		if err := json.Unmarshal(data[0], &testArray); err == nil {
-			isSnapshot = true
-			for _, item := range testArray {
-				var singleOrder [3]json.RawMessage
-				if err := json.Unmarshal(item, &singleOrder); err != nil {
-					continue
-				}
-				r.processSingleRawBookEvent(chanID, channelInfo, singleOrder[:], connID, recvTS, isSnapshot)
+func (r *Router) routeRawBooks(chanID int32, channelInfo *ChannelInfo, data []json.RawMessage, connID string, meta FrameMeta) error {
+	if entries, ok := snapshotEntries(data); ok {
+		isSnapshot := r.books.startSnapshot(connID, chanID)
+		for _, item := range entries {
+			var singleOrder [3]json.RawMessage
+			if err := json.Unmarshal(item, &singleOrder); err != nil {
+				continue
 			}
-			return nil
+			r.processSingleRawBookEvent(chanID, channelInfo, singleOrder[:], connID, meta, isSnapshot)
 		}
-		bookData = data
+		return nil
 	}
 
+	bookData := unwrapEntry(data)
 	if len(bookData) >= 3 {
-		return r.processSingleRawBookEvent(chanID, channelInfo, bookData, connID, recvTS, isSnapshot)
+		return r.processSingleRawBookEvent(chanID, channelInfo, bookData, connID, meta, false)
 	}
 
 	return nil
 }
 
-func (r *Router) processSingleRawBookEvent(chanID int32, channelInfo *ChannelInfo, data []json.RawMessage, connID string, recvTS int64, isSnapshot bool) error {
+func (r *Router) processSingleRawBookEvent(chanID int32, channelInfo *ChannelInfo, data []json.RawMessage, connID string, meta FrameMeta, isSnapshot bool) error {
 	if len(data) < 3 {
 		return nil
 	}
@@ -388,7 +500,9 @@ func (r *Router) processSingleRawBookEvent(chanID int32, channelInfo *ChannelInf
 			ConnID:         connID,
 			ChanID:         chanID,
 			SubID:          channelInfo.SubID,
-			RecvTS:         recvTS,
+			Seq:            meta.Seq,
+			WSTS:           meta.SrvTS,
+			RecvTS:         meta.RecvTS,
 		},
 		OrderID:    orderID,
 		Price:      price,
@@ -398,11 +512,8 @@ func (r *Router) processSingleRawBookEvent(chanID int32, channelInfo *ChannelInf
 		IsSnapshot: isSnapshot,
 	}
 
-	select {
-	case r.rawBooksChan <- event:
-	default:
-		r.logger.Warn("Raw books channel full, dropping message")
-	}
+	r.books.applyOrder(connID, chanID, data, orderID, price, amount)
+	r.dispatchRawBookEvent(event)
 
 	return nil
 }
@@ -438,9 +549,20 @@ func parseIntFromString(s string) int {
 }
 
 func (r *Router) Close() {
-	close(r.tickerChan)
-	close(r.tradesChan)
-	close(r.booksChan)
-	close(r.rawBooksChan)
-	close(r.controlsChan)
-}
\ No newline at end of file
+	if r.tickerSampler != nil {
+		r.tickerSampler.stop()
+	}
+	for _, run := range r.tradeDedup.takeRuns() {
+		r.recordDuplicateTrades(run)
+	}
+
+	r.handlersMutex.Lock()
+	handlers := r.handlers
+	r.handlers = make(map[string]*handlerQueues)
+	r.handlerList = nil
+	r.handlersMutex.Unlock()
+
+	for _, hq := range handlers {
+		hq.close()
+	}
+}
@@ -0,0 +1,166 @@
+package ws
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/trade-engine/data-controller/internal/config"
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+type SamplingMode string
+
+const (
+	// SamplingLastValue emits the first update of an interval immediately and
+	// the latest suppressed update once the interval has elapsed.
+	SamplingLastValue SamplingMode = "last_value"
+	// SamplingAligned emits the latest update of each whole interval of
+	// event time (e.g. every whole second) once the boundary passes.
+	SamplingAligned SamplingMode = "aligned"
+)
+
+type SamplerStats struct {
+	Received   int64
+	Emitted    int64
+	Suppressed int64
+}
+
+// tickerSampler sits between routeTicker and the handlers and limits each
+// symbol to at most one ticker per interval, plus optional change-triggered
+// emits. It runs on event time, the recv_ts of the tickers offered, so a
+// replayed tape samples the same way it did live: an interval is only over
+// once a later ticker shows that its boundary has passed.
+type tickerSampler struct {
+	interval  time.Duration
+	mode      SamplingMode
+	changeBps float64
+	emit      func(*schema.Ticker)
+
+	mu      sync.Mutex
+	symbols map[string]*sampleState
+	stats   SamplerStats
+}
+
+type sampleState struct {
+	lastEmit  time.Time
+	lastPrice float64
+	pending   *schema.Ticker
+}
+
+func newTickerSampler(cfg config.TickerConfig, emit func(*schema.Ticker)) (*tickerSampler, error) {
+	mode := SamplingMode(cfg.SamplingMode)
+	switch mode {
+	case "":
+		mode = SamplingLastValue
+	case SamplingLastValue, SamplingAligned:
+	default:
+		return nil, fmt.Errorf("unknown ticker sampling mode %q", cfg.SamplingMode)
+	}
+
+	return &tickerSampler{
+		interval:  cfg.SamplingRate,
+		mode:      mode,
+		changeBps: cfg.EmitOnChangeBps,
+		emit:      emit,
+		symbols:   make(map[string]*sampleState),
+	}, nil
+}
+
+func (s *tickerSampler) offer(ticker *schema.Ticker) {
+	now := time.Unix(0, ticker.RecvTS)
+
+	s.mu.Lock()
+	s.stats.Received++
+
+	// Pending updates whose interval ended before now go out first, for
+	// every symbol, so a quiet symbol is not held back by its own silence.
+	out := s.due(now)
+
+	st, exists := s.symbols[ticker.Symbol]
+	if !exists {
+		st = &sampleState{}
+		s.symbols[ticker.Symbol] = st
+	}
+
+	if st.pending != nil {
+		st.pending = nil
+		s.stats.Suppressed++
+	}
+
+	emitNow := s.changeBps > 0 && st.lastPrice != 0 &&
+		math.Abs(ticker.Last-st.lastPrice)/math.Abs(st.lastPrice)*10000 >= s.changeBps
+	if s.mode == SamplingLastValue && now.Sub(st.lastEmit) >= s.interval {
+		emitNow = true
+	}
+
+	if emitNow {
+		s.markEmitted(st, ticker, now)
+		out = append(out, ticker)
+	} else {
+		st.pending = ticker
+	}
+	s.mu.Unlock()
+
+	for _, t := range out {
+		s.emit(t)
+	}
+}
+
+// due takes the pending updates whose interval is over at now. It must be
+// called with s.mu held.
+func (s *tickerSampler) due(now time.Time) []*schema.Ticker {
+	var out []*schema.Ticker
+	for _, st := range s.symbols {
+		if st.pending == nil {
+			continue
+		}
+
+		var boundary time.Time
+		if s.mode == SamplingAligned {
+			boundary = time.Unix(0, st.pending.RecvTS).Truncate(s.interval).Add(s.interval)
+		} else {
+			boundary = st.lastEmit.Add(s.interval)
+		}
+		if now.Before(boundary) {
+			continue
+		}
+
+		out = append(out, st.pending)
+		s.markEmitted(st, st.pending, boundary)
+		st.pending = nil
+	}
+	return out
+}
+
+func (s *tickerSampler) markEmitted(st *sampleState, ticker *schema.Ticker, now time.Time) {
+	st.lastEmit = now
+	st.lastPrice = ticker.Last
+	s.stats.Emitted++
+}
+
+func (s *tickerSampler) statsSnapshot() SamplerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// stop emits every pending update; their intervals end with the stream.
+func (s *tickerSampler) stop() {
+	s.mu.Lock()
+	out := make([]*schema.Ticker, 0)
+	for _, st := range s.symbols {
+		if st.pending == nil {
+			continue
+		}
+		out = append(out, st.pending)
+		s.markEmitted(st, st.pending, time.Unix(0, st.pending.RecvTS))
+		st.pending = nil
+	}
+	s.mu.Unlock()
+
+	for _, ticker := range out {
+		s.emit(ticker)
+	}
+}
@@ -0,0 +1,98 @@
+package ws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/trade-engine/data-controller/internal/config"
+	"github.com/trade-engine/data-controller/pkg/schema"
+)
+
+// sampleRun offers tickers at the given event times, in milliseconds, and
+// returns the times of those emitted, stop included.
+func sampleRun(t *testing.T, mode SamplingMode, offers []struct {
+	symbol string
+	ms     int64
+}) (map[string][]int64, SamplerStats) {
+	t.Helper()
+
+	emitted := make(map[string][]int64)
+	sampler, err := newTickerSampler(config.TickerConfig{
+		SamplingRate: time.Second,
+		SamplingMode: string(mode),
+	}, func(ticker *schema.Ticker) {
+		emitted[ticker.Symbol] = append(emitted[ticker.Symbol], ticker.RecvTS/int64(time.Millisecond))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Event time starts an hour after the epoch so the test is unaffected by
+	// the wall clock.
+	base := time.Hour.Nanoseconds()
+	for _, offer := range offers {
+		ticker := &schema.Ticker{}
+		ticker.Symbol = offer.symbol
+		ticker.RecvTS = base + offer.ms*int64(time.Millisecond)
+		sampler.offer(ticker)
+	}
+	sampler.stop()
+
+	for symbol, times := range emitted {
+		for i := range times {
+			times[i] -= base / int64(time.Millisecond)
+		}
+		emitted[symbol] = times
+	}
+	return emitted, sampler.statsSnapshot()
+}
+
+var sampleOffers = []struct {
+	symbol string
+	ms     int64
+}{
+	{"tBTCUSD", 100},
+	{"tETHUSD", 300},
+	{"tBTCUSD", 500},
+	{"tBTCUSD", 900},
+	{"tBTCUSD", 1200},
+	{"tBTCUSD", 2500},
+}
+
+func checkTimes(t *testing.T, symbol string, got, want []int64) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s emitted at %v, want %v", symbol, got, want)
+		return
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("%s emitted at %v, want %v", symbol, got, want)
+			return
+		}
+	}
+}
+
+func TestSamplerAlignedUsesEventTime(t *testing.T) {
+	emitted, stats := sampleRun(t, SamplingAligned, sampleOffers)
+
+	// The last update of each whole second goes out once a later ticker of
+	// any symbol crosses its boundary.
+	checkTimes(t, "tBTCUSD", emitted["tBTCUSD"], []int64{900, 1200, 2500})
+	checkTimes(t, "tETHUSD", emitted["tETHUSD"], []int64{300})
+	if stats.Received != 6 || stats.Emitted != 4 || stats.Suppressed != 2 {
+		t.Errorf("stats %+v, want 6 received, 4 emitted, 2 suppressed", stats)
+	}
+}
+
+func TestSamplerLastValueUsesEventTime(t *testing.T) {
+	emitted, stats := sampleRun(t, SamplingLastValue, sampleOffers)
+
+	// The first update is emitted at once, the last of its interval once
+	// event time passes 1100ms, and so on from there.
+	checkTimes(t, "tBTCUSD", emitted["tBTCUSD"], []int64{100, 900, 1200, 2500})
+	checkTimes(t, "tETHUSD", emitted["tETHUSD"], []int64{300})
+	if stats.Received != 6 || stats.Emitted != 5 || stats.Suppressed != 1 {
+		t.Errorf("stats %+v, want 6 received, 5 emitted, 1 suppressed", stats)
+	}
+}
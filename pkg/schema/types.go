@@ -15,6 +15,7 @@ const (
 	ChannelTrades   Channel = "trades"
 	ChannelBooks    Channel = "books"
 	ChannelRawBooks Channel = "raw_books"
+	ChannelControls Channel = "controls"
 )
 
 type MessageType string
@@ -26,6 +27,32 @@ const (
 	MessageTypeCS MessageType = "cs"
 )
 
+type ControlType string
+
+const (
+	ControlTypeConnected        ControlType = "connected"
+	ControlTypeConnectError     ControlType = "connect_error"
+	ControlTypeDisconnected     ControlType = "disconnected"
+	ControlTypeReconnect        ControlType = "reconnect"
+	ControlTypeSubscribed       ControlType = "subscribed"
+	ControlTypeUnsubscribed     ControlType = "unsubscribed"
+	ControlTypeSubscribeError   ControlType = "subscribe_error"
+	ControlTypeInfo             ControlType = "info"
+	ControlTypeChecksumOK       ControlType = "checksum_ok"
+	ControlTypeChecksumMismatch ControlType = "checksum_mismatch"
+	ControlTypeHeartbeatMissed  ControlType = "hb_missed"
+	ControlTypeGap              ControlType = "gap"
+	ControlTypeDrop             ControlType = "drop"
+	ControlTypeDedup            ControlType = "dedup"
+
+	// Written by the storage manager.
+	ControlTypeDiskLow         ControlType = "disk_low"
+	ControlTypeChannelPaused   ControlType = "channel_paused"
+	ControlTypeChannelResumed  ControlType = "channel_resumed"
+	ControlTypeSegmentArchived ControlType = "segment_archived"
+	ControlTypeSegmentDeleted  ControlType = "segment_deleted"
+)
+
 type Side string
 
 const (
@@ -40,33 +67,36 @@ const (
 	OperationDelete Operation = "delete"
 )
 
+// CommonFields are the leading columns of every row type. The optional
+// (pointer) columns get their encodings and timestamp types from the parquet
+// sink, since struct tags cannot set them on pointers.
 type CommonFields struct {
-	Exchange        Exchange `parquet:"exchange,plain"`
-	Channel         Channel  `parquet:"channel,plain"`
-	Symbol          string   `parquet:"symbol,plain"`
-	PairOrCurrency  string   `parquet:"pair_or_currency,plain"`
-	ConnID          string   `parquet:"conn_id,plain"`
-	ChanID          int32    `parquet:"chan_id,plain"`
-	SubID           *int64   `parquet:"sub_id,optional"`
-	ConfFlags       int64    `parquet:"conf_flags,plain"`
-	Seq             *int64   `parquet:"seq,optional"`
-	SrvMTS          *int64   `parquet:"srv_mts,optional"`
-	WSTS            *int64   `parquet:"ws_ts,optional"`
-	RecvTS          int64    `parquet:"recv_ts,plain"`
-	BatchID         *int64   `parquet:"batch_id,optional"`
-	IngestID        string   `parquet:"ingest_id,plain"`
-	SourceFile      string   `parquet:"source_file,plain"`
-	LineNo          *int64   `parquet:"line_no,optional"`
+	Exchange       Exchange `parquet:"exchange,enum,dict"`
+	Channel        Channel  `parquet:"channel,enum,dict"`
+	Symbol         string   `parquet:"symbol,dict"`
+	PairOrCurrency string   `parquet:"pair_or_currency,dict"`
+	ConnID         string   `parquet:"conn_id,dict"`
+	ChanID         int32    `parquet:"chan_id,delta"`
+	SubID          *int64   `parquet:"sub_id,optional"`
+	ConfFlags      int64    `parquet:"conf_flags,delta"`
+	Seq            *int64   `parquet:"seq,optional"`
+	SrvMTS         *int64   `parquet:"srv_mts,optional"`
+	WSTS           *int64   `parquet:"ws_ts,optional"`
+	RecvTS         int64    `parquet:"recv_ts,timestamp(nanosecond),delta"`
+	BatchID        *int64   `parquet:"batch_id,optional"`
+	IngestID       string   `parquet:"ingest_id,dict"`
+	SourceFile     string   `parquet:"source_file,dict"`
+	LineNo         *int64   `parquet:"line_no,optional"`
 }
 
 type RawBookEvent struct {
 	CommonFields
-	OrderID     int64     `parquet:"order_id,plain"`
-	Price       float64   `parquet:"price,plain"`
-	Amount      float64   `parquet:"amount,plain"`
-	Op          Operation `parquet:"op,plain"`
-	Side        Side      `parquet:"side,plain"`
-	IsSnapshot  bool      `parquet:"is_snapshot,plain"`
+	OrderID    int64     `parquet:"order_id,delta"`
+	Price      float64   `parquet:"price,plain"`
+	Amount     float64   `parquet:"amount,plain"`
+	Op         Operation `parquet:"op,enum,dict"`
+	Side       Side      `parquet:"side,enum,dict"`
+	IsSnapshot bool      `parquet:"is_snapshot,plain"`
 }
 
 type BookLevel struct {
@@ -74,61 +104,121 @@ type BookLevel struct {
 	Price      float64 `parquet:"price,plain"`
 	Count      int32   `parquet:"count,plain"`
 	Amount     float64 `parquet:"amount,plain"`
-	Side       Side    `parquet:"side,plain"`
-	Prec       string  `parquet:"prec,plain"`
-	Freq       string  `parquet:"freq,plain"`
-	Len        int32   `parquet:"len,plain"`
+	Side       Side    `parquet:"side,enum,dict"`
+	Prec       string  `parquet:"prec,dict"`
+	Freq       string  `parquet:"freq,dict"`
+	Len        int32   `parquet:"len,delta"`
 	IsSnapshot bool    `parquet:"is_snapshot,plain"`
 }
 
 type Trade struct {
 	CommonFields
-	TradeID     int64       `parquet:"trade_id,plain"`
-	MTS         int64       `parquet:"mts,plain"`
-	Amount      float64     `parquet:"amount,plain"`
-	Price       float64     `parquet:"price,plain"`
-	MsgType     MessageType `parquet:"msg_type,plain"`
-	IsSnapshot  bool        `parquet:"is_snapshot,plain"`
+	TradeID    int64       `parquet:"trade_id,delta"`
+	MTS        int64       `parquet:"mts,timestamp(millisecond),delta"`
+	Amount     float64     `parquet:"amount,plain"`
+	Price      float64     `parquet:"price,plain"`
+	MsgType    MessageType `parquet:"msg_type,enum,dict"`
+	IsSnapshot bool        `parquet:"is_snapshot,plain"`
+}
+
+// TradeKey identifies a trade message for deduplication. The "te" and the
+// "tu" of a trade share its ID but are different messages; snapshot trades
+// are executed trades, so they count as the "tu".
+type TradeKey struct {
+	TradeID int64
+	Update  bool
+}
+
+func (t *Trade) Key() TradeKey {
+	return TradeKey{TradeID: t.TradeID, Update: t.MsgType != MessageTypeTE}
 }
 
 type Ticker struct {
 	CommonFields
-	Bid              float64 `parquet:"bid,plain"`
-	BidSize          float64 `parquet:"bid_sz,plain"`
-	Ask              float64 `parquet:"ask,plain"`
-	AskSize          float64 `parquet:"ask_sz,plain"`
-	Last             float64 `parquet:"last,plain"`
-	Vol              float64 `parquet:"vol,plain"`
-	High             float64 `parquet:"high,plain"`
-	Low              float64 `parquet:"low,plain"`
-	DailyChange      float64 `parquet:"daily_change,plain"`
-	DailyChangeRel   float64 `parquet:"daily_change_rel,plain"`
+	Bid            float64 `parquet:"bid,plain"`
+	BidSize        float64 `parquet:"bid_sz,plain"`
+	Ask            float64 `parquet:"ask,plain"`
+	AskSize        float64 `parquet:"ask_sz,plain"`
+	Last           float64 `parquet:"last,plain"`
+	Vol            float64 `parquet:"vol,plain"`
+	High           float64 `parquet:"high,plain"`
+	Low            float64 `parquet:"low,plain"`
+	DailyChange    float64 `parquet:"daily_change,plain"`
+	DailyChangeRel float64 `parquet:"daily_change_rel,plain"`
 }
 
 type Control struct {
 	CommonFields
-	Type      string    `parquet:"type,plain"`
-	Reason    string    `parquet:"reason,plain"`
-	Checksum  *int32    `parquet:"checksum,optional"`
-	LastSeq   *int64    `parquet:"last_seq,optional"`
-	Timestamp time.Time `parquet:"timestamp,timestamp(millis)"`
+	Type      ControlType `parquet:"type,enum,dict"`
+	Reason    string      `parquet:"reason,dict"`
+	Checksum  *int32      `parquet:"checksum,optional"`
+	LastSeq   *int64      `parquet:"last_seq,optional"`
+	Timestamp time.Time   `parquet:"timestamp,timestamp(millisecond)"`
+	// Count is how many events a dedup control stands for; zero means one.
+	// It is not stored, the reason spells it out.
+	Count int64 `parquet:"-"`
+}
+
+// SchemaVersion identifies the layout of the parquet rows written by this
+// build.
+//
+// bfx.v2 annotates recv_ts (ns), srv_mts, ws_ts and mts (ms) as UTC
+// timestamps, stores exchange, channel, side, op, msg_type and type as
+// dictionary-encoded enums, and delta-encodes the integer columns. Column
+// names and physical types are the same as in bfx.v1.
+const SchemaVersion = "bfx.v2"
+
+// Keys of the key-value metadata in the footer of every parquet file.
+const (
+	MetadataSchemaVersion = "bfx.schema_version"
+	MetadataIngestID      = "bfx.ingest_id"
+	// MetadataSubscription holds the file's Subscription as JSON.
+	MetadataSubscription = "bfx.subscription"
+)
+
+// Subscription describes the channel subscription a file's rows came from.
+type Subscription struct {
+	Channel        string            `json:"channel"`
+	Symbol         string            `json:"symbol"`
+	PairOrCurrency string            `json:"pair_or_currency,omitempty"`
+	ChanID         int32             `json:"chan_id,omitempty"`
+	SubID          *int64            `json:"sub_id,omitempty"`
+	ConfFlags      int64             `json:"conf_flags"`
+	Book           *BookSubscription `json:"book,omitempty"`
 }
 
 type SegmentManifest struct {
-	SchemaVersion    string            `json:"schema_version"`
-	Exchange         string            `json:"exchange"`
-	Channel          string            `json:"channel"`
-	Symbol           string            `json:"symbol"`
-	PairOrCurrency   string            `json:"pair_or_currency"`
-	WSURL            string            `json:"ws_url"`
-	ConnID           string            `json:"conn_id"`
-	ChanID           int32             `json:"chan_id"`
-	SubID            *int64            `json:"sub_id,omitempty"`
-	ConfFlags        int64             `json:"conf_flags"`
-	Book             *BookSubscription `json:"book,omitempty"`
-	Segment          SegmentInfo       `json:"segment"`
-	Seq              *SeqInfo          `json:"seq,omitempty"`
-	Quality          QualityMetrics    `json:"quality"`
+	SchemaVersion  string            `json:"schema_version"`
+	Exchange       string            `json:"exchange"`
+	Channel        string            `json:"channel"`
+	Symbol         string            `json:"symbol"`
+	PairOrCurrency string            `json:"pair_or_currency"`
+	WSURL          string            `json:"ws_url"`
+	Endpoints      []string          `json:"endpoints"`
+	ConnID         string            `json:"conn_id"`
+	ConnIDs        []string          `json:"conn_ids"`
+	IngestID       string            `json:"ingest_id"`
+	ChanID         int32             `json:"chan_id"`
+	SubID          *int64            `json:"sub_id,omitempty"`
+	ConfFlags      int64             `json:"conf_flags"`
+	Book           *BookSubscription `json:"book,omitempty"`
+	Segment        SegmentInfo       `json:"segment"`
+	Seq            *SeqInfo          `json:"seq,omitempty"`
+	Quality        QualityMetrics    `json:"quality"`
+	Recovered      bool              `json:"recovered,omitempty"`
+	Compaction     *CompactionInfo   `json:"compaction,omitempty"`
+	// ArchivedAt is set once retention has moved the segment to the archive
+	// path.
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+}
+
+// CompactionInfo is set in the manifest of a segment written by compaction.
+// From lists the merged segment directories, relative to the storage root.
+type CompactionInfo struct {
+	From       []string `json:"from"`
+	RowsIn     int64    `json:"rows_in"`
+	Dedup      bool     `json:"dedup"`
+	Duplicates int64    `json:"duplicates,omitempty"`
 }
 
 type BookSubscription struct {
@@ -138,10 +228,56 @@ type BookSubscription struct {
 }
 
 type SegmentInfo struct {
-	BytesTarget int64     `json:"bytes_target"`
-	UTCStart    time.Time `json:"utc_start"`
-	UTCEnd      time.Time `json:"utc_end"`
-	Files       []string  `json:"files"`
+	BytesTarget int64       `json:"bytes_target"`
+	UTCStart    time.Time   `json:"utc_start"`
+	UTCEnd      time.Time   `json:"utc_end"`
+	Bytes       int64       `json:"bytes"`
+	Files       []string    `json:"files"`
+	FileStats   []FileStats `json:"file_stats"`
+}
+
+// FileStats describes one parquet file of a segment. recv_ts is in
+// nanoseconds and srv_mts in milliseconds, as in the rows.
+type FileStats struct {
+	Name      string `json:"name"`
+	Rows      int64  `json:"rows"`
+	Bytes     int64  `json:"bytes"`
+	SHA256    string `json:"sha256"`
+	RecvTSMin int64  `json:"recv_ts_min,omitempty"`
+	RecvTSMax int64  `json:"recv_ts_max,omitempty"`
+	SrvMTSMin *int64 `json:"srv_mts_min,omitempty"`
+	SrvMTSMax *int64 `json:"srv_mts_max,omitempty"`
+	// Compression is unset for files recovered after a crash.
+	Compression *CompressionInfo `json:"compression,omitempty"`
+}
+
+// CompressionInfo is the parquet codec a file was written with. Level is 0
+// for codecs without levels.
+type CompressionInfo struct {
+	Codec string `json:"codec"`
+	Level int    `json:"level,omitempty"`
+}
+
+// Observe folds one row's timestamps into the file's ranges.
+func (f *FileStats) Observe(common *CommonFields) {
+	f.Rows++
+	if common.RecvTS > 0 {
+		if f.RecvTSMin == 0 || common.RecvTS < f.RecvTSMin {
+			f.RecvTSMin = common.RecvTS
+		}
+		if common.RecvTS > f.RecvTSMax {
+			f.RecvTSMax = common.RecvTS
+		}
+	}
+	if common.SrvMTS != nil {
+		mts := *common.SrvMTS
+		if f.SrvMTSMin == nil || mts < *f.SrvMTSMin {
+			f.SrvMTSMin = &mts
+		}
+		if f.SrvMTSMax == nil || mts > *f.SrvMTSMax {
+			f.SrvMTSMax = &mts
+		}
+	}
 }
 
 type SeqInfo struct {
@@ -151,8 +287,58 @@ type SeqInfo struct {
 
 type QualityMetrics struct {
 	ChecksumMismatch        int `json:"checksum_mismatch"`
-	HBMissed               int `json:"hb_missed"`
-	Reconnects             int `json:"reconnects"`
-	TradesDedupDropped     int `json:"trades_dedup_dropped"`
+	HBMissed                int `json:"hb_missed"`
+	Reconnects              int `json:"reconnects"`
+	TradesDedupDropped      int `json:"trades_dedup_dropped"`
 	BookUpdatesDedupDropped int `json:"book_updates_dedup_dropped"`
-}
\ No newline at end of file
+	Gaps                    int `json:"gaps"`
+	Dropped                 int `json:"dropped"`
+}
+
+// CatalogEntry is one line of the dataset catalog at a storage root: a
+// summary of a closed segment's manifest. Path is the segment directory
+// relative to the storage root, with forward slashes.
+type CatalogEntry struct {
+	SchemaVersion string    `json:"schema_version"`
+	Channel       string    `json:"channel"`
+	Symbol        string    `json:"symbol"`
+	Path          string    `json:"path"`
+	UTCStart      time.Time `json:"utc_start"`
+	UTCEnd        time.Time `json:"utc_end"`
+	Seq           *SeqInfo  `json:"seq,omitempty"`
+	Rows          int64     `json:"rows"`
+	Bytes         int64     `json:"bytes"`
+	Files         []string  `json:"files"`
+	// Flags names the non-zero quality counters of the segment, and
+	// "recovered" for segments finished by crash recovery.
+	Flags []string `json:"flags,omitempty"`
+	// Replaces lists the paths of earlier entries whose segments were
+	// compacted into this one. Those entries no longer exist on disk.
+	Replaces []string `json:"replaces,omitempty"`
+	// Deleted marks a segment removed from the storage root by retention.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// Flags lists the names of the non-zero counters, as in the manifest JSON.
+func (q QualityMetrics) Flags() []string {
+	counters := []struct {
+		name  string
+		count int
+	}{
+		{"checksum_mismatch", q.ChecksumMismatch},
+		{"hb_missed", q.HBMissed},
+		{"reconnects", q.Reconnects},
+		{"trades_dedup_dropped", q.TradesDedupDropped},
+		{"book_updates_dedup_dropped", q.BookUpdatesDedupDropped},
+		{"gaps", q.Gaps},
+		{"dropped", q.Dropped},
+	}
+
+	var flags []string
+	for _, c := range counters {
+		if c.count > 0 {
+			flags = append(flags, c.name)
+		}
+	}
+	return flags
+}